@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"log"
 	"syscall"
 	"time"
@@ -30,11 +31,19 @@ var AcceptHandler FileProc = func(loop *AeEventLoop, fd int, extra any) {
 	client := NewClient(nfd)
 	server.clients[client.nfd] = client
 	//check max clients number limit
-	if len(server.clients) > MAX_CLIENTS {
+	if len(server.clients) > server.maxClients {
 		errMsg := []byte("-ERR max number of clients reached\r\n")
 		// it's a best effort error message, so don't check write errors
 		_, _ = Write(client.nfd, errMsg)
+		server.statRejectedConn++
 		freeClient(client)
+		return
+	}
+	server.statNumConnections++
+	if server.tcpKeepalive > 0 {
+		if err := KeepAlive(client.nfd, server.tcpKeepalive); err != nil {
+			log.Printf("set keepalive of client %d error: %v", client.id, err)
+		}
 	}
 	// the fd can be read
 	server.aeloop.AddFileEvent(client.nfd, AE_READABLE, ReadQueryFromClient, client)
@@ -44,15 +53,21 @@ var AcceptHandler FileProc = func(loop *AeEventLoop, fd int, extra any) {
 // ReadQueryFromClient the 'extra' should store the client
 var ReadQueryFromClient FileProc = func(loop *AeEventLoop, nfd int, extra any) {
 	client := extra.(*GedisClient)
-	//expand query buffer's capacity if it is less than the max command capacity，
-	if len(client.queryBuf)-client.queryLen < GEDIS_MAX_CMD_BUF {
-		client.queryBuf = append(client.queryBuf, make([]byte, GEDIS_MAX_CMD_BUF)...)
+	readLen := GEDIS_IO_BUF
+	// the big argument is read directly into its own buffer, not more than the rest of it
+	if client.cmdType == CMD_BULK && client.bulkLen >= GEDIS_MBULK_BIG_ARG {
+		if remaining := client.bulkLen + 2 - (client.queryLen - client.qbPos); remaining > 0 {
+			readLen = remaining
+		}
 	}
+	client.makeRoomForQuery(readLen)
 
 	// no blocked read
-	n, err := Read(nfd, client.queryBuf[client.queryLen:])
+	n, err := Read(nfd, client.queryBuf[client.queryLen:client.queryLen+readLen])
 	if err != nil {
-		log.Printf("client %v read error: %v", nfd, err)
+		if err != io.EOF {
+			log.Printf("client %v read error: %v", nfd, err)
+		}
 		freeClient(client)
 		return
 	}
@@ -60,6 +75,16 @@ var ReadQueryFromClient FileProc = func(loop *AeEventLoop, nfd int, extra any) {
 		return
 	}
 	client.queryLen += n
+	client.lastInteraction = GetTimeMs()
+	// the bytes from the master are kept until they are applied, see replicationCommandProcessed
+	if client.flags&CLIENT_MASTER != 0 {
+		client.readReplOff += int64(n)
+		client.replBuf = append(client.replBuf, client.queryBuf[client.queryLen-n:client.queryLen]...)
+	} else if int64(len(client.queryBuf)) > server.clientMaxQueryBufLen {
+		log.Printf("closing client %d that reached max query buffer length", client.id)
+		freeClient(client)
+		return
+	}
 
 	err = client.ProcessQueryBuf()
 	if err != nil {
@@ -74,7 +99,9 @@ var ServerCron TimeProc = func(loop *AeEventLoop, id int, extra any) {
 	d := server.db.expire
 	num, now := d.Size(), GetTimeMs()
 
-	if num > 0 {
+	// the dataset isn't modified during CLIENT PAUSE
+	checkClientPauseTimeout(now)
+	if num > 0 && server.clientPauseType == CLIENT_PAUSE_OFF {
 		if num > GEDIS_EXPIRELOOKUPS_PER_CRON {
 			num = GEDIS_EXPIRELOOKUPS_PER_CRON
 		}
@@ -86,9 +113,40 @@ var ServerCron TimeProc = func(loop *AeEventLoop, id int, extra any) {
 			if now > de.Val.IntVal() {
 				_ = server.db.data.Delete(de.Key)
 				_ = d.Delete(de.Key)
+				server.statExpiredKeys++
+				touchWatchedKey(de.Key)
+				trackingInvalidateKey(de.Key)
+				notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", de.Key)
 			}
 			num--
 		}
+		latencyAddSampleIfNeeded(LATENCY_EXPIRE_CYCLE, GetTimeMs()-now)
+	}
+
+	if now-server.statOpsLastTime >= STATS_METRIC_SAMPLE_PERIOD {
+		trackInstantaneousOps(now)
+	}
+	if now-server.statPeakMemoryTime >= PEAK_MEMORY_SAMPLE_PERIOD {
+		server.statPeakMemoryTime = now
+		updatePeakMemory()
+	}
+	if server.metricsPort > 0 && now-server.metricsRefreshTime >= METRICS_REFRESH_PERIOD {
+		server.metricsRefreshTime = now
+		updateMetricsSnapshot()
+	}
+
+	if now-server.clientsCronTime >= CLIENTS_CRON_PERIOD {
+		server.clientsCronTime = now
+		clientsCron(now)
+	}
+	freeClientsInAsyncFreeQueue()
+	handleBlockedClientsTimeout(now)
+	processUnblockedClients()
+	trackingBroadcastInvalidationMessages()
+
+	if now-server.replCronTime >= REPL_CRON_PERIOD {
+		server.replCronTime = now
+		replicationCron(now)
 	}
 
 	//check is background AOF rewrite finished
@@ -122,29 +180,16 @@ var ServerCron TimeProc = func(loop *AeEventLoop, id int, extra any) {
 
 var SendReplyToClient FileProc = func(loop *AeEventLoop, nfd int, extra any) {
 	client := extra.(*GedisClient)
-	for client.reply.Length() > 0 {
-		rep := client.reply.First()
-		buf := []byte(rep.Val.StrVal())
-		bufLen := len(buf)
-		if client.sentLen < bufLen {
-			n, err := Write(nfd, buf[client.sentLen:])
-			if err != nil {
-				log.Println("sent reply error: ", err)
-				freeClient(client)
-				return
-			}
-			client.sentLen += n
-			if client.sentLen == bufLen {
-				client.reply.DelNode(rep)
-				client.sentLen = 0
-			} else {
-				break
-			}
-		}
+	if err := writeToClient(client); err != nil {
+		log.Println("sent reply error: ", err)
+		freeClient(client)
+		return
 	}
-	if client.reply.Length() == 0 { //finish write
-		client.sentLen = 0
+	if !client.hasPendingReplies() { //finish write
 		loop.RemoveFileEvent(nfd, AE_WRITABLE)
+		if client.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+			freeClient(client)
+		}
 	}
 }
 
@@ -303,18 +348,16 @@ func (loop *AeEventLoop) RemoveTimeEvent(id int) {
 	}
 }
 
-func (loop *AeEventLoop) AeProcess() {
-	timeout := loop.nearestTime() - GetTimeMs()
-	// at least block 1 ms
-	if timeout <= 0 {
-		timeout = 1
-	}
+// processFileEvents waits the file events for timeout ms at most and executes them, the time the
+// wait returned is returned too, false if the wait failed
+func (loop *AeEventLoop) processFileEvents(timeout int) (int64, bool) {
 	events := [128]syscall.EpollEvent{}
-	n, err := syscall.EpollWait(loop.efd, events[:], int(timeout))
+	n, err := syscall.EpollWait(loop.efd, events[:], timeout)
 	if err != nil && err != syscall.EINTR {
 		log.Printf("epoll wait error: %v\n", err)
-		return
+		return 0, false
 	}
+	polled := GetTimeMs()
 
 	// exec file event
 	for i := 0; i < n; i++ {
@@ -331,6 +374,19 @@ func (loop *AeEventLoop) AeProcess() {
 			}
 		}
 	}
+	return polled, true
+}
+
+func (loop *AeEventLoop) AeProcess() {
+	timeout := loop.nearestTime() - GetTimeMs()
+	// at least block 1 ms
+	if timeout <= 0 {
+		timeout = 1
+	}
+	polled, ok := loop.processFileEvents(int(timeout))
+	if !ok {
+		return
+	}
 
 	// exec time event
 	p := loop.TimeEventsHead
@@ -346,6 +402,14 @@ func (loop *AeEventLoop) AeProcess() {
 		}
 		p = p.next
 	}
+	// the wait for the events isn't counted
+	latencyAddSampleIfNeeded(LATENCY_EVENT_LOOP, GetTimeMs()-polled)
+}
+
+// processEventsWhileBlocked processes the file events without waiting, it's called while the
+// server is busy, like a long running script, to reply the clients
+func processEventsWhileBlocked() {
+	_, _ = server.aeloop.processFileEvents(0)
 }
 
 func (loop *AeEventLoop) AeMain() {
@@ -2,13 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
 )
 
+/* appendfsync */
+const (
+	AOF_FSYNC_NO       = 0 // the OS flushes the data when it wants
+	AOF_FSYNC_ALWAYS   = 1 // fsync after every write of the AOF buffer
+	AOF_FSYNC_EVERYSEC = 2 // fsync once a second at most
+)
+
+var aofFsyncNames = []string{AOF_FSYNC_NO: "no", AOF_FSYNC_ALWAYS: "always", AOF_FSYNC_EVERYSEC: "everysec"}
+
 func rewriteAppendOnlyFileBackground() error {
 	if server.aofRewriteChan != nil {
 		return errors.New("already rewriting")
@@ -34,7 +45,6 @@ func rewriteAppendOnlyFileBackground() error {
 //This function also called when the save command is executed
 //it will overwrite the rewritten data to the 'filename' file
 func rewriteAppendOnlyFile(filename string) error {
-	now := GetTimeMs()
 	//create temp file
 	tempFile := "temp-rewriteAOF.aof"
 
@@ -46,121 +56,250 @@ func rewriteAppendOnlyFile(filename string) error {
 		return err
 	}
 	aof := NewRioWithFile(fp)
+	if err = rewriteAppendOnlyFileRio(aof); err != nil {
+		goto wErr
+	}
+
+	//make sure data will not remain on the OS's output buffers
+	if err = aof.file.fp.Sync(); err != nil {
+		log.Printf("sync disk error when aof rewriting: %v \n", err)
+		goto wErr
+	}
+	if err = aof.file.fp.Close(); err != nil {
+		log.Printf("close file error when aof rewriting: %v \n", err)
+		goto wErr
+	}
+
+	//Use RENAME to make sure the DB file is changed atomically only if the generate DB file is ok.
+	if err = os.Rename(tempFile, filename); err != nil {
+		log.Printf("moving temp append only file on the final destination error: %v", err)
+		_ = os.Remove(tempFile)
+		return err
+	}
+
+	log.Printf("SYNC append only file rewrite done\n")
+	return nil
+
+wErr:
+	aof.file.fp.Close()
+	_ = os.Remove(tempFile)
+	return err
+}
+
+// rewriteAppendOnlyFileRio writes the commands rebuilding the dataset, it's the AOF rewrite and
+// the snapshot sent to the replicas too
+func rewriteAppendOnlyFileRio(aof *RioFile) error {
+	now := GetTimeMs()
 	di := NewDictSafeIterator(server.db.data)
+	defer ReleaseIterator(di)
 	for e := di.DictNext(); e != nil; e = di.DictNext() {
 		key := e.Key
 		o := e.Val
 
 		//don't save if it has expired
-		expireTime := getExpire(key)
+		expireTime := int64(-1)
+		if ee := server.db.expire.Find(key); ee != nil {
+			expireTime = ee.Val.IntVal()
+		}
 		if expireTime != -1 && expireTime < now {
 			continue
 		}
 
 		switch o.Type_ {
-		case STR:
+		case STR, BITMAP:
 			setCmd := []byte("*3\r\n$3\r\nset\r\n")
-			if err = aof.Write(setCmd, len(setCmd)); err != nil {
-				goto wErr
+			if err := aof.Write(setCmd, len(setCmd)); err != nil {
+				return err
+			}
+			if err := aof.WriteBulkString(key.StrVal()); err != nil {
+				return err
 			}
-			if err = aof.WriteBulkString(key.StrVal()); err != nil {
-				goto wErr
+			if err := aof.WriteBulkString(string(o.BytesVal())); err != nil {
+				return err
 			}
-			if err = aof.WriteBulkString(o.StrVal()); err != nil {
-				goto wErr
+		case LIST:
+			if err := rewriteListObject(aof, key, o.Val_.(*List)); err != nil {
+				return err
+			}
+		case ZSET:
+			if err := rewriteSortedSetObject(aof, key, o.Val_.(*ZSet)); err != nil {
+				return err
+			}
+		case STREAM:
+			if err := rewriteStreamObject(aof, key, o.Val_.(*Stream)); err != nil {
+				return err
 			}
 		}
 		// save the expiry time
 		if expireTime != -1 {
-			cmd := []byte("*3\r\n$9\r\npexpireat\r\n")
-			if aof.Write(cmd, len(cmd)) != nil {
-				goto wErr
-			}
-			if aof.WriteBulkString(key.StrVal()) != nil {
-				goto wErr
-			}
-			if aof.WriteBulkInt64(expireTime) != nil {
-				goto wErr
+			if err := rewriteCommand(aof, "pexpireat", key.StrVal(), strconv.FormatInt(expireTime, 10)); err != nil {
+				return err
 			}
 		}
 	}
-	ReleaseIterator(di)
+	return nil
+}
 
-	//make sure data will not remain on the OS's output buffers
-	if err = aof.file.fp.Sync(); err != nil {
-		log.Printf("sync disk error when aof rewriting: %v \n", err)
-		goto wErr
+// emit a RPUSH command with all the elements of the list
+func rewriteListObject(aof *RioFile, key *GObj, l *List) error {
+	if err := aof.WriteBulkCount("*", 2+l.Length()); err != nil {
+		return err
 	}
-	if err = aof.file.fp.Close(); err != nil {
-		log.Printf("close file error when aof rewriting: %v \n", err)
-		goto wErr
+	if err := aof.WriteBulkString("rpush"); err != nil {
+		return err
+	}
+	if err := aof.WriteBulkString(key.StrVal()); err != nil {
+		return err
+	}
+	for ln := l.head; ln != nil; ln = ln.next {
+		if err := aof.WriteBulkString(ln.Val.StrVal()); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	//Use RENAME to make sure the DB file is changed atomically only if the generate DB file is ok.
-	if err = os.Rename(tempFile, filename); err != nil {
-		log.Printf("moving temp append only file on the final destination error: %v", err)
-		_ = os.Remove(tempFile)
+// emit a ZADD command with all the elements of the sorted set
+func rewriteSortedSetObject(aof *RioFile, key *GObj, zs *ZSet) error {
+	if err := aof.WriteBulkCount("*", 2+int(zs.Length())*2); err != nil {
+		return err
+	}
+	if err := aof.WriteBulkString("zadd"); err != nil {
 		return err
 	}
+	if err := aof.WriteBulkString(key.StrVal()); err != nil {
+		return err
+	}
+	for ln := zs.SkipList.header.level[0].forward; ln != nil; ln = ln.level[0].forward {
+		if err := aof.WriteBulkString(strconv.FormatFloat(ln.Score, 'f', -1, 64)); err != nil {
+			return err
+		}
+		if err := aof.WriteBulkString(ln.Member.StrVal()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	log.Printf("SYNC append only file rewrite done\n")
+// emit the command with the args
+func rewriteCommand(aof *RioFile, args ...string) error {
+	if err := aof.WriteBulkCount("*", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := aof.WriteBulkString(arg); err != nil {
+			return err
+		}
+	}
 	return nil
+}
 
-wErr:
-	aof.file.fp.Close()
-	_ = os.Remove(tempFile)
-	if di != nil {
-		ReleaseIterator(di)
+// emit the XADD of every entry, then restore the metadata by XSETID, and the consumer groups by
+// XGROUP and the pending entries by XCLAIM
+func rewriteStreamObject(aof *RioFile, key *GObj, s *Stream) error {
+	k := key.StrVal()
+	if s.Length() == 0 {
+		// create the empty stream
+		if err := rewriteCommand(aof, "xadd", k, "maxlen", "0", "0-1", "x", "y"); err != nil {
+			return err
+		}
 	}
-	return err
+	for _, e := range s.entries {
+		args := make([]string, 0, 3+len(e.fields))
+		args = append(args, "xadd", k, e.id.String())
+		for _, f := range e.fields {
+			args = append(args, f.StrVal())
+		}
+		if err := rewriteCommand(aof, args...); err != nil {
+			return err
+		}
+	}
+	if err := rewriteCommand(aof, "xsetid", k, s.lastID.String(), "entriesadded",
+		strconv.FormatInt(s.entriesAdded, 10), "maxdeletedid", s.maxDeletedID.String()); err != nil {
+		return err
+	}
+
+	for name, cg := range s.cgroups {
+		if err := rewriteCommand(aof, "xgroup", "create", k, name, cg.lastID.String()); err != nil {
+			return err
+		}
+		for _, consumer := range cg.consumers {
+			if err := rewriteCommand(aof, "xgroup", "createconsumer", k, name, consumer.name); err != nil {
+				return err
+			}
+		}
+		for id, nack := range cg.pel {
+			if err := rewriteCommand(aof, "xclaim", k, name, nack.consumer.name, "0", id.String(),
+				"time", strconv.FormatInt(nack.deliveryTime, 10),
+				"retrycount", strconv.FormatInt(nack.deliveryCount, 10), "justid", "force"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func loadAppendOnlyFile(filename string) error {
-	//create a fake client
-	fakeClient := NewClient(0)
 	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
 		log.Printf("open append only file for reading error: %v \n", err)
 		return err
 	}
-	sn := bufio.NewScanner(f)
+	err = loadCommands(bufio.NewReader(f))
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	aofUpdateCurrentSize()
+	server.aofRewriteBaseSize = 0
+	return nil
+}
+
+// loadCommands executes the commands in the AOF format by a fake client, it loads the AOF and
+// the snapshot received from the master
+func loadCommands(rd *bufio.Reader) error {
+	//create a fake client
+	fakeClient := NewClient(0)
+	//the commands loaded are not propagated again
+	server.loading = true
+	defer func() { server.loading = false }()
+	var line []byte
+	var err error
 	for true {
-		if !sn.Scan() {
-			if sn.Err() != nil {
-				goto rErr
-			}
+		line, err = readAofLine(rd)
+		if err == io.EOF && len(line) == 0 {
 			break
 		}
+		if err != nil {
+			goto rErr
+		}
 
-		if sn.Bytes()[0] != '*' {
+		if len(line) == 0 || line[0] != '*' {
 			goto fmtErr
 		}
-		argc := bytes2int(sn.Bytes()[1:])
+		argc := bytes2int(line[1:])
 		if argc < 1 {
 			goto fmtErr
 		}
 
 		for i := 0; i < argc; i++ {
 			//there will be 'args' number of argument be read in expectations. if not we consider it format error
-			if !sn.Scan() {
+			line, err = readAofLine(rd)
+			if err != nil || len(line) == 0 || line[0] != '$' {
 				goto fmtErr
 			}
 
-			if sn.Bytes()[0] != '$' {
+			strLen := bytes2int(line[1:])
+			if strLen < 0 {
 				goto fmtErr
 			}
 
-			strLen := bytes2int(sn.Bytes()[1:])
-
-			if !sn.Scan() {
+			//read the payload by its length, so the binary strings are safe
+			arg := make([]byte, strLen+2)
+			if _, err = io.ReadFull(rd, arg); err != nil || arg[strLen] != '\r' || arg[strLen+1] != '\n' {
 				goto fmtErr
 			}
-
-			argStr := string(sn.Bytes())
-			if len(argStr) != strLen {
-				goto fmtErr
-			}
-			fakeClient.args = append(fakeClient.args, NewObject(STR, argStr))
+			fakeClient.args = append(fakeClient.args, NewObject(STR, string(arg[:strLen])))
 		}
 
 		//command lookup
@@ -170,15 +309,21 @@ func loadAppendOnlyFile(filename string) error {
 			return errors.New("unknown command")
 		}
 
-		cmd.proc(fakeClient)
+		// the transaction is executed once EXEC is read
+		if fakeClient.flags&CLIENT_MULTI != 0 && cmd.name != "exec" {
+			queueMultiCommand(fakeClient, cmd)
+		} else {
+			cmd.proc(fakeClient)
+		}
 		//reset fake client
 		fakeClient.args = make([]*GObj, 0)
 	}
 
 	// this point can only be reached when EOF is reached without errors.
-	_ = f.Close()
-	aofUpdateCurrentSize()
-	server.aofRewriteBaseSize = 0
+	if fakeClient.flags&CLIENT_MULTI != 0 {
+		log.Printf("revert incomplete MULTI/EXEC transaction in AOF file \n")
+		discardTransaction(fakeClient)
+	}
 	return nil
 
 rErr:
@@ -190,9 +335,9 @@ fmtErr:
 	return errors.New("invalid aof file format")
 }
 
-//write the append only file buffer on disk.
+//write the append only file buffer on disk, and fsync it as appendfsync asks.
 func flushAppendOnlyFile() {
-	if len(server.aofBuf) == 0 {
+	if len(server.aofBuf) == 0 && !aofFsyncNeeded() {
 		return
 	}
 	f, err := os.OpenFile(server.aofFileName, os.O_WRONLY|os.O_APPEND, 0)
@@ -200,23 +345,53 @@ func flushAppendOnlyFile() {
 		log.Printf("can't open append only file: %v \n", err)
 		return
 	}
+	defer f.Close()
 
-	n, err := f.Write([]byte(server.aofBuf))
-	if err != nil {
-		log.Printf("flush buffer to append only file error: %v \n", err)
-		if n > 0 {
-			server.aofCurrentSize += int64(n)
-			server.aofBuf = server.aofBuf[n:]
+	if len(server.aofBuf) > 0 {
+		start := GetTimeMs()
+		n, err := f.Write([]byte(server.aofBuf))
+		latencyAddSampleIfNeeded(LATENCY_AOF_WRITE, GetTimeMs()-start)
+		if err != nil {
+			log.Printf("flush buffer to append only file error: %v \n", err)
+			if n > 0 {
+				server.aofCurrentSize += int64(n)
+				server.aofBuf = server.aofBuf[n:]
+			}
+			return
 		}
-		return
+		server.aofCurrentSize += int64(n)
+		server.aofBuf = ""
+	}
+
+	if aofFsyncNeeded() {
+		start := GetTimeMs()
+		if err = f.Sync(); err != nil {
+			log.Printf("fsync append only file error: %v \n", err)
+			return
+		}
+		server.aofLastFsync = GetTimeMs()
+		server.aofFsyncedSize = server.aofCurrentSize
+		latencyAddSampleIfNeeded(LATENCY_AOF_FSYNC, server.aofLastFsync-start)
 	}
+}
 
-	server.aofCurrentSize += int64(n)
-	server.aofBuf = ""
+// aofFsyncNeeded reports whether the data written to the AOF should be fsynced now
+func aofFsyncNeeded() bool {
+	if server.aofFsyncedSize == server.aofCurrentSize {
+		return false
+	}
+	switch server.aofFsync {
+	case AOF_FSYNC_ALWAYS:
+		return true
+	case AOF_FSYNC_EVERYSEC:
+		return GetTimeMs()-server.aofLastFsync >= 1000
+	}
+	return false
 }
 
 //the master goroutine calls this function when the child goroutine completes the AOF rewrite.
 func bgRewriteDoneHandler(exitFlag bool) {
+	start := GetTimeMs()
 	if exitFlag == true {
 		f, err := os.OpenFile("temp-rewriteAof-bg.aof", os.O_APPEND|os.O_WRONLY, 0666)
 		if err != nil {
@@ -248,20 +423,12 @@ clearUp:
 	_ = os.Remove("temp-rewriteAof-bg.aof")
 
 	server.aofRewriteChan = nil
+	latencyAddSampleIfNeeded(LATENCY_AOF_REWRITE_DONE, GetTimeMs()-start)
 }
 
 //append the command to the AOF file or, if the AOF rewrite is in progress, to the AOF rewrite buffer.
 func feedAppendOnlyFile(cmd *GedisCommand, args []*GObj) error {
-	//Translate EXPIRE into PEXPIREAT
-	var buf string
-
-	if cmd.name == "expire" {
-		buf = catAppendOnlyExpireAtFile(cmd, args[1], args[2])
-	} else if cmd.name == "set" || cmd.name == "pexpireat" {
-		buf = catAppendOnlyGenericCommand(args)
-	} else {
-		return nil
-	}
+	buf := catPersistedCommand(cmd, args)
 
 	server.aofBuf += buf
 
@@ -275,6 +442,15 @@ func feedAppendOnlyFile(cmd *GedisCommand, args []*GObj) error {
 	return nil
 }
 
+// catPersistedCommand restores the persisted command to the protocol format, EXPIRE is
+// translated into PEXPIREAT so the command has the same effect when it's executed later
+func catPersistedCommand(cmd *GedisCommand, args []*GObj) string {
+	if cmd.name == "expire" {
+		return catAppendOnlyExpireAtFile(cmd, args[1], args[2])
+	}
+	return catAppendOnlyGenericCommand(args)
+}
+
 //append data to the AOF rewrite buffer,
 func aofRewriteBufferAppend(s string) {
 	server.aofRewriteBuf = append(server.aofRewriteBuf, []byte(s)...)
@@ -324,6 +500,15 @@ func catAppendOnlyGenericCommand(args []*GObj) string {
 	return genericCmd
 }
 
+// read a line ending with CRLF, the CRLF is not included in the returned line
+func readAofLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return line, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'}), nil
+}
+
 func bytes2int(b []byte) int {
 	num, _ := strconv.Atoi(string(b))
 	return num
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -75,3 +76,78 @@ func Test_autoRewriteAOF(t *testing.T) {
 
 	ServerCron(server.aeloop, 0, 0)
 }
+
+func Test_aofFsync(t *testing.T) {
+	initTestServer(t)
+	server.aofFileName = filepath.Join(t.TempDir(), "fsync.aof")
+	assert.Nil(t, os.WriteFile(server.aofFileName, nil, 0644))
+
+	assert.Equal(t, "*2\r\n$11\r\nappendfsync\r\n$8\r\neverysec\r\n", runCommand(NewClient(0), "config", "get", "appendfsync"))
+	assert.NotNil(t, loadServerConfigFromString("appendfsync sometimes"))
+	assert.Nil(t, loadServerConfigFromString("appendfsync Always"))
+	assert.Equal(t, AOF_FSYNC_ALWAYS, server.aofFsync)
+
+	server.aofBuf = "*1\r\n$4\r\nping\r\n"
+	assert.False(t, aofFsyncNeeded())
+	flushAppendOnlyFile()
+	assert.Equal(t, "", server.aofBuf)
+	assert.Equal(t, int64(14), server.aofCurrentSize)
+	assert.Equal(t, int64(14), server.aofFsyncedSize)
+	assert.NotEqual(t, int64(0), server.aofLastFsync)
+
+	// everysec waits a second since the latest fsync
+	server.aofFsync = AOF_FSYNC_EVERYSEC
+	server.aofBuf = "*1\r\n$4\r\nping\r\n"
+	flushAppendOnlyFile()
+	assert.Equal(t, int64(14), server.aofFsyncedSize)
+	assert.False(t, aofFsyncNeeded())
+	server.aofLastFsync -= 1000
+	assert.True(t, aofFsyncNeeded())
+	flushAppendOnlyFile()
+	assert.Equal(t, int64(28), server.aofFsyncedSize)
+
+	server.aofFsync = AOF_FSYNC_NO
+	server.aofBuf = "*1\r\n$4\r\nping\r\n"
+	flushAppendOnlyFile()
+	assert.Equal(t, int64(42), server.aofCurrentSize)
+	assert.Equal(t, int64(28), server.aofFsyncedSize)
+}
+
+func Test_propagateChanges(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	// the writes changing nothing aren't propagated
+	runCommand(c, "set", "s", "v")
+	server.aofBuf = ""
+	assert.Equal(t, REPLY_WRONG_TYPE, runCommand(c, "lpush", "s", "a"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "zadd", "z", "xx", "1", "m"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "zrem", "z", "m"))
+	assert.Equal(t, "", server.aofBuf)
+
+	// XREADGROUP is propagated by its effects only, even when it blocks
+	server.aofFileName = "test_propagate.aof"
+	defer os.Remove(server.aofFileName)
+	runCommand(c, "xadd", "x", "1-1", "f", "v")
+	runCommand(c, "xadd", "x", "2-1", "f", "v")
+	runCommand(c, "xadd", "x", "3-1", "f", "v")
+	runCommand(c, "xgroup", "create", "x", "g", "0")
+	runCommand(c, "xgroup", "create", "y", "g", "$", "mkstream")
+	aof := server.aofBuf
+	runCommand(c, "xreadgroup", "group", "g", "alice", "count", "1", "streams", "x", ">")
+	assert.NotContains(t, server.aofBuf[len(aof):], "xreadgroup")
+	assert.Contains(t, server.aofBuf[len(aof):], "xclaim")
+	aof = server.aofBuf
+	blocked := NewClient(0)
+	assert.Equal(t, "", runCommand(blocked, "xreadgroup", "group", "g", "bob", "block", "0", "streams", "y", ">"))
+	assert.Equal(t, aof, server.aofBuf)
+
+	// only the delivered entry is pending once the AOF is loaded
+	assert.Nil(t, os.WriteFile(server.aofFileName, []byte(server.aofBuf), 0666))
+	initTestServer(t)
+	server.aofFileName = "test_propagate.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	c = NewClient(0)
+	assert.Equal(t, "*4\r\n:1\r\n$3\r\n1-1\r\n$3\r\n1-1\r\n*1\r\n*2\r\n$5\r\nalice\r\n$1\r\n1\r\n",
+		runCommand(c, "xpending", "x", "g"))
+}
@@ -1,5 +1,39 @@
 package main
 
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the bitmap can be at most 512MB, the same limit as a string
+	BITMAP_MAX_BITS int64 = 512 * 1024 * 1024 * 8
+
+	REPLY_BIT_OFFSET     = "-ERR bit offset is not an integer or out of range\r\n"
+	REPLY_BIT_VALUE      = "-ERR bit is not an integer or out of range\r\n"
+	REPLY_BITFIELD_TYPE  = "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"
+	REPLY_BITFIELD_RO    = "-ERR BITFIELD_RO only supports the GET subcommand\r\n"
+	REPLY_BITOP_NOT      = "-ERR BITOP NOT must be called with a single source key.\r\n"
+	REPLY_OVERFLOW_TYPE  = "-ERR Invalid OVERFLOW type specified\r\n"
+	REPLY_OFFSET_RANGE   = "-ERR offset is out of range\r\n"
+	REPLY_STRING_TOO_BIG = "-ERR string exceeds maximum allowed size (512MB)\r\n"
+
+	BITOP_AND = 0
+	BITOP_OR  = 1
+	BITOP_XOR = 2
+	BITOP_NOT = 3
+
+	BITFIELDOP_GET    = 0
+	BITFIELDOP_SET    = 1
+	BITFIELDOP_INCRBY = 2
+
+	BFOVERFLOW_WRAP = 0
+	BFOVERFLOW_SAT  = 1
+	BFOVERFLOW_FAIL = 2
+)
+
 type Bitmap []byte
 
 func (b *Bitmap) BitLength() int64 {
@@ -23,28 +57,27 @@ func growIfNeedBitmap(b *Bitmap, bitLen int64) *Bitmap {
 	return b
 }
 
-func (b *Bitmap) SetBit(bitOffset int64, on int64) {
+// SetBit set or clear the bit at 'bitOffset' and returns the original value of the bit.
+func (b *Bitmap) SetBit(bitOffset int64, on int64) int {
 	growIfNeedBitmap(b, bitOffset)
 
 	/* Get current values */
 	offset := bitOffset >> 3
 	byteVal := (*b)[offset]
 	bit := 7 - (bitOffset & 0x7)
-	bitVal := byte(byteVal & (1 << bit))
+	bitVal := int((byteVal >> bit) & 0x1)
 
-	/* Either it is newly created, changed length, or the bit changes before and after.
-	 * Note that the bitval here is actually a decimal number.
-	 * So we need to use `!!` to convert it to 0 or 1 for comparison. */
-	if ^^bitVal != byte(on) {
+	/* Update the byte only if the bit really changes */
+	if bitVal != int(on) {
 		byteVal &= ^(1 << bit)
 		byteVal |= (byte(on) & 0x1) << bit
 		(*b)[offset] = byteVal
 	}
-
+	return bitVal
 }
 
 func (b *Bitmap) GetBit(bitOffset int64) int {
-	if bitOffset > int64(len(*b))<<3 {
+	if bitOffset >= b.BitLength() {
 		return 0
 	}
 
@@ -58,57 +91,645 @@ func (b *Bitmap) GetBit(bitOffset int64) int {
 	}
 }
 
+// BitCount counts the number of set bits in the inclusive bit range [start, end].
+func (b *Bitmap) BitCount(start, end int64) int64 {
+	cnt := int64(0)
+	// count the bits one by one until reach a byte boundary
+	for ; start <= end && start&0x7 != 0; start++ {
+		cnt += int64(b.GetBit(start))
+	}
+	// then count whole bytes
+	for ; start+7 <= end; start += 8 {
+		cnt += int64(bits.OnesCount8((*b)[start>>3]))
+	}
+	for ; start <= end; start++ {
+		cnt += int64(b.GetBit(start))
+	}
+	return cnt
+}
+
+// BitPos returns the position of the first bit set to 'bit' in the inclusive bit range [start, end],
+// -1 is returned if there is no such bit.
+func (b *Bitmap) BitPos(bit int, start, end int64) int64 {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for start <= end {
+		// a whole byte that can't contain the bit is skipped at once
+		if start&0x7 == 0 && start+7 <= end && (*b)[start>>3] == skip {
+			start += 8
+			continue
+		}
+		if b.GetBit(start) == bit {
+			return start
+		}
+		start++
+	}
+	return -1
+}
+
+// GetUnsignedField returns the unsigned integer stored with 'width' bits at 'offset',
+// the most significant bit comes first.
+func (b *Bitmap) GetUnsignedField(offset int64, width int) uint64 {
+	var value uint64
+	for i := 0; i < width; i++ {
+		value = value<<1 | uint64(b.GetBit(offset+int64(i)))
+	}
+	return value
+}
+
+func (b *Bitmap) GetSignedField(offset int64, width int) int64 {
+	value := int64(b.GetUnsignedField(offset, width))
+	// sign extension
+	if width < 64 && value&(1<<(width-1)) != 0 {
+		value |= -1 << width
+	}
+	return value
+}
+
+// SetField stores the low 'width' bits of the value at 'offset', the caller should make sure
+// the bitmap is large enough.
+func (b *Bitmap) SetField(offset int64, width int, value uint64) {
+	for i := 0; i < width; i++ {
+		on := int64((value >> (width - 1 - i)) & 0x1)
+		b.SetBit(offset+int64(i), on)
+	}
+}
+
+// checkUnsignedBitfieldOverflow checks if value+incr overflows an unsigned integer of 'width' bits.
+// It returns 1 on overflow, -1 on underflow and 0 otherwise, limit is the value to store
+// according to the overflow policy.
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, width int, owtype int) (int, uint64) {
+	max := uint64(1)<<width - 1
+	maxIncr := int64(max - value)
+	minIncr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxIncr) {
+		if owtype == BFOVERFLOW_WRAP {
+			return 1, (value + uint64(incr)) & max
+		}
+		return 1, max
+	} else if incr < 0 && incr < minIncr {
+		if owtype == BFOVERFLOW_WRAP {
+			return -1, (value + uint64(incr)) & max
+		}
+		return -1, 0
+	}
+	return 0, 0
+}
+
+// checkSignedBitfieldOverflow is the signed version of checkUnsignedBitfieldOverflow.
+func checkSignedBitfieldOverflow(value int64, incr int64, width int, owtype int) (int, int64) {
+	max := int64(math.MaxInt64)
+	if width != 64 {
+		max = int64(1)<<(width-1) - 1
+	}
+	min := -max - 1
+	maxIncr := max - value
+	minIncr := min - value
+
+	overflow := 0
+	if value > max || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr) {
+		overflow = 1
+	} else if value < min || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr) {
+		overflow = -1
+	}
+	if overflow == 0 {
+		return 0, 0
+	}
+
+	if owtype == BFOVERFLOW_SAT {
+		if overflow == 1 {
+			return 1, max
+		}
+		return -1, min
+	}
+	// wrap around and keep the sign of the 'width' bits integer
+	res := uint64(value) + uint64(incr)
+	if width < 64 {
+		mask := ^uint64(0) << width
+		if res&(uint64(1)<<(width-1)) != 0 {
+			res |= mask
+		} else {
+			res &= ^mask
+		}
+	}
+	return overflow, int64(res)
+}
+
+// lookupBitmapOrCreate returns the bitmap stored at 'key', a new one is created if the key doesn't exist.
+// A string value is converted in place so the bit commands and the string commands share the same bytes.
+// nil is returned if the key holds another type, the error reply has been added in this case.
+func lookupBitmapOrCreate(c *GedisClient, key *GObj) *Bitmap {
+	bobj := LookupKey(key)
+	if bobj == nil {
+		bm := make(Bitmap, 0)
+		_ = server.db.data.Add(key, NewObject(BITMAP, &bm))
+		return &bm
+	}
+
+	switch bobj.Type_ {
+	case BITMAP:
+		return bobj.Val_.(*Bitmap)
+	case STR:
+		bm := Bitmap(bobj.StrVal())
+		bobj.Type_ = BITMAP
+		bobj.Val_ = &bm
+		return &bm
+	}
+	c.AddReply(REPLY_WRONG_TYPE)
+	return nil
+}
+
+// lookupBitmapRead returns the bytes of a string or bitmap value as a bitmap without modifying it.
+// ok is false if the key holds another type.
+func lookupBitmapRead(key *GObj) (bm *Bitmap, ok bool) {
+	bobj := LookupKeyRead(key)
+	if bobj == nil {
+		return nil, true
+	}
+	if bobj.Type_ != STR && bobj.Type_ != BITMAP {
+		return nil, false
+	}
+	b := Bitmap(bobj.BytesVal())
+	return &b, true
+}
+
+// getBitOffset parses a bit offset, the offset can be prefixed by '#' to be multiplied by the width.
+func getBitOffset(s string, hash bool, width int) (int64, bool) {
+	mul := int64(1)
+	if hash && len(s) > 0 && s[0] == '#' {
+		mul = int64(width)
+		s = s[1:]
+	}
+	var offset int64
+	if GetNumber(s, &offset) != nil || offset < 0 {
+		return 0, false
+	}
+	if offset > BITMAP_MAX_BITS/mul {
+		return 0, false
+	}
+	offset *= mul
+	if offset+int64(width) > BITMAP_MAX_BITS {
+		return 0, false
+	}
+	return offset, true
+}
+
+// getBitfieldType parses a type like 'i16' or 'u8'.
+func getBitfieldType(s string) (signed bool, width int, ok bool) {
+	if len(s) < 2 {
+		return false, 0, false
+	}
+	switch s[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+		signed = false
+	default:
+		return false, 0, false
+	}
+	w, err := strconv.Atoi(s[1:])
+	if err != nil || w < 1 || (signed && w > 64) || (!signed && w > 63) {
+		return false, 0, false
+	}
+	return signed, w, true
+}
+
+// getBitRange translates the range arguments [start end [BYTE|BIT]] to an inclusive bit range.
+// 'empty' is true if the range contains nothing, ok is false if an error reply has been added.
+func getBitRange(c *GedisClient, args []*GObj, byteLen int64) (start, end int64, empty, ok bool) {
+	isBit := false
+	if len(args) == 3 {
+		switch strings.ToLower(args[2].StrVal()) {
+		case "bit":
+			isBit = true
+		case "byte":
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return 0, 0, false, false
+		}
+	}
+
+	totLen := byteLen
+	if isBit {
+		totLen = byteLen << 3
+	}
+	start, end = 0, totLen-1
+	if len(args) > 0 && GetNumber(args[0].StrVal(), &start) != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return 0, 0, false, false
+	}
+	if len(args) > 1 && GetNumber(args[1].StrVal(), &end) != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return 0, 0, false, false
+	}
+
+	if start < 0 {
+		start = totLen + start
+	}
+	if end < 0 {
+		end = totLen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totLen {
+		end = totLen - 1
+	}
+	if start > end {
+		return 0, 0, true, true
+	}
+
+	if !isBit {
+		start, end = start<<3, end<<3+7
+	}
+	return start, end, false, true
+}
+
 /* Bit operations. */
 
 var setbitCommand CommandProc = func(c *GedisClient) {
 	var bitOffset, on int64
 
-	if GetNumber(c.args[2].StrVal(), &bitOffset) != nil || GetNumber(c.args[3].StrVal(), &on) != nil {
-		c.AddReply(REPLY_INVALID_VALUE)
+	if GetNumber(c.args[2].StrVal(), &bitOffset) != nil || bitOffset < 0 || bitOffset >= BITMAP_MAX_BITS {
+		c.AddReply(REPLY_BIT_OFFSET)
+		return
+	}
+	if GetNumber(c.args[3].StrVal(), &on) != nil {
+		c.AddReply(REPLY_BIT_VALUE)
 		return
 	}
 
 	/* Bits can only be set or cleared */
-	if on & ^1 > 0 {
-		c.AddReply(REPLY_INVALID_VALUE)
+	if on & ^1 != 0 {
+		c.AddReply(REPLY_BIT_VALUE)
+		return
+	}
+
+	bm := lookupBitmapOrCreate(c, c.args[1])
+	if bm == nil {
+		return
+	}
+
+	old := bm.SetBit(bitOffset, on)
+	signalModifiedKey(c, c.args[1])
+	server.dirty++
+	notifyKeyspaceEvent(NOTIFY_STRING, "setbit", c.args[1])
+	c.AddReplyInt(old)
+}
+
+var getbitCommand CommandProc = func(c *GedisClient) {
+	var bitOffset int64
+	if GetNumber(c.args[2].StrVal(), &bitOffset) != nil || bitOffset < 0 || bitOffset >= BITMAP_MAX_BITS {
+		c.AddReply(REPLY_BIT_OFFSET)
 		return
 	}
 
-	bobj := LookupKey(c.args[1])
-	if bobj != nil && bobj.Type_ != BITMAP {
+	bm, ok := lookupBitmapRead(c.args[1])
+	if !ok {
 		c.AddReply(REPLY_WRONG_TYPE)
 		return
 	}
+	if bm == nil {
+		c.AddReplyInt(0)
+		return
+	}
 
-	var bm *Bitmap
-	if bobj == nil {
-		bm = growIfNeedBitmap(bm, bitOffset)
-		_ = server.db.data.Add(c.args[1], NewObject(BITMAP, bm))
-	} else {
-		bm = bobj.Val_.(*Bitmap)
+	c.AddReplyInt(bm.GetBit(bitOffset))
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+var bitcountCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) != 2 && len(c.args) != 4 && len(c.args) != 5 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+
+	bm, ok := lookupBitmapRead(c.args[1])
+	if !ok {
+		c.AddReply(REPLY_WRONG_TYPE)
+		return
+	}
+	if bm == nil {
+		c.AddReplyInt(0)
+		return
 	}
 
-	bm.SetBit(bitOffset, on)
-	c.AddReplyInt(int(on))
+	start, end, empty, ok := getBitRange(c, c.args[2:], bm.ByteLength())
+	if !ok {
+		return
+	}
+	if empty {
+		c.AddReplyInt(0)
+		return
+	}
+	c.AddReplyInt(int(bm.BitCount(start, end)))
 }
 
-var getbitCommand CommandProc = func(c *GedisClient) {
-	var bitOffset int64
-	if GetNumber(c.args[2].StrVal(), &bitOffset) != nil {
-		c.AddReply(REPLY_INVALID_VALUE)
+// BITPOS key bit [start [end [BYTE|BIT]]]
+var bitposCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) > 6 {
+		c.AddReply(REPLY_SYNTAX_ERR)
 		return
 	}
 
-	bobj := LookupKey(c.args[1])
-	if bobj == nil {
-		c.AddReply(REPLY_NIL)
+	var bit int64
+	if GetNumber(c.args[2].StrVal(), &bit) != nil || bit & ^1 != 0 {
+		c.AddReply(REPLY_BIT_VALUE)
 		return
 	}
-	if bobj.Type_ != BITMAP {
+
+	bm, ok := lookupBitmapRead(c.args[1])
+	if !ok {
 		c.AddReply(REPLY_WRONG_TYPE)
 		return
 	}
-	bm := bobj.Val_.(*Bitmap)
+	/* If the key does not exist, from our point of view it is an infinite
+	 * array of 0 bits. If the user is looking for the first clear bit return 0,
+	 * If the user is looking for the first set bit, return -1. */
+	if bm == nil {
+		if bit == 1 {
+			c.AddReplyInt(-1)
+		} else {
+			c.AddReplyInt(0)
+		}
+		return
+	}
 
-	c.AddReplyInt(bm.GetBit(bitOffset))
+	start, end, empty, ok := getBitRange(c, c.args[3:], bm.ByteLength())
+	if !ok {
+		return
+	}
+	if empty {
+		c.AddReplyInt(-1)
+		return
+	}
+
+	pos := bm.BitPos(int(bit), start, end)
+	/* If we are looking for clear bits, and the user specified an exact
+	 * range with start-end, we can't consider the right of the range as
+	 * zero padded. Otherwise the first bit after the string is returned. */
+	endGiven := len(c.args) >= 5
+	if pos == -1 && bit == 0 && !endGiven {
+		pos = end + 1
+	}
+	c.AddReplyInt(int(pos))
+}
+
+// BITOP op destkey srckey1 srckey2 srckey3 ... srckeyN
+var bitopCommand CommandProc = func(c *GedisClient) {
+	var op int
+	switch strings.ToLower(c.args[1].StrVal()) {
+	case "and":
+		op = BITOP_AND
+	case "or":
+		op = BITOP_OR
+	case "xor":
+		op = BITOP_XOR
+	case "not":
+		op = BITOP_NOT
+	default:
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	if op == BITOP_NOT && len(c.args) != 4 {
+		c.AddReply(REPLY_BITOP_NOT)
+		return
+	}
+
+	// lookup all the source keys, a missing key is considered as a zero length string
+	srcs := make([]Bitmap, 0, len(c.args)-3)
+	maxLen := 0
+	for i := 3; i < len(c.args); i++ {
+		bm, ok := lookupBitmapRead(c.args[i])
+		if !ok {
+			c.AddReply(REPLY_WRONG_TYPE)
+			return
+		}
+		if bm == nil {
+			srcs = append(srcs, Bitmap{})
+			continue
+		}
+		srcs = append(srcs, *bm)
+		if len(*bm) > maxLen {
+			maxLen = len(*bm)
+		}
+	}
+
+	res := make(Bitmap, maxLen)
+	for j := 0; j < maxLen; j++ {
+		var output byte
+		for i, src := range srcs {
+			var b byte
+			if j < len(src) {
+				b = src[j]
+			}
+			if i == 0 {
+				output = b
+				continue
+			}
+			switch op {
+			case BITOP_AND:
+				output &= b
+			case BITOP_OR:
+				output |= b
+			case BITOP_XOR:
+				output ^= b
+			}
+		}
+		if op == BITOP_NOT {
+			output = ^output
+		}
+		res[j] = output
+	}
+
+	dest := c.args[2]
+	_ = removeExpire(dest)
+	if maxLen == 0 {
+		if server.db.data.Delete(dest) == nil {
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dest)
+		}
+	} else {
+		server.db.data.Set(dest, NewObject(BITMAP, &res))
+		notifyKeyspaceEvent(NOTIFY_STRING, "set", dest)
+	}
+	signalModifiedKey(c, dest)
+	server.dirty++
+	c.AddReplyInt(maxLen)
+}
+
+type bitfieldOp struct {
+	opcode int
+	offset int64
+	width  int
+	signed bool
+	i64    int64 // the value to set or the increment
+	owtype int
+}
+
+func bitfieldGeneric(c *GedisClient, readonly bool) {
+	ops := make([]bitfieldOp, 0)
+	owtype := BFOVERFLOW_WRAP
+	changes := false
+
+	for i := 2; i < len(c.args); i++ {
+		remain := len(c.args) - i - 1
+		subCmd := strings.ToLower(c.args[i].StrVal())
+		var opcode int
+		if subCmd == "get" && remain >= 2 {
+			opcode = BITFIELDOP_GET
+		} else if subCmd == "set" && remain >= 3 {
+			opcode = BITFIELDOP_SET
+		} else if subCmd == "incrby" && remain >= 3 {
+			opcode = BITFIELDOP_INCRBY
+		} else if subCmd == "overflow" && remain >= 1 {
+			switch strings.ToLower(c.args[i+1].StrVal()) {
+			case "wrap":
+				owtype = BFOVERFLOW_WRAP
+			case "sat":
+				owtype = BFOVERFLOW_SAT
+			case "fail":
+				owtype = BFOVERFLOW_FAIL
+			default:
+				c.AddReply(REPLY_OVERFLOW_TYPE)
+				return
+			}
+			i++
+			continue
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+
+		signed, width, ok := getBitfieldType(c.args[i+1].StrVal())
+		if !ok {
+			c.AddReply(REPLY_BITFIELD_TYPE)
+			return
+		}
+		offset, ok := getBitOffset(c.args[i+2].StrVal(), true, width)
+		if !ok {
+			c.AddReply(REPLY_BIT_OFFSET)
+			return
+		}
+
+		op := bitfieldOp{opcode: opcode, offset: offset, width: width, signed: signed, owtype: owtype}
+		if opcode != BITFIELDOP_GET {
+			if readonly {
+				c.AddReply(REPLY_BITFIELD_RO)
+				return
+			}
+			if GetNumber(c.args[i+3].StrVal(), &op.i64) != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			changes = true
+			i++
+		}
+		ops = append(ops, op)
+		i += 2
+	}
+
+	var bm *Bitmap
+	if changes {
+		if bm = lookupBitmapOrCreate(c, c.args[1]); bm == nil {
+			return
+		}
+		// grow the bitmap once to the highest offset that will be written
+		highest := int64(0)
+		for _, op := range ops {
+			if op.opcode != BITFIELDOP_GET && op.offset+int64(op.width)-1 > highest {
+				highest = op.offset + int64(op.width) - 1
+			}
+		}
+		growIfNeedBitmap(bm, highest)
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
+		notifyKeyspaceEvent(NOTIFY_STRING, "setbit", c.args[1])
+	} else {
+		var ok bool
+		if bm, ok = lookupBitmapRead(c.args[1]); !ok {
+			c.AddReply(REPLY_WRONG_TYPE)
+			return
+		}
+		if bm == nil {
+			bm = &Bitmap{}
+		}
+	}
+
+	c.AddReplyArrayLen(len(ops))
+	for _, op := range ops {
+		if op.opcode == BITFIELDOP_GET {
+			if op.signed {
+				c.AddReplyInt(int(bm.GetSignedField(op.offset, op.width)))
+			} else {
+				c.AddReplyInt(int(bm.GetUnsignedField(op.offset, op.width)))
+			}
+			continue
+		}
+
+		if op.signed {
+			oldVal := bm.GetSignedField(op.offset, op.width)
+			newVal, incr := op.i64, int64(0)
+			if op.opcode == BITFIELDOP_INCRBY {
+				newVal, incr = oldVal+op.i64, op.i64
+			}
+			value := oldVal
+			if op.opcode == BITFIELDOP_SET {
+				value = op.i64
+			}
+			overflow, limit := checkSignedBitfieldOverflow(value, incr, op.width, op.owtype)
+			if overflow != 0 {
+				newVal = limit
+			}
+			if overflow != 0 && op.owtype == BFOVERFLOW_FAIL {
+				c.AddReplyNull()
+				continue
+			}
+			bm.SetField(op.offset, op.width, uint64(newVal))
+			if op.opcode == BITFIELDOP_SET {
+				c.AddReplyInt(int(oldVal))
+			} else {
+				c.AddReplyInt(int(newVal))
+			}
+		} else {
+			oldVal := bm.GetUnsignedField(op.offset, op.width)
+			newVal, incr := uint64(op.i64), int64(0)
+			if op.opcode == BITFIELDOP_INCRBY {
+				newVal, incr = oldVal+uint64(op.i64), op.i64
+			}
+			value := oldVal
+			if op.opcode == BITFIELDOP_SET {
+				value = uint64(op.i64)
+			}
+			overflow, limit := checkUnsignedBitfieldOverflow(value, incr, op.width, op.owtype)
+			if overflow != 0 {
+				newVal = limit
+			}
+			if overflow != 0 && op.owtype == BFOVERFLOW_FAIL {
+				c.AddReplyNull()
+				continue
+			}
+			bm.SetField(op.offset, op.width, newVal)
+			if op.opcode == BITFIELDOP_SET {
+				c.AddReplyInt(int(oldVal))
+			} else {
+				c.AddReplyInt(int(newVal))
+			}
+		}
+	}
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]
+var bitfieldCommand CommandProc = func(c *GedisClient) {
+	bitfieldGeneric(c, false)
+}
+
+// BITFIELD_RO key [GET type offset] ...
+var bitfieldroCommand CommandProc = func(c *GedisClient) {
+	bitfieldGeneric(c, true)
 }
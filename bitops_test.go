@@ -18,3 +18,101 @@ func Test_BitMap(t *testing.T) {
 
 	assert.Equal(t, 0, b.GetBit(9999999))
 }
+
+func Test_BitCountAndPos(t *testing.T) {
+	b := Bitmap{0xff, 0xf0, 0x00}
+
+	assert.Equal(t, int64(12), b.BitCount(0, b.BitLength()-1))
+	assert.Equal(t, int64(4), b.BitCount(8, 15))
+	assert.Equal(t, int64(5), b.BitCount(5, 9))
+	assert.Equal(t, int64(0), b.BitCount(16, 23))
+
+	assert.Equal(t, int64(0), b.BitPos(1, 0, 23))
+	assert.Equal(t, int64(12), b.BitPos(0, 0, 23))
+	assert.Equal(t, int64(-1), b.BitPos(1, 12, 23))
+	assert.Equal(t, int64(-1), b.BitPos(0, 0, 7))
+}
+
+func Test_BitField(t *testing.T) {
+	b := make(Bitmap, 8)
+
+	b.SetField(3, 8, 200)
+	assert.Equal(t, uint64(200), b.GetUnsignedField(3, 8))
+	assert.Equal(t, int64(-56), b.GetSignedField(3, 8))
+
+	b.SetField(0, 64, uint64(1)<<63)
+	assert.Equal(t, int64(-1)<<63, b.GetSignedField(0, 64))
+
+	overflow, limit := checkUnsignedBitfieldOverflow(250, 10, 8, BFOVERFLOW_WRAP)
+	assert.Equal(t, 1, overflow)
+	assert.Equal(t, uint64(4), limit)
+	overflow, limit = checkUnsignedBitfieldOverflow(5, -10, 8, BFOVERFLOW_SAT)
+	assert.Equal(t, -1, overflow)
+	assert.Equal(t, uint64(0), limit)
+
+	overflow, slimit := checkSignedBitfieldOverflow(120, 10, 8, BFOVERFLOW_WRAP)
+	assert.Equal(t, 1, overflow)
+	assert.Equal(t, int64(-126), slimit)
+	overflow, slimit = checkSignedBitfieldOverflow(-120, -10, 8, BFOVERFLOW_SAT)
+	assert.Equal(t, -1, overflow)
+	assert.Equal(t, int64(-128), slimit)
+	overflow, _ = checkSignedBitfieldOverflow(100, 27, 8, BFOVERFLOW_FAIL)
+	assert.Equal(t, 0, overflow)
+}
+
+func Test_BitCommands(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, ":0\r\n", runCommand(c, "setbit", "bm", "7", "1"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "setbit", "bm", "7", "0"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "getbit", "bm", "8"))
+	assert.Equal(t, REPLY_BIT_OFFSET, runCommand(c, "setbit", "bm", "-1", "1"))
+
+	// bitmaps and strings share the same bytes
+	runCommand(c, "set", "s", "foobar")
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "bitcount"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "bitpos", "s"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "bitfield"))
+	assert.Equal(t, ":26\r\n", runCommand(c, "bitcount", "s"))
+	assert.Equal(t, ":4\r\n", runCommand(c, "bitcount", "s", "0", "0"))
+	assert.Equal(t, ":6\r\n", runCommand(c, "bitcount", "s", "1", "1"))
+	assert.Equal(t, ":17\r\n", runCommand(c, "bitcount", "s", "5", "30", "bit"))
+	runCommand(c, "setbit", "s", "7", "1")
+	assert.Equal(t, "$6\r\ngoobar\r\n", runCommand(c, "get", "s"))
+	assert.Equal(t, ":11\r\n", runCommand(c, "setrange", "s", "6", "=five"))
+	assert.Equal(t, REPLY_STRING_TOO_BIG, runCommand(c, "setrange", "s", "9223372036854775807", "x"))
+	assert.Equal(t, "$5\r\n=five\r\n", runCommand(c, "getrange", "s", "-5", "-1"))
+	assert.Equal(t, "$4\r\nooba\r\n", runCommand(c, "getrange", "s", "1", "4"))
+
+	runCommand(c, "set", "p", "\xff\xf0\x00")
+	assert.Equal(t, ":12\r\n", runCommand(c, "bitpos", "p", "0"))
+	assert.Equal(t, ":8\r\n", runCommand(c, "bitpos", "p", "1", "1"))
+	assert.Equal(t, ":-1\r\n", runCommand(c, "bitpos", "p", "1", "2", "-1"))
+	assert.Equal(t, ":7\r\n", runCommand(c, "bitpos", "p", "1", "7", "15", "bit"))
+	runCommand(c, "set", "full", "\xff")
+	assert.Equal(t, ":8\r\n", runCommand(c, "bitpos", "full", "0"))
+	assert.Equal(t, ":-1\r\n", runCommand(c, "bitpos", "full", "0", "0", "-1"))
+
+	runCommand(c, "set", "a", "\x0f\xff")
+	runCommand(c, "set", "b", "\xf1")
+	assert.Equal(t, ":2\r\n", runCommand(c, "bitop", "and", "dest", "a", "b"))
+	assert.Equal(t, "$2\r\n\x01\x00\r\n", runCommand(c, "get", "dest"))
+	runCommand(c, "bitop", "or", "dest", "a", "b")
+	assert.Equal(t, "$2\r\n\xff\xff\r\n", runCommand(c, "get", "dest"))
+	runCommand(c, "bitop", "xor", "dest", "a", "b")
+	assert.Equal(t, "$2\r\n\xfe\xff\r\n", runCommand(c, "get", "dest"))
+	runCommand(c, "bitop", "not", "dest", "b")
+	assert.Equal(t, "$1\r\n\x0e\r\n", runCommand(c, "get", "dest"))
+	assert.Equal(t, REPLY_BITOP_NOT, runCommand(c, "bitop", "not", "dest", "a", "b"))
+
+	assert.Equal(t, "*2\r\n:0\r\n:100\r\n",
+		runCommand(c, "bitfield", "bf", "set", "u8", "#1", "100", "get", "u8", "8"))
+	assert.Equal(t, "*2\r\n:255\r\n$-1\r\n",
+		runCommand(c, "bitfield", "bf", "incrby", "u8", "8", "155", "overflow", "fail", "incrby", "u8", "8", "1"))
+	assert.Equal(t, "*1\r\n:255\r\n", runCommand(c, "bitfield", "bf", "overflow", "sat", "incrby", "u8", "8", "1"))
+	assert.Equal(t, "*1\r\n:-1\r\n", runCommand(c, "bitfield_ro", "bf", "get", "i8", "8"))
+	assert.Equal(t, REPLY_BITFIELD_RO, runCommand(c, "bitfield_ro", "bf", "set", "i8", "8", "1"))
+	assert.Equal(t, REPLY_BITFIELD_TYPE, runCommand(c, "bitfield", "bf", "get", "u64", "0"))
+	assert.Equal(t, REPLY_BIT_OFFSET, runCommand(c, "bitfield", "bf", "get", "u2", "#4611686018427387904"))
+}
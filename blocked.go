@@ -0,0 +1,151 @@
+package main
+
+/* A client blocked on keys stops processing its query until one of the keys receives data
+ * or the timeout is reached. When a write command makes a blocked key ready, the blocked
+ * commands of the key are executed again after that write command, in the order the
+ * clients blocked, and a command that still has nothing to serve blocks again with its
+ * original deadline. */
+
+const (
+	BLOCKED_NONE     = 0
+	BLOCKED_STREAM   = 1 // XREAD and XREADGROUP
+	BLOCKED_WAIT     = 2 // WAIT for the acknowledgement of replicas
+	BLOCKED_POSTPONE = 3 // the command waits for the end of CLIENT PAUSE
+)
+
+type blockingState struct {
+	btype   int
+	timeout int64   // unix time in ms, 0 means block forever
+	keys    []*GObj // the keys the client is waiting for
+
+	numReplicas int   // the replicas WAIT needs
+	replOff     int64 // the replication offset the replicas need to acknowledge
+}
+
+// blockClient blocks the client until the operation unblocks it or the timeout
+func blockClient(c *GedisClient, btype int, timeout int64) {
+	// a command executed again keeps the deadline of the first time
+	if c.flags&CLIENT_REPROCESSING == 0 {
+		c.bstate.timeout = timeout
+	}
+	c.bstate.btype = btype
+	c.flags |= CLIENT_BLOCKED
+	server.blockedClients[c] = struct{}{}
+}
+
+// blockForKeys blocks the client on the keys until one of them is ready or the timeout
+func blockForKeys(c *GedisClient, btype int, keys []*GObj, timeout int64) {
+	c.bstate.keys = keys
+	for _, key := range keys {
+		k := key.StrVal()
+		server.blockingKeys[k] = append(server.blockingKeys[k], c)
+	}
+	blockClient(c, btype, timeout)
+}
+
+// unblockClient removes the client from all the keys it is blocked on
+func unblockClient(c *GedisClient) {
+	for _, key := range c.bstate.keys {
+		removeClient(server.blockingKeys, key.StrVal(), c)
+	}
+	if c.bstate.btype == BLOCKED_WAIT {
+		server.clientsWaitingAcks = removeClientFromList(server.clientsWaitingAcks, c)
+	}
+	if c.bstate.btype == BLOCKED_POSTPONE {
+		server.postponedClients = removeClientFromList(server.postponedClients, c)
+	}
+	c.bstate.keys = nil
+	c.bstate.btype = BLOCKED_NONE
+	c.flags &= ^CLIENT_BLOCKED
+	delete(server.blockedClients, c)
+}
+
+// signalKeyAsReady marks the key as ready if some clients are blocked on it
+func signalKeyAsReady(key *GObj) {
+	k := key.StrVal()
+	if _, ok := server.blockingKeys[k]; !ok {
+		return
+	}
+	server.readyKeys[k] = struct{}{}
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on the ready keys by executing
+// their commands again. The served commands may make other keys ready, so it loops until
+// there are no ready keys.
+func handleClientsBlockedOnKeys() {
+	for len(server.readyKeys) > 0 {
+		readyKeys := server.readyKeys
+		server.readyKeys = make(map[string]struct{})
+		for k := range readyKeys {
+			// the clients blocked again are appended to the list, don't serve them twice
+			clients := append([]*GedisClient(nil), server.blockingKeys[k]...)
+			for _, c := range clients {
+				if c.flags&CLIENT_BLOCKED == 0 {
+					continue
+				}
+				unblockClient(c)
+				cmd := lookUpCommand(c.args[0].StrVal())
+				c.flags |= CLIENT_REPROCESSING
+				call(c, cmd)
+				c.flags &= ^CLIENT_REPROCESSING
+				if c.flags&CLIENT_BLOCKED == 0 {
+					unblockedClientReady(c)
+				}
+			}
+		}
+	}
+}
+
+// replyToBlockedClientTimedOut adds the reply of a timed out blocking operation
+func replyToBlockedClientTimedOut(c *GedisClient) {
+	switch c.bstate.btype {
+	case BLOCKED_STREAM:
+		c.AddReplyNullArray()
+	case BLOCKED_WAIT:
+		c.AddReplyLongLong(int64(replicationCountAcksByOffset(c.bstate.replOff)))
+	}
+}
+
+// handleBlockedClientsTimeout unblocks the clients which reached their deadline
+func handleBlockedClientsTimeout(now int64) {
+	for c := range server.blockedClients {
+		if c.bstate.timeout != 0 && c.bstate.timeout <= now {
+			replyToBlockedClientTimedOut(c)
+			unblockClient(c)
+			unblockedClientReady(c)
+		}
+	}
+}
+
+// unblockedClientReady sends the reply of the unblocked client, and queues it to process the
+// rest of its query
+func unblockedClientReady(c *GedisClient) {
+	// the blocked command is done now
+	resetClient(c)
+	server.aeloop.AddFileEvent(c.nfd, AE_WRITABLE, SendReplyToClient, c)
+	server.unblockedClients = append(server.unblockedClients, c)
+}
+
+// processUnblockedClients processes the query which was pending while the client was blocked,
+// and the command postponed by CLIENT PAUSE
+func processUnblockedClients() {
+	clients := server.unblockedClients
+	server.unblockedClients = nil
+	for _, c := range clients {
+		// the client may be freed or blocked again
+		if server.clients[c.nfd] != c || c.flags&CLIENT_BLOCKED != 0 {
+			continue
+		}
+		if c.flags&CLIENT_PENDING_COMMAND != 0 {
+			c.flags &= ^CLIENT_PENDING_COMMAND
+			ProcessCommand(c)
+			server.aeloop.AddFileEvent(c.nfd, AE_WRITABLE, SendReplyToClient, c)
+			if c.flags&CLIENT_BLOCKED != 0 {
+				continue
+			}
+		}
+		if err := c.ProcessQueryBuf(); err != nil {
+			freeClient(c)
+		}
+	}
+}
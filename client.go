@@ -0,0 +1,639 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The CLIENT command inspects and manages the connected clients. CLIENT PAUSE stalls the
+ * commands of the clients during a maintenance like a failover: the postponed commands block the
+ * client like a blocking operation, and they're executed once the pause ends. The replicas, the
+ * master and the CLIENT command itself are never paused, so the pause can be lifted. */
+
+const (
+	CLIENTS_CRON_PERIOD         = 100 // ms, the period of clientsCron
+	CLIENTS_CRON_MIN_ITERATIONS = 5   // the clients checked by clientsCron at least
+)
+
+/* the types of the clients, see getClientType */
+const (
+	CLIENT_TYPE_NORMAL = 0
+	CLIENT_TYPE_SLAVE  = 1
+	CLIENT_TYPE_PUBSUB = 2
+	CLIENT_TYPE_MASTER = 3
+
+	CLIENT_TYPE_OBUF_COUNT = 3 // the types with the output buffer limits, the master gets no reply
+)
+
+// clientBufferLimit is the output buffer limit of a type of the clients, the client is closed
+// once its output buffer reaches the hard limit, or stays over the soft limit for longer than
+// softSeconds
+type clientBufferLimit struct {
+	hard        int64 // bytes, 0 disables the limit
+	soft        int64
+	softSeconds int64
+}
+
+/* the types of the pause, ALL is stronger than WRITE */
+const (
+	CLIENT_PAUSE_OFF   = 0
+	CLIENT_PAUSE_WRITE = 1 // only the commands which may modify the dataset are paused
+	CLIENT_PAUSE_ALL   = 2
+)
+
+// getClientType returns the type of the client, which is selected by TYPE of CLIENT LIST and KILL,
+// and selects the output buffer limits
+func getClientType(c *GedisClient) int {
+	switch {
+	case c.flags&CLIENT_MASTER != 0:
+		return CLIENT_TYPE_MASTER
+	case c.flags&CLIENT_SLAVE != 0:
+		return CLIENT_TYPE_SLAVE
+	case c.flags&CLIENT_PUBSUB != 0:
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+// getClientTypeByName returns the type of the name, -1 if it's unknown
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "slave", "replica":
+		return CLIENT_TYPE_SLAVE
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	case "master":
+		return CLIENT_TYPE_MASTER
+	}
+	return -1
+}
+
+// getClientTypeName returns the name of the type, like CONFIG GET client-output-buffer-limit
+func getClientTypeName(ctype int) string {
+	switch ctype {
+	case CLIENT_TYPE_SLAVE:
+		return "slave"
+	case CLIENT_TYPE_PUBSUB:
+		return "pubsub"
+	case CLIENT_TYPE_MASTER:
+		return "master"
+	}
+	return "normal"
+}
+
+// clientFlagsString describes the flags of the client by the letters of CLIENT LIST
+func clientFlagsString(c *GedisClient) string {
+	var sb strings.Builder
+	for _, f := range []struct {
+		flag   int
+		letter byte
+	}{
+		{CLIENT_SLAVE, 'S'},
+		{CLIENT_MASTER, 'M'},
+		{CLIENT_PUBSUB, 'P'},
+		{CLIENT_MULTI, 'x'},
+		{CLIENT_BLOCKED, 'b'},
+		{CLIENT_TRACKING, 't'},
+		{CLIENT_TRACKING_BROKEN, 'R'},
+		{CLIENT_TRACKING_BCAST, 'B'},
+		{CLIENT_DIRTY_CAS, 'd'},
+		{CLIENT_CLOSE_AFTER_REPLY, 'c'},
+		{CLIENT_NO_EVICT, 'e'},
+	} {
+		if c.flags&f.flag != 0 {
+			sb.WriteByte(f.letter)
+		}
+	}
+	if sb.Len() == 0 {
+		return "N"
+	}
+	return sb.String()
+}
+
+// clientOutputMemory returns the bytes of the replies not sent yet
+func clientOutputMemory(c *GedisClient) int {
+	return c.bufpos + c.replyBytes
+}
+
+// catClientInfoString describes the client by a line of CLIENT LIST
+func catClientInfoString(c *GedisClient, now int64) string {
+	multi := -1
+	if c.flags&CLIENT_MULTI != 0 {
+		multi = len(c.mstate.commands)
+	}
+	events := ""
+	if server.aeloop.FileEvents[getFeKey(c.nfd, AE_READABLE)] != nil {
+		events += "r"
+	}
+	if server.aeloop.FileEvents[getFeKey(c.nfd, AE_WRITABLE)] != nil {
+		events += "w"
+	}
+	cmd := "NULL"
+	if c.lastCmd != nil {
+		cmd = c.lastCmd.name
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=%d ssub=%d "+
+		"multi=%d qbuf=%d qbuf-free=%d obl=%d oll=%d omem=%d events=%s cmd=%s user=default redir=%d resp=%d",
+		c.id, c.peerID(), c.sockID(), c.nfd, c.name, (now-c.ctime)/1000, (now-c.lastInteraction)/1000,
+		clientFlagsString(c), len(c.pubsubChannels), len(c.pubsubPatterns), len(c.pubsubShardChannels),
+		multi, c.queryLen-c.qbPos, len(c.queryBuf)-c.queryLen, c.bufpos, len(c.reply), clientOutputMemory(c),
+		events, cmd, int64(c.trackingRedirect), c.resp)
+}
+
+// sortedClients returns the connected clients in the order of their IDs
+func sortedClients() []*GedisClient {
+	clients := make([]*GedisClient, 0, len(server.clients))
+	for _, c := range server.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// clientsCron checks a part of the clients at a time so all the clients are checked about
+// once a second, the cron doesn't block the server even if there are many of them
+func clientsCron(now int64) {
+	iterations := len(server.clients) * CLIENTS_CRON_PERIOD / 1000
+	if iterations < CLIENTS_CRON_MIN_ITERATIONS {
+		iterations = CLIENTS_CRON_MIN_ITERATIONS
+	}
+	for ; iterations > 0; iterations-- {
+		// a new round starts with the clients connected now
+		if len(server.clientsCronList) == 0 {
+			if len(server.clients) == 0 {
+				return
+			}
+			server.clientsCronList = make([]*GedisClient, 0, len(server.clients))
+			for _, c := range server.clients {
+				server.clientsCronList = append(server.clientsCronList, c)
+			}
+		}
+		c := server.clientsCronList[0]
+		server.clientsCronList[0] = nil
+		server.clientsCronList = server.clientsCronList[1:]
+		// the client may be freed since the round started
+		if server.clients[c.nfd] != c {
+			continue
+		}
+		if clientsCronHandleTimeout(c, now) {
+			continue
+		}
+		// the client over the soft limit is closed even if nothing is added to its replies
+		closeClientOnOutputBufferLimitReached(c, now)
+	}
+}
+
+// clientsCronHandleTimeout closes the client idle longer than the timeout, true is returned if
+// it's closed. The replicas, the master and the subscribers are never closed, and the blocked
+// client only times out by the deadline of its command
+func clientsCronHandleTimeout(c *GedisClient, now int64) bool {
+	if server.maxIdleTime == 0 || c.flags&(CLIENT_SLAVE|CLIENT_MASTER|CLIENT_BLOCKED|CLIENT_PUBSUB) != 0 {
+		return false
+	}
+	if now-c.lastInteraction <= server.maxIdleTime {
+		return false
+	}
+	log.Printf("closing idle client %d", c.id)
+	freeClient(c)
+	return true
+}
+
+// parseClientOutputBufferLimit parses the limits like "normal 0 0 0 pubsub 32mb 8mb 60", the
+// limits are set only if all of them are valid
+func parseClientOutputBufferLimit(s string) error {
+	args := strings.Fields(s)
+	if len(args) == 0 || len(args)%4 != 0 {
+		return fmt.Errorf("wrong number of arguments in buffer limit configuration")
+	}
+	limits := server.clientObufLimits
+	for i := 0; i < len(args); i += 4 {
+		ctype := getClientTypeByName(args[i])
+		if ctype == -1 || ctype == CLIENT_TYPE_MASTER {
+			return fmt.Errorf("invalid client class specified in buffer limit configuration")
+		}
+		hard, err := memtoll(args[i+1])
+		if err != nil || hard < 0 {
+			return fmt.Errorf("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		soft, err := memtoll(args[i+2])
+		if err != nil || soft < 0 {
+			return fmt.Errorf("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		softSeconds, err := strconv.ParseInt(args[i+3], 10, 64)
+		if err != nil || softSeconds < 0 {
+			return fmt.Errorf("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		limits[ctype] = clientBufferLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	server.clientObufLimits = limits
+	return nil
+}
+
+// formatClientOutputBufferLimit formats the limits of all the types, the memory is formatted by
+// format like the bytes of CONFIG GET or the units of the config file
+func formatClientOutputBufferLimit(format func(int64) string) string {
+	fields := make([]string, 0, CLIENT_TYPE_OBUF_COUNT*4)
+	for ctype, limit := range server.clientObufLimits {
+		fields = append(fields, getClientTypeName(ctype), format(limit.hard), format(limit.soft),
+			strconv.FormatInt(limit.softSeconds, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// freeClientAsync closes the client later by freeClientsInAsyncFreeQueue, so the client can be
+// closed while the caller is still using it, like adding the replies to many clients
+func freeClientAsync(c *GedisClient) {
+	if c.flags&CLIENT_CLOSE_ASAP != 0 {
+		return
+	}
+	c.flags |= CLIENT_CLOSE_ASAP
+	server.clientsPendingClose = append(server.clientsPendingClose, c)
+}
+
+// freeClientsInAsyncFreeQueue closes the clients scheduled by freeClientAsync, it's called by
+// ServerCron
+func freeClientsInAsyncFreeQueue() {
+	clients := server.clientsPendingClose
+	server.clientsPendingClose = nil
+	for _, c := range clients {
+		// the client may be freed already
+		if server.clients[c.nfd] == c {
+			freeClient(c)
+		}
+	}
+}
+
+// pauseClients pauses the clients until end, which is unix time in ms. The pause of the stronger
+// type and the later end is kept if the clients are already paused
+func pauseClients(ptype int, end int64) {
+	if ptype > server.clientPauseType {
+		server.clientPauseType = ptype
+	}
+	if end > server.clientPauseEnd {
+		server.clientPauseEnd = end
+	}
+}
+
+// unpauseClients ends the pause, the postponed commands are executed by processUnblockedClients
+func unpauseClients() {
+	server.clientPauseType = CLIENT_PAUSE_OFF
+	server.clientPauseEnd = 0
+	clients := server.postponedClients
+	server.postponedClients = nil
+	for _, c := range clients {
+		unblockClient(c)
+		c.flags |= CLIENT_PENDING_COMMAND
+		server.unblockedClients = append(server.unblockedClients, c)
+	}
+}
+
+// checkClientPauseTimeout ends the pause once it's timed out, it's called by ServerCron
+func checkClientPauseTimeout(now int64) {
+	if server.clientPauseType != CLIENT_PAUSE_OFF && now >= server.clientPauseEnd {
+		unpauseClients()
+	}
+}
+
+// clientPauseAffects reports whether the command of the client has to wait for the end of the
+// pause, the commands which may propagate writes are paused by the WRITE mode
+func clientPauseAffects(c *GedisClient, cmd *GedisCommand) bool {
+	if server.clientPauseType == CLIENT_PAUSE_OFF || server.loading ||
+		c.flags&(CLIENT_MASTER|CLIENT_SLAVE|CLIENT_SCRIPT) != 0 || cmd.name == "client" {
+		return false
+	}
+	if server.clientPauseType == CLIENT_PAUSE_ALL {
+		return true
+	}
+	switch cmd.name {
+	case "eval", "evalsha", "publish", "spublish":
+		return true
+	case "exec":
+		for _, mc := range c.mstate.commands {
+			if mc.cmd.flags&CMD_WRITE != 0 {
+				return true
+			}
+		}
+	}
+	return cmd.flags&CMD_WRITE != 0
+}
+
+// blockPostponeClient blocks the client until the pause ends, its command is executed then
+func blockPostponeClient(c *GedisClient) {
+	blockClient(c, BLOCKED_POSTPONE, 0)
+	server.postponedClients = append(server.postponedClients, c)
+}
+
+// clientKillFilter selects the clients killed by CLIENT KILL
+type clientKillFilter struct {
+	id     uint64
+	addr   string
+	laddr  string
+	ctype  int
+	skipMe bool
+	maxAge int64 // seconds, the clients older are killed
+}
+
+func (f *clientKillFilter) match(c, self *GedisClient, now int64) bool {
+	return (f.id == 0 || c.id == f.id) &&
+		(f.addr == "" || c.peerID() == f.addr) &&
+		(f.laddr == "" || c.sockID() == f.laddr) &&
+		(f.ctype == -1 || getClientType(c) == f.ctype) &&
+		(!f.skipMe || c != self) &&
+		(f.maxAge == 0 || (now-c.ctime)/1000 >= f.maxAge)
+}
+
+// killClient closes the client, the client killing itself gets the reply first
+func killClient(c, self *GedisClient) {
+	if c == self {
+		c.flags |= CLIENT_CLOSE_AFTER_REPLY
+		return
+	}
+	freeClient(c)
+}
+
+// CLIENT KILL addr:port | CLIENT KILL <filter> <value> [<filter> <value> ...]
+func clientKillCommand(c *GedisClient) {
+	now := GetTimeMs()
+	// the old form kills the client of the address
+	if len(c.args) == 3 {
+		addr := c.args[2].StrVal()
+		for _, target := range sortedClients() {
+			if target.peerID() == addr {
+				killClient(target, c)
+				c.AddReply(REPLY_OK)
+				return
+			}
+		}
+		c.AddReplyError("No such client")
+		return
+	}
+	if len(c.args)%2 != 0 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	filter := clientKillFilter{ctype: -1, skipMe: true}
+	for i := 2; i < len(c.args); i += 2 {
+		val := c.args[i+1].StrVal()
+		switch strings.ToLower(c.args[i].StrVal()) {
+		case "id":
+			id, err := strconv.ParseUint(val, 10, 64)
+			if err != nil || id == 0 {
+				c.AddReplyError("client-id should be greater than 0")
+				return
+			}
+			filter.id = id
+		case "addr":
+			filter.addr = val
+		case "laddr":
+			filter.laddr = val
+		case "type":
+			if filter.ctype = getClientTypeByName(val); filter.ctype == -1 {
+				c.AddReplyErrorf("Unknown client type '%s'", val)
+				return
+			}
+		case "user":
+			// only the default user exists
+			if val != "default" {
+				c.AddReplyErrorf("No such user '%s'", val)
+				return
+			}
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				c.AddReply(REPLY_SYNTAX_ERR)
+				return
+			}
+		case "maxage":
+			age, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || age <= 0 {
+				c.AddReplyError("maxage should be greater than 0")
+				return
+			}
+			filter.maxAge = age
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+	targets := sortedClients()
+	if filter.id != 0 {
+		// the client of the ID is the only candidate
+		targets = nil
+		if target := lookupClientByID(filter.id); target != nil {
+			targets = append(targets, target)
+		}
+	}
+	killed := 0
+	for _, target := range targets {
+		if filter.match(target, c, now) {
+			killClient(target, c)
+			killed++
+		}
+	}
+	c.AddReplyInt(killed)
+}
+
+// CLIENT LIST [TYPE type] [ID id [id ...]]
+func clientListCommand(c *GedisClient) {
+	ctype := -1
+	var ids map[uint64]struct{}
+	if len(c.args) > 2 {
+		switch opt := strings.ToLower(c.args[2].StrVal()); {
+		case opt == "type" && len(c.args) == 4:
+			if ctype = getClientTypeByName(c.args[3].StrVal()); ctype == -1 {
+				c.AddReplyErrorf("Unknown client type '%s'", c.args[3].StrVal())
+				return
+			}
+		case opt == "id" && len(c.args) >= 4:
+			ids = make(map[uint64]struct{})
+			for _, arg := range c.args[3:] {
+				id, err := strconv.ParseUint(arg.StrVal(), 10, 64)
+				if err != nil || id == 0 {
+					c.AddReplyError("Invalid client ID")
+					return
+				}
+				ids[id] = struct{}{}
+			}
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+	now := GetTimeMs()
+	var sb strings.Builder
+	for _, target := range sortedClients() {
+		if ctype != -1 && getClientType(target) != ctype {
+			continue
+		}
+		if _, ok := ids[target.id]; ids != nil && !ok {
+			continue
+		}
+		sb.WriteString(catClientInfoString(target, now) + "\n")
+	}
+	c.AddReplyVerbatim(sb.String(), "txt")
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func clientPauseCommand(c *GedisClient) {
+	timeout, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		c.AddReplyError("timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		c.AddReplyError("timeout is negative")
+		return
+	}
+	now := GetTimeMs()
+	if timeout > math.MaxInt64-now {
+		c.AddReplyError("timeout is out of range")
+		return
+	}
+	ptype := CLIENT_PAUSE_ALL
+	if len(c.args) == 4 {
+		switch strings.ToLower(c.args[3].StrVal()) {
+		case "write":
+			ptype = CLIENT_PAUSE_WRITE
+		case "all":
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+	pauseClients(ptype, now+timeout)
+	c.AddReply(REPLY_OK)
+}
+
+// CLIENT REPLY ON|OFF|SKIP
+func clientReplyCommand(c *GedisClient) {
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "on":
+		c.flags &= ^(CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP | CLIENT_REPLY_SKIP_NEXT)
+		c.AddReply(REPLY_OK)
+	case "off":
+		c.flags |= CLIENT_REPLY_OFF
+	case "skip":
+		if c.flags&CLIENT_REPLY_OFF == 0 {
+			c.flags |= CLIENT_REPLY_SKIP_NEXT
+		}
+	default:
+		c.AddReply(REPLY_SYNTAX_ERR)
+	}
+}
+
+var clientHelp = []string{
+	"CACHING (YES|NO)",
+	"    Enable/disable tracking of the keys for next command in OPTIN/OPTOUT modes.",
+	"GETREDIR",
+	"    Return the client ID we are redirecting to when tracking is enabled.",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current client connection.",
+	"KILL <ip:port>",
+	"    Kill connection made from <ip:port>.",
+	"KILL <option> <value> [<option> <value> [...]]",
+	"    Kill connections. Options are:",
+	"    * ADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made from the specified address",
+	"    * LADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made to specified local address",
+	"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+	"      Kill connections by type.",
+	"    * USER <username>",
+	"      Kill connections authenticated by <username>.",
+	"    * SKIPME (YES|NO)",
+	"      Skip killing current connection (default: yes).",
+	"    * ID <client-id>",
+	"      Kill connections by client id.",
+	"    * MAXAGE <maxage>",
+	"      Kill connections older than the specified age.",
+	"LIST [options ...]",
+	"    Return information about client connections. Options:",
+	"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+	"      Return clients of specified type.",
+	"    * ID <client-id> [<client-id> ...]",
+	"      Return clients of specified IDs only.",
+	"PAUSE <timeout> [WRITE|ALL]",
+	"    Suspend all, or just write, clients for <timeout> milliseconds.",
+	"UNPAUSE",
+	"    Stop the current client pause, resuming traffic.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"NO-EVICT (ON|OFF)",
+	"    Protect current client connection from eviction.",
+	"REPLY (ON|OFF|SKIP)",
+	"    Control the replies sent to the current connection.",
+	"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]]",
+	"         [OPTIN] [OPTOUT] [NOLOOP]",
+	"    Control server assisted client side caching.",
+}
+
+// CLIENT subcommand [argument ...]
+var clientCommand CommandProc = func(c *GedisClient) {
+	switch sub := strings.ToLower(c.args[1].StrVal()); {
+	case sub == "help" && len(c.args) == 2:
+		c.AddReplyHelp("client", clientHelp)
+	case sub == "id" && len(c.args) == 2:
+		c.AddReplyLongLong(int64(c.id))
+	case sub == "info" && len(c.args) == 2:
+		c.AddReplyVerbatim(catClientInfoString(c, GetTimeMs())+"\n", "txt")
+	case sub == "list":
+		clientListCommand(c)
+	case sub == "kill" && len(c.args) >= 3:
+		clientKillCommand(c)
+	case sub == "setname" && len(c.args) == 3:
+		name := c.args[2].StrVal()
+		if !validClientName(name) {
+			c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		// the empty name removes the name
+		c.name = name
+		c.AddReply(REPLY_OK)
+	case sub == "getname" && len(c.args) == 2:
+		if c.name == "" {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulkString(c.name)
+		}
+	case sub == "pause" && (len(c.args) == 3 || len(c.args) == 4):
+		clientPauseCommand(c)
+	case sub == "unpause" && len(c.args) == 2:
+		unpauseClients()
+		c.AddReply(REPLY_OK)
+	case sub == "reply" && len(c.args) == 3:
+		clientReplyCommand(c)
+	case sub == "no-evict" && len(c.args) == 3:
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags |= CLIENT_NO_EVICT
+		case "off":
+			c.flags &= ^CLIENT_NO_EVICT
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+		c.AddReply(REPLY_OK)
+	case sub == "tracking" && len(c.args) >= 3:
+		clientTrackingCommand(c)
+	case sub == "caching" && len(c.args) == 3:
+		clientCachingCommand(c)
+	case sub == "getredir" && len(c.args) == 2:
+		clientGetredirCommand(c)
+	default:
+		c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+	}
+}
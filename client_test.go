@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// clientInfoFields parses a line of CLIENT LIST
+func clientInfoFields(t *testing.T, line string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		assert.Len(t, kv, 2)
+		fields[kv[0]] = kv[1]
+	}
+	return fields
+}
+
+// verbatimText returns the text of the verbatim string replied in RESP2
+func verbatimText(reply string) string {
+	return reply[strings.Index(reply, "\r\n")+2 : len(reply)-2]
+}
+
+func TestClientInfo(t *testing.T) {
+	initTestServer(t)
+	sfd, err := TcpServer(6670)
+	assert.Nil(t, err)
+	defer Close(sfd)
+	cfd, err := Dial([4]byte{127, 0, 0, 1}, 6670)
+	assert.Nil(t, err)
+	defer Close(cfd)
+	nfd, err := Accept(sfd)
+	assert.Nil(t, err)
+	c := NewClient(nfd)
+	server.clients[nfd] = c
+
+	ip, port, err := SockName(cfd)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+	runCommand(c, "client", "setname", "conn1")
+	runCommand(c, "ping")
+
+	fields := clientInfoFields(t, verbatimText(runCommand(c, "client", "info")))
+	assert.Equal(t, fmt.Sprint(c.id), fields["id"])
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), fields["addr"])
+	assert.Equal(t, "127.0.0.1:6670", fields["laddr"])
+	assert.Equal(t, "conn1", fields["name"])
+	assert.Equal(t, "0", fields["age"])
+	assert.Equal(t, "N", fields["flags"])
+	assert.Equal(t, "0", fields["db"])
+	assert.Equal(t, "-1", fields["multi"])
+	assert.Equal(t, "client", fields["cmd"])
+	assert.Equal(t, "default", fields["user"])
+
+	runCommand(c, "multi")
+	assert.Equal(t, "x", clientFlagsString(c))
+	runCommand(c, "discard")
+
+	// the old form of KILL closes the client of the address
+	other := NewClient(0)
+	assert.Equal(t, "-ERR No such client\r\n", runCommand(other, "client", "kill", "127.0.0.1:1"))
+	assert.Equal(t, "+OK\r\n", runCommand(other, "client", "kill", fields["addr"]))
+	assert.Nil(t, server.clients[nfd])
+}
+
+func TestClientName(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	assert.Equal(t, "$-1\r\n", runCommand(c, "client", "getname"))
+	assert.Equal(t, "+OK\r\n", runCommand(c, "client", "setname", "worker-1"))
+	assert.Equal(t, "$8\r\nworker-1\r\n", runCommand(c, "client", "getname"))
+	assert.Equal(t, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n",
+		runCommand(c, "client", "setname", "a b"))
+	// the empty name removes the name
+	assert.Equal(t, "+OK\r\n", runCommand(c, "client", "setname", ""))
+	assert.Equal(t, "$-1\r\n", runCommand(c, "client", "getname"))
+}
+
+func TestClientList(t *testing.T) {
+	initTestServer(t)
+	a, _ := newSocketClient(t)
+	b, _ := newSocketClient(t)
+	runCommand(b, "subscribe", "ch")
+
+	lines := strings.Split(strings.TrimSuffix(verbatimText(runCommand(a, "client", "list")), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, fmt.Sprint(a.id), clientInfoFields(t, lines[0])["id"])
+	fields := clientInfoFields(t, lines[1])
+	assert.Equal(t, fmt.Sprint(b.id), fields["id"])
+	assert.Equal(t, "P", fields["flags"])
+	assert.Equal(t, "1", fields["sub"])
+	assert.Equal(t, "subscribe", fields["cmd"])
+
+	reply := verbatimText(runCommand(a, "client", "list", "type", "pubsub"))
+	assert.Equal(t, fmt.Sprint(b.id), clientInfoFields(t, strings.TrimSuffix(reply, "\n"))["id"])
+	reply = verbatimText(runCommand(a, "client", "list", "id", fmt.Sprint(a.id), "12345"))
+	assert.Equal(t, fmt.Sprint(a.id), clientInfoFields(t, strings.TrimSuffix(reply, "\n"))["id"])
+	assert.Equal(t, "-ERR Unknown client type 'foo'\r\n", runCommand(a, "client", "list", "type", "foo"))
+	assert.Equal(t, "-ERR Invalid client ID\r\n", runCommand(a, "client", "list", "id", "x"))
+}
+
+func TestClientKill(t *testing.T) {
+	initTestServer(t)
+	a, _ := newSocketClient(t)
+	b, _ := newSocketClient(t)
+	c, _ := newSocketClient(t)
+	runCommand(c, "subscribe", "ch")
+
+	assert.Equal(t, ":0\r\n", runCommand(a, "client", "kill", "id", "12345"))
+	assert.Equal(t, b, lookupClientByID(b.id))
+	assert.Equal(t, ":1\r\n", runCommand(a, "client", "kill", "id", fmt.Sprint(b.id)))
+	assert.Nil(t, server.clients[b.nfd])
+	assert.Nil(t, lookupClientByID(b.id))
+	assert.Equal(t, ":0\r\n", runCommand(a, "client", "kill", "id", fmt.Sprint(b.id)))
+	assert.Equal(t, ":1\r\n", runCommand(a, "client", "kill", "type", "pubsub"))
+	assert.Nil(t, server.clients[c.nfd])
+	assert.Empty(t, server.pubsubChannels["ch"])
+
+	// the client itself is skipped by default, and closed after the reply otherwise
+	assert.Equal(t, ":0\r\n", runCommand(a, "client", "kill", "type", "normal"))
+	assert.Equal(t, ":1\r\n", runCommand(a, "client", "kill", "type", "normal", "skipme", "no"))
+	assert.NotZero(t, a.flags&CLIENT_CLOSE_AFTER_REPLY)
+
+	d, _ := newSocketClient(t)
+	assert.Equal(t, "-ERR client-id should be greater than 0\r\n", runCommand(d, "client", "kill", "id", "0"))
+	assert.Equal(t, "-ERR Unknown client type 'foo'\r\n", runCommand(d, "client", "kill", "type", "foo"))
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(d, "client", "kill", "id", "1", "type"))
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(d, "client", "kill", "foo", "bar"))
+}
+
+func TestClientReply(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	assert.Equal(t, "", runCommand(c, "client", "reply", "off"))
+	assert.Equal(t, "", runCommand(c, "set", "k", "v"))
+	assert.Equal(t, "", runCommand(c, "get", "k"))
+	assert.Equal(t, "+OK\r\n", runCommand(c, "client", "reply", "on"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+
+	// only the reply of the next command is skipped
+	assert.Equal(t, "", runCommand(c, "client", "reply", "skip"))
+	assert.Equal(t, "", runCommand(c, "get", "k"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+	// ON replies even right after SKIP
+	assert.Equal(t, "", runCommand(c, "client", "reply", "skip"))
+	assert.Equal(t, "+OK\r\n", runCommand(c, "client", "reply", "on"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+
+	// the messages are pushed even if the replies are off
+	runCommand(c, "subscribe", "ch")
+	runCommand(c, "client", "reply", "off")
+	publisher := NewClient(0)
+	runCommand(publisher, "publish", "ch", "hi")
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", drainClientReply(c))
+}
+
+func TestClientPause(t *testing.T) {
+	initTestServer(t)
+	admin, _ := newSocketClient(t)
+	c, _ := newSocketClient(t)
+	runCommand(c, "set", "k", "v")
+
+	assert.Equal(t, "+OK\r\n", runCommand(admin, "client", "pause", "100000", "write"))
+	// the reads go on, the writes wait for the end of the pause
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+	assert.Equal(t, "", runCommand(c, "set", "k", "v2"))
+	assert.NotZero(t, c.flags&CLIENT_BLOCKED)
+	assert.Equal(t, []*GedisClient{c}, server.postponedClients)
+
+	// the transaction is queued, EXEC waits
+	other, _ := newSocketClient(t)
+	runCommand(other, "multi")
+	assert.Equal(t, "+QUEUED\r\n", runCommand(other, "set", "n", "1"))
+	assert.Equal(t, "", runCommand(other, "exec"))
+	assert.Equal(t, []*GedisClient{c, other}, server.postponedClients)
+
+	assert.Equal(t, "+OK\r\n", runCommand(admin, "client", "unpause"))
+	processUnblockedClients()
+	assert.Equal(t, "+OK\r\n", drainClientReply(c))
+	assert.Equal(t, "*1\r\n+OK\r\n", drainClientReply(other))
+	assert.Equal(t, "v2", server.db.data.Get(NewObject(STR, "k")).StrVal())
+	assert.Empty(t, server.postponedClients)
+
+	// ALL pauses the reads too, until the timeout
+	runCommand(admin, "client", "pause", "10", "all")
+	runCommand(admin, "client", "pause", "5", "write")
+	assert.Equal(t, CLIENT_PAUSE_ALL, server.clientPauseType)
+	assert.Equal(t, "", runCommand(c, "get", "k"))
+	checkClientPauseTimeout(server.clientPauseEnd)
+	processUnblockedClients()
+	assert.Equal(t, "$2\r\nv2\r\n", drainClientReply(c))
+	assert.Equal(t, CLIENT_PAUSE_OFF, server.clientPauseType)
+
+	assert.Equal(t, "-ERR timeout is negative\r\n", runCommand(admin, "client", "pause", "-1"))
+	assert.Equal(t, "-ERR timeout is out of range\r\n", runCommand(admin, "client", "pause", "9223372036854775807"))
+	assert.Equal(t, CLIENT_PAUSE_OFF, server.clientPauseType)
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(admin, "client", "pause", "10", "foo"))
+}
+
+func TestClientsCronTimeout(t *testing.T) {
+	initTestServer(t)
+	server.maxIdleTime = 10 * 1000
+	now := GetTimeMs()
+	clients := make([]*GedisClient, 12)
+	for i := range clients {
+		clients[i], _ = newSocketClient(t)
+		clients[i].lastInteraction = now - 20*1000
+	}
+	// the blocked client only times out by its own deadline, the subscriber is never idle
+	blockClient(clients[0], BLOCKED_STREAM, 0)
+	clients[1].flags |= CLIENT_PUBSUB
+	clients[2].lastInteraction = now
+
+	// a part of the clients is checked at a time
+	clientsCron(now)
+	assert.Len(t, server.clientsCronList, 12-CLIENTS_CRON_MIN_ITERATIONS)
+	assert.Greater(t, len(server.clients), 3)
+	clientsCron(now)
+	clientsCron(now)
+	assert.Len(t, server.clients, 3)
+	for _, c := range clients[:3] {
+		assert.Equal(t, c, server.clients[c.nfd])
+	}
+
+	server.maxIdleTime = 0
+	clients[2].lastInteraction = now - 20*1000
+	clientsCron(now)
+	assert.Len(t, server.clients, 3)
+}
+
+func TestClientOutputBufferLimits(t *testing.T) {
+	initTestServer(t)
+	assert.Nil(t, parseClientOutputBufferLimit("pubsub 64kb 32kb 1"))
+	publisher := NewClient(0)
+	hard, _ := newSocketClient(t)
+	runCommand(hard, "subscribe", "big")
+	soft, _ := newSocketClient(t)
+	runCommand(soft, "subscribe", "small")
+
+	// the hard limit closes the client at once, the close is asynchronous
+	runCommand(publisher, "publish", "big", strings.Repeat("x", 70*1024))
+	assert.NotZero(t, hard.flags&CLIENT_CLOSE_ASAP)
+	assert.Equal(t, hard, server.clients[hard.nfd])
+	replyBytes := hard.replyBytes
+	runCommand(publisher, "publish", "big", "more")
+	assert.Equal(t, replyBytes, hard.replyBytes)
+	freeClientsInAsyncFreeQueue()
+	assert.Nil(t, server.clients[hard.nfd])
+	assert.Empty(t, server.pubsubChannels["big"])
+
+	// the soft limit closes the client once it's over the limit for longer than the soft seconds
+	now := GetTimeMs()
+	runCommand(publisher, "publish", "small", strings.Repeat("x", 40*1024))
+	assert.Zero(t, soft.flags&CLIENT_CLOSE_ASAP)
+	assert.NotZero(t, soft.obufSoftLimitReachedTime)
+	assert.False(t, checkClientOutputBufferLimits(soft, now+1000))
+	clientsCron(now + 2000)
+	assert.NotZero(t, soft.flags&CLIENT_CLOSE_ASAP)
+	freeClientsInAsyncFreeQueue()
+	assert.Nil(t, server.clients[soft.nfd])
+
+	// the soft time is reset once the replies are sent
+	c, _ := newSocketClient(t)
+	runCommand(c, "subscribe", "small")
+	runCommand(publisher, "publish", "small", strings.Repeat("x", 40*1024))
+	drainClientReply(c)
+	assert.False(t, checkClientOutputBufferLimits(c, now+2000))
+	assert.Zero(t, c.obufSoftLimitReachedTime)
+
+	// the normal clients have no limits by default
+	normal, _ := newSocketClient(t)
+	runCommand(normal, "set", "k", strings.Repeat("x", 1024*1024))
+	runCommand(normal, "get", "k")
+	assert.Zero(t, normal.flags&CLIENT_CLOSE_ASAP)
+
+	fields := infoFields(t, runCommand(publisher, "info", "stats"))
+	assert.Equal(t, "2", fields["client_output_buffer_limit_disconnections"])
+}
+
+func TestClientOutputBufferLimitConfig(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	assert.Equal(t, "*2\r\n$26\r\nclient-output-buffer-limit\r\n$67\r\nnormal 0 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60\r\n",
+		runCommand(c, "config", "get", "client-output-buffer-limit"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "client-output-buffer-limit", "normal 1mb 512kb 10 replica 0 0 0"))
+	assert.Equal(t, clientBufferLimit{hard: 1024 * 1024, soft: 512 * 1024, softSeconds: 10}, server.clientObufLimits[CLIENT_TYPE_NORMAL])
+	assert.Equal(t, clientBufferLimit{}, server.clientObufLimits[CLIENT_TYPE_SLAVE])
+	assert.Equal(t, "normal 1mb 512kb 10 slave 0 0 0 pubsub 32mb 8mb 60", formatClientOutputBufferLimit(formatMemory))
+
+	// the limits are kept unless all of them are valid
+	for _, val := range []string{"normal 1mb 1mb", "master 0 0 0", "normal 0 0 0 pubsub x 0 0", "pubsub 0 0 -1"} {
+		assert.NotNil(t, parseClientOutputBufferLimit(val), val)
+	}
+	assert.Equal(t, int64(1024*1024), server.clientObufLimits[CLIENT_TYPE_NORMAL].hard)
+}
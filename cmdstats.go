@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Every command counts the calls, the time spent, the calls rejected before the execution,
+ * like the wrong number of arguments, and the calls which replied an error. The latency of the
+ * calls is recorded by a histogram with the buckets like HdrHistogram: the values below
+ * 2*LATENCY_HIST_SUB_BUCKETS have their own bucket, the bigger ones are split into
+ * LATENCY_HIST_SUB_BUCKETS buckets for every power of 2, so the relative error is below 2%. */
+
+const (
+	LATENCY_HIST_SUB_BUCKETS = 64
+	LATENCY_HIST_MAX_SHIFT   = 40 // the histogram records the latency up to 2^46 ns, about 19 hours
+	LATENCY_HIST_BUCKETS     = 2*LATENCY_HIST_SUB_BUCKETS + LATENCY_HIST_MAX_SHIFT*LATENCY_HIST_SUB_BUCKETS
+
+	ERROR_STATS_MAX = 128 // the distinct error codes tracked by INFO errorstats
+)
+
+type commandStats struct {
+	calls         int64
+	duration      int64 // ns
+	rejectedCalls int64 // rejected before the execution
+	failedCalls   int64 // executed, but replied an error
+	latency       *latencyHistogram
+}
+
+type latencyHistogram struct {
+	counts [LATENCY_HIST_BUCKETS]int64
+	total  int64
+	sum    int64 // ns
+}
+
+func latencyBucket(ns int64) int {
+	if ns < 0 {
+		ns = 0
+	}
+	v := uint64(ns)
+	if v < 2*LATENCY_HIST_SUB_BUCKETS {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 7 // the top 7 bits select the sub bucket
+	if shift > LATENCY_HIST_MAX_SHIFT {
+		return LATENCY_HIST_BUCKETS - 1
+	}
+	return 2*LATENCY_HIST_SUB_BUCKETS + (shift-1)*LATENCY_HIST_SUB_BUCKETS + int(v>>shift) - LATENCY_HIST_SUB_BUCKETS
+}
+
+// latencyBucketValue returns the highest value of the bucket
+func latencyBucketValue(idx int) int64 {
+	if idx < 2*LATENCY_HIST_SUB_BUCKETS {
+		return int64(idx)
+	}
+	idx -= 2 * LATENCY_HIST_SUB_BUCKETS
+	shift := idx/LATENCY_HIST_SUB_BUCKETS + 1
+	sub := int64(idx%LATENCY_HIST_SUB_BUCKETS + LATENCY_HIST_SUB_BUCKETS)
+	return (sub+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(ns int64) {
+	h.counts[latencyBucket(ns)]++
+	h.total++
+	h.sum += ns
+}
+
+// countBelow returns the samples of the buckets whose values are at most ns
+func (h *latencyHistogram) countBelow(ns int64) int64 {
+	var n int64
+	for i, c := range h.counts {
+		if latencyBucketValue(i) > ns {
+			break
+		}
+		n += c
+	}
+	return n
+}
+
+// percentile returns the latency in ns which the percent of the samples are at most
+func (h *latencyHistogram) percentile(percent float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(percent / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= target {
+			return latencyBucketValue(i)
+		}
+	}
+	return latencyBucketValue(LATENCY_HIST_BUCKETS - 1)
+}
+
+// initCommandStats creates the stats of every command in the command table
+func initCommandStats() {
+	server.commandStats = make(map[*GedisCommand]*commandStats, len(server.commands))
+	for _, cmd := range server.commands {
+		server.commandStats[cmd] = &commandStats{}
+	}
+	server.errorStats = make(map[string]int64)
+}
+
+// resetCommandStats clears the stats of the commands and of the errors, which is CONFIG RESETSTAT
+func resetCommandStats() {
+	for _, stats := range server.commandStats {
+		*stats = commandStats{}
+	}
+	server.errorStats = make(map[string]int64)
+	server.statTotalErrorReplies = 0
+}
+
+// recordCommandCall records the call of the command which took ns, failed if it replied an error
+func recordCommandCall(cmd *GedisCommand, ns int64, failed bool) {
+	stats := server.commandStats[cmd]
+	if stats == nil {
+		return
+	}
+	stats.calls++
+	stats.duration += ns
+	if failed {
+		stats.failedCalls++
+	}
+	if server.latencyTracking {
+		if stats.latency == nil {
+			stats.latency = &latencyHistogram{}
+		}
+		stats.latency.record(ns)
+	}
+}
+
+// recordCommandRejected counts the command rejected before the execution
+func recordCommandRejected(cmd *GedisCommand) {
+	if stats := server.commandStats[cmd]; stats != nil {
+		stats.rejectedCalls++
+	}
+}
+
+// recordErrorReply counts the error by its code, which is the first word like "ERR" or "WRONGTYPE"
+func recordErrorReply(reply string) {
+	server.statTotalErrorReplies++
+	if server.errorStats == nil {
+		server.errorStats = make(map[string]int64)
+	}
+	code := strings.TrimPrefix(reply, "-")
+	if i := strings.IndexAny(code, " \r\n"); i >= 0 {
+		code = code[:i]
+	}
+	if _, ok := server.errorStats[code]; !ok && len(server.errorStats) >= ERROR_STATS_MAX {
+		return
+	}
+	server.errorStats[code]++
+}
+
+// parseLatencyPercentiles parses the percentiles like "50 99 99.9"
+func parseLatencyPercentiles(s string) ([]float64, error) {
+	var percentiles []float64
+	for _, field := range strings.Fields(s) {
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("the percentiles must be numbers between 0 and 100")
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+func formatLatencyPercentiles(percentiles []float64) string {
+	fields := make([]string, len(percentiles))
+	for i, p := range percentiles {
+		fields[i] = strconv.FormatFloat(p, 'f', -1, 64)
+	}
+	return strings.Join(fields, " ")
+}
+
+// sortedStatsCommands returns the commands with the stats in the order of their names
+func sortedStatsCommands() []*GedisCommand {
+	cmds := make([]*GedisCommand, 0, len(server.commandStats))
+	for cmd := range server.commandStats {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+func genCommandStatsString(sb *strings.Builder) {
+	for _, cmd := range sortedStatsCommands() {
+		stats := server.commandStats[cmd]
+		if stats.calls == 0 && stats.rejectedCalls == 0 && stats.failedCalls == 0 {
+			continue
+		}
+		usec := stats.duration / 1000
+		perCall := 0.0
+		if stats.calls > 0 {
+			perCall = float64(stats.duration) / 1000 / float64(stats.calls)
+		}
+		fmt.Fprintf(sb, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			cmd.name, stats.calls, usec, perCall, stats.rejectedCalls, stats.failedCalls)
+	}
+}
+
+func genLatencyStatsString(sb *strings.Builder) {
+	for _, cmd := range sortedStatsCommands() {
+		stats := server.commandStats[cmd]
+		if stats.latency == nil || stats.latency.total == 0 {
+			continue
+		}
+		fmt.Fprintf(sb, "latency_percentiles_usec_%s:", cmd.name)
+		for i, p := range server.latencyTrackingPercentiles {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(sb, "p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), float64(stats.latency.percentile(p))/1000)
+		}
+		sb.WriteString("\r\n")
+	}
+}
+
+func genErrorStatsString(sb *strings.Builder) {
+	codes := make([]string, 0, len(server.errorStats))
+	for code := range server.errorStats {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(sb, "errorstat_%s:count=%d\r\n", code, server.errorStats[code])
+	}
+}
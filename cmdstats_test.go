@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	// the small values have their own buckets, and every bucket contains its highest value
+	for _, ns := range []int64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, 1 << 40} {
+		idx := latencyBucket(ns)
+		assert.True(t, ns <= latencyBucketValue(idx), ns)
+		if idx > 0 {
+			assert.True(t, ns > latencyBucketValue(idx-1), ns)
+		}
+	}
+	assert.Equal(t, 127, latencyBucket(127))
+	assert.Equal(t, int64(129), latencyBucketValue(latencyBucket(128)))
+	assert.Equal(t, LATENCY_HIST_BUCKETS-1, latencyBucket(1<<62))
+
+	h := &latencyHistogram{}
+	assert.Equal(t, int64(0), h.percentile(50))
+	for i := int64(1); i <= 1000; i++ {
+		h.record(i * 1000)
+	}
+	// the relative error is below 2%
+	for _, c := range []struct {
+		percent float64
+		want    int64
+	}{{50, 500000}, {99, 990000}, {99.9, 999000}, {100, 1000000}} {
+		got := h.percentile(c.percent)
+		assert.True(t, got >= c.want && got < c.want+c.want/50, "%v: %d", c.percent, got)
+	}
+}
+
+func TestLatencyHistogramCountBelow(t *testing.T) {
+	h := &latencyHistogram{}
+	for _, ns := range []int64{5, 100, 1000, 1000000} {
+		h.record(ns)
+	}
+	assert.Equal(t, int64(1001105), h.sum)
+	assert.Equal(t, int64(0), h.countBelow(4))
+	assert.Equal(t, int64(2), h.countBelow(100))
+	assert.Equal(t, int64(3), h.countBelow(2000))
+	assert.Equal(t, int64(4), h.countBelow(1<<40))
+}
+
+func TestCommandStats(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "get", "k")
+	runCommand(c, "GET", "k")
+	runCommand(c, "get")
+	runCommand(c, "lpush", "k", "a")
+	runCommand(c, "pfcount", "k")
+	runCommand(c, "nosuchcommand")
+
+	stats := server.commandStats[lookUpCommand("get")]
+	assert.Equal(t, int64(2), stats.calls)
+	assert.Equal(t, int64(1), stats.rejectedCalls)
+	assert.Equal(t, int64(0), stats.failedCalls)
+	assert.Equal(t, int64(2), stats.latency.total)
+	stats = server.commandStats[lookUpCommand("lpush")]
+	assert.Equal(t, int64(1), stats.calls)
+	assert.Equal(t, int64(1), stats.failedCalls)
+
+	fields := infoFields(t, runCommand(c, "info", "commandstats", "errorstats", "latencystats", "stats"))
+	assert.True(t, strings.HasPrefix(fields["cmdstat_get"], "calls=2,usec="), fields["cmdstat_get"])
+	assert.True(t, strings.HasSuffix(fields["cmdstat_get"], ",rejected_calls=1,failed_calls=0"), fields["cmdstat_get"])
+	assert.True(t, strings.HasSuffix(fields["cmdstat_lpush"], ",rejected_calls=0,failed_calls=1"), fields["cmdstat_lpush"])
+	assert.NotContains(t, fields, "cmdstat_ping")
+	assert.Equal(t, "count=3", fields["errorstat_ERR"])
+	assert.Equal(t, "count=1", fields["errorstat_WRONGTYPE"])
+	assert.Equal(t, "4", fields["total_error_replies"])
+	assert.Regexp(t, `^p50=\d+\.\d{3},p99=\d+\.\d{3},p99\.9=\d+\.\d{3}$`, fields["latency_percentiles_usec_get"])
+	// the running INFO isn't recorded yet
+	assert.NotContains(t, fields, "latency_percentiles_usec_info")
+
+	// the percentiles are configurable, and the latency isn't recorded once the tracking is disabled
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "latency-tracking-info-percentiles", "90 100"))
+	assert.Equal(t, "*2\r\n$33\r\nlatency-tracking-info-percentiles\r\n$6\r\n90 100\r\n",
+		runCommand(c, "config", "get", "latency-tracking-info-percentiles"))
+	fields = infoFields(t, runCommand(c, "info", "latencystats"))
+	assert.Regexp(t, `^p90=\d+\.\d{3},p100=\d+\.\d{3}$`, fields["latency_percentiles_usec_get"])
+	assert.NotNil(t, loadServerConfigFromString("latency-tracking-info-percentiles 50 101"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "latency-tracking", "no"))
+	runCommand(c, "get", "k")
+	assert.Equal(t, int64(3), server.commandStats[lookUpCommand("get")].calls)
+	assert.Equal(t, int64(2), server.commandStats[lookUpCommand("get")].latency.total)
+
+	// the default sections only include the errors
+	reply := runCommand(c, "info")
+	assert.True(t, strings.Contains(reply, "# Errorstats\r\n"), reply)
+	assert.False(t, strings.Contains(reply, "# Commandstats"), reply)
+	reply = runCommand(c, "info", "everything")
+	assert.True(t, strings.Contains(reply, "# Commandstats\r\n"), reply)
+	assert.True(t, strings.Contains(reply, "# Latencystats\r\n"), reply)
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "resetstat"))
+	fields = infoFields(t, runCommand(c, "info", "commandstats", "errorstats", "latencystats"))
+	assert.Equal(t, 1, len(fields))
+	assert.Contains(t, fields, "cmdstat_config")
+	assert.Equal(t, int64(0), server.statTotalErrorReplies)
+}
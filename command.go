@@ -0,0 +1,242 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/* command flags */
+const (
+	CMD_WRITE        = 1 << 0 // "w"
+	CMD_READONLY     = 1 << 1 // "r"
+	CMD_DENYOOM      = 1 << 2 // "m"
+	CMD_ADMIN        = 1 << 3 // "a"
+	CMD_PUBSUB       = 1 << 4 // "p"
+	CMD_NOSCRIPT     = 1 << 5 // "s"
+	CMD_LOADING      = 1 << 6 // "l"
+	CMD_STALE        = 1 << 7 // "t"
+	CMD_FAST         = 1 << 8 // "F"
+	CMD_MOVABLE_KEYS = 1 << 9 // computed, the keys are found by getKeys
+)
+
+var commandFlagNames = []struct {
+	flag int
+	name string
+}{
+	{CMD_WRITE, "write"},
+	{CMD_READONLY, "readonly"},
+	{CMD_DENYOOM, "denyoom"},
+	{CMD_ADMIN, "admin"},
+	{CMD_PUBSUB, "pubsub"},
+	{CMD_NOSCRIPT, "noscript"},
+	{CMD_LOADING, "loading"},
+	{CMD_STALE, "stale"},
+	{CMD_FAST, "fast"},
+	{CMD_MOVABLE_KEYS, "movablekeys"},
+}
+
+// populateCommandTable indexes the commands of cmdTable by name and turns their string flags
+// into the bit flags, the commands not implemented yet are left out
+func populateCommandTable() {
+	server.commands = make(map[string]*GedisCommand, len(cmdTable))
+	for i := range cmdTable {
+		cmd := &cmdTable[i]
+		if cmd.proc == nil {
+			continue
+		}
+		cmd.flags = 0
+		for _, f := range cmd.sflags {
+			switch f {
+			case 'w':
+				cmd.flags |= CMD_WRITE
+			case 'r':
+				cmd.flags |= CMD_READONLY
+			case 'm':
+				cmd.flags |= CMD_DENYOOM
+			case 'a':
+				cmd.flags |= CMD_ADMIN
+			case 'p':
+				cmd.flags |= CMD_PUBSUB
+			case 's':
+				cmd.flags |= CMD_NOSCRIPT
+			case 'l':
+				cmd.flags |= CMD_LOADING
+			case 't':
+				cmd.flags |= CMD_STALE
+			case 'F':
+				cmd.flags |= CMD_FAST
+			default:
+				panic("unsupported command flag " + string(f) + " of " + cmd.name)
+			}
+		}
+		if cmd.getKeys != nil {
+			cmd.flags |= CMD_MOVABLE_KEYS
+		}
+		server.commands[cmd.name] = cmd
+	}
+}
+
+// arityOk reports whether the number of the arguments matches the arity of the command
+func (cmd *GedisCommand) arityOk(argc int) bool {
+	if cmd.arity > 0 {
+		return argc == cmd.arity
+	}
+	return argc >= -cmd.arity
+}
+
+// getKeysFromCommand returns the positions of the keys in the arguments of the command
+func getKeysFromCommand(cmd *GedisCommand, args []*GObj) []int {
+	if cmd.getKeys != nil {
+		return cmd.getKeys(args)
+	}
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []int
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.keyStep {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// evalGetKeys finds the keys of EVAL and EVALSHA, which are the numkeys arguments after numkeys
+func evalGetKeys(args []*GObj) []int {
+	if len(args) < 3 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[2].StrVal())
+	if err != nil || numKeys <= 0 || numKeys > len(args)-3 {
+		return nil
+	}
+	keys := make([]int, numKeys)
+	for i := range keys {
+		keys[i] = 3 + i
+	}
+	return keys
+}
+
+// xreadGetKeys finds the keys of XREAD and XREADGROUP, which are the first half of the arguments
+// after STREAMS, the values of the options are skipped in case one of them is "streams"
+func xreadGetKeys(args []*GObj) []int {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i].StrVal()) {
+		case "count", "block":
+			i++
+		case "group":
+			i += 2
+		case "streams":
+			num := (len(args) - i - 1) / 2
+			keys := make([]int, num)
+			for j := range keys {
+				keys[j] = i + 1 + j
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// addReplyCommandInfo replies the name, arity, flags and the key positions of the command
+func addReplyCommandInfo(c *GedisClient, cmd *GedisCommand) {
+	c.AddReplyArrayLen(6)
+	c.AddReplyBulkString(cmd.name)
+	c.AddReplyInt(cmd.arity)
+	var flags []string
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	c.AddReplySetLen(len(flags))
+	for _, name := range flags {
+		c.AddReplyStatus(name)
+	}
+	c.AddReplyInt(cmd.firstKey)
+	c.AddReplyInt(cmd.lastKey)
+	c.AddReplyInt(cmd.keyStep)
+}
+
+// COMMAND [COUNT | INFO [command ...] | DOCS [command ...] | GETKEYS command [arg ...]]
+var commandCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) == 1 {
+		c.AddReplyArrayLen(len(server.commands))
+		for _, cmd := range server.commands {
+			addReplyCommandInfo(c, cmd)
+		}
+		return
+	}
+	switch strings.ToLower(c.args[1].StrVal()) {
+	case "count":
+		if len(c.args) != 2 {
+			break
+		}
+		c.AddReplyInt(len(server.commands))
+		return
+	case "info":
+		if len(c.args) == 2 {
+			c.AddReplyArrayLen(len(server.commands))
+			for _, cmd := range server.commands {
+				addReplyCommandInfo(c, cmd)
+			}
+			return
+		}
+		c.AddReplyArrayLen(len(c.args) - 2)
+		for _, name := range c.args[2:] {
+			if cmd := lookUpCommand(name.StrVal()); cmd != nil {
+				addReplyCommandInfo(c, cmd)
+			} else {
+				c.AddReplyNullArray()
+			}
+		}
+		return
+	case "docs":
+		// there is no documentation of the commands, so only the names are replied
+		var cmds []*GedisCommand
+		if len(c.args) == 2 {
+			for _, cmd := range server.commands {
+				cmds = append(cmds, cmd)
+			}
+		} else {
+			for _, name := range c.args[2:] {
+				if cmd := lookUpCommand(name.StrVal()); cmd != nil {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+		c.AddReplyMapLen(len(cmds))
+		for _, cmd := range cmds {
+			c.AddReplyBulkString(cmd.name)
+			c.AddReplyMapLen(0)
+		}
+		return
+	case "getkeys":
+		if len(c.args) < 3 {
+			break
+		}
+		cmd := lookUpCommand(c.args[2].StrVal())
+		if cmd == nil {
+			c.AddReplyError("Invalid command specified")
+			return
+		}
+		args := c.args[2:]
+		if !cmd.arityOk(len(args)) {
+			c.AddReplyError("Invalid number of arguments specified for command")
+			return
+		}
+		keys := getKeysFromCommand(cmd, args)
+		if len(keys) == 0 {
+			c.AddReplyError("The command has no key arguments")
+			return
+		}
+		c.AddReplyArrayLen(len(keys))
+		for _, i := range keys {
+			c.AddReplyBulk(args[i])
+		}
+		return
+	}
+	c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLookUpCommand(t *testing.T) {
+	initTestServer(t)
+
+	cmd := lookUpCommand("SET")
+	assert.NotNil(t, cmd)
+	assert.Equal(t, "set", cmd.name)
+	assert.True(t, cmd == lookUpCommand("set"), "the lookup returns the entry of the table")
+	assert.Equal(t, CMD_WRITE|CMD_DENYOOM, cmd.flags)
+	assert.Equal(t, CMD_NOSCRIPT|CMD_MOVABLE_KEYS, lookUpCommand("eval").flags)
+	// the commands not implemented yet are unknown
+	assert.Nil(t, lookUpCommand("hget"))
+	assert.Nil(t, lookUpCommand("nosuchcommand"))
+
+	c := NewClient(0)
+	assert.Equal(t, REPLY_UNKNOWN_CMD, runCommand(c, "hget", "h", "f"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "SET", "k", "v"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "Get", "k"))
+	// the negative arity is the minimum number of arguments
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "bitop", "and", "dest"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "bitop", "and", "dest", "nokey"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "get", "k", "k"))
+}
+
+func TestGetKeysFromCommand(t *testing.T) {
+	initTestServer(t)
+	getKeys := func(args ...string) []int {
+		objs := make([]*GObj, len(args))
+		for i, a := range args {
+			objs[i] = NewObject(STR, a)
+		}
+		return getKeysFromCommand(lookUpCommand(args[0]), objs)
+	}
+
+	assert.Equal(t, []int{1}, getKeys("get", "k"))
+	assert.Equal(t, []int{1, 2, 3}, getKeys("pfcount", "a", "b", "c"))
+	assert.Equal(t, []int{2, 3, 4}, getKeys("bitop", "or", "dest", "a", "b"))
+	assert.Equal(t, []int{1, 2}, getKeys("geosearchstore", "dst", "src", "frommember", "m", "byradius", "1", "km"))
+	assert.Equal(t, []int{3, 4}, getKeys("eval", "return 1", "2", "a", "b", "arg"))
+	assert.Nil(t, getKeys("eval", "return 1", "0"))
+	assert.Nil(t, getKeys("eval", "return 1", "3", "a"))
+	assert.Equal(t, []int{4, 5}, getKeys("xread", "count", "1", "streams", "s1", "s2", "0", "0"))
+	assert.Equal(t, []int{7}, getKeys("xreadgroup", "group", "g", "c", "count", "1", "streams", "s", ">"))
+	assert.Equal(t, []int{5}, getKeys("xreadgroup", "group", "streams", "c", "streams", "s", ">"))
+	assert.Nil(t, getKeys("ping"))
+}
+
+func TestCommandCommand(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", len(server.commands)), runCommand(c, "command", "count"))
+	assert.True(t, strings.HasPrefix(runCommand(c, "command"), fmt.Sprintf("*%d\r\n*6\r\n", len(server.commands))))
+
+	assert.Equal(t, "*1\r\n*6\r\n$5\r\nbitop\r\n:-4\r\n*2\r\n+write\r\n+denyoom\r\n:2\r\n:-1\r\n:1\r\n",
+		runCommand(c, "command", "info", "BITOP"))
+	assert.Equal(t, "*1\r\n*6\r\n$5\r\nxread\r\n:-4\r\n*2\r\n+readonly\r\n+movablekeys\r\n:0\r\n:0\r\n:0\r\n",
+		runCommand(c, "command", "info", "xread"))
+	assert.Equal(t, "*1\r\n*-1\r\n", runCommand(c, "command", "info", "nosuchcommand"))
+	assert.Equal(t, "*2\r\n$3\r\nget\r\n*0\r\n", runCommand(c, "command", "docs", "get", "nosuchcommand"))
+
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", runCommand(c, "command", "getkeys", "eval", "return 1", "2", "a", "b"))
+	assert.Equal(t, "-ERR Invalid command specified\r\n", runCommand(c, "command", "getkeys", "nosuchcommand"))
+	assert.Equal(t, "-ERR Invalid number of arguments specified for command\r\n", runCommand(c, "command", "getkeys", "get"))
+	assert.Equal(t, "-ERR The command has no key arguments\r\n", runCommand(c, "command", "getkeys", "ping"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'nope'\r\n", runCommand(c, "command", "nope"))
+
+	// RESP3 replies the flags as a set and the docs as a map
+	c.resp = 3
+	assert.Equal(t, "*1\r\n*6\r\n$3\r\nttl\r\n:2\r\n~2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n",
+		runCommand(c, "command", "info", "ttl"))
+	assert.Equal(t, "%1\r\n$3\r\nttl\r\n%0\r\n", runCommand(c, "command", "docs", "ttl"))
+}
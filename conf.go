@@ -1,36 +1,700 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
 const (
 	PORT        int = 8888
 	MAX_CLIENTS int = 10000
 
+	CLIENT_TIMEOUT = 0   // seconds, the idle client is closed once idle longer, 0 disables it
+	TCP_KEEPALIVE  = 300 // seconds, the idle time before the keepalive probes of the clients, 0 disables them
+
 	AOF_AUTOSYNC_BYTES   int = 1024 * 1024 * 10
 	DEFULT_AOF_FILENAME      = "appendOnly.aof"
 	AOF_REWRITE_MIN_SIZE     = 1024 * 1024 * 32
 	AOF_REWRITE_PERC         = 80
+	AOF_FSYNC                = AOF_FSYNC_EVERYSEC
+
+	HLL_SPARSE_MAX_BYTES = 3000 // promote the sparse HLL to dense once it's bigger than it
+
+	SCRIPT_TIME_LIMIT = 5000 // ms, the server processes the events once a script runs longer
+
+	NOTIFY_KEYSPACE_EVENTS = "" // the classes of keyspace events, see notify.go
+
+	REPL_BACKLOG_SIZE     = 1024 * 1024 // the bytes of the replication stream kept for the partial resync
+	REPL_BACKLOG_MIN_SIZE = 1024 * 16
+	REPL_PING_PERIOD      = 10 * 1000 // ms, the master pings the replicas so they can detect the timeout
+	REPL_TIMEOUT          = 60 * 1000 // ms, the link with the master or a replica is closed once idle longer
+	REPL_CRON_PERIOD      = 1000      // ms, the period of replicationCron
+	REPLICA_READ_ONLY     = true
+
+	PROTO_MAX_BULK_LEN        = 512 * 1024 * 1024  // the max length of a bulk string in the query
+	CLIENT_QUERY_BUFFER_LIMIT = 1024 * 1024 * 1024 // the client is closed once its query buffer is larger
+
+	// the hard limit, the soft limit and the soft seconds of the output buffer of every type of the clients
+	CLIENT_OUTPUT_BUFFER_LIMIT = "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60"
+
+	LATENCY_TRACKING             = true
+	LATENCY_TRACKING_PERCENTILES = "50 99 99.9" // the percentiles of INFO latencystats
 )
 
 // global variable
 var server GedisServer
 
-func InitServer() error {
+// initServerConfig resets the global server with the default configuration
+func initServerConfig() {
 	server = GedisServer{
-		port: PORT,
+		port:       PORT,
+		maxClients: MAX_CLIENTS,
 		db: &GedisDB{
 			data:   NewDict(DictType{HashFunc: HashStr, EqualFunc: EqualStr}),
 			expire: NewDict(DictType{HashFunc: HashStr, EqualFunc: EqualStr}),
 		},
-		clients:           make(map[int]*GedisClient),
-		aofFileName:       DEFULT_AOF_FILENAME,
-		aofRewriteMinSize: AOF_REWRITE_MIN_SIZE,
-		aofRewritePerc:    AOF_REWRITE_PERC,
-		aofRewriteBuf:     make([]byte, 0),
+		clients:             make(map[int]*GedisClient),
+		clientsIndex:        make(map[uint64]*GedisClient),
+		aofFileName:         DEFULT_AOF_FILENAME,
+		aofRewriteMinSize:   AOF_REWRITE_MIN_SIZE,
+		aofRewritePerc:      AOF_REWRITE_PERC,
+		aofRewriteBuf:       make([]byte, 0),
+		blockingKeys:        make(map[string][]*GedisClient),
+		readyKeys:           make(map[string]struct{}),
+		blockedClients:      make(map[*GedisClient]struct{}),
+		pubsubChannels:      make(map[string][]*GedisClient),
+		pubsubPatterns:      make(map[string][]*GedisClient),
+		pubsubShardChannels: make(map[string][]*GedisClient),
+		watchedKeys:         make(map[string][]*GedisClient),
+		trackingTable:       make(map[string]map[uint64]struct{}),
+		trackingPrefixes:    make(map[string]*bcastState),
+	}
+	server.hllSparseMaxBytes = HLL_SPARSE_MAX_BYTES
+	server.script.timeLimit = SCRIPT_TIME_LIMIT
+	server.notifyKeyspaceEvents = keyspaceEventsStringToFlags(NOTIFY_KEYSPACE_EVENTS)
+	server.runID = genReplicationID()
+	server.startTime = GetTimeMs()
+	server.statOpsLastTime = server.startTime
+	server.replid = genReplicationID()
+	clearReplicationID2()
+	server.replTransferFd = -1
+	server.replicaReadOnly = REPLICA_READ_ONLY
+	server.replBacklogSize = REPL_BACKLOG_SIZE
+	server.replPingPeriod = REPL_PING_PERIOD
+	server.replTimeout = REPL_TIMEOUT
+	server.maxIdleTime = CLIENT_TIMEOUT * 1000
+	server.tcpKeepalive = TCP_KEEPALIVE
+	server.protoMaxBulkLen = PROTO_MAX_BULK_LEN
+	server.clientMaxQueryBufLen = CLIENT_QUERY_BUFFER_LIMIT
+	_ = parseClientOutputBufferLimit(CLIENT_OUTPUT_BUFFER_LIMIT)
+	server.latencyTracking = LATENCY_TRACKING
+	server.latencyTrackingPercentiles, _ = parseLatencyPercentiles(LATENCY_TRACKING_PERCENTILES)
+	server.aofFsync = AOF_FSYNC
+	server.metricsPort = METRICS_PORT
+	server.latencyMonitorThreshold = LATENCY_MONITOR_THRESHOLD
+	server.slowlogLogSlowerThan = SLOWLOG_LOG_SLOWER_THAN
+	server.slowlogMaxLen = SLOWLOG_MAX_LEN
+	populateCommandTable()
+	initCommandStats()
+	initConfigDefaults()
+	scriptingInit()
+}
+
+// loadServerArgs loads the config file if the first argument isn't an option, the options like
+// --port 6380 are turned into the directives which override the ones of the file
+func loadServerArgs(args []string) error {
+	var config strings.Builder
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if server.configFile, err = filepath.Abs(args[0]); err != nil {
+			return err
+		}
+		config.Write(data)
+		config.WriteByte('\n')
+		args = args[1:]
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			if i > 0 {
+				config.WriteByte('\n')
+			}
+			config.WriteString(arg[2:])
+		} else if i == 0 {
+			return fmt.Errorf("invalid option %s", arg)
+		} else {
+			config.WriteByte(' ')
+			config.WriteString(reprString(arg))
+		}
+	}
+	return loadServerConfigFromString(config.String())
+}
+
+// loadServerConfigFromString applies the directives of the config, one per line
+func loadServerConfigFromString(config string) error {
+	for i, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return fmt.Errorf("line %d '%s': unbalanced quotes in configuration line", i+1, line)
+		}
+		entry := lookupConfig(args[0])
+		if entry == nil || (entry.flags&CONFIG_MULTI_ARG == 0 && len(args) != 2) {
+			return fmt.Errorf("line %d '%s': bad directive or wrong number of arguments", i+1, line)
+		}
+		if err = entry.set(strings.Join(args[1:], " ")); err != nil {
+			return fmt.Errorf("line %d '%s': %v", i+1, line, err)
+		}
 	}
+	return nil
+}
+
+func InitServer() error {
+	initServerConfig()
+	return initServer()
+}
+
+// initServer creates the event loop and listens the port of the configuration, and the port of
+// the metrics if it's enabled
+func initServer() error {
 	var err error
 	server.aeloop, err = NewAeEventLoop()
 	if err != nil {
 		return err
 	}
 	server.sfd, err = TcpServer(server.port)
+	if err != nil {
+		return err
+	}
+	if server.metricsPort > 0 {
+		_, err = startMetricsServer(server.metricsPort)
+	}
 	return err
 }
+
+/* The parameters of the configuration are described by configTable, which is shared by the
+ * config file, the command line options and CONFIG GET/SET/REWRITE. CONFIG GET replies the
+ * values in the same format as the config file, the memory in bytes and the time in the unit
+ * of the parameter. */
+
+/* config flags */
+const (
+	CONFIG_IMMUTABLE = 1 << 0 // can't be changed by CONFIG SET
+	CONFIG_MEMORY    = 1 << 1 // the value is a size like 32mb, CONFIG GET replies the bytes
+	CONFIG_MULTI_ARG = 1 << 2 // the directive takes several arguments in the config file
+
+	CONFIG_REWRITE_SIGNATURE = "# Generated by CONFIG REWRITE"
+)
+
+type configEntry struct {
+	name    string
+	alias   string
+	flags   int
+	get     func() string
+	set     func(val string) error // validates and applies the value
+	rewrite func() string          // the value written by CONFIG REWRITE, empty to leave it out
+}
+
+// the values of the parameters before the config file and the options are loaded
+var configDefaults map[string]string
+
+var configTable = []*configEntry{
+	numericConfig("port", "", CONFIG_IMMUTABLE, &server.port, 1, 65535, 1),
+	numericConfig("maxclients", "", 0, &server.maxClients, 1, math.MaxInt32, 1),
+	numericConfig("timeout", "", 0, &server.maxIdleTime, 0, math.MaxInt32, 1000),
+	numericConfig("tcp-keepalive", "", 0, &server.tcpKeepalive, 0, math.MaxInt32, 1),
+	numericConfig("metrics-port", "", CONFIG_IMMUTABLE, &server.metricsPort, 0, 65535, 1),
+	stringConfig("appendfilename", "", CONFIG_IMMUTABLE, &server.aofFileName, validateFileName),
+	numericConfig("auto-aof-rewrite-percentage", "", 0, &server.aofRewritePerc, 0, math.MaxInt32, 1),
+	numericConfig("auto-aof-rewrite-min-size", "", CONFIG_MEMORY, &server.aofRewriteMinSize, 0, math.MaxInt64, 1),
+	{
+		name: "appendfsync",
+		get: func() string {
+			return aofFsyncNames[server.aofFsync]
+		},
+		set: func(val string) error {
+			for policy, name := range aofFsyncNames {
+				if strings.EqualFold(name, val) {
+					server.aofFsync = policy
+					return nil
+				}
+			}
+			return fmt.Errorf("argument must be one of the following: always, everysec, no")
+		},
+	},
+	numericConfig("hll-sparse-max-bytes", "", CONFIG_MEMORY, &server.hllSparseMaxBytes, 0, math.MaxInt64, 1),
+	numericConfig("lua-time-limit", "busy-reply-threshold", 0, &server.script.timeLimit, 0, math.MaxInt64, 1),
+	{
+		name: "notify-keyspace-events",
+		get: func() string {
+			return keyspaceEventsFlagsToString(server.notifyKeyspaceEvents)
+		},
+		set: func(val string) error {
+			flags := keyspaceEventsStringToFlags(val)
+			if flags == -1 {
+				return fmt.Errorf("invalid event class character, use 'Ag$lshzxeKEtmdn'")
+			}
+			server.notifyKeyspaceEvents = flags
+			return nil
+		},
+		rewrite: func() string {
+			return configQuote(keyspaceEventsFlagsToString(server.notifyKeyspaceEvents))
+		},
+	},
+	{
+		name:  "repl-backlog-size",
+		flags: CONFIG_MEMORY,
+		get: func() string {
+			return strconv.FormatInt(server.replBacklogSize, 10)
+		},
+		set: func(val string) error {
+			size, err := parseConfigNumber(val, CONFIG_MEMORY, REPL_BACKLOG_MIN_SIZE, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			// the backlog is created again, so the history is lost like a restart
+			if server.replBacklog != nil && size != server.replBacklogSize {
+				server.replBacklog = newReplBacklog(int(size))
+			}
+			server.replBacklogSize = size
+			return nil
+		},
+		rewrite: func() string {
+			return formatMemory(server.replBacklogSize)
+		},
+	},
+	numericConfig("repl-ping-replica-period", "repl-ping-slave-period", 0, &server.replPingPeriod, 1, math.MaxInt32, 1000),
+	numericConfig("repl-timeout", "", 0, &server.replTimeout, 1, math.MaxInt32, 1000),
+	boolConfig("replica-read-only", "slave-read-only", 0, &server.replicaReadOnly),
+	numericConfig("proto-max-bulk-len", "", CONFIG_MEMORY, &server.protoMaxBulkLen, 1024*1024, math.MaxInt64, 1),
+	numericConfig("client-query-buffer-limit", "", CONFIG_MEMORY, &server.clientMaxQueryBufLen, 1024*1024, math.MaxInt64, 1),
+	{
+		name:  "client-output-buffer-limit",
+		flags: CONFIG_MULTI_ARG,
+		get: func() string {
+			return formatClientOutputBufferLimit(func(n int64) string { return strconv.FormatInt(n, 10) })
+		},
+		set: parseClientOutputBufferLimit,
+		rewrite: func() string {
+			return formatClientOutputBufferLimit(formatMemory)
+		},
+	},
+	numericConfig("latency-monitor-threshold", "", 0, &server.latencyMonitorThreshold, 0, math.MaxInt64, 1),
+	numericConfig("slowlog-log-slower-than", "", 0, &server.slowlogLogSlowerThan, -1, math.MaxInt64, 1),
+	numericConfig("slowlog-max-len", "", 0, &server.slowlogMaxLen, 0, math.MaxInt32, 1),
+	boolConfig("latency-tracking", "", 0, &server.latencyTracking),
+	{
+		name:  "latency-tracking-info-percentiles",
+		flags: CONFIG_MULTI_ARG,
+		get: func() string {
+			return formatLatencyPercentiles(server.latencyTrackingPercentiles)
+		},
+		set: func(val string) error {
+			percentiles, err := parseLatencyPercentiles(val)
+			if err != nil {
+				return err
+			}
+			server.latencyTrackingPercentiles = percentiles
+			return nil
+		},
+		rewrite: func() string {
+			if len(server.latencyTrackingPercentiles) == 0 {
+				return configQuote("")
+			}
+			return formatLatencyPercentiles(server.latencyTrackingPercentiles)
+		},
+	},
+	{
+		// the replication is changed by REPLICAOF at runtime
+		name:  "replicaof",
+		alias: "slaveof",
+		flags: CONFIG_IMMUTABLE | CONFIG_MULTI_ARG,
+		get: func() string {
+			if server.masterHost == "" {
+				return ""
+			}
+			return fmt.Sprintf("%s %d", server.masterHost, server.masterPort)
+		},
+		set: func(val string) error {
+			fields := strings.Fields(val)
+			if len(fields) != 2 {
+				return fmt.Errorf("replicaof requires the host and the port")
+			}
+			if strings.EqualFold(fields[0], "no") && strings.EqualFold(fields[1], "one") {
+				server.masterHost, server.masterPort = "", 0
+				server.replState = REPL_STATE_NONE
+				return nil
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("invalid master port %s", fields[1])
+			}
+			server.masterHost, server.masterPort = fields[0], port
+			server.replState = REPL_STATE_CONNECT
+			return nil
+		},
+	},
+}
+
+// lookupConfig finds the parameter by the case insensitive name or alias
+func lookupConfig(name string) *configEntry {
+	for _, entry := range configTable {
+		if strings.EqualFold(entry.name, name) || (entry.alias != "" && strings.EqualFold(entry.alias, name)) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// initConfigDefaults remembers the default values, CONFIG REWRITE leaves out the parameters
+// which are still the default and aren't in the config file
+func initConfigDefaults() {
+	configDefaults = make(map[string]string, len(configTable))
+	for _, entry := range configTable {
+		configDefaults[entry.name] = entry.get()
+	}
+}
+
+// rewriteValue returns the value written to the config file, empty if the directive is left out
+func (entry *configEntry) rewriteValue() string {
+	if entry.rewrite != nil {
+		return entry.rewrite()
+	}
+	return entry.get()
+}
+
+func boolConfig(name, alias string, flags int, val *bool) *configEntry {
+	return &configEntry{
+		name:  name,
+		alias: alias,
+		flags: flags,
+		get: func() string {
+			if *val {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(s string) error {
+			switch strings.ToLower(s) {
+			case "yes":
+				*val = true
+			case "no":
+				*val = false
+			default:
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+// numericConfig describes the parameter stored as unit times the value, like the seconds of
+// the config stored in ms
+func numericConfig[T int | int64](name, alias string, flags int, val *T, min, max, unit int64) *configEntry {
+	entry := &configEntry{
+		name:  name,
+		alias: alias,
+		flags: flags,
+		get: func() string {
+			return strconv.FormatInt(int64(*val)/unit, 10)
+		},
+		set: func(s string) error {
+			n, err := parseConfigNumber(s, flags, min, max)
+			if err != nil {
+				return err
+			}
+			*val = T(n * unit)
+			return nil
+		},
+	}
+	if flags&CONFIG_MEMORY != 0 {
+		entry.rewrite = func() string {
+			return formatMemory(int64(*val))
+		}
+	}
+	return entry
+}
+
+func parseConfigNumber(s string, flags int, min, max int64) (int64, error) {
+	var n int64
+	var err error
+	if flags&CONFIG_MEMORY != 0 {
+		if n, err = memtoll(s); err != nil {
+			return 0, fmt.Errorf("argument must be a memory value")
+		}
+	} else if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+		return 0, fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+	}
+	return n, nil
+}
+
+func stringConfig(name, alias string, flags int, val *string, validate func(string) error) *configEntry {
+	return &configEntry{
+		name:  name,
+		alias: alias,
+		flags: flags,
+		get: func() string {
+			return *val
+		},
+		set: func(s string) error {
+			if validate != nil {
+				if err := validate(s); err != nil {
+					return err
+				}
+			}
+			*val = s
+			return nil
+		},
+		rewrite: func() string {
+			return configQuote(*val)
+		},
+	}
+}
+
+func validateFileName(name string) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("the file name can't be empty or contain a path")
+	}
+	return nil
+}
+
+// configQuote quotes the argument for the config file if it's empty or has the characters
+// splitArgs treats specially
+func configQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"'\\") {
+		return reprString(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return reprString(s)
+		}
+	}
+	return s
+}
+
+// rewriteConfig writes the current configuration to the config file. The lines of the
+// parameters are updated in place and the comments are kept, the parameters not in the file
+// yet are appended unless they are still the default.
+func rewriteConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	// the lines of every parameter in the old file
+	positions := make(map[*configEntry][]int)
+	hasSignature := false
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == CONFIG_REWRITE_SIGNATURE {
+			hasSignature = true
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil || len(args) == 0 {
+			continue
+		}
+		if entry := lookupConfig(args[0]); entry != nil {
+			positions[entry] = append(positions[entry], i)
+		}
+	}
+
+	removed := make(map[int]bool)
+	var appended []string
+	for _, entry := range configTable {
+		value := entry.rewriteValue()
+		line := entry.name + " " + value
+		pos := positions[entry]
+		if len(pos) == 0 {
+			if value != "" && entry.get() != configDefaults[entry.name] {
+				appended = append(appended, line)
+			}
+			continue
+		}
+		if value == "" {
+			removed[pos[0]] = true
+		} else {
+			lines[pos[0]] = line
+		}
+		for _, i := range pos[1:] {
+			removed[i] = true
+		}
+	}
+
+	var buf strings.Builder
+	for i, line := range lines {
+		if !removed[i] {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if len(appended) > 0 {
+		if !hasSignature {
+			buf.WriteString(CONFIG_REWRITE_SIGNATURE + "\n")
+		}
+		for _, line := range appended {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	// write a temp file and rename it, so the config file is never half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-config-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(buf.String()); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		_ = os.Chmod(tmp.Name(), fi.Mode())
+	} else {
+		_ = os.Chmod(tmp.Name(), 0644)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resetServerStats resets the stats of the server, which is CONFIG RESETSTAT
+func resetServerStats() {
+	server.statNumCommands = 0
+	server.statNumConnections = 0
+	server.statRejectedConn = 0
+	server.statObufLimitConn = 0
+	server.statExpiredKeys = 0
+	server.statKeyspaceHits = 0
+	server.statKeyspaceMisses = 0
+	server.statPeakMemory = 0
+	server.statOpsSamples = [STATS_METRIC_SAMPLES]int64{}
+	server.statOpsIdx = 0
+	server.statOpsLastTime = GetTimeMs()
+	server.statOpsLastCount = 0
+	resetCommandStats()
+}
+
+// CONFIG GET pattern [pattern ...] | SET parameter value [parameter value ...] | REWRITE | RESETSTAT
+var configCommand CommandProc = func(c *GedisClient) {
+	switch strings.ToLower(c.args[1].StrVal()) {
+	case "get":
+		if len(c.args) < 3 {
+			break
+		}
+		configGetCommand(c)
+		return
+	case "set":
+		if len(c.args) < 4 || len(c.args)%2 != 0 {
+			break
+		}
+		configSetCommand(c)
+		return
+	case "rewrite":
+		if len(c.args) != 2 {
+			break
+		}
+		if server.configFile == "" {
+			c.AddReplyError("The server is running without a config file")
+			return
+		}
+		if err := rewriteConfig(server.configFile); err != nil {
+			log.Printf("CONFIG REWRITE failed: %v \n", err)
+			c.AddReplyErrorf("Rewriting config file: %v", err)
+			return
+		}
+		log.Printf("CONFIG REWRITE executed with success. \n")
+		c.AddReply(REPLY_OK)
+		return
+	case "resetstat":
+		if len(c.args) != 2 {
+			break
+		}
+		resetServerStats()
+		c.AddReply(REPLY_OK)
+		return
+	}
+	c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+}
+
+// configGetCommand replies the name and the value of the parameters matching any of the
+// patterns, the alias is replied if it's matched instead of the name
+func configGetCommand(c *GedisClient) {
+	var reply []string
+	for _, entry := range configTable {
+		for _, pattern := range c.args[2:] {
+			p := pattern.StrVal()
+			if stringMatch(p, entry.name, true) {
+				reply = append(reply, entry.name, entry.get())
+				break
+			}
+			if entry.alias != "" && stringMatch(p, entry.alias, true) {
+				reply = append(reply, entry.alias, entry.get())
+				break
+			}
+		}
+	}
+	c.AddReplyMapLen(len(reply) / 2)
+	for _, s := range reply {
+		c.AddReplyBulkString(s)
+	}
+}
+
+// configSetCommand sets all the parameters or none of them, the applied ones are restored
+// once any of the values is invalid
+func configSetCommand(c *GedisClient) {
+	var entries []*configEntry
+	for i := 2; i < len(c.args); i += 2 {
+		name := c.args[i].StrVal()
+		entry := lookupConfig(name)
+		if entry == nil {
+			c.AddReplyErrorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+			return
+		}
+		if entry.flags&CONFIG_IMMUTABLE != 0 {
+			c.AddReplyErrorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+			return
+		}
+		for _, e := range entries {
+			if e == entry {
+				c.AddReplyErrorf("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)
+				return
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	olds := make([]string, len(entries))
+	for i, entry := range entries {
+		olds[i] = entry.get()
+		if err := entry.set(c.args[3+i*2].StrVal()); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				_ = entries[j].set(olds[j])
+			}
+			c.AddReplyErrorf("CONFIG SET failed (possibly related to argument '%s') - %v", c.args[2+i*2].StrVal(), err)
+			return
+		}
+	}
+	c.AddReply(REPLY_OK)
+}
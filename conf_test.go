@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	initTestServer(t)
+
+	config := `
+# the comments and the blank lines are skipped
+port 6380
+  MaxClients 100
+slave-read-only no
+auto-aof-rewrite-min-size 64mb
+repl-timeout 30
+notify-keyspace-events "Kx"
+appendfilename 'data file.aof'
+replicaof 127.0.0.1 6379
+`
+	assert.Nil(t, loadServerConfigFromString(config))
+	assert.Equal(t, 6380, server.port)
+	assert.Equal(t, 100, server.maxClients)
+	assert.False(t, server.replicaReadOnly)
+	assert.Equal(t, int64(64<<20), server.aofRewriteMinSize)
+	assert.Equal(t, int64(30*1000), server.replTimeout)
+	assert.Equal(t, NOTIFY_KEYSPACE|NOTIFY_EXPIRED, server.notifyKeyspaceEvents)
+	assert.Equal(t, "data file.aof", server.aofFileName)
+	assert.Equal(t, "127.0.0.1", server.masterHost)
+	assert.Equal(t, 6379, server.masterPort)
+	assert.Equal(t, REPL_STATE_CONNECT, server.replState)
+
+	for _, bad := range []string{
+		"nosuchoption 1",
+		"port",
+		"port 1 2",
+		"port 70000",
+		"maxclients many",
+		"replica-read-only maybe",
+		"proto-max-bulk-len 1kb",
+		"notify-keyspace-events Q",
+		"appendfilename dir/file.aof",
+		"replicaof 127.0.0.1",
+		`port "6380`,
+	} {
+		assert.NotNil(t, loadServerConfigFromString(bad), bad)
+	}
+	err := loadServerConfigFromString("port 6381\nport x")
+	assert.Equal(t, "line 2 'port x': argument couldn't be parsed into an integer", err.Error())
+}
+
+func TestLoadServerArgs(t *testing.T) {
+	initTestServer(t)
+	path := filepath.Join(t.TempDir(), "gedis.conf")
+	assert.Nil(t, os.WriteFile(path, []byte("port 6380\nmaxclients 10\n"), 0644))
+
+	// the options override the config file
+	assert.Nil(t, loadServerArgs([]string{path, "--port", "6381", "--replicaof", "10.0.0.1", "7000", "--lua-time-limit", "100"}))
+	assert.Equal(t, path, server.configFile)
+	assert.Equal(t, 6381, server.port)
+	assert.Equal(t, 10, server.maxClients)
+	assert.Equal(t, "10.0.0.1", server.masterHost)
+	assert.Equal(t, 7000, server.masterPort)
+	assert.Equal(t, int64(100), server.script.timeLimit)
+
+	initTestServer(t)
+	assert.Nil(t, loadServerArgs([]string{"--notify-keyspace-events", "", "--proto-max-bulk-len", "1gb"}))
+	assert.Equal(t, "", server.configFile)
+	assert.Equal(t, int64(1<<30), server.protoMaxBulkLen)
+	assert.Equal(t, 0, server.notifyKeyspaceEvents)
+
+	assert.NotNil(t, loadServerArgs([]string{"--port"}))
+	assert.NotNil(t, loadServerArgs([]string{"--unknown", "1"}))
+	assert.NotNil(t, loadServerArgs([]string{filepath.Join(t.TempDir(), "missing.conf")}))
+}
+
+func TestConfigGetSet(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, "*2\r\n$4\r\nport\r\n$4\r\n8888\r\n", runCommand(c, "config", "get", "port"))
+	assert.Equal(t, "*4\r\n$4\r\nport\r\n$4\r\n8888\r\n$10\r\nmaxclients\r\n$5\r\n10000\r\n",
+		runCommand(c, "config", "get", "PORT", "max*"))
+	assert.Equal(t, "*4\r\n$27\r\nauto-aof-rewrite-percentage\r\n$2\r\n80\r\n$25\r\nauto-aof-rewrite-min-size\r\n$8\r\n33554432\r\n",
+		runCommand(c, "config", "get", "auto-aof-*"))
+	// the alias is replied if it's matched
+	assert.Equal(t, "*2\r\n$15\r\nslave-read-only\r\n$3\r\nyes\r\n", runCommand(c, "config", "get", "slave-read-only"))
+	assert.Equal(t, "*0\r\n", runCommand(c, "config", "get", "nosuchoption"))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "maxclients", "50", "repl-timeout", "5"))
+	assert.Equal(t, 50, server.maxClients)
+	assert.Equal(t, int64(5000), server.replTimeout)
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "notify-keyspace-events", "KEA"))
+	assert.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nAKE\r\n", runCommand(c, "config", "get", "notify-keyspace-events"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "proto-max-bulk-len", "2mb"))
+	assert.Equal(t, int64(2<<20), server.protoMaxBulkLen)
+
+	assert.Equal(t, "-ERR Unknown option or number of arguments for CONFIG SET - 'nosuchoption'\r\n",
+		runCommand(c, "config", "set", "nosuchoption", "1"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config\r\n",
+		runCommand(c, "config", "set", "port", "6380"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'maxclients') - duplicate parameter\r\n",
+		runCommand(c, "config", "set", "maxclients", "1", "maxclients", "2"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'repl-timeout') - argument must be between 1 and 2147483647 inclusive\r\n",
+		runCommand(c, "config", "set", "repl-timeout", "0"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "config"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'set'\r\n",
+		runCommand(c, "config", "set", "maxclients"))
+
+	// none of the parameters is set if any of them is invalid
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'replica-read-only') - argument must be 'yes' or 'no'\r\n",
+		runCommand(c, "config", "set", "maxclients", "70", "auto-aof-rewrite-min-size", "1gb", "replica-read-only", "maybe"))
+	assert.Equal(t, 50, server.maxClients)
+	assert.Equal(t, int64(AOF_REWRITE_MIN_SIZE), server.aofRewriteMinSize)
+
+	// the backlog is created again with the new size
+	server.replBacklog = newReplBacklog(int(server.replBacklogSize))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "repl-backlog-size", "32kb"))
+	assert.Equal(t, 32*1024, len(server.replBacklog.buf))
+
+	c.resp = 3
+	assert.Equal(t, "%1\r\n$4\r\nport\r\n$4\r\n8888\r\n", runCommand(c, "config", "get", "port"))
+
+	// RESETSTAT
+	runCommand(c, "ping")
+	assert.NotEqual(t, int64(0), server.statNumCommands)
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "resetstat"))
+	assert.Equal(t, int64(1), server.statNumCommands)
+}
+
+func TestConfigRewrite(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	assert.Equal(t, "-ERR The server is running without a config file\r\n", runCommand(c, "config", "rewrite"))
+
+	path := filepath.Join(t.TempDir(), "gedis.conf")
+	old := `# Gedis configuration
+
+# the clients limit
+maxclients 100
+port 6380
+Slave-Read-Only yes
+replica-read-only no
+`
+	assert.Nil(t, os.WriteFile(path, []byte(old), 0600))
+	assert.Nil(t, loadServerArgs([]string{path}))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "maxclients", "200", "notify-keyspace-events", "Ex"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "auto-aof-rewrite-min-size", "64mb"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "rewrite"))
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `# Gedis configuration
+
+# the clients limit
+maxclients 200
+port 6380
+replica-read-only no
+# Generated by CONFIG REWRITE
+auto-aof-rewrite-min-size 64mb
+notify-keyspace-events xE
+`, string(data))
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// the rewritten file is loaded to the same configuration, and rewriting it again changes nothing
+	initTestServer(t)
+	assert.Nil(t, loadServerArgs([]string{path}))
+	assert.Equal(t, 200, server.maxClients)
+	assert.Equal(t, NOTIFY_KEYEVENT|NOTIFY_EXPIRED, server.notifyKeyspaceEvents)
+	assert.Nil(t, rewriteConfig(path))
+	again, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	// the empty string is quoted, and the replicaof line is removed once the server is a master
+	server.notifyKeyspaceEvents = 0
+	server.masterHost = "127.0.0.1"
+	server.masterPort = 7000
+	assert.Nil(t, rewriteConfig(path))
+	data, _ = os.ReadFile(path)
+	assert.True(t, strings.HasSuffix(string(data), "# Generated by CONFIG REWRITE\nauto-aof-rewrite-min-size 64mb\nnotify-keyspace-events \"\"\nreplicaof 127.0.0.1 7000\n"), string(data))
+	server.masterHost = ""
+	assert.Nil(t, rewriteConfig(path))
+	data, _ = os.ReadFile(path)
+	assert.False(t, strings.Contains(string(data), "replicaof"))
+}
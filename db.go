@@ -12,6 +12,31 @@ func LookupKey(key *GObj) *GObj {
 	return entry.Val
 }
 
+// LookupKeyRead looks up the key read by the command, the keyspace hits and misses are counted
+func LookupKeyRead(key *GObj) *GObj {
+	val := LookupKey(key)
+	if val == nil {
+		server.statKeyspaceMisses++
+	} else {
+		server.statKeyspaceHits++
+	}
+	return val
+}
+
+// signalModifiedKey is called by every command modifying the key
+func signalModifiedKey(c *GedisClient, key *GObj) {
+	touchWatchedKey(key)
+	trackingInvalidateKey(key)
+}
+
+// emptyData removes all the keys, like the replica loading the snapshot of the master
+func emptyData() {
+	touchAllWatchedKeys()
+	trackingInvalidateKeysOnFlush()
+	server.db.data = NewDict(DictType{HashFunc: HashStr, EqualFunc: EqualStr})
+	server.db.expire = NewDict(DictType{HashFunc: HashStr, EqualFunc: EqualStr})
+}
+
 func GetNumber(s string, target *int64) (err error) {
 	*target, err = strconv.ParseInt(s, 10, 64)
 	return err
@@ -73,6 +73,10 @@ func (iter *DictIterator) DictNext() *Entry {
 
 		if iter.entry == nil {
 			ht := iter.d.HTables[iter.table]
+			// the table is allocated by the first insert
+			if ht == nil {
+				break
+			}
 
 			//if the first iteration
 			if iter.index == -1 && iter.table == 0 {
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,47 +17,145 @@ type CmdType int8
 const (
 	REPLY_UNKNOWN_CMD   string = "-ERR unknown command\r\n"
 	REPLY_WRONG_ARITY   string = "-ERR wrong number of arguments\r\n"
-	REPLY_NIL           string = "+nil\r\n"
+	REPLY_NIL           string = "$-1\r\n"
 	REPLY_WRONG_TYPE    string = "-ERR invalid type\r\n"
-	REPLY_INVALID_VALUE        = "-ERR value is not an integer or out of range\n"
-	REPLY_OK            string = "+ok\r\n"
+	REPLY_INVALID_VALUE string = "-ERR value is not an integer or out of range\r\n"
+	REPLY_OK            string = "+OK\r\n"
 	REPLY_ZERO          string = ":0\r\n"
 	REPLY_ONE           string = ":1\r\n"
+	REPLY_SYNTAX_ERR    string = "-ERR syntax error\r\n"
 
 	CMD_UNKNOWN CmdType = 0
 	CMD_INLINE  CmdType = 1
 	CMD_BULK    CmdType = 2
 
 	GEDIS_IO_BUF                 int   = 1024 * 8
-	GEDIS_MAX_CMD_BUF            int   = 1024 * 4
+	GEDIS_MAX_CMD_BUF            int   = 1024 * 64 // the max length of the inline command and of the protocol lines
+	GEDIS_MAX_MULTIBULK_LEN      int   = 1024 * 1024
+	GEDIS_MBULK_BIG_ARG          int   = 1024 * 32 // the bulk strings at least this long are read into their own buffer
 	GEDIS_EXPIRELOOKUPS_PER_CRON int64 = 100
+
+	/* client flags */
+	CLIENT_BLOCKED            = 1 << 0  // the client is waiting in a blocking operation
+	CLIENT_PREVENT_PROP       = 1 << 1  // don't propagate the executed command
+	CLIENT_REPROCESSING       = 1 << 2  // the blocked command is executed again
+	CLIENT_PUBSUB             = 1 << 3  // the client is in the pub/sub mode
+	CLIENT_CLOSE_AFTER_REPLY  = 1 << 4  // close the connection after the reply is sent
+	CLIENT_MULTI              = 1 << 5  // the client is in a transaction
+	CLIENT_DIRTY_CAS          = 1 << 6  // a watched key was modified, EXEC will fail
+	CLIENT_DIRTY_EXEC         = 1 << 7  // an error happened while queueing, EXEC will fail
+	CLIENT_SCRIPT             = 1 << 8  // the fake client executing the commands of scripts
+	CLIENT_PROTECTED          = 1 << 9  // the client runs a slow script, its query is processed later
+	CLIENT_SLAVE              = 1 << 10 // the client is a replica of this server
+	CLIENT_MASTER             = 1 << 11 // the client is the master of this server
+	CLIENT_MASTER_FORCE_REPLY = 1 << 12 // the master gets the reply, like the ACK asked by REPLCONF GETACK
+	CLIENT_TRACKING           = 1 << 13 // the client side caching is enabled
+	CLIENT_TRACKING_BCAST     = 1 << 14 // the client gets the invalidations of the prefixes
+	CLIENT_TRACKING_OPTIN     = 1 << 15 // only the keys read after CLIENT CACHING yes are tracked
+	CLIENT_TRACKING_OPTOUT    = 1 << 16 // the keys read after CLIENT CACHING no are not tracked
+	CLIENT_TRACKING_CACHING   = 1 << 17 // CLIENT CACHING was called for the next command
+	CLIENT_TRACKING_BROKEN    = 1 << 18 // the client redirected to is gone, which was notified
+	CLIENT_REPLY_OFF          = 1 << 19 // CLIENT REPLY OFF, no reply is sent
+	CLIENT_REPLY_SKIP_NEXT    = 1 << 20 // CLIENT REPLY SKIP, the reply of the next command is skipped
+	CLIENT_REPLY_SKIP         = 1 << 21 // the reply of the current command is skipped
+	CLIENT_NO_EVICT           = 1 << 22 // CLIENT NO-EVICT on, the client is exempt from the eviction of clients
+	CLIENT_PENDING_COMMAND    = 1 << 23 // the command postponed by CLIENT PAUSE is ready to be executed
+	CLIENT_PUSHING            = 1 << 24 // the message pushed to the client is sent even if the replies are off
+	CLIENT_CLOSE_ASAP         = 1 << 25 // the client is closed by freeClientsInAsyncFreeQueue, no reply is added
+
+	GEDIS_VERSION = "1.0.0"
 )
 
 type GedisClient struct {
 	//conn     *net.TCPConn
-	nfd      int
-	db       *GedisDB
-	args     []*GObj
-	reply    *List  // the type of node is string
-	sentLen  int    //the length that has been sent
-	queryBuf []byte //client buffer
-	queryLen int    //the effective length of the buffer
-	cmdType  CmdType
-	bulkCnt  int //the number of bulk strings to be read
-	bulkLen  int //the length of string that need to read At present
+	id         uint64 //unique and increasing
+	nfd        int
+	resp       int    //the protocol version, 2 or 3
+	name       string //set by HELLO SETNAME
+	db         *GedisDB
+	args       []*GObj
+	buf        []byte        //the static reply buffer
+	bufpos     int           //the length of the replies in buf
+	reply      []*replyBlock //the replies which don't fit in buf
+	replyBytes int           //the bytes of the reply blocks, see the output buffer limits
+	sentLen    int           //the length that has been sent of buf, or of the first block if buf is empty
+	queryBuf   []byte        //client buffer
+	qbPos      int           //the read offset of the buffer, the query before it is processed
+	queryLen   int           //the effective length of the buffer
+	cmdType    CmdType
+	bulkCnt    int //the number of bulk strings to be read
+	bulkLen    int //the length of string that need to read At present, -1 if it's not read yet
+	flags      int
+	bstate     blockingState //the state of blocking operation, valid if CLIENT_BLOCKED is set
+
+	pubsubChannels      map[string]struct{} //the channels the client subscribed
+	pubsubPatterns      map[string]struct{}
+	pubsubShardChannels map[string]struct{}
+
+	mstate      multiState //the state of transaction, valid if CLIENT_MULTI is set
+	watchedKeys []*GObj
+
+	addr            string        //the address of the peer like 127.0.0.1:6379, cached by peerID
+	laddr           string        //the local address of the connection, cached by sockID
+	ctime           int64         //unix time in ms the client was created
+	lastInteraction int64         //unix time in ms of the last read
+	lastCmd         *GedisCommand //the latest command executed, or being executed
+
+	obufSoftLimitReachedTime int64 //unix time in ms the output buffer reached the soft limit, 0 if it's below
+	obufExemptBytes          int   //the bytes of the reply blocks not counted by the limits, like the snapshot of SYNC
+
+	// replication
+	replAckOff  int64  //the offset acknowledged by the replica, valid if CLIENT_SLAVE is set
+	replAckTime int64  //unix time in ms of the last ACK, 0 if the replica never acknowledged
+	slavePort   int    //the listening port of the replica
+	readReplOff int64  //the offset of the bytes read from the master, valid if CLIENT_MASTER is set
+	replOff     int64  //the offset of the commands applied from the master
+	replBuf     []byte //the bytes read from the master not applied yet
+
+	// client side caching
+	trackingRedirect uint64              //the ID of the client getting the invalidations, 0 means itself
+	trackingPrefixes map[string]struct{} //the prefixes of the BCAST mode
 }
 
 func NewClient(nfd int) *GedisClient {
 	var client GedisClient
+	server.nextClientID++
+	client.id = server.nextClientID
 	client.nfd = nfd
+	client.resp = 2
 	client.db = server.db
+	client.ctime = GetTimeMs()
+	client.lastInteraction = client.ctime
 	client.queryBuf = make([]byte, GEDIS_IO_BUF)
-	client.reply = ListCreate(ListType{EqualFunc: EqualStr}) //the type of node is string
+	client.bulkLen = -1
+	client.buf = make([]byte, GEDIS_REPLY_CHUNK_BYTES)
+	client.pubsubChannels = make(map[string]struct{})
+	client.pubsubPatterns = make(map[string]struct{})
+	client.pubsubShardChannels = make(map[string]struct{})
+	// the fake clients, like the one of the scripts, can't be looked up
+	if nfd > 0 {
+		server.clientsIndex[client.id] = &client
+	}
 	return &client
 }
 
 func freeClient(client *GedisClient) {
+	if client.flags&CLIENT_BLOCKED != 0 {
+		unblockClient(client)
+	}
+	if client.flags&CLIENT_SLAVE != 0 {
+		replicationRemoveSlave(client)
+	}
+	if client == server.master {
+		replicationHandleMasterDisconnection()
+	}
+	if client.flags&CLIENT_TRACKING != 0 {
+		disableTracking(client)
+	}
+	pubsubUnsubscribeAll(client)
+	discardTransaction(client)
 	delete(server.clients, client.nfd)
+	delete(server.clientsIndex, client.id)
 	server.aeloop.RemoveFileEvent(client.nfd, AE_READABLE)
 	server.aeloop.RemoveFileEvent(client.nfd, AE_WRITABLE)
 
@@ -63,40 +164,279 @@ func freeClient(client *GedisClient) {
 	}
 }
 
+// resetClient prepares the client for the next command, the reply of the command after
+// CLIENT REPLY SKIP is skipped
 func resetClient(client *GedisClient) {
 	client.bulkCnt = 0
+	client.bulkLen = -1
 	client.cmdType = CMD_UNKNOWN
+	// the blocked command isn't done until it's unblocked
+	if client.flags&CLIENT_BLOCKED == 0 {
+		client.flags &= ^CLIENT_REPLY_SKIP
+		if client.flags&CLIENT_REPLY_SKIP_NEXT != 0 {
+			client.flags |= CLIENT_REPLY_SKIP
+			client.flags &= ^CLIENT_REPLY_SKIP_NEXT
+		}
+	}
+}
+
+// peerID returns the address of the client like 127.0.0.1:6379, empty if it isn't connected
+func (client *GedisClient) peerID() string {
+	if client.addr == "" {
+		if ip, port, err := PeerName(client.nfd); err == nil {
+			client.addr = ip + ":" + strconv.Itoa(port)
+		}
+	}
+	return client.addr
+}
+
+// sockID returns the local address of the connection of the client
+func (client *GedisClient) sockID() string {
+	if client.laddr == "" {
+		if ip, port, err := SockName(client.nfd); err == nil {
+			client.laddr = ip + ":" + strconv.Itoa(port)
+		}
+	}
+	return client.laddr
+}
+
+// replyAllowed reports whether the reply can be added, the master gets no reply unless it's
+// forced, and the client turning off the replies by CLIENT REPLY gets only the pushed messages
+func (client *GedisClient) replyAllowed() bool {
+	if client.flags&CLIENT_CLOSE_ASAP != 0 {
+		return false
+	}
+	if client.flags&(CLIENT_REPLY_OFF|CLIENT_REPLY_SKIP) != 0 && client.flags&CLIENT_PUSHING == 0 {
+		return false
+	}
+	return client.flags&CLIENT_MASTER == 0 || client.flags&CLIENT_MASTER_FORCE_REPLY != 0
 }
 
+/* The reply API queues the replies to the reply buffer of the client, which is sent by
+ * SendReplyToClient. The commands build the replies by these helpers instead of writing the
+ * protocol themselves. */
+
+// AddReply adds the reply already in the protocol format
 func (client *GedisClient) AddReply(str string) {
-	node := NewObject(STR, str)
-	client.reply.TailPush(node)
+	// the errors are counted even if the client gets no reply
+	if len(str) > 0 && str[0] == '-' {
+		recordErrorReply(str)
+	}
+	if !client.replyAllowed() {
+		return
+	}
+	client.addReplyProto(str)
+}
+
+// AddReplyStatus adds the simple string, which can't contain newlines
+func (client *GedisClient) AddReplyStatus(status string) {
+	client.AddReply("+" + sanitizeErrorMsg(status) + "\r\n")
+}
+
+// AddReplyError adds the error, the generic "ERR" code is used unless the message starts with
+// "-" and its own code, like "-WRONGTYPE ..."
+func (client *GedisClient) AddReplyError(msg string) {
+	if !strings.HasPrefix(msg, "-") {
+		msg = "-ERR " + msg
+	}
+	client.AddReply(sanitizeErrorMsg(msg) + "\r\n")
+}
+
+func (client *GedisClient) AddReplyErrorf(format string, args ...any) {
+	client.AddReplyError(fmt.Sprintf(format, args...))
+}
+
+func (client *GedisClient) AddReplyLongLong(n int64) {
+	client.AddReply(fmt.Sprintf(":%d\r\n", n))
 }
 
-func (client *GedisClient) AddReplyStr(obj *GObj) {
-	if obj.Type_ != STR {
+func (client *GedisClient) AddReplyInt(i int) {
+	client.AddReplyLongLong(int64(i))
+}
+
+// AddReplyBulk adds the string or the bitmap as the bulk string
+func (client *GedisClient) AddReplyBulk(obj *GObj) {
+	if obj.Type_ == STR {
+		client.AddReplyBulkString(obj.StrVal())
 		return
 	}
-	node := NewObject(STR, fmt.Sprintf("$%d\r\n%s\r\n", len(obj.StrVal()), obj.StrVal()))
-	client.reply.TailPush(node)
+	client.AddReplyBulkBytes(obj.BytesVal())
 }
 
+// AddReplyBulkString adds the bulk string, the large one is referenced instead of copied
+func (client *GedisClient) AddReplyBulkString(s string) {
+	if !client.replyAllowed() {
+		return
+	}
+	client.addReplyProto("$" + strconv.Itoa(len(s)) + "\r\n")
+	if len(s) >= GEDIS_REPLY_SHARED_BYTES {
+		client.addReplyRef(s)
+	} else {
+		client.addReplyProto(s)
+	}
+	client.addReplyProto("\r\n")
+}
+
+// AddReplyBulkBytes adds the bytes as the bulk string, they are copied since they may change
+// before being sent
+func (client *GedisClient) AddReplyBulkBytes(b []byte) {
+	client.AddReply(fmt.Sprintf("$%d\r\n%s\r\n", len(b), b))
+}
+
+// AddReplyFloat adds the float as the bulk string, like the distance of GEODIST
 func (client *GedisClient) AddReplyFloat(f float64) {
+	client.AddReplyBulkString(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func (client *GedisClient) AddReplyArrayLen(n int) {
+	client.AddReply(fmt.Sprintf("*%d\r\n", n))
+}
+
+// AddReplyHelp adds the help of the command as the status lines, the lines describe the
+// subcommands except HELP itself
+func (client *GedisClient) AddReplyHelp(name string, help []string) {
+	client.AddReplyArrayLen(len(help) + 3)
+	client.AddReplyStatus(strings.ToUpper(name) + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+	for _, line := range help {
+		client.AddReplyStatus(line)
+	}
+	client.AddReplyStatus("HELP")
+	client.AddReplyStatus("    Print this help.")
+}
+
+// AddReplyDeferredLen adds the placeholder of the header, which is set once the count of the
+// elements is known. nil is returned if the client gets no reply
+func (client *GedisClient) AddReplyDeferredLen() *replyBlock {
+	if !client.replyAllowed() {
+		return nil
+	}
+	return client.addReplyPlaceholder()
+}
+
+func (client *GedisClient) SetDeferredArrayLen(node *replyBlock, n int) {
+	if node != nil {
+		client.setReplyPlaceholder(node, fmt.Sprintf("*%d\r\n", n))
+	}
+}
+
+func (client *GedisClient) SetDeferredMapLen(node *replyBlock, n int) {
+	if node == nil {
+		return
+	}
+	if client.resp > 2 {
+		client.setReplyPlaceholder(node, fmt.Sprintf("%%%d\r\n", n))
+	} else {
+		client.setReplyPlaceholder(node, fmt.Sprintf("*%d\r\n", n*2))
+	}
+}
+
+/* The RESP3 types fall back to the nearest RESP2 encodings for the RESP2 clients. */
+
+// AddReplyNull adds the nil, which is the nil bulk string in RESP2
+func (client *GedisClient) AddReplyNull() {
+	if client.resp > 2 {
+		client.AddReply("_\r\n")
+	} else {
+		client.AddReply(REPLY_NIL)
+	}
+}
+
+// AddReplyNullArray adds the nil, which is the nil array in RESP2
+func (client *GedisClient) AddReplyNullArray() {
+	if client.resp > 2 {
+		client.AddReply("_\r\n")
+	} else {
+		client.AddReply("*-1\r\n")
+	}
+}
+
+// AddReplyMapLen adds the header of a map of n pairs, a flat array of 2n elements in RESP2
+func (client *GedisClient) AddReplyMapLen(n int) {
+	if client.resp > 2 {
+		client.AddReply(fmt.Sprintf("%%%d\r\n", n))
+	} else {
+		client.AddReplyArrayLen(n * 2)
+	}
+}
+
+// AddReplySetLen adds the header of a set, an array in RESP2
+func (client *GedisClient) AddReplySetLen(n int) {
+	if client.resp > 2 {
+		client.AddReply(fmt.Sprintf("~%d\r\n", n))
+	} else {
+		client.AddReplyArrayLen(n)
+	}
+}
+
+// AddReplyPushLen adds the header of an out of band message, an array in RESP2
+func (client *GedisClient) AddReplyPushLen(n int) {
+	if client.resp > 2 {
+		client.AddReply(fmt.Sprintf(">%d\r\n", n))
+	} else {
+		client.AddReplyArrayLen(n)
+	}
+}
+
+// AddReplyDouble adds the double, a bulk string in RESP2
+func (client *GedisClient) AddReplyDouble(f float64) {
+	if client.resp <= 2 {
+		client.AddReplyFloat(f)
+		return
+	}
 	s := strconv.FormatFloat(f, 'f', -1, 64)
-	node := NewObject(STR, fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
-	client.reply.TailPush(node)
+	if math.IsInf(f, 1) {
+		s = "inf"
+	} else if math.IsInf(f, -1) {
+		s = "-inf"
+	}
+	client.AddReply(fmt.Sprintf(",%s\r\n", s))
 }
 
-func (client *GedisClient) AddReplyInt(i int) {
-	s := strconv.Itoa(i)
-	node := NewObject(STR, fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
-	client.reply.TailPush(node)
+// AddReplyBool adds the boolean, the integer 1 or 0 in RESP2
+func (client *GedisClient) AddReplyBool(b bool) {
+	switch {
+	case client.resp > 2 && b:
+		client.AddReply("#t\r\n")
+	case client.resp > 2:
+		client.AddReply("#f\r\n")
+	case b:
+		client.AddReply(REPLY_ONE)
+	default:
+		client.AddReply(REPLY_ZERO)
+	}
+}
+
+// AddReplyBigNum adds the decimal integer out of the 64 bit range, a bulk string in RESP2
+func (client *GedisClient) AddReplyBigNum(num string) {
+	if client.resp > 2 {
+		client.AddReply(fmt.Sprintf("(%s\r\n", num))
+	} else {
+		client.AddReplyBulkString(num)
+	}
+}
+
+// AddReplyVerbatim adds the text with its format like "txt" or "mkd", a bulk string in RESP2
+func (client *GedisClient) AddReplyVerbatim(text, format string) {
+	if client.resp > 2 {
+		client.AddReply(fmt.Sprintf("=%d\r\n%s:%s\r\n", len(text)+4, format, text))
+	} else {
+		client.AddReplyBulkString(text)
+	}
 }
 
 func (client *GedisClient) ProcessQueryBuf() error {
-	for client.queryLen > 0 {
+	for client.qbPos < client.queryLen {
+		// the rest of query will be processed once the client is unblocked
+		if client.flags&(CLIENT_BLOCKED|CLIENT_PROTECTED) != 0 {
+			break
+		}
+		// the client is going to be closed, discard the rest of query
+		if client.flags&(CLIENT_CLOSE_AFTER_REPLY|CLIENT_CLOSE_ASAP) != 0 {
+			client.qbPos = client.queryLen
+			break
+		}
 		if client.cmdType == CMD_UNKNOWN { // the command have not processed currently
-			if client.queryBuf[0] == '*' {
+			if client.queryBuf[client.qbPos] == '*' {
 				client.cmdType = CMD_BULK
 			} else {
 				client.cmdType = CMD_INLINE
@@ -113,7 +453,12 @@ func (client *GedisClient) ProcessQueryBuf() error {
 			return errors.New("unknown Gedis command type")
 		}
 		if err != nil {
-			return err
+			// the protocol error is replied, then the connection is closed
+			client.AddReplyErrorf("Protocol error: %v", err)
+			client.flags |= CLIENT_CLOSE_AFTER_REPLY
+			client.qbPos = client.queryLen
+			server.aeloop.AddFileEvent(client.nfd, AE_WRITABLE, SendReplyToClient, client)
+			break
 		}
 		if ok { // commands can be executed
 			if len(client.args) == 0 { //nothing to do
@@ -122,31 +467,66 @@ func (client *GedisClient) ProcessQueryBuf() error {
 				ProcessCommand(client)
 				server.aeloop.AddFileEvent(client.nfd, AE_WRITABLE, SendReplyToClient, client)
 			}
+			if client.flags&CLIENT_MASTER != 0 {
+				replicationCommandProcessed(client)
+			}
 		} else {
 			break //incomplete command
 		}
 	}
+	// the buffer is reused once all the query is processed
+	if client.qbPos == client.queryLen {
+		client.qbPos, client.queryLen = 0, 0
+	}
 	return nil
 }
 
-// return the index of next CRLF, -1 will be returned if didn't find
-func findCRLFInQuery(client *GedisClient) (int, error) {
-	index := strings.Index(string(client.queryBuf[:client.queryLen]), "\r\n")
-	if index < 0 && client.queryLen > GEDIS_MAX_CMD_BUF { //缓冲区被读满了还没出现换行符
-		return index, errors.New("command is too big")
+// makeRoomForQuery makes sure n bytes can be read to the query buffer, the processed query is
+// discarded first
+func (client *GedisClient) makeRoomForQuery(n int) {
+	if len(client.queryBuf)-client.queryLen >= n {
+		return
+	}
+	if client.qbPos > 0 {
+		client.queryLen = copy(client.queryBuf, client.queryBuf[client.qbPos:client.queryLen])
+		client.qbPos = 0
+	}
+	if len(client.queryBuf)-client.queryLen < n {
+		size := 2 * len(client.queryBuf)
+		if size < client.queryLen+n {
+			size = client.queryLen + n
+		}
+		buf := make([]byte, size)
+		copy(buf, client.queryBuf[:client.queryLen])
+		client.queryBuf = buf
 	}
-	return index, nil
 }
 
-//  if the inline command is ready, it returns true
+// readQueryLine returns the line at the read offset without the CRLF, ok is false if the line
+// is incomplete
+func readQueryLine(client *GedisClient) (line string, ok bool, err error) {
+	query := client.queryBuf[client.qbPos:client.queryLen]
+	index := bytes.IndexByte(query, '\n')
+	if index < 0 {
+		if len(query) > GEDIS_MAX_CMD_BUF {
+			return "", false, errors.New("too big request line")
+		}
+		return "", false, nil
+	}
+	client.qbPos += index + 1
+	return strings.TrimSuffix(string(query[:index]), "\r"), true, nil
+}
+
+// if the inline command is ready, it returns true
 func handleInlineBuf(client *GedisClient) (bool, error) {
-	index, err := findCRLFInQuery(client)
-	if index < 0 { //未找到或出错，不进行处理
+	line, ok, err := readQueryLine(client)
+	if !ok {
 		return false, err
 	}
-	//  find a complete command
-	subs := strings.Split(string(client.queryBuf[:index]), " ")
-	client.skipCRLF(index)
+	subs, err := splitArgs(line)
+	if err != nil {
+		return false, errors.New("unbalanced quotes in request")
+	}
 	client.args = make([]*GObj, len(subs))
 	for i, v := range subs {
 		client.args[i] = NewObject(STR, v)
@@ -154,71 +534,73 @@ func handleInlineBuf(client *GedisClient) (bool, error) {
 	return true, nil
 }
 
-// note that it will skip a CRLF behind the number
-func getNumInQuery(client *GedisClient, start, end int) (int, error) {
-	num, err := strconv.Atoi(string(client.queryBuf[start:end]))
-	client.skipCRLF(end)
-	return num, err
-}
-
-// skip a \r\n in query buffer
-func (client *GedisClient) skipCRLF(index int) {
-	client.queryBuf = client.queryBuf[index+2:]
-	client.queryLen -= index + 2
-}
-
 // if the bulk command is completely, handleBulkBuf returns true, the Rules of parsing as:
-//For Simple Strings, the first byte is "+"
-//For Errors, the first byte is "-"
-//For Integers, the first byte is ":"
-//For Bulk Strings, the first byte is "$"
-//For Arrays, the first byte is "*"
+// For Simple Strings, the first byte is "+"
+// For Errors, the first byte is "-"
+// For Integers, the first byte is ":"
+// For Bulk Strings, the first byte is "$"
+// For Arrays, the first byte is "*"
 // example: set key value  --> *3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
 func handleBulkBuf(client *GedisClient) (bool, error) {
 	if client.bulkCnt == 0 { //if first time to handle the bulk command
-		index, err := findCRLFInQuery(client)
-		if index < 0 {
+		line, ok, err := readQueryLine(client)
+		if !ok {
 			return false, err
 		}
 		// skip the beginning char '*'
-		bCnt, err := getNumInQuery(client, 1, index)
-		if err != nil {
-			return false, err
+		bCnt, err := strconv.Atoi(line[1:])
+		if err != nil || bCnt > GEDIS_MAX_MULTIBULK_LEN {
+			return false, errors.New("invalid multibulk length")
 		}
-		if bCnt == 0 {
+		if bCnt <= 0 {
+			client.args = nil
 			return true, nil
 		}
 		client.bulkCnt = bCnt
-		client.args = make([]*GObj, bCnt)
+		client.args = make([]*GObj, 0, bCnt)
 	}
 	// read every string according to bNum
 	for client.bulkCnt > 0 {
-		if client.bulkLen == 0 {
-			index, err := findCRLFInQuery(client)
-			if index < 0 {
+		if client.bulkLen < 0 {
+			line, ok, err := readQueryLine(client)
+			if !ok {
 				return false, err
 			}
-			if client.queryBuf[0] != '$' {
-				return false, errors.New("expect $ for bulk length")
+			if line == "" || line[0] != '$' {
+				return false, fmt.Errorf("expected '$', got '%.1s'", line)
 			}
 			// skip the char '$'
-			bLen, err := getNumInQuery(client, 1, index)
-			if err != nil || bLen == 0 {
-				return false, err
+			bLen, err := strconv.ParseInt(line[1:], 10, 64)
+			if err != nil || bLen < 0 || bLen > server.protoMaxBulkLen {
+				return false, errors.New("invalid bulk length")
 			}
-			if bLen > GEDIS_MAX_CMD_BUF {
-				return false, errors.New("bulk command is too big")
+			client.bulkLen = int(bLen)
+			// the big argument is read directly into a buffer of its size, see ReadQueryFromClient
+			if client.bulkLen >= GEDIS_MBULK_BIG_ARG && client.queryLen-client.qbPos < client.bulkLen+2 {
+				buf := make([]byte, client.bulkLen+2)
+				client.queryLen = copy(buf, client.queryBuf[client.qbPos:client.queryLen])
+				client.queryBuf, client.qbPos = buf, 0
 			}
-			client.bulkLen = bLen
 		}
 		// read the bulk string
-		if client.queryLen < client.bulkLen+2 { //if this bulk command is incomplete
+		if client.queryLen-client.qbPos < client.bulkLen+2 { //if this bulk command is incomplete
 			return false, nil
 		}
-		index := client.bulkLen
-		client.args[len(client.args)-client.bulkCnt] = NewObject(STR, string(client.queryBuf[:index]))
-		client.skipCRLF(index)
-		client.bulkLen = 0
+		end := client.qbPos + client.bulkLen
+		if client.queryBuf[end] != '\r' || client.queryBuf[end+1] != '\n' {
+			return false, errors.New("bulk string isn't terminated by CRLF")
+		}
+		var arg string
+		if client.qbPos == 0 && client.bulkLen >= GEDIS_MBULK_BIG_ARG && len(client.queryBuf) == client.bulkLen+2 {
+			// the buffer becomes the argument without copying, the client gets a new one
+			arg = bytesToString(client.queryBuf[:client.bulkLen])
+			client.queryBuf, client.queryLen = make([]byte, GEDIS_IO_BUF), 0
+		} else {
+			arg = string(client.queryBuf[client.qbPos:end])
+			client.qbPos = end + 2
+		}
+		client.args = append(client.args, NewObject(STR, arg))
+		client.bulkLen = -1
 		client.bulkCnt -= 1
 	}
 	return true, nil
@@ -231,6 +613,60 @@ type GedisServer struct {
 	clients map[int]*GedisClient
 	aeloop  *AeEventLoop //also global unique
 
+	clientsIndex map[uint64]*GedisClient //the connected clients by ID
+
+	configFile string //the absolute path of the config file, empty if there is none
+	runID      string //random, different for every run of the server
+	startTime  int64  //unix time in ms the server started
+	maxClients int
+
+	maxIdleTime     int64          //ms, the client is closed once idle longer, 0 disables the timeout
+	tcpKeepalive    int            //seconds, the idle time before the keepalive probes, 0 disables them
+	clientsCronTime int64          //unix time in ms of the last clientsCron
+	clientsCronList []*GedisClient //the clients left to check by clientsCron in this round
+
+	clientObufLimits    [CLIENT_TYPE_OBUF_COUNT]clientBufferLimit //the output buffer limits of every type of the clients
+	clientsPendingClose []*GedisClient                            //the clients closed by freeClientsInAsyncFreeQueue
+
+	metricsPort        int   //the port of the Prometheus metrics, 0 disables them
+	metricsRefreshTime int64 //unix time in ms of the latest rendering of the metrics
+
+	commands map[string]*GedisCommand //the command table indexed by the lowercase name
+
+	nextClientID uint64 //the ID of the last created client
+
+	protoMaxBulkLen      int64 //the max length of a bulk string in the query
+	clientMaxQueryBufLen int64 //the client is closed once its query buffer is larger
+	hllSparseMaxBytes    int64 //the sparse HLL is promoted to dense once it's bigger
+
+	// stats, reset by CONFIG RESETSTAT
+	statNumCommands    int64 //the commands processed
+	statNumConnections int64 //the connections accepted
+	statRejectedConn   int64 //the connections rejected because of maxclients
+	statObufLimitConn  int64 //the clients closed for reaching the output buffer limits
+	statExpiredKeys    int64 //the keys deleted once expired
+	statKeyspaceHits   int64 //the lookups of the read commands finding the key
+	statKeyspaceMisses int64
+	statPeakMemory     uint64                      //the max of used_memory sampled
+	statPeakMemoryTime int64                       //unix time in ms of the last sample of the peak memory
+	statOpsSamples     [STATS_METRIC_SAMPLES]int64 //the ops/sec of the latest samples, see trackInstantaneousOps
+	statOpsIdx         int
+	statOpsLastTime    int64 //unix time in ms of the last sample
+	statOpsLastCount   int64 //total_commands_processed at the last sample
+
+	commandStats               map[*GedisCommand]*commandStats //the calls and the latency of every command
+	errorStats                 map[string]int64                //the error replies counted by the code like "ERR"
+	statTotalErrorReplies      int64
+	latencyTracking            bool      //the latency of every call is recorded by the histogram
+	latencyTrackingPercentiles []float64 //the percentiles of INFO latencystats
+
+	latencyMonitorThreshold int64                         //ms, the events taking longer are sampled, 0 disables the monitor
+	latencyEvents           map[string]*latencyTimeSeries //the samples of the events, see latency.go
+
+	slowlog              slowlog
+	slowlogLogSlowerThan int64 //us, the commands running longer are logged
+	slowlogMaxLen        int
+
 	//   AOF
 	aofFileName        string // Name of the AOF file
 	aofRewriteMinSize  int64  // the AOF file is at least N bytes
@@ -240,74 +676,330 @@ type GedisServer struct {
 	aofBuf             string // AOF buffer, written before entering the event loop
 	aofRewriteChan     chan bool
 	aofRewriteBuf      []byte //Hold changes during an AOF rewrite
+	loading            bool   //the AOF is being loaded
+	dirty              int64  //the changes of the dataset, the commands changing nothing aren't propagated
+	aofFsync           int    // appendfsync, AOF_FSYNC_*
+	aofFsyncedSize     int64  // the AOF size at the latest fsync
+	aofLastFsync       int64  // unix time in ms of the latest fsync
+
+	// blocking operations
+	blockingKeys     map[string][]*GedisClient // clients blocked on the key, in the order they blocked
+	readyKeys        map[string]struct{}       // blocked keys that received data, served after the command
+	blockedClients   map[*GedisClient]struct{}
+	unblockedClients []*GedisClient // unblocked clients that may have the pending query to process
+
+	// CLIENT PAUSE, see client.go
+	clientPauseType  int            // CLIENT_PAUSE_*
+	clientPauseEnd   int64          // unix time in ms the pause ends
+	postponedClients []*GedisClient // the clients whose commands wait for the end of the pause
+
+	// pub/sub
+	pubsubChannels       map[string][]*GedisClient // the subscribers of every channel
+	pubsubPatterns       map[string][]*GedisClient // the subscribers of every pattern
+	pubsubShardChannels  map[string][]*GedisClient
+	notifyKeyspaceEvents int // the classes of keyspace events to publish, see notify.go
+
+	// client side caching, see tracking.go
+	trackingTable    map[string]map[uint64]struct{} // the IDs of the clients which may cache the key
+	trackingPrefixes map[string]*bcastState         // the clients and the modified keys of every BCAST prefix
+
+	// replication, see replication.go
+	replid             string // the replication ID of the history of the dataset
+	replid2            string // the replication ID of the former master
+	secondReplidOffset int64  // replid2 is accepted by PSYNC up to this offset
+	masterReplOffset   int64  // the offset of the replication stream
+	replBacklog        *replBacklog
+	slaves             []*GedisClient
+	clientsWaitingAcks []*GedisClient // the clients blocked by WAIT
+	replicaReadOnly    bool           // the replica rejects the write commands
+	replBacklogSize    int64          // the size of the backlog created with the first replica
+	replPingPeriod     int64          // ms, the master pings the replicas so they can detect the timeout
+	replTimeout        int64          // ms, the link with the master or a replica is closed once idle longer
+	replCronTime       int64          // unix time in ms of the last replicationCron
+	replLastPing       int64          // unix time in ms of the last PING sent to the replicas
+	masterHost         string         // the master of this replica, empty if this server is a master
+	masterPort         int
+	master             *GedisClient // the client of the master, valid once the sync is done
+	replState          int          // the state of the link with the master
+	replTransferFd     int          // the socket to the master while the handshake is in progress
+	replTransferBuf    []byte       // the bytes read from the master not processed yet
+	replTransferSize   int          // the size of the snapshot, -1 if it's not received yet
+	replTransferLastIO int64        // unix time in ms of the last I/O with the master while syncing
+	replTransferReplid string       // the replication ID of the snapshot in transfer
+	replTransferOffset int64        // the replication offset of the snapshot in transfer
+
+	// transaction
+	watchedKeys   map[string][]*GedisClient // the clients watching the key
+	inTransaction bool                      // EXEC is executing the queued commands
+	txCommands    []propagatedCmd           // the commands to propagate when the transaction is done
+
+	script scriptState
 }
 
 type CommandProc func(client *GedisClient)
+type GetKeysProc func(args []*GObj) []int
+
+/* The flags of the command are written as a string of characters in the table, which are
+ * turned into the bit flags by populateCommandTable:
+ * w: write command, it may modify the dataset
+ * r: read only command, it never modifies the dataset
+ * m: the command may increase the memory usage
+ * a: admin command, like SYNC or REPLICAOF
+ * p: pub/sub related command
+ * s: command not allowed in scripts
+ * l: allowed while the server is loading the dataset
+ * t: allowed while a replica has stale data
+ * F: fast command, O(1) or O(log(N))
+ *
+ * The keys are the arguments from firstKey to lastKey by keyStep, a negative lastKey counts
+ * from the end, like -1 for the last argument. The commands with the keys at variable
+ * positions set getKeys instead. */
 type GedisCommand struct {
-	name  string
-	arity int
-	proc  CommandProc
+	name     string
+	arity    int // the exact number of arguments, or at least -arity if negative
+	proc     CommandProc
+	sflags   string
+	flags    int // computed from sflags
+	getKeys  GetKeysProc
+	firstKey int // the position of the first key, 0 if the command has no key
+	lastKey  int
+	keyStep  int
 }
 
 var cmdTable = []GedisCommand{
-	{"get", 2, getCommand},
-	{"set", 3, setCommand},
-	{"expire", 3, expireCommand},
-	{"ttl", 2, ttlCommand},
-	{"pexpireat", 3, pexpireatCommand},
+	{"get", 2, getCommand, "rF", 0, nil, 1, 1, 1},
+	{"set", 3, setCommand, "wm", 0, nil, 1, 1, 1},
+	{"expire", 3, expireCommand, "wF", 0, nil, 1, 1, 1},
+	{"ttl", 2, ttlCommand, "rF", 0, nil, 1, 1, 1},
+	{"pexpireat", 3, pexpireatCommand, "wF", 0, nil, 1, 1, 1},
 	/* list command */
-	{"lpush", 3, lpushCommand},
-	{"rpush", 3, rpushCommand},
-	{"lpop", 3, lpopCommand},
-	{"rpop", 3, rpopCommand},
-	{"llen", 2, llenCommand},
-	{"lindex", 3, lindexCommand},
-	{"lrange", 4, lrangeCommand},
-	{"lrem", 4, lremCommand},
+	{"lpush", 3, lpushCommand, "wmF", 0, nil, 1, 1, 1},
+	{"rpush", 3, rpushCommand, "wmF", 0, nil, 1, 1, 1},
+	{"lpop", 3, lpopCommand, "wF", 0, nil, 1, 1, 1},
+	{"rpop", 3, rpopCommand, "wF", 0, nil, 1, 1, 1},
+	{"llen", 2, llenCommand, "rF", 0, nil, 1, 1, 1},
+	{"lindex", 3, lindexCommand, "r", 0, nil, 1, 1, 1},
+	{"lrange", 4, lrangeCommand, "r", 0, nil, 1, 1, 1},
+	{"lrem", 4, lremCommand, "w", 0, nil, 1, 1, 1},
 	//TODO: hash command
-	{"hget", 3, nil},
-	{"hset", 4, nil},
-	{"hdel", 3, nil},
-	{"hgetall", 2, nil},
+	{"hget", 3, nil, "rF", 0, nil, 1, 1, 1},
+	{"hset", 4, nil, "wmF", 0, nil, 1, 1, 1},
+	{"hdel", 3, nil, "wF", 0, nil, 1, 1, 1},
+	{"hgetall", 2, nil, "r", 0, nil, 1, 1, 1},
 	/* zset commmad */
-	{"zadd", 4, zaddCommand},
-	{"zincrby", 4, zincrbyCommand},
-	{"zrem", 3, zremCommand},
-	{"zrange", 4, zrangeCommand},
-	{"zrevrange", 4, zrevrangeCommand},
+	{"zadd", -4, zaddCommand, "wmF", 0, nil, 1, 1, 1},
+	{"zincrby", 4, zincrbyCommand, "wmF", 0, nil, 1, 1, 1},
+	{"zrem", -3, zremCommand, "wF", 0, nil, 1, 1, 1},
+	{"zrange", -4, zrangeCommand, "r", 0, nil, 1, 1, 1},
+	{"zrevrange", -4, zrevrangeCommand, "r", 0, nil, 1, 1, 1},
+	/* geo command */
+	{"geoadd", -5, geoaddCommand, "wm", 0, nil, 1, 1, 1},
+	{"geopos", -2, geoposCommand, "r", 0, nil, 1, 1, 1},
+	{"geodist", -4, geodistCommand, "r", 0, nil, 1, 1, 1},
+	{"geohash", -2, geohashCommand, "r", 0, nil, 1, 1, 1},
+	{"geosearch", -7, geosearchCommand, "r", 0, nil, 1, 1, 1},
+	{"geosearchstore", -8, geosearchstoreCommand, "wm", 0, nil, 1, 2, 1},
 	/* bitmap command */
-	{"setbit", 4, setbitCommand},
-	{"getbit", 3, getbitCommand},
+	{"setbit", 4, setbitCommand, "wm", 0, nil, 1, 1, 1},
+	{"getbit", 3, getbitCommand, "rF", 0, nil, 1, 1, 1},
+	{"bitcount", -2, bitcountCommand, "r", 0, nil, 1, 1, 1},
+	{"bitpos", -3, bitposCommand, "r", 0, nil, 1, 1, 1},
+	{"bitop", -4, bitopCommand, "wm", 0, nil, 2, -1, 1},
+	{"bitfield", -2, bitfieldCommand, "wm", 0, nil, 1, 1, 1},
+	{"bitfield_ro", -2, bitfieldroCommand, "rF", 0, nil, 1, 1, 1},
+	{"setrange", 4, setrangeCommand, "wm", 0, nil, 1, 1, 1},
+	{"getrange", 4, getrangeCommand, "r", 0, nil, 1, 1, 1},
+	/* hyperloglog command */
+	{"pfadd", -2, pfaddCommand, "wmF", 0, nil, 1, 1, 1},
+	{"pfcount", -2, pfcountCommand, "r", 0, nil, 1, -1, 1},
+	{"pfmerge", -2, pfmergeCommand, "wm", 0, nil, 1, -1, 1},
+	{"pfdebug", 3, pfdebugCommand, "wa", 0, nil, 2, 2, 1},
+	/* stream command */
+	{"xadd", -5, xaddCommand, "wmF", 0, nil, 1, 1, 1},
+	{"xrange", -4, xrangeCommand, "r", 0, nil, 1, 1, 1},
+	{"xrevrange", -4, xrevrangeCommand, "r", 0, nil, 1, 1, 1},
+	{"xlen", 2, xlenCommand, "rF", 0, nil, 1, 1, 1},
+	{"xdel", -3, xdelCommand, "wF", 0, nil, 1, 1, 1},
+	{"xtrim", -4, xtrimCommand, "w", 0, nil, 1, 1, 1},
+	{"xsetid", -3, xsetidCommand, "wmF", 0, nil, 1, 1, 1},
+	{"xread", -4, xreadCommand, "r", 0, xreadGetKeys, 0, 0, 0},
+	{"xreadgroup", -7, xreadgroupCommand, "wm", 0, xreadGetKeys, 0, 0, 0},
+	{"xgroup", -4, xgroupCommand, "wm", 0, nil, 2, 2, 1},
+	{"xack", -4, xackCommand, "wF", 0, nil, 1, 1, 1},
+	{"xpending", -3, xpendingCommand, "r", 0, nil, 1, 1, 1},
+	{"xclaim", -6, xclaimCommand, "wF", 0, nil, 1, 1, 1},
+	{"xautoclaim", -6, xautoclaimCommand, "wF", 0, nil, 1, 1, 1},
+	/* pub/sub command */
+	{"subscribe", -2, subscribeCommand, "pslt", 0, nil, 0, 0, 0},
+	{"unsubscribe", -1, unsubscribeCommand, "pslt", 0, nil, 0, 0, 0},
+	{"psubscribe", -2, psubscribeCommand, "pslt", 0, nil, 0, 0, 0},
+	{"punsubscribe", -1, punsubscribeCommand, "pslt", 0, nil, 0, 0, 0},
+	{"ssubscribe", -2, ssubscribeCommand, "pslt", 0, nil, 1, -1, 1},
+	{"sunsubscribe", -1, sunsubscribeCommand, "pslt", 0, nil, 1, -1, 1},
+	{"publish", 3, publishCommand, "pltF", 0, nil, 0, 0, 0},
+	{"spublish", 3, spublishCommand, "pltF", 0, nil, 1, 1, 1},
+	{"pubsub", -2, pubsubCommand, "plt", 0, nil, 0, 0, 0},
+	/* transaction command */
+	{"multi", 1, multiCommand, "sF", 0, nil, 0, 0, 0},
+	{"exec", 1, execCommand, "s", 0, nil, 0, 0, 0},
+	{"discard", 1, discardCommand, "sF", 0, nil, 0, 0, 0},
+	{"watch", -2, watchCommand, "sF", 0, nil, 1, -1, 1},
+	{"unwatch", 1, unwatchCommand, "sF", 0, nil, 0, 0, 0},
+	/* scripting command */
+	{"eval", -3, evalCommand, "s", 0, evalGetKeys, 0, 0, 0},
+	{"evalsha", -3, evalshaCommand, "s", 0, evalGetKeys, 0, 0, 0},
+	{"script", -2, scriptCommand, "s", 0, nil, 0, 0, 0},
+	/* replication command */
+	{"sync", 1, syncCommand, "ars", 0, nil, 0, 0, 0},
+	{"psync", 3, syncCommand, "ars", 0, nil, 0, 0, 0},
+	{"replconf", -1, replconfCommand, "aslt", 0, nil, 0, 0, 0},
+	{"replicaof", 3, replicaofCommand, "ast", 0, nil, 0, 0, 0},
+	{"slaveof", 3, replicaofCommand, "ast", 0, nil, 0, 0, 0},
+	{"wait", 3, waitCommand, "s", 0, nil, 0, 0, 0},
+	{"role", 1, roleCommand, "ltF", 0, nil, 0, 0, 0},
+	/* connection command */
+	{"ping", -1, pingCommand, "tF", 0, nil, 0, 0, 0},
+	{"quit", 1, quitCommand, "slt", 0, nil, 0, 0, 0},
+	{"client", -2, clientCommand, "aslt", 0, nil, 0, 0, 0},
+	{"hello", -1, helloCommand, "sltF", 0, nil, 0, 0, 0},
+	/* server command */
+	{"command", -1, commandCommand, "lt", 0, nil, 0, 0, 0},
+	{"config", -2, configCommand, "aslt", 0, nil, 0, 0, 0},
+	{"slowlog", -2, slowlogCommand, "alt", 0, nil, 0, 0, 0},
+	{"latency", -2, latencyCommand, "alt", 0, nil, 0, 0, 0},
+	{"info", -1, infoCommand, "lt", 0, nil, 0, 0, 0},
+}
+
+// PING [message]
+var pingCommand CommandProc = func(client *GedisClient) {
+	if len(client.args) > 2 {
+		client.AddReply(REPLY_WRONG_ARITY)
+		return
+	}
+	// in the pub/sub mode of RESP2 the reply is a message
+	if client.flags&CLIENT_PUBSUB != 0 && client.resp == 2 {
+		msg := ""
+		if len(client.args) == 2 {
+			msg = client.args[1].StrVal()
+		}
+		addReplyBulkStrings(client, "pong", msg)
+		return
+	}
+	if len(client.args) == 2 {
+		client.AddReplyBulk(client.args[1])
+		return
+	}
+	client.AddReplyStatus("PONG")
+}
+
+// QUIT, the connection is closed once the reply is sent
+var quitCommand CommandProc = func(client *GedisClient) {
+	client.AddReply(REPLY_OK)
+	client.flags |= CLIENT_CLOSE_AFTER_REPLY
+}
+
+// validClientName reports whether the name has no spaces, newlines or special characters
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+var helloCommand CommandProc = func(client *GedisClient) {
+	resp := client.resp
+	if len(client.args) > 1 {
+		ver, err := strconv.Atoi(client.args[1].StrVal())
+		if err != nil {
+			client.AddReplyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if ver != 2 && ver != 3 {
+			client.AddReplyError("-NOPROTO unsupported protocol version")
+			return
+		}
+		resp = ver
+	}
+	name, setName := "", false
+	for i := 2; i < len(client.args); i++ {
+		moreArgs := len(client.args) - i - 1
+		switch opt := strings.ToLower(client.args[i].StrVal()); {
+		case opt == "auth" && moreArgs >= 2:
+			// there is no password, only the default user exists
+			if client.args[i+1].StrVal() != "default" {
+				client.AddReplyError("-WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			i += 2
+		case opt == "setname" && moreArgs >= 1:
+			name, setName = client.args[i+1].StrVal(), true
+			if !validClientName(name) {
+				client.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			i++
+		default:
+			client.AddReplyErrorf("Syntax error in HELLO option '%s'", client.args[i].StrVal())
+			return
+		}
+	}
+	if setName {
+		client.name = name
+	}
+	client.resp = resp
+
+	role := "master"
+	if server.masterHost != "" {
+		role = "replica"
+	}
+	client.AddReplyMapLen(7)
+	client.AddReplyBulkString("server")
+	client.AddReplyBulkString("gedis")
+	client.AddReplyBulkString("version")
+	client.AddReplyBulkString(GEDIS_VERSION)
+	client.AddReplyBulkString("proto")
+	client.AddReplyLongLong(int64(client.resp))
+	client.AddReplyBulkString("id")
+	client.AddReplyLongLong(int64(client.id))
+	client.AddReplyBulkString("mode")
+	client.AddReplyBulkString("standalone")
+	client.AddReplyBulkString("role")
+	client.AddReplyBulkString(role)
+	client.AddReplyBulkString("modules")
+	client.AddReplyArrayLen(0)
 }
 
 //get a string
 var getCommand CommandProc = func(client *GedisClient) {
-	key := client.args[1]
-	expireIfNeeded(key)
-	entry := server.db.data.Find(key)
-	if entry == nil {
-		client.AddReply(REPLY_NIL)
+	obj := LookupKeyRead(client.args[1])
+	if obj == nil {
+		client.AddReplyNull()
 		return
 	}
-	if entry.Val.Type_ != STR {
+	// a bitmap is a string too
+	if obj.Type_ != STR && obj.Type_ != BITMAP {
 		client.AddReply(REPLY_WRONG_TYPE)
 		return
 	}
-	client.AddReply(fmt.Sprintf("$%d\r\n", len(entry.Val.StrVal())))
-	client.AddReply(fmt.Sprintf("%s\r\n", entry.Val.StrVal()))
-	return
+	client.AddReplyBulk(obj)
 }
 
 // set a string value, and will remove expire time of key
 var setCommand CommandProc = func(client *GedisClient) {
 	key, val := client.args[1], client.args[2]
 	entry := server.db.data.Find(key)
-	if entry != nil && entry.Val.Type_ != STR {
+	if entry != nil && entry.Val.Type_ != STR && entry.Val.Type_ != BITMAP {
 		client.AddReply(REPLY_WRONG_TYPE)
 		return
 	}
 	server.db.data.Set(key, val)
 	_ = removeExpire(key)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "set", key)
+	server.dirty++
 	client.AddReply(REPLY_OK)
 }
 
@@ -315,36 +1007,119 @@ func loadDataFromDisk() error {
 	return loadAppendOnlyFile(server.aofFileName)
 }
 
+// lookUpCommand finds the command by the case insensitive name
 func lookUpCommand(name string) *GedisCommand {
-	for _, cmd := range cmdTable {
-		if cmd.name == name {
-			return &cmd
-		}
-	}
-	return nil
+	return server.commands[strings.ToLower(name)]
 }
 
 func ProcessCommand(client *GedisClient) {
 	cmd := lookUpCommand(client.args[0].StrVal())
 	if cmd == nil {
+		flagTransaction(client)
 		client.AddReply(REPLY_UNKNOWN_CMD)
 		resetClient(client)
 		return
-	} else if cmd.arity > 0 && cmd.arity != len(client.args) {
+	}
+	client.lastCmd = cmd
+	if !cmd.arityOk(len(client.args)) {
+		flagTransaction(client)
+		recordCommandRejected(cmd)
 		client.AddReply(REPLY_WRONG_ARITY)
 		resetClient(client)
 		return
 	}
-	//exec the command
-	cmd.proc(client)
-	//persist the command
-	propagate(cmd, client.args)
+	// the server only accepts SCRIPT KILL while a script is running too long
+	if server.script.timedOut && client.flags&CLIENT_SCRIPT == 0 && !scriptAllowedWhileBusy(client) {
+		recordCommandRejected(cmd)
+		client.AddReply(REPLY_BUSY)
+		resetClient(client)
+		return
+	}
+	// only the pub/sub commands are allowed in the pub/sub mode of RESP2, the messages of RESP3
+	// are pushed out of band
+	if client.flags&CLIENT_PUBSUB != 0 && client.resp == 2 && !allowedInPubsub(cmd.name) {
+		recordCommandRejected(cmd)
+		client.AddReplyErrorf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context", cmd.name)
+		resetClient(client)
+		return
+	}
+	// the replica only accepts the writes from its master
+	if server.masterHost != "" && server.replicaReadOnly && client.flags&CLIENT_MASTER == 0 && cmd.flags&CMD_WRITE != 0 {
+		flagTransaction(client)
+		recordCommandRejected(cmd)
+		client.AddReplyError("-READONLY You can't write against a read only replica.")
+		resetClient(client)
+		return
+	}
+	// the command waits for the end of CLIENT PAUSE, the queued commands of a transaction wait for EXEC
+	if (client.flags&CLIENT_MULTI == 0 || cmd.name == "exec") && clientPauseAffects(client, cmd) {
+		blockPostponeClient(client)
+		resetClient(client)
+		return
+	}
+	// queue the command in a transaction
+	if client.flags&CLIENT_MULTI != 0 && !isTransactionCommand(cmd.name) {
+		queueMultiCommand(client, cmd)
+		client.AddReplyStatus("QUEUED")
+		resetClient(client)
+		return
+	}
+	call(client, cmd)
 	resetClient(client)
+	// the blocked clients are served after the whole script
+	if len(server.readyKeys) > 0 && client.flags&CLIENT_SCRIPT == 0 {
+		handleClientsBlockedOnKeys()
+	}
+}
+
+func allowedInPubsub(name string) bool {
+	switch name {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe", "ping", "quit":
+		return true
+	}
+	return false
 }
 
-//propagate the specified command to AOF
+// call executes the command and then persists it if it's a write command which changed the
+// dataset, unless the command asks not to. The call is failed if the command replied any error
+func call(client *GedisClient, cmd *GedisCommand) {
+	client.flags &= ^CLIENT_PREVENT_PROP
+	dirty := server.dirty
+	errors := server.statTotalErrorReplies
+	start := time.Now()
+	cmd.proc(client)
+	duration := int64(time.Since(start))
+	recordCommandCall(cmd, duration, server.statTotalErrorReplies > errors)
+	if !server.loading {
+		slowlogPushEntryIfNeeded(client, client.args, duration/1000)
+	}
+	server.statNumCommands++
+	if client.flags&CLIENT_PREVENT_PROP == 0 && cmd.flags&CMD_WRITE != 0 && server.dirty > dirty {
+		propagate(cmd, client.args)
+	}
+	client.flags &= ^CLIENT_PREVENT_PROP
+	trackingCommandDone(client, cmd)
+}
+
+//propagate the specified command to AOF and the replicas, the commands executed by EXEC are
+//propagated together once the transaction is done
 func propagate(cmd *GedisCommand, args []*GObj) {
+	if server.loading {
+		return
+	}
+	if server.inTransaction {
+		server.txCommands = append(server.txCommands, propagatedCmd{cmd: cmd, args: args})
+		return
+	}
 	_ = feedAppendOnlyFile(cmd, args)
+	replicationFeedSlaves(cmd, args)
+}
+
+// alsoPropagate persists the specified command besides the executed one, the command which
+// propagates its effects in this way usually sets CLIENT_PREVENT_PROP to skip itself
+func alsoPropagate(args ...*GObj) {
+	// only the name is needed to persist the command
+	propagate(&GedisCommand{name: args[0].StrVal()}, args)
 }
 
 type GedisDB struct {
@@ -367,6 +1142,10 @@ func expireIfNeeded(key *GObj) {
 	}
 	_ = server.db.expire.Delete(key)
 	_ = server.db.data.Delete(key)
+	server.statExpiredKeys++
+	touchWatchedKey(key)
+	trackingInvalidateKey(key)
+	notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key)
 }
 
 func removeExpire(key *GObj) error {
@@ -391,6 +1170,9 @@ var expireCommand CommandProc = func(client *GedisClient) {
 	}
 	expireTime := time.Now().Add(time.Second * time.Duration(sc)).UnixMilli()
 	setExpire(key, strconv.FormatInt(expireTime, 10))
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
+	server.dirty++
 	client.AddReply(REPLY_ONE)
 }
 
@@ -417,7 +1199,7 @@ func getExpire(key *GObj) int64 {
 var ttlCommand CommandProc = func(client *GedisClient) {
 	key := client.args[1]
 	ttl := getExpire(key)
-	client.AddReply(fmt.Sprintf(":%d\r\n", ttl))
+	client.AddReplyLongLong(int64(ttl))
 }
 
 var pexpireatCommand CommandProc = func(client *GedisClient) {
@@ -429,11 +1211,18 @@ var pexpireatCommand CommandProc = func(client *GedisClient) {
 		return
 	}
 	setExpire(key, client.args[2].StrVal())
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
+	server.dirty++
 	client.AddReply(REPLY_ONE)
 }
 
 func main() {
-	err := InitServer()
+	initServerConfig()
+	if err := loadServerArgs(os.Args[1:]); err != nil {
+		panic("invalid arguments: " + err.Error())
+	}
+	err := initServer()
 	if err != nil {
 		panic("init server error: " + err.Error())
 	}
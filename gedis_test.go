@@ -1,17 +1,41 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 )
 
-func fillQuery(client *GedisClient, query string) {
-	byteData := []byte(query)
-	for _, v := range byteData {
-		client.queryBuf[client.queryLen] = v
-		client.queryLen += 1
+var updateGolden = flag.Bool("update", false, "rewrite the golden files with the current replies")
+
+// initTestServer resets the server state without listening on the port
+func initTestServer(t *testing.T) {
+	initServerConfig()
+	var err error
+	server.aeloop, err = NewAeEventLoop()
+	assert.Nil(t, err)
+}
+
+// runCommand executes the command by the client and returns all the replies it got
+func runCommand(client *GedisClient, args ...string) string {
+	client.args = make([]*GObj, len(args))
+	for i, a := range args {
+		client.args[i] = NewObject(STR, a)
 	}
+	ProcessCommand(client)
+	return drainClientReply(client)
+}
+
+func fillQuery(client *GedisClient, query string) {
+	client.makeRoomForQuery(len(query))
+	client.queryLen += copy(client.queryBuf[client.queryLen:], query)
 }
 
 func printArgs(client *GedisClient) {
@@ -62,6 +86,7 @@ func TestHandleInlineBuf(t *testing.T) {
 }
 
 func TestHandleBulkBuf(t *testing.T) {
+	initTestServer(t)
 	client := NewClient(0)
 
 	//legal command
@@ -123,3 +148,217 @@ func TestProcessQueryBuf(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 3, len(client.args))
 }
+
+func TestPipelinedQuery(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	// the empty argument and the commands split at any byte
+	query := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$0\r\n\r\n*2\r\n$3\r\nget\r\n$1\r\nk\r\nget  k\n"
+	for i := 0; i < len(query); i++ {
+		fillQuery(c, query[i:i+1])
+		assert.Nil(t, c.ProcessQueryBuf())
+	}
+	assert.Equal(t, REPLY_OK+"$0\r\n\r\n$0\r\n\r\n", drainClientReply(c))
+	assert.Equal(t, 0, c.qbPos)
+	assert.Equal(t, 0, c.queryLen)
+
+	// the inline arguments can be quoted
+	fillQuery(c, "set k \"hello world\\n\"\r\nget k\r\nget 'k\r\n")
+	assert.Nil(t, c.ProcessQueryBuf())
+	assert.Equal(t, REPLY_OK+"$12\r\nhello world\n\r\n-ERR Protocol error: unbalanced quotes in request\r\n", drainClientReply(c))
+}
+
+func TestBigArgument(t *testing.T) {
+	initTestServer(t)
+	c, peer := newSocketClient(t)
+	value := strings.Repeat("v", 100*1024)
+	query := fmt.Sprintf("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$%d\r\n%s\r\n*2\r\n$3\r\nget\r\n$1\r\nk\r\n", len(value), value)
+
+	// the value is read into the buffer of its size
+	_, err := syscall.Write(peer, []byte(query[:1024]))
+	assert.Nil(t, err)
+	ReadQueryFromClient(server.aeloop, c.nfd, c)
+	assert.Equal(t, len(value)+2, len(c.queryBuf))
+	go func() { _, _ = syscall.Write(peer, []byte(query[1024:])) }()
+	expected := REPLY_OK + "$102400\r\n" + value + "\r\n"
+	reply := ""
+	for len(reply) < len(expected) {
+		ReadQueryFromClient(server.aeloop, c.nfd, c)
+		reply += drainClientReply(c)
+	}
+	assert.Equal(t, expected, reply)
+	assert.Equal(t, GEDIS_IO_BUF, len(c.queryBuf))
+}
+
+func TestQueryLimits(t *testing.T) {
+	initTestServer(t)
+	c, _ := newSocketClient(t)
+	server.protoMaxBulkLen = 10
+	fillQuery(c, "*2\r\n$3\r\nget\r\n$11\r\n")
+	assert.Nil(t, c.ProcessQueryBuf())
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", drainClientReply(c))
+	assert.NotEqual(t, 0, c.flags&CLIENT_CLOSE_AFTER_REPLY)
+
+	c = NewClient(0)
+	fillQuery(c, "*1\r\nget\r\n")
+	assert.Nil(t, c.ProcessQueryBuf())
+	assert.Equal(t, "-ERR Protocol error: expected '$', got 'g'\r\n", drainClientReply(c))
+
+	// the client is closed once the query buffer is too large
+	c, peer := newSocketClient(t)
+	server.clientMaxQueryBufLen = int64(GEDIS_IO_BUF)
+	_, err := syscall.Write(peer, []byte("*1\r\n$"+strings.Repeat("1", GEDIS_IO_BUF)))
+	assert.Nil(t, err)
+	ReadQueryFromClient(server.aeloop, c.nfd, c)
+	ReadQueryFromClient(server.aeloop, c.nfd, c)
+	assert.Nil(t, server.clients[c.nfd])
+}
+
+func TestHello(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	resp2 := fmt.Sprintf("*14\r\n$6\r\nserver\r\n$5\r\ngedis\r\n$7\r\nversion\r\n$5\r\n%s\r\n$5\r\nproto\r\n:2\r\n"+
+		"$2\r\nid\r\n:%d\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n", GEDIS_VERSION, c.id)
+	assert.Equal(t, resp2, runCommand(c, "hello"))
+	assert.Equal(t, 2, c.resp)
+
+	reply := runCommand(c, "hello", "3", "auth", "default", "pass", "setname", "app")
+	assert.Equal(t, "%7\r\n$6\r\nserver\r\n", reply[:16])
+	assert.Contains(t, reply, "$5\r\nproto\r\n:3\r\n")
+	assert.Equal(t, 3, c.resp)
+	assert.Equal(t, "app", c.name)
+
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", runCommand(c, "hello", "4"))
+	assert.Equal(t, "-ERR Protocol version is not an integer or out of range\r\n", runCommand(c, "hello", "x"))
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		runCommand(c, "hello", "2", "auth", "admin", "pass"))
+	assert.Equal(t, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n",
+		runCommand(c, "hello", "2", "setname", "a b"))
+	assert.Equal(t, "-ERR Syntax error in HELLO option 'setname'\r\n", runCommand(c, "hello", "2", "setname"))
+	// the failed HELLO changes nothing
+	assert.Equal(t, 3, c.resp)
+	assert.Equal(t, "app", c.name)
+}
+
+func TestResp3Replies(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	// the RESP2 fallbacks
+	c.AddReplyNull()
+	c.AddReplyNullArray()
+	c.AddReplyMapLen(2)
+	c.AddReplySetLen(2)
+	c.AddReplyPushLen(3)
+	c.AddReplyDouble(1.5)
+	c.AddReplyBool(true)
+	c.AddReplyBigNum("12345678901234567890")
+	c.AddReplyVerbatim("text", "txt")
+	c.AddReplyInt(7)
+	assert.Equal(t, REPLY_NIL+"*-1\r\n*4\r\n*2\r\n*3\r\n$3\r\n1.5\r\n:1\r\n$20\r\n12345678901234567890\r\n$4\r\ntext\r\n:7\r\n",
+		drainClientReply(c))
+
+	c.resp = 3
+	c.AddReplyNull()
+	c.AddReplyNullArray()
+	c.AddReplyMapLen(2)
+	c.AddReplySetLen(2)
+	c.AddReplyPushLen(3)
+	c.AddReplyDouble(1.5)
+	c.AddReplyDouble(math.Inf(-1))
+	c.AddReplyBool(false)
+	c.AddReplyBigNum("12345678901234567890")
+	c.AddReplyVerbatim("text", "txt")
+	c.AddReplyInt(7)
+	assert.Equal(t, "_\r\n_\r\n%2\r\n~2\r\n>3\r\n,1.5\r\n,-inf\r\n#f\r\n(12345678901234567890\r\n=8\r\ntxt:text\r\n:7\r\n",
+		drainClientReply(c))
+
+	// the commands use the RESP3 types
+	runCommand(c, "zadd", "z", "1", "a", "2.5", "b")
+	assert.Equal(t, "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2.5\r\n", runCommand(c, "zrange", "z", "0", "-1", "withscores"))
+	assert.Equal(t, "*2\r\n$1\r\nb\r\n$1\r\na\r\n", runCommand(c, "zrevrange", "z", "0", "-1"))
+	assert.Equal(t, ",3.5\r\n", runCommand(c, "zincrby", "z", "1", "b"))
+	assert.Equal(t, "_\r\n", runCommand(c, "get", "k"))
+}
+
+func TestDeferredLen(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	node := c.AddReplyDeferredLen()
+	c.AddReplyBulkString("a")
+	c.AddReplyInt(1)
+	c.SetDeferredArrayLen(node, 2)
+	assert.Equal(t, "*2\r\n$1\r\na\r\n:1\r\n", drainClientReply(c))
+
+	node = c.AddReplyDeferredLen()
+	c.AddReplyBulkString("k")
+	c.AddReplyBulkString("v")
+	c.SetDeferredMapLen(node, 1)
+	assert.Equal(t, "*2\r\n$1\r\nk\r\n$1\r\nv\r\n", drainClientReply(c))
+
+	// the master gets no placeholder
+	c.flags |= CLIENT_MASTER
+	assert.Nil(t, c.AddReplyDeferredLen())
+	assert.False(t, c.hasPendingReplies())
+}
+
+func TestAddReplyError(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	c.AddReplyError("bad\r\nthing")
+	c.AddReplyErrorf("-WRONGTYPE %s", "kind")
+	c.AddReplyStatus("PONG")
+	c.AddReplyLongLong(-3)
+	assert.Equal(t, "-ERR bad  thing\r\n-WRONGTYPE kind\r\n+PONG\r\n:-3\r\n", drainClientReply(c))
+}
+
+/* The golden files in testdata are the transcripts of commands and the exact bytes replied to
+ * them. A line starting with "> " is a command, whose arguments are split like the inline
+ * commands, and the line after it is its quoted reply, the
+ * other lines are comments. Run "go test -run TestGoldenReplies -update" to rewrite
+ * the replies after an intended change of the protocol. */
+
+func TestGoldenReplies(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.golden"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			runGoldenFile(t, file)
+		})
+	}
+}
+
+func runGoldenFile(t *testing.T, file string) {
+	initTestServer(t)
+	c := NewClient(0)
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !strings.HasPrefix(line, "> ") {
+			out = append(out, line)
+			continue
+		}
+		args, err := splitArgs(line[2:])
+		assert.Nil(t, err, "%s:%d", file, i+1)
+		reply := strconv.Quote(runCommand(c, args...))
+		out = append(out, line, reply)
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\"") {
+			i++
+			if !*updateGolden {
+				assert.Equal(t, lines[i], reply, "%s:%d %s", file, i+1, line)
+			}
+		} else if !*updateGolden {
+			t.Errorf("%s:%d no reply for %s", file, i+1, line)
+		}
+	}
+	if *updateGolden {
+		assert.Nil(t, os.WriteFile(file, []byte(strings.Join(out, "\n")+"\n"), 0644))
+	}
+}
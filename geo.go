@@ -0,0 +1,612 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The geo commands store the points in a sorted set, the score of an element is the 52 bits
+ * geohash of its longitude and latitude. A search finds the hash box of the center and its
+ * 8 neighbors at a precision about the search radius, then every box is a score range of the
+ * skip list and the points in it are filtered by the distance. */
+
+const (
+	GEO_CIRCULAR_TYPE  = 1
+	GEO_RECTANGLE_TYPE = 2
+
+	SORT_NONE = 0
+	SORT_ASC  = 1
+	SORT_DESC = 2
+
+	GEO_ALPHABET = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	REPLY_GEO_UNIT = "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n"
+)
+
+type geoShape struct {
+	shapeType  int
+	xy         [2]float64 // the center
+	conversion float64    // the unit conversion to meters
+	radius     float64
+	width      float64
+	height     float64
+	bounds     [4]float64 // min longitude, min latitude, max longitude, max latitude
+}
+
+type geoPoint struct {
+	longitude float64
+	latitude  float64
+	dist      float64 // in meters
+	score     float64
+	member    *GObj
+}
+
+// extractUnit returns the conversion from the unit to meters, -1 is returned if unknown.
+func extractUnit(unit string) float64 {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1
+	case "km":
+		return 1000
+	case "ft":
+		return 0.3048
+	case "mi":
+		return 1609.34
+	}
+	return -1
+}
+
+// extractLongLat parses the longitude and latitude, false is returned if the error reply was added.
+func extractLongLat(c *GedisClient, lonArg, latArg *GObj) (float64, float64, bool) {
+	lon, err1 := strconv.ParseFloat(lonArg.StrVal(), 64)
+	lat, err2 := strconv.ParseFloat(latArg.StrVal(), 64)
+	if err1 != nil || err2 != nil {
+		c.AddReplyError("value is not a valid float")
+		return 0, 0, false
+	}
+	if lon < GEO_LONG_MIN || lon > GEO_LONG_MAX || lat < GEO_LAT_MIN || lat > GEO_LAT_MAX {
+		c.AddReplyErrorf("invalid longitude,latitude pair %f,%f", lon, lat)
+		return 0, 0, false
+	}
+	return lon, lat, true
+}
+
+// geoScore encodes the point to the score of 52 bits
+func geoScore(lon, lat float64) float64 {
+	hash, _ := geohashEncodeWGS84(lon, lat, GEO_STEP_MAX)
+	return float64(geohashAlign52Bits(hash))
+}
+
+// decodeGeoScore decodes the score to the longitude and latitude
+func decodeGeoScore(score float64) (float64, float64) {
+	return geohashDecodeToLongLatWGS84(GeoHashBits{bits: uint64(score), step: GEO_STEP_MAX})
+}
+
+// geohashBoundingBox computes the bounding box of the shape, the box is a bit larger at the
+// border of the hemisphere.
+func geohashBoundingBox(shape *geoShape) {
+	longitude, latitude := shape.xy[0], shape.xy[1]
+	height := shape.conversion * shape.height / 2
+	width := shape.conversion * shape.width / 2
+	if shape.shapeType == GEO_CIRCULAR_TYPE {
+		height = shape.conversion * shape.radius
+		width = height
+	}
+
+	latDelta := radDeg(height / EARTH_RADIUS_IN_METERS)
+	longDeltaTop := radDeg(width / EARTH_RADIUS_IN_METERS / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / EARTH_RADIUS_IN_METERS / math.Cos(degRad(latitude-latDelta)))
+	/* The directions of the northern and southern hemispheres
+	 * are opposite, so we choice different points as min/max long/lat */
+	if latitude < 0 {
+		shape.bounds[0] = longitude - longDeltaBottom
+		shape.bounds[2] = longitude + longDeltaBottom
+	} else {
+		shape.bounds[0] = longitude - longDeltaTop
+		shape.bounds[2] = longitude + longDeltaTop
+	}
+	shape.bounds[1] = latitude - latDelta
+	shape.bounds[3] = latitude + latDelta
+}
+
+// geohashCalculateAreasByShapeWGS84 returns the hash of the center and the neighbors that
+// covers the shape, the useless neighbors are zeroed.
+func geohashCalculateAreasByShapeWGS84(shape *geoShape) GeoHashRadius {
+	geohashBoundingBox(shape)
+	minLon, minLat, maxLon, maxLat := shape.bounds[0], shape.bounds[1], shape.bounds[2], shape.bounds[3]
+	longitude, latitude := shape.xy[0], shape.xy[1]
+
+	radiusMeters := shape.radius
+	if shape.shapeType == GEO_RECTANGLE_TYPE {
+		radiusMeters = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	radiusMeters *= shape.conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, latitude)
+	longRange, latRange := geohashGetCoordRange()
+	hash, _ := geohashEncode(longRange, latRange, longitude, latitude, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecode(longRange, latRange, hash)
+
+	/* Check if the step is enough at the limits of the covered area.
+	 * Sometimes when the search area is near an edge of the
+	 * area, the estimated step is not small enough, since one of the
+	 * north / south / west / east square is too near to the search area
+	 * to cover everything. */
+	north := geohashDecode(longRange, latRange, neighbors.north)
+	south := geohashDecode(longRange, latRange, neighbors.south)
+	east := geohashDecode(longRange, latRange, neighbors.east)
+	west := geohashDecode(longRange, latRange, neighbors.west)
+	if steps > 1 && (north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon) {
+		steps--
+		hash, _ = geohashEncode(longRange, latRange, longitude, latitude, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecode(longRange, latRange, hash)
+	}
+
+	/* Exclude the search areas that are useless. */
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south = GeoHashBits{}
+			neighbors.southWest = GeoHashBits{}
+			neighbors.southEast = GeoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north = GeoHashBits{}
+			neighbors.northEast = GeoHashBits{}
+			neighbors.northWest = GeoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west = GeoHashBits{}
+			neighbors.southWest = GeoHashBits{}
+			neighbors.northWest = GeoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east = GeoHashBits{}
+			neighbors.southEast = GeoHashBits{}
+			neighbors.northEast = GeoHashBits{}
+		}
+	}
+	return GeoHashRadius{hash: hash, area: area, neighbors: neighbors}
+}
+
+// distanceIfInShape returns the distance in meters from the center if the point is in the shape.
+func (shape *geoShape) distanceIfInShape(lon, lat float64) (float64, bool) {
+	if shape.shapeType == GEO_CIRCULAR_TYPE {
+		dist := geohashGetDistance(shape.xy[0], shape.xy[1], lon, lat)
+		return dist, dist <= shape.radius*shape.conversion
+	}
+	/* latitude distance is less expensive to compute than longitude distance
+	 * so we check first for the latitude condition */
+	if geohashGetLatDistance(lat, shape.xy[1]) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	/* the longitude distance is measured at the latitude of the point */
+	if geohashGetDistance(lon, lat, shape.xy[0], lat) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+	return geohashGetDistance(shape.xy[0], shape.xy[1], lon, lat), true
+}
+
+// geoGetPointsInRange appends the points in the score range [min, max) that are in the shape.
+// limit is the max number of points to collect, 0 means no limit.
+func geoGetPointsInRange(zs *ZSet, min, max float64, shape *geoShape, points []geoPoint, limit int) []geoPoint {
+	r := zRangeSpec{min: min, max: max, minex: false, maxex: true}
+	for ln := zs.SkipList.firstInRange(&r); ln != nil && r.valueLteMax(ln.Score); ln = ln.level[0].forward {
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		lon, lat := decodeGeoScore(ln.Score)
+		dist, ok := shape.distanceIfInShape(lon, lat)
+		if !ok {
+			continue
+		}
+		points = append(points, geoPoint{longitude: lon, latitude: lat, dist: dist, score: ln.Score, member: ln.Member})
+	}
+	return points
+}
+
+// membersOfAllNeighbors collects the points of the center box and the neighbor boxes.
+func membersOfAllNeighbors(zs *ZSet, n GeoHashRadius, shape *geoShape, limit int) []geoPoint {
+	boxes := [9]GeoHashBits{n.hash, n.neighbors.north, n.neighbors.south, n.neighbors.east, n.neighbors.west,
+		n.neighbors.northEast, n.neighbors.northWest, n.neighbors.southEast, n.neighbors.southWest}
+	points := make([]geoPoint, 0)
+	lastProcessed := 0
+	for i, box := range boxes {
+		if box.isZero() {
+			continue
+		}
+		/* When a huge Radius (in the 5000 km range or more) is used,
+		 * adjacent neighbors can be the same, leading to duplicated
+		 * elements. Skip every range which is the same as the one
+		 * processed previously. */
+		if lastProcessed != 0 && box == boxes[lastProcessed] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		min := float64(geohashAlign52Bits(box))
+		box.bits++
+		max := float64(geohashAlign52Bits(box))
+		points = geoGetPointsInRange(zs, min, max, shape, points, limit)
+		lastProcessed = i
+	}
+	return points
+}
+
+func formatGeoFloat(f float64) *GObj {
+	return NewObject(STR, strconv.FormatFloat(f, 'f', 4, 64))
+}
+
+func formatGeoCoord(f float64) *GObj {
+	return NewObject(STR, strconv.FormatFloat(f, 'g', 17, 64))
+}
+
+// lookupGeoRead returns the sorted set stored at the key, ok is false if the error reply was added.
+func lookupGeoRead(c *GedisClient, key *GObj) (zs *ZSet, ok bool) {
+	zobj := LookupKeyRead(key)
+	if zobj == nil {
+		return nil, true
+	}
+	if zobj.Type_ != ZSET {
+		c.AddReply(REPLY_WRONG_TYPE)
+		return nil, false
+	}
+	return zobj.Val_.(*ZSet), true
+}
+
+/* geo command implement */
+
+// GEOADD key [NX|XX] [CH] long lat name [long2 lat2 name2 ... longN latN nameN]
+var geoaddCommand CommandProc = func(c *GedisClient) {
+	xx, nx := false, false
+	longIdx := 2
+	for ; longIdx < len(c.args); longIdx++ {
+		opt := strings.ToLower(c.args[longIdx].StrVal())
+		if opt == "nx" {
+			nx = true
+		} else if opt == "xx" {
+			xx = true
+		} else if opt != "ch" {
+			break
+		}
+	}
+
+	elements := len(c.args) - longIdx
+	if elements == 0 || elements%3 != 0 || (xx && nx) {
+		c.AddReplyError("syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+		return
+	}
+
+	/* The arguments are rewritten as a ZADD command with the same options,
+	 * so the command is propagated as ZADD too. */
+	argv := make([]*GObj, 0, longIdx+elements/3*2)
+	argv = append(argv, NewObject(STR, "zadd"))
+	argv = append(argv, c.args[1:longIdx]...)
+	for i := longIdx; i < len(c.args); i += 3 {
+		lon, lat, ok := extractLongLat(c, c.args[i], c.args[i+1])
+		if !ok {
+			return
+		}
+		score := strconv.FormatFloat(geoScore(lon, lat), 'f', -1, 64)
+		argv = append(argv, NewObject(STR, score), c.args[i+2])
+	}
+
+	c.args = argv
+	zaddGenericCommand(c, ZADD_IN_NONE)
+}
+
+// GEOPOS key ele1 ele2 ... eleN
+var geoposCommand CommandProc = func(c *GedisClient) {
+	zs, ok := lookupGeoRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	c.AddReplyArrayLen(len(c.args) - 2)
+	for i := 2; i < len(c.args); i++ {
+		var score float64
+		exists := false
+		if zs != nil {
+			score, exists = zs.Score(c.args[i])
+		}
+		if !exists {
+			c.AddReplyNullArray()
+			continue
+		}
+		lon, lat := decodeGeoScore(score)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(formatGeoCoord(lon))
+		c.AddReplyBulk(formatGeoCoord(lat))
+	}
+}
+
+// GEODIST key ele1 ele2 [unit]
+var geodistCommand CommandProc = func(c *GedisClient) {
+	toMeter := float64(1)
+	if len(c.args) == 5 {
+		if toMeter = extractUnit(c.args[4].StrVal()); toMeter < 0 {
+			c.AddReply(REPLY_GEO_UNIT)
+			return
+		}
+	} else if len(c.args) > 5 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+
+	zs, ok := lookupGeoRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	if zs == nil {
+		c.AddReplyNull()
+		return
+	}
+	score1, ok1 := zs.Score(c.args[2])
+	score2, ok2 := zs.Score(c.args[3])
+	if !ok1 || !ok2 {
+		c.AddReplyNull()
+		return
+	}
+	lon1, lat1 := decodeGeoScore(score1)
+	lon2, lat2 := decodeGeoScore(score2)
+	c.AddReplyBulk(formatGeoFloat(geohashGetDistance(lon1, lat1, lon2, lat2) / toMeter))
+}
+
+// GEOHASH key ele1 ele2 ... eleN
+var geohashCommand CommandProc = func(c *GedisClient) {
+	zs, ok := lookupGeoRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	c.AddReplyArrayLen(len(c.args) - 2)
+	for i := 2; i < len(c.args); i++ {
+		var score float64
+		exists := false
+		if zs != nil {
+			score, exists = zs.Score(c.args[i])
+		}
+		if !exists {
+			c.AddReplyNull()
+			continue
+		}
+		/* The internal format we use for geocoding is a bit different
+		 * than the standard, since we use as initial latitude range
+		 * -85,85, while the normal geohashing algorithm uses -90,90.
+		 * So we have to decode our position and re-encode using the
+		 * standard ranges in order to output a valid geohash string. */
+		lon, lat := decodeGeoScore(score)
+		hash, _ := geohashEncode(GeoHashRange{-180, 180}, GeoHashRange{-90, 90}, lon, lat, GEO_STEP_MAX)
+		buf := make([]byte, 11)
+		for j := 0; j < 11; j++ {
+			idx := 0
+			/* We have just 52 bits, but the API used to output
+			 * an 11 bytes geohash. For compatibility we assume
+			 * zero. */
+			if j != 10 {
+				idx = int(hash.bits>>(52-(j+1)*5)) & 0x1f
+			}
+			buf[j] = GEO_ALPHABET[idx]
+		}
+		c.AddReplyBulkString(string(buf))
+	}
+}
+
+// geosearchGeneric implements GEOSEARCH and GEOSEARCHSTORE, the arguments start at 'srcIdx'.
+func geosearchGeneric(c *GedisClient, srcIdx int, store bool) {
+	shape := geoShape{}
+	var fromMember *GObj
+	fromLonLat, byRadius, byBox := false, false, false
+	withDist, withHash, withCoords, storeDist, any := false, false, false, false, false
+	sortType, count := SORT_NONE, int64(0)
+
+	args := c.args
+	for i := srcIdx + 1; i < len(args); i++ {
+		remain := len(args) - i - 1
+		opt := strings.ToLower(args[i].StrVal())
+		if opt == "withdist" && !store {
+			withDist = true
+		} else if opt == "withhash" && !store {
+			withHash = true
+		} else if opt == "withcoord" && !store {
+			withCoords = true
+		} else if opt == "storedist" && store {
+			storeDist = true
+		} else if opt == "any" {
+			any = true
+		} else if opt == "asc" {
+			sortType = SORT_ASC
+		} else if opt == "desc" {
+			sortType = SORT_DESC
+		} else if opt == "count" && remain >= 1 {
+			if GetNumber(args[i+1].StrVal(), &count) != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			if count <= 0 {
+				c.AddReplyError("COUNT must be > 0")
+				return
+			}
+			i++
+		} else if opt == "frommember" && remain >= 1 && !fromLonLat {
+			fromMember = args[i+1]
+			i++
+		} else if opt == "fromlonlat" && remain >= 2 && fromMember == nil {
+			lon, lat, ok := extractLongLat(c, args[i+1], args[i+2])
+			if !ok {
+				return
+			}
+			shape.xy = [2]float64{lon, lat}
+			fromLonLat = true
+			i += 2
+		} else if opt == "byradius" && remain >= 2 && !byBox {
+			radius, err := strconv.ParseFloat(args[i+1].StrVal(), 64)
+			if err != nil {
+				c.AddReplyError("need numeric radius")
+				return
+			}
+			if radius < 0 {
+				c.AddReplyError("radius cannot be negative")
+				return
+			}
+			if shape.conversion = extractUnit(args[i+2].StrVal()); shape.conversion < 0 {
+				c.AddReply(REPLY_GEO_UNIT)
+				return
+			}
+			shape.shapeType = GEO_CIRCULAR_TYPE
+			shape.radius = radius
+			byRadius = true
+			i += 2
+		} else if opt == "bybox" && remain >= 3 && !byRadius {
+			width, err1 := strconv.ParseFloat(args[i+1].StrVal(), 64)
+			height, err2 := strconv.ParseFloat(args[i+2].StrVal(), 64)
+			if err1 != nil || err2 != nil {
+				c.AddReplyError("need numeric width and height")
+				return
+			}
+			if width < 0 || height < 0 {
+				c.AddReplyError("height or width cannot be negative")
+				return
+			}
+			if shape.conversion = extractUnit(args[i+3].StrVal()); shape.conversion < 0 {
+				c.AddReply(REPLY_GEO_UNIT)
+				return
+			}
+			shape.shapeType = GEO_RECTANGLE_TYPE
+			shape.width, shape.height = width, height
+			byBox = true
+			i += 3
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+
+	if fromMember == nil && !fromLonLat {
+		c.AddReplyError("exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+		return
+	}
+	if !byRadius && !byBox {
+		c.AddReplyError("exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+		return
+	}
+	if any && count == 0 {
+		c.AddReplyError("the ANY argument requires COUNT argument")
+		return
+	}
+
+	zs, ok := lookupGeoRead(c, args[srcIdx])
+	if !ok {
+		return
+	}
+	if zs == nil {
+		if store {
+			if server.db.data.Delete(args[1]) == nil {
+				notifyKeyspaceEvent(NOTIFY_GENERIC, "del", args[1])
+			}
+			_ = removeExpire(args[1])
+			signalModifiedKey(c, args[1])
+			server.dirty++
+			c.AddReplyInt(0)
+		} else {
+			c.AddReplyArrayLen(0)
+		}
+		return
+	}
+	if fromMember != nil {
+		score, exists := zs.Score(fromMember)
+		if !exists {
+			c.AddReplyError("could not decode requested zset member")
+			return
+		}
+		shape.xy[0], shape.xy[1] = decodeGeoScore(score)
+	}
+
+	/* COUNT without ordering does not make much sense (we need to
+	 * sort in order to return the closest N entries),
+	 * force ASC ordering if COUNT was specified but no sorting was
+	 * requested. Note that this is not needed for ANY option. */
+	if count != 0 && sortType == SORT_NONE && !any {
+		sortType = SORT_ASC
+	}
+
+	limit := 0
+	if any {
+		limit = int(count)
+	}
+	points := membersOfAllNeighbors(zs, geohashCalculateAreasByShapeWGS84(&shape), &shape, limit)
+	if sortType == SORT_ASC {
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	} else if sortType == SORT_DESC {
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if count > 0 && int64(len(points)) > count {
+		points = points[:count]
+	}
+
+	if store {
+		dest := args[1]
+		_ = removeExpire(dest)
+		signalModifiedKey(c, dest)
+		server.dirty++
+		if len(points) == 0 {
+			if server.db.data.Delete(dest) == nil {
+				notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dest)
+			}
+			c.AddReplyInt(0)
+			return
+		}
+		dst := NewZSet()
+		for _, p := range points {
+			score := p.score
+			if storeDist {
+				score = p.dist / shape.conversion
+			}
+			dst.Add(p.member, score, ZADD_IN_NONE)
+		}
+		server.db.data.Set(dest, NewObject(ZSET, dst))
+		notifyKeyspaceEvent(NOTIFY_ZSET, "geosearchstore", dest)
+		c.AddReplyInt(len(points))
+		return
+	}
+
+	optionLen := 0
+	for _, with := range []bool{withDist, withHash, withCoords} {
+		if with {
+			optionLen++
+		}
+	}
+	c.AddReplyArrayLen(len(points))
+	for _, p := range points {
+		if optionLen > 0 {
+			c.AddReplyArrayLen(optionLen + 1)
+		}
+		c.AddReplyBulk(p.member)
+		if withDist {
+			c.AddReplyBulk(formatGeoFloat(p.dist / shape.conversion))
+		}
+		if withHash {
+			c.AddReplyInt(int(p.score))
+		}
+		if withCoords {
+			c.AddReplyArrayLen(2)
+			c.AddReplyBulk(formatGeoCoord(p.longitude))
+			c.AddReplyBulk(formatGeoCoord(p.latitude))
+		}
+	}
+}
+
+// GEOSEARCH key [FROMMEMBER member] [FROMLONLAT long lat] [BYRADIUS radius unit]
+// [BYBOX width height unit] [WITHCOORD] [WITHDIST] [WITHHASH] [COUNT count [ANY]] [ASC|DESC]
+var geosearchCommand CommandProc = func(c *GedisClient) {
+	geosearchGeneric(c, 1, false)
+}
+
+// GEOSEARCHSTORE dest_key src_key [FROMMEMBER member] [FROMLONLAT long lat] [BYRADIUS radius unit]
+// [BYBOX width height unit] [COUNT count [ANY]] [ASC|DESC] [STOREDIST]
+var geosearchstoreCommand CommandProc = func(c *GedisClient) {
+	geosearchGeneric(c, 2, true)
+}
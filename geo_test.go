@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestGeohash(t *testing.T) {
+	assert.Equal(t, uint64(0xb), interleave64(0x1, 0x3))
+	x, y := deinterleave64(0xb)
+	assert.Equal(t, uint32(0x1), x)
+	assert.Equal(t, uint32(0x3), y)
+
+	hash, ok := geohashEncodeWGS84(13.361389, 38.115556, GEO_STEP_MAX)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3479099956230698), geohashAlign52Bits(hash))
+	lon, lat := geohashDecodeToLongLatWGS84(hash)
+	assert.InDelta(t, 13.361389, lon, 0.00001)
+	assert.InDelta(t, 38.115556, lat, 0.00001)
+
+	_, ok = geohashEncodeWGS84(0, 86, GEO_STEP_MAX)
+	assert.False(t, ok)
+
+	// moving to a neighbor and back returns to the same box
+	n := geohashNeighbors(hash)
+	back := geohashNeighbor(n.northEast, -1, -1)
+	assert.Equal(t, hash, back)
+
+	assert.InDelta(t, 166274.1516, geohashGetDistance(13.361389, 38.115556, 15.087269, 37.502669), 0.5)
+	assert.Equal(t, uint8(GEO_STEP_MAX), geohashEstimateStepsByRadius(0, 0))
+}
+
+func TestGeoCommands(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, ":2\r\n", runCommand(c, "geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "geoadd", "Sicily", "nx", "13.361389", "38.115556", "Palermo"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "geoadd", "Sicily", "xx", "13.361389", "38.115556", "Nowhere"))
+	assert.Equal(t, "-ERR invalid longitude,latitude pair 200.000000,10.000000\r\n",
+		runCommand(c, "geoadd", "Sicily", "200", "10", "Nowhere"))
+
+	assert.Equal(t, "$11\r\n166274.1516\r\n", runCommand(c, "geodist", "Sicily", "Palermo", "Catania"))
+	assert.Equal(t, "$8\r\n166.2742\r\n", runCommand(c, "geodist", "Sicily", "Palermo", "Catania", "km"))
+	assert.Equal(t, "$8\r\n103.3182\r\n", runCommand(c, "geodist", "Sicily", "Palermo", "Catania", "mi"))
+	assert.Equal(t, REPLY_NIL, runCommand(c, "geodist", "Sicily", "Palermo", "Nowhere"))
+	assert.Equal(t, REPLY_GEO_UNIT, runCommand(c, "geodist", "Sicily", "Palermo", "Catania", "yard"))
+
+	assert.Equal(t, "*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n"+REPLY_NIL,
+		runCommand(c, "geohash", "Sicily", "Palermo", "Catania", "Nowhere"))
+	assert.Equal(t, "*2\r\n*2\r\n$18\r\n13.361389338970184\r\n$18\r\n38.115556395496299\r\n*-1\r\n",
+		runCommand(c, "geopos", "Sicily", "Palermo", "Nowhere"))
+
+	assert.Equal(t, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"))
+	assert.Equal(t, "*1\r\n$7\r\nCatania\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "100", "km"))
+	assert.Equal(t, "*1\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "desc", "count", "1", "withdist"))
+	assert.Equal(t, "*1\r\n$7\r\nPalermo\r\n",
+		runCommand(c, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "1", "km"))
+
+	runCommand(c, "geoadd", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+	assert.Equal(t, "*4\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n"+
+		"*2\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "asc", "withdist"))
+	assert.Equal(t, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"))
+	// 1.2 degrees of longitude are ~62.6km at the latitude of the point, but ~66.7km at the center
+	runCommand(c, "geoadd", "north", "1.2", "62", "p")
+	assert.Equal(t, "*1\r\n$1\r\np\r\n", runCommand(c, "geosearch", "north", "fromlonlat", "0", "60", "bybox", "130", "500", "km"))
+
+	assert.Equal(t, ":2\r\n",
+		runCommand(c, "geosearchstore", "near", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "storedist"))
+	near := LookupKey(NewObject(STR, "near")).Val_.(*ZSet)
+	dist, _ := near.Score(NewObject(STR, "Catania"))
+	assert.InDelta(t, 56.4413, dist, 0.0001)
+	assert.Equal(t, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n", runCommand(c, "zrange", "near", "0", "-1"))
+
+	assert.Equal(t, "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n",
+		runCommand(c, "geosearch", "Sicily", "byradius", "200", "km", "asc", "withcoord"))
+	assert.Equal(t, "-ERR the ANY argument requires COUNT argument\r\n",
+		runCommand(c, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "any"))
+	assert.Equal(t, REPLY_SYNTAX_ERR,
+		runCommand(c, "geosearchstore", "near", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "withdist"))
+}
+
+func TestGeoPersistence(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	server.aofFileName = "test_geo.aof"
+	defer os.Remove(server.aofFileName)
+
+	runCommand(c, "geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	assert.Nil(t, rewriteAppendOnlyFile(server.aofFileName))
+
+	initTestServer(t)
+	server.aofFileName = "test_geo.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	assert.Equal(t, "$11\r\n166274.1516\r\n", runCommand(NewClient(0), "geodist", "Sicily", "Palermo", "Catania"))
+}
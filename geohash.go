@@ -0,0 +1,255 @@
+package main
+
+import "math"
+
+/* Geohash encodes a longitude/latitude pair into interleaved bits, the latitude bits are stored
+ * in the even positions and the longitude bits in the odd positions. A hash of 26 steps has 52
+ * bits, which can be stored exactly as the score of a sorted set element. */
+
+const (
+	GEO_STEP_MAX = 26 /* 26*2 = 52 bits. */
+
+	/* Limits from EPSG:900913 / EPSG:3785 / OSGEO:41001 */
+	GEO_LAT_MIN  = -85.05112878
+	GEO_LAT_MAX  = 85.05112878
+	GEO_LONG_MIN = -180.0
+	GEO_LONG_MAX = 180.0
+
+	EARTH_RADIUS_IN_METERS = 6372797.560856
+	MERCATOR_MAX           = 20037726.37
+)
+
+type GeoHashBits struct {
+	bits uint64
+	step uint8
+}
+
+type GeoHashRange struct {
+	min, max float64
+}
+
+type GeoHashArea struct {
+	hash      GeoHashBits
+	longitude GeoHashRange
+	latitude  GeoHashRange
+}
+
+type GeoHashNeighbors struct {
+	north, east, west, south                   GeoHashBits
+	northEast, southEast, northWest, southWest GeoHashBits
+}
+
+// GeoHashRadius is the hash of the center and its neighbors which cover the search area
+type GeoHashRadius struct {
+	hash      GeoHashBits
+	area      GeoHashArea
+	neighbors GeoHashNeighbors
+}
+
+func (h GeoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+func degRad(ang float64) float64 {
+	return ang * (math.Pi / 180.0)
+}
+
+func radDeg(ang float64) float64 {
+	return ang / (math.Pi / 180.0)
+}
+
+// interleave64 interleaves the lower bits of x and y, x is in the even positions.
+func interleave64(x, y uint32) uint64 {
+	var res uint64
+	for i := 0; i < 32; i++ {
+		res |= uint64(x>>i&1) << (2 * i)
+		res |= uint64(y>>i&1) << (2*i + 1)
+	}
+	return res
+}
+
+// deinterleave64 is the reverse of interleave64
+func deinterleave64(interleaved uint64) (x, y uint32) {
+	for i := 0; i < 32; i++ {
+		x |= uint32(interleaved>>(2*i)&1) << i
+		y |= uint32(interleaved>>(2*i+1)&1) << i
+	}
+	return x, y
+}
+
+func geohashGetCoordRange() (longRange, latRange GeoHashRange) {
+	return GeoHashRange{GEO_LONG_MIN, GEO_LONG_MAX}, GeoHashRange{GEO_LAT_MIN, GEO_LAT_MAX}
+}
+
+func geohashEncode(longRange, latRange GeoHashRange, longitude, latitude float64, step uint8) (GeoHashBits, bool) {
+	if step > 32 || step == 0 {
+		return GeoHashBits{}, false
+	}
+	/* Return an error when trying to index outside the supported constraints. */
+	if longitude > GEO_LONG_MAX || longitude < GEO_LONG_MIN || latitude > GEO_LAT_MAX || latitude < GEO_LAT_MIN {
+		return GeoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return GeoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	/* convert to fixed point based on the step size */
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return GeoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint8) (GeoHashBits, bool) {
+	longRange, latRange := geohashGetCoordRange()
+	return geohashEncode(longRange, latRange, longitude, latitude, step)
+}
+
+func geohashDecode(longRange, latRange GeoHashRange, hash GeoHashBits) GeoHashArea {
+	ilato, ilono := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	div := float64(uint64(1) << hash.step)
+
+	/* divide by 2**step.
+	 * Then, for 0-1 coordinate, multiply times scale and add
+	 * to the min to get the absolute coordinate. */
+	return GeoHashArea{
+		hash: hash,
+		latitude: GeoHashRange{
+			min: latRange.min + (float64(ilato)/div)*latScale,
+			max: latRange.min + (float64(ilato+1)/div)*latScale,
+		},
+		longitude: GeoHashRange{
+			min: longRange.min + (float64(ilono)/div)*longScale,
+			max: longRange.min + (float64(ilono+1)/div)*longScale,
+		},
+	}
+}
+
+// geohashDecodeAreaToLongLat returns the center of the area
+func geohashDecodeAreaToLongLat(area GeoHashArea) (float64, float64) {
+	longitude := (area.longitude.min + area.longitude.max) / 2
+	latitude := (area.latitude.min + area.latitude.max) / 2
+	longitude = math.Max(GEO_LONG_MIN, math.Min(GEO_LONG_MAX, longitude))
+	latitude = math.Max(GEO_LAT_MIN, math.Min(GEO_LAT_MAX, latitude))
+	return longitude, latitude
+}
+
+// geohashDecodeToLongLatWGS84 decodes a 52 bits hash to the longitude and latitude
+func geohashDecodeToLongLatWGS84(hash GeoHashBits) (float64, float64) {
+	longRange, latRange := geohashGetCoordRange()
+	return geohashDecodeAreaToLongLat(geohashDecode(longRange, latRange, hash))
+}
+
+func geohashMoveX(hash *GeoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *GeoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+	hash.bits = x | y
+}
+
+func geohashNeighbor(hash GeoHashBits, dx, dy int) GeoHashBits {
+	geohashMoveX(&hash, dx)
+	geohashMoveY(&hash, dy)
+	return hash
+}
+
+func geohashNeighbors(hash GeoHashBits) GeoHashNeighbors {
+	return GeoHashNeighbors{
+		east:      geohashNeighbor(hash, 1, 0),
+		west:      geohashNeighbor(hash, -1, 0),
+		south:     geohashNeighbor(hash, 0, -1),
+		north:     geohashNeighbor(hash, 0, 1),
+		northWest: geohashNeighbor(hash, -1, 1),
+		southWest: geohashNeighbor(hash, -1, -1),
+		northEast: geohashNeighbor(hash, 1, 1),
+		southEast: geohashNeighbor(hash, 1, -1),
+	}
+}
+
+// geohashAlign52Bits left shifts the hash to be the score of 52 bits
+func geohashAlign52Bits(hash GeoHashBits) uint64 {
+	return hash.bits << (52 - uint(hash.step)*2)
+}
+
+// geohashEstimateStepsByRadius returns the precision where the area of a hash is about the radius
+func geohashEstimateStepsByRadius(rangeMeters, lat float64) uint8 {
+	if rangeMeters == 0 {
+		return GEO_STEP_MAX
+	}
+	step := 1
+	for rangeMeters < MERCATOR_MAX {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 /* Make sure range is included in most of the base cases. */
+
+	/* Wider range towards the poles... Note: it is possible to do better
+	 * than this approximation by computing the distance between meridians
+	 * at this latitude, but this does the trick for now. */
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	/* Frame to valid range. */
+	if step < 1 {
+		step = 1
+	}
+	if step > GEO_STEP_MAX {
+		step = GEO_STEP_MAX
+	}
+	return uint8(step)
+}
+
+// geohashGetLatDistance returns the distance between two points with the same longitude
+func geohashGetLatDistance(lat1d, lat2d float64) float64 {
+	return EARTH_RADIUS_IN_METERS * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// geohashGetDistance calculates the distance using the haversine great circle distance formula
+func geohashGetDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lon1r := degRad(lon1d)
+	lon2r := degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	/* if v == 0 we can avoid doing expensive math when lons are practically the same */
+	if v == 0.0 {
+		return geohashGetLatDistance(lat1d, lat2d)
+	}
+	lat1r := degRad(lat1d)
+	lat2r := degRad(lat2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * EARTH_RADIUS_IN_METERS * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+/* The HyperLogLog is stored as a string (a bitmap object) with the same layout as Redis:
+ *
+ * +------+---+-----+----------+
+ * | HYLL | E | N/U | Cardin.  |
+ * +------+---+-----+----------+
+ *
+ * The first 4 bytes are the magic "HYLL", E is one byte encoding (dense or sparse),
+ * N/U are three not used bytes, and Cardin. is the 64 bit little endian cached
+ * cardinality, the most significant bit of the last byte is set if the cache is invalid.
+ *
+ * The dense representation packs 16384 registers of 6 bits, the least significant bits
+ * of a register are stored in the first byte. The sparse representation run length encodes
+ * the registers with three opcodes:
+ *   ZERO:  00xxxxxx, a run of 1-64 registers set to 0.
+ *   XZERO: 01xxxxxx yyyyyyyy, a run of 1-16384 registers set to 0.
+ *   VAL:   1vvvvvxx, a run of 1-4 registers set to the value 1-32. */
+
+const (
+	HLL_P             = 14 // the greater is P, the smaller the error
+	HLL_Q             = 64 - HLL_P
+	HLL_REGISTERS     = 1 << HLL_P
+	HLL_P_MASK        = HLL_REGISTERS - 1
+	HLL_BITS          = 6
+	HLL_REGISTER_MAX  = (1 << HLL_BITS) - 1
+	HLL_HDR_SIZE      = 16
+	HLL_DENSE_SIZE    = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8
+	HLL_DENSE         = 0
+	HLL_SPARSE        = 1
+	HLL_MAX_ENCODING  = 1
+	HLL_ALPHA_INF     = 0.721347520444481703680
+	HLL_HASH_SEED     = 0xadc83b19
+	HLL_MAGIC         = "HYLL"
+	HLL_CARD_INVALID  = 1 << 7
+	HLL_CARD_BYTE_MSB = 15
+
+	HLL_SPARSE_XZERO_BIT      = 0x40
+	HLL_SPARSE_VAL_BIT        = 0x80
+	HLL_SPARSE_VAL_MAX_VALUE  = 32
+	HLL_SPARSE_VAL_MAX_LEN    = 4
+	HLL_SPARSE_ZERO_MAX_LEN   = 64
+	HLL_SPARSE_XZERO_MAX_LEN  = 16384
+	HLL_SPARSE_IS_ZERO_MASK   = 0xc0
+	HLL_SPARSE_IS_XZERO_MASK  = 0xc0
+	HLL_SPARSE_ZERO_OPCODE    = 0x00
+	HLL_SPARSE_XZERO_OPCODE   = 0x40
+	HLL_SPARSE_VAL_OPCODE_BIT = 0x80
+
+	REPLY_INVALID_HLL = "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"
+	REPLY_CORRUPT_HLL = "-INVALIDOBJ Corrupted HLL object detected\r\n"
+)
+
+// MurmurHash64A is the 64 bit version of MurmurHash2 used by Redis, the input is read as little endian.
+func MurmurHash64A(key []byte, seed uint64) uint64 {
+	const m uint64 = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register index of the element and the length of the pattern 000..1
+// of the remaining bits, which is the value the register should be set to.
+func hllPatLen(ele []byte) (int, uint8) {
+	hash := MurmurHash64A(ele, HLL_HASH_SEED)
+	index := int(hash & HLL_P_MASK)
+	hash >>= HLL_P
+	hash |= uint64(1) << HLL_Q // make sure the count will be <= Q+1
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+func hllDenseGetRegister(regs []byte, index int) uint8 {
+	b := index * HLL_BITS / 8
+	fb := uint(index * HLL_BITS & 7)
+	val := uint(regs[b]) >> fb
+	if b+1 < len(regs) {
+		val |= uint(regs[b+1]) << (8 - fb)
+	}
+	return uint8(val & HLL_REGISTER_MAX)
+}
+
+func hllDenseSetRegister(regs []byte, index int, val uint8) {
+	b := index * HLL_BITS / 8
+	fb := uint(index * HLL_BITS & 7)
+	v := uint(val)
+	regs[b] &= ^byte(HLL_REGISTER_MAX << fb)
+	regs[b] |= byte(v << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &= ^byte(HLL_REGISTER_MAX >> (8 - fb))
+		regs[b+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// createHLL creates an empty HLL with the sparse encoding.
+func createHLL() *Bitmap {
+	hll := make(Bitmap, HLL_HDR_SIZE, HLL_HDR_SIZE+2)
+	copy(hll, HLL_MAGIC)
+	hll[4] = HLL_SPARSE
+	// a single XZERO opcode covers all the registers
+	runLen := HLL_REGISTERS - 1
+	hll = append(hll, byte(HLL_SPARSE_XZERO_BIT|runLen>>8), byte(runLen&0xff))
+	return &hll
+}
+
+// isHLL checks if the bytes look like a valid HLL, the sparse encoding is validated when decoded.
+func isHLL(b []byte) bool {
+	if len(b) < HLL_HDR_SIZE || string(b[:4]) != HLL_MAGIC || b[4] > HLL_MAX_ENCODING {
+		return false
+	}
+	if b[4] == HLL_DENSE && len(b) != HLL_DENSE_SIZE {
+		return false
+	}
+	return true
+}
+
+func hllInvalidateCache(hll Bitmap) {
+	hll[HLL_CARD_BYTE_MSB] |= HLL_CARD_INVALID
+}
+
+func hllCacheValid(hll Bitmap) bool {
+	return hll[HLL_CARD_BYTE_MSB]&HLL_CARD_INVALID == 0
+}
+
+// hllSparseDecode expands the sparse registers to one byte per register.
+// false is returned if the sparse representation is corrupted.
+func hllSparseDecode(sparse []byte, regs []uint8) bool {
+	idx := 0
+	for i := 0; i < len(sparse); i++ {
+		op := sparse[i]
+		switch {
+		case op&HLL_SPARSE_IS_ZERO_MASK == HLL_SPARSE_ZERO_OPCODE:
+			idx += int(op&0x3f) + 1
+		case op&HLL_SPARSE_IS_XZERO_MASK == HLL_SPARSE_XZERO_OPCODE:
+			if i+1 >= len(sparse) {
+				return false
+			}
+			idx += (int(op&0x3f)<<8 | int(sparse[i+1])) + 1
+			i++
+		default:
+			val, runLen := (op>>2)&0x1f+1, int(op&0x3)+1
+			if idx+runLen > HLL_REGISTERS {
+				return false
+			}
+			for j := 0; j < runLen; j++ {
+				regs[idx+j] = val
+			}
+			idx += runLen
+		}
+		if idx > HLL_REGISTERS {
+			return false
+		}
+	}
+	return idx == HLL_REGISTERS
+}
+
+// hllSparseEncode run length encodes the registers, all the values must be <= 32.
+func hllSparseEncode(regs []uint8) []byte {
+	sparse := make([]byte, 0, 64)
+	for i := 0; i < HLL_REGISTERS; {
+		j := i + 1
+		for j < HLL_REGISTERS && regs[j] == regs[i] {
+			j++
+		}
+		runLen := j - i
+		if regs[i] == 0 {
+			for runLen > 0 {
+				if runLen > HLL_SPARSE_ZERO_MAX_LEN {
+					l := runLen
+					if l > HLL_SPARSE_XZERO_MAX_LEN {
+						l = HLL_SPARSE_XZERO_MAX_LEN
+					}
+					sparse = append(sparse, byte(HLL_SPARSE_XZERO_BIT|(l-1)>>8), byte((l-1)&0xff))
+					runLen -= l
+				} else {
+					sparse = append(sparse, byte(runLen-1))
+					runLen = 0
+				}
+			}
+		} else {
+			for runLen > 0 {
+				l := runLen
+				if l > HLL_SPARSE_VAL_MAX_LEN {
+					l = HLL_SPARSE_VAL_MAX_LEN
+				}
+				sparse = append(sparse, hllSparseVal(regs[i], l))
+				runLen -= l
+			}
+		}
+		i = j
+	}
+	return sparse
+}
+
+// hllRegisters returns one byte per register whatever the encoding is.
+func hllRegisters(hll Bitmap, regs []uint8) bool {
+	if hll[4] == HLL_DENSE {
+		for i := 0; i < HLL_REGISTERS; i++ {
+			regs[i] = hllDenseGetRegister(hll[HLL_HDR_SIZE:], i)
+		}
+		return true
+	}
+	return hllSparseDecode(hll[HLL_HDR_SIZE:], regs)
+}
+
+// hllSparseToDense converts the HLL to the dense encoding, nothing is done if it's already dense.
+func hllSparseToDense(hll *Bitmap) bool {
+	if (*hll)[4] == HLL_DENSE {
+		return true
+	}
+	regs := make([]uint8, HLL_REGISTERS)
+	if !hllSparseDecode((*hll)[HLL_HDR_SIZE:], regs) {
+		return false
+	}
+	dense := make(Bitmap, HLL_DENSE_SIZE)
+	copy(dense, (*hll)[:HLL_HDR_SIZE])
+	dense[4] = HLL_DENSE
+	for i, v := range regs {
+		hllDenseSetRegister(dense[HLL_HDR_SIZE:], i, v)
+	}
+	*hll = dense
+	return true
+}
+
+// hllSet sets the register at 'index' to 'count' if the current value is smaller.
+// It returns 1 if the register was updated, 0 if not, and -1 on corruption.
+func hllSet(hll *Bitmap, index int, count uint8) int {
+	if (*hll)[4] == HLL_DENSE {
+		regs := (*hll)[HLL_HDR_SIZE:]
+		if hllDenseGetRegister(regs, index) >= count {
+			return 0
+		}
+		hllDenseSetRegister(regs, index, count)
+		return 1
+	}
+	return hllSparseSet(hll, index, count)
+}
+
+// hllSparseVal returns a VAL opcode, 'val' must be <= 32 and 'runLen' <= 4.
+func hllSparseVal(val uint8, runLen int) byte {
+	return byte(HLL_SPARSE_VAL_BIT | int(val-1)<<2 | (runLen - 1))
+}
+
+// hllSparseAppendZero appends the ZERO or XZERO opcode for a run of 'runLen' zero registers.
+func hllSparseAppendZero(seq []byte, runLen int) []byte {
+	if runLen == 0 {
+		return seq
+	}
+	if runLen <= HLL_SPARSE_ZERO_MAX_LEN {
+		return append(seq, byte(runLen-1))
+	}
+	return append(seq, byte(HLL_SPARSE_XZERO_BIT|(runLen-1)>>8), byte((runLen-1)&0xff))
+}
+
+// hllSparseSet updates the sparse representation in place like Redis hllSparseSet: the opcode
+// covering the register is split in at most 3 opcodes, then the VAL opcodes around it are merged
+// if they have the same value. The HLL is promoted to dense when the value can't be represented
+// by a VAL opcode or the sparse representation would grow beyond hll-sparse-max-bytes.
+func hllSparseSet(hll *Bitmap, index int, count uint8) int {
+	if count > HLL_SPARSE_VAL_MAX_VALUE {
+		return hllPromoteAndSet(hll, index, count)
+	}
+
+	// find the opcode covering the register, 'first' is the first register it covers
+	sparse := (*hll)[HLL_HDR_SIZE:]
+	first, pos, prev, opLen, span := 0, 0, -1, 0, 0
+	for pos < len(sparse) {
+		op := sparse[pos]
+		switch {
+		case op&HLL_SPARSE_IS_ZERO_MASK == HLL_SPARSE_ZERO_OPCODE:
+			opLen, span = 1, int(op&0x3f)+1
+		case op&HLL_SPARSE_IS_XZERO_MASK == HLL_SPARSE_XZERO_OPCODE:
+			if pos+1 >= len(sparse) {
+				return -1
+			}
+			opLen, span = 2, (int(op&0x3f)<<8|int(sparse[pos+1]))+1
+		default:
+			opLen, span = 1, int(op&0x3)+1
+		}
+		if index < first+span {
+			break
+		}
+		prev = pos
+		first += span
+		pos += opLen
+	}
+	if pos >= len(sparse) {
+		return -1
+	}
+
+	// build the opcodes replacing the current one: the registers before 'index',
+	// the register itself, and the registers after it
+	op := sparse[pos]
+	left, right := index-first, first+span-1-index
+	seq := make([]byte, 0, 5)
+	if op&HLL_SPARSE_VAL_BIT != 0 {
+		old := (op>>2)&0x1f + 1
+		if old >= count {
+			return 0
+		}
+		if left > 0 {
+			seq = append(seq, hllSparseVal(old, left))
+		}
+		seq = append(seq, hllSparseVal(count, 1))
+		if right > 0 {
+			seq = append(seq, hllSparseVal(old, right))
+		}
+	} else {
+		seq = hllSparseAppendZero(seq, left)
+		seq = append(seq, hllSparseVal(count, 1))
+		seq = hllSparseAppendZero(seq, right)
+	}
+
+	grow := len(seq) - opLen
+	if grow > 0 && int64(len(*hll)+grow) > server.hllSparseMaxBytes {
+		return hllPromoteAndSet(hll, index, count)
+	}
+	start, end, size := HLL_HDR_SIZE+pos, HLL_HDR_SIZE+pos+opLen, len(*hll)
+	if grow > 0 {
+		*hll = append(*hll, seq[:grow]...)
+	}
+	h := *hll
+	copy(h[end+grow:], h[end:size])
+	copy(h[start:], seq)
+	h = h[:size+grow]
+
+	// merge the adjacent VAL opcodes with the same value, starting from the previous opcode
+	sparse = h[HLL_HDR_SIZE:]
+	p := 0
+	if prev >= 0 {
+		p = prev
+	}
+	for scan := 0; p < len(sparse) && scan < 5; scan++ {
+		switch {
+		case sparse[p]&HLL_SPARSE_IS_ZERO_MASK == HLL_SPARSE_ZERO_OPCODE:
+			p++
+			continue
+		case sparse[p]&HLL_SPARSE_IS_XZERO_MASK == HLL_SPARSE_XZERO_OPCODE:
+			p += 2
+			continue
+		}
+		if p+1 < len(sparse) && sparse[p+1]&HLL_SPARSE_VAL_BIT != 0 && (sparse[p]>>2)&0x1f == (sparse[p+1]>>2)&0x1f {
+			runLen := int(sparse[p]&0x3) + int(sparse[p+1]&0x3) + 2
+			if runLen <= HLL_SPARSE_VAL_MAX_LEN {
+				sparse[p] = hllSparseVal((sparse[p]>>2)&0x1f+1, runLen)
+				copy(sparse[p+1:], sparse[p+2:])
+				sparse = sparse[:len(sparse)-1]
+				continue
+			}
+		}
+		p++
+	}
+	*hll = h[:HLL_HDR_SIZE+len(sparse)]
+	return 1
+}
+
+// hllPromoteAndSet converts the sparse HLL to dense before setting the register.
+func hllPromoteAndSet(hll *Bitmap, index int, count uint8) int {
+	if !hllSparseToDense(hll) {
+		return -1
+	}
+	return hllSet(hll, index, count)
+}
+
+// hllAdd adds the element to the HLL, the return value is the same as hllSet.
+func hllAdd(hll *Bitmap, ele []byte) int {
+	index, count := hllPatLen(ele)
+	return hllSet(hll, index, count)
+}
+
+// hllSigma helper function sigma as defined in "New cardinality estimation algorithms
+// for HyperLogLog sketches" Otmar Ertl, arXiv:1702.01284
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+// hllTau helper function tau as defined in "New cardinality estimation algorithms
+// for HyperLogLog sketches" Otmar Ertl, arXiv:1702.01284
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllCountRegisters estimates the cardinality from one byte per register.
+func hllCountRegisters(regs []uint8) uint64 {
+	m := float64(HLL_REGISTERS)
+	var histo [64]int
+	for _, v := range regs {
+		histo[v]++
+	}
+
+	z := m * hllTau((m-float64(histo[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(HLL_ALPHA_INF * m * m / z))
+}
+
+// hllCount returns the approximated cardinality, the cached value is used and updated if possible.
+func hllCount(hll Bitmap) (uint64, bool) {
+	if hllCacheValid(hll) {
+		return binary.LittleEndian.Uint64(hll[8:HLL_HDR_SIZE]), true
+	}
+	regs := make([]uint8, HLL_REGISTERS)
+	if !hllRegisters(hll, regs) {
+		return 0, false
+	}
+	card := hllCountRegisters(regs)
+	binary.LittleEndian.PutUint64(hll[8:HLL_HDR_SIZE], card)
+	return card, true
+}
+
+// hllMerge merges the registers of the HLL into 'max' by keeping the greatest value.
+func hllMerge(max []uint8, hll Bitmap) bool {
+	regs := make([]uint8, HLL_REGISTERS)
+	if !hllRegisters(hll, regs) {
+		return false
+	}
+	for i, v := range regs {
+		if v > max[i] {
+			max[i] = v
+		}
+	}
+	return true
+}
+
+// lookupHLLRead returns the bytes of the HLL stored at the key, ok is false if the error reply was added.
+func lookupHLLRead(c *GedisClient, key *GObj) (hll Bitmap, ok bool) {
+	o := LookupKeyRead(key)
+	if o == nil {
+		return nil, true
+	}
+	if (o.Type_ != STR && o.Type_ != BITMAP) || !isHLL(o.BytesVal()) {
+		c.AddReply(REPLY_INVALID_HLL)
+		return nil, false
+	}
+	return o.BytesVal(), true
+}
+
+// lookupHLLOrCreate returns the HLL stored at the key for writing, a new one is created if missing.
+func lookupHLLOrCreate(c *GedisClient, key *GObj) (hll *Bitmap, created bool) {
+	o := LookupKey(key)
+	if o == nil {
+		hll = createHLL()
+		_ = server.db.data.Add(key, NewObject(BITMAP, hll))
+		return hll, true
+	}
+	if (o.Type_ != STR && o.Type_ != BITMAP) || !isHLL(o.BytesVal()) {
+		c.AddReply(REPLY_INVALID_HLL)
+		return nil, false
+	}
+	return lookupBitmapOrCreate(c, key), false
+}
+
+/* HyperLogLog command implement */
+
+// PFADD key [element ...]
+var pfaddCommand CommandProc = func(c *GedisClient) {
+	hll, created := lookupHLLOrCreate(c, c.args[1])
+	if hll == nil {
+		return
+	}
+	updated := 0
+	if created {
+		updated = 1
+	}
+	for i := 2; i < len(c.args); i++ {
+		switch hllAdd(hll, []byte(c.args[i].StrVal())) {
+		case 1:
+			updated = 1
+		case -1:
+			c.AddReply(REPLY_CORRUPT_HLL)
+			return
+		}
+	}
+	if updated == 1 {
+		hllInvalidateCache(*hll)
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
+		notifyKeyspaceEvent(NOTIFY_STRING, "pfadd", c.args[1])
+	}
+	c.AddReplyInt(updated)
+}
+
+// PFCOUNT key [key ...]
+var pfcountCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) == 2 {
+		hll, ok := lookupHLLRead(c, c.args[1])
+		if !ok {
+			return
+		}
+		if hll == nil {
+			c.AddReplyInt(0)
+			return
+		}
+		// update the cached cardinality in place
+		card, ok := hllCount(*lookupBitmapOrCreate(c, c.args[1]))
+		if !ok {
+			c.AddReply(REPLY_CORRUPT_HLL)
+			return
+		}
+		c.AddReplyInt(int(card))
+		return
+	}
+
+	// count the union of multiple HLLs, merge all of them into a temporary one
+	max := make([]uint8, HLL_REGISTERS)
+	for i := 1; i < len(c.args); i++ {
+		hll, ok := lookupHLLRead(c, c.args[i])
+		if !ok {
+			return
+		}
+		if hll == nil {
+			continue
+		}
+		if !hllMerge(max, hll) {
+			c.AddReply(REPLY_CORRUPT_HLL)
+			return
+		}
+	}
+	c.AddReplyInt(int(hllCountRegisters(max)))
+}
+
+// PFMERGE destkey [sourcekey ...]
+var pfmergeCommand CommandProc = func(c *GedisClient) {
+	max := make([]uint8, HLL_REGISTERS)
+	// the destination is merged too, so check all the keys before creating it
+	for i := 1; i < len(c.args); i++ {
+		hll, ok := lookupHLLRead(c, c.args[i])
+		if !ok {
+			return
+		}
+		if hll == nil {
+			continue
+		}
+		if !hllMerge(max, hll) {
+			c.AddReply(REPLY_CORRUPT_HLL)
+			return
+		}
+	}
+
+	hll, _ := lookupHLLOrCreate(c, c.args[1])
+	if hll == nil {
+		return
+	}
+	if !hllSparseToDense(hll) {
+		c.AddReply(REPLY_CORRUPT_HLL)
+		return
+	}
+	for i, v := range max {
+		hllDenseSetRegister((*hll)[HLL_HDR_SIZE:], i, v)
+	}
+	hllInvalidateCache(*hll)
+	signalModifiedKey(c, c.args[1])
+	server.dirty++
+	notifyKeyspaceEvent(NOTIFY_STRING, "pfadd", c.args[1])
+	c.AddReply(REPLY_OK)
+}
+
+// PFDEBUG <subcommand> <key> ... args ...
+// GETREG, DECODE, ENCODING and TODENSE are supported.
+var pfdebugCommand CommandProc = func(c *GedisClient) {
+	subCmd := strings.ToLower(c.args[1].StrVal())
+	hll, ok := lookupHLLRead(c, c.args[2])
+	if !ok {
+		return
+	}
+	if hll == nil {
+		c.AddReplyError("The specified key does not exist")
+		return
+	}
+	hllp := lookupBitmapOrCreate(c, c.args[2])
+
+	switch subCmd {
+	case "getreg":
+		if (*hllp)[4] == HLL_SPARSE {
+			if !hllSparseToDense(hllp) {
+				c.AddReply(REPLY_CORRUPT_HLL)
+				return
+			}
+			server.dirty++
+		}
+		c.AddReplyArrayLen(HLL_REGISTERS)
+		for i := 0; i < HLL_REGISTERS; i++ {
+			c.AddReplyInt(int(hllDenseGetRegister((*hllp)[HLL_HDR_SIZE:], i)))
+		}
+	case "decode":
+		if (*hllp)[4] != HLL_SPARSE {
+			c.AddReplyError("HLL encoding is not sparse")
+			return
+		}
+		var sb strings.Builder
+		sparse := (*hllp)[HLL_HDR_SIZE:]
+		for i := 0; i < len(sparse); i++ {
+			op := sparse[i]
+			switch {
+			case op&HLL_SPARSE_IS_ZERO_MASK == HLL_SPARSE_ZERO_OPCODE:
+				sb.WriteString(fmt.Sprintf("z:%d ", op&0x3f+1))
+			case op&HLL_SPARSE_IS_XZERO_MASK == HLL_SPARSE_XZERO_OPCODE && i+1 < len(sparse):
+				sb.WriteString(fmt.Sprintf("Z:%d ", (int(op&0x3f)<<8|int(sparse[i+1]))+1))
+				i++
+			default:
+				sb.WriteString(fmt.Sprintf("v:%d,%d ", (op>>2)&0x1f+1, op&0x3+1))
+			}
+		}
+		c.AddReplyBulkString(strings.TrimSuffix(sb.String(), " "))
+	case "encoding":
+		if (*hllp)[4] == HLL_DENSE {
+			c.AddReplyStatus("dense")
+		} else {
+			c.AddReplyStatus("sparse")
+		}
+	case "todense":
+		converted := (*hllp)[4] == HLL_SPARSE
+		if !hllSparseToDense(hllp) {
+			c.AddReply(REPLY_CORRUPT_HLL)
+			return
+		}
+		if converted {
+			server.dirty++
+			c.AddReplyInt(1)
+		} else {
+			c.AddReplyInt(0)
+		}
+	default:
+		c.AddReplyErrorf("Unknown PFDEBUG subcommand '%s'", c.args[1].StrVal())
+	}
+}
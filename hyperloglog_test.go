@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestHLLSparseEncode(t *testing.T) {
+	regs := make([]uint8, HLL_REGISTERS)
+	regs[0], regs[1], regs[100], regs[HLL_REGISTERS-1] = 3, 3, 32, 1
+
+	decoded := make([]uint8, HLL_REGISTERS)
+	assert.True(t, hllSparseDecode(hllSparseEncode(regs), decoded))
+	assert.Equal(t, regs, decoded)
+
+	// an empty HLL is a single XZERO opcode
+	hll := createHLL()
+	assert.Equal(t, HLL_HDR_SIZE+2, len(*hll))
+	assert.True(t, isHLL(*hll))
+	assert.False(t, hllSparseDecode([]byte{0x00}, decoded))
+}
+
+func TestHLLSparseSet(t *testing.T) {
+	initTestServer(t)
+	server.hllSparseMaxBytes = 1 << 20
+
+	// splitting a XZERO run and merging the adjacent VAL opcodes
+	hll := createHLL()
+	assert.Equal(t, 1, hllSet(hll, 100, 3))
+	assert.Equal(t, []byte{0x40 | 99>>8, 99, hllSparseVal(3, 1), 0x40 | 16282>>8, 16282 & 0xff}, []byte((*hll)[HLL_HDR_SIZE:]))
+	assert.Equal(t, 1, hllSet(hll, 101, 3))
+	assert.Equal(t, 0, hllSet(hll, 101, 2))
+	assert.Equal(t, []byte{0x40 | 99>>8, 99, hllSparseVal(3, 2), 0x40 | 16281>>8, 16281 & 0xff}, []byte((*hll)[HLL_HDR_SIZE:]))
+
+	r := rand.New(rand.NewSource(1))
+	expected := make([]uint8, HLL_REGISTERS)
+	regs := make([]uint8, HLL_REGISTERS)
+	for i := 0; i < 5000; i++ {
+		index, count := r.Intn(HLL_REGISTERS), uint8(r.Intn(HLL_SPARSE_VAL_MAX_VALUE)+1)
+		if i%2 == 0 {
+			// hit the VAL opcodes too
+			index = r.Intn(256)
+		}
+		updated := 0
+		if expected[index] < count {
+			expected[index] = count
+			updated = 1
+		}
+		assert.Equal(t, updated, hllSet(hll, index, count))
+	}
+	assert.Equal(t, uint8(HLL_SPARSE), (*hll)[4])
+	assert.True(t, hllSparseDecode((*hll)[HLL_HDR_SIZE:], regs))
+	assert.Equal(t, expected, regs)
+
+	// promoted when the value is too big for a VAL opcode or the HLL grows too much
+	assert.Equal(t, 1, hllSet(hll, 7, HLL_SPARSE_VAL_MAX_VALUE+1))
+	assert.Equal(t, uint8(HLL_DENSE), (*hll)[4])
+	expected[7] = HLL_SPARSE_VAL_MAX_VALUE + 1
+	assert.True(t, hllRegisters(*hll, regs))
+	assert.Equal(t, expected, regs)
+
+	server.hllSparseMaxBytes = HLL_HDR_SIZE + 4
+	hll = createHLL()
+	assert.Equal(t, 1, hllSet(hll, 0, 1))
+	assert.Equal(t, uint8(HLL_SPARSE), (*hll)[4])
+	assert.Equal(t, 1, hllSet(hll, 1000, 1))
+	assert.Equal(t, uint8(HLL_DENSE), (*hll)[4])
+	assert.Equal(t, uint8(1), hllDenseGetRegister((*hll)[HLL_HDR_SIZE:], 1000))
+}
+
+func TestHLLDenseRegisters(t *testing.T) {
+	regs := make([]byte, HLL_DENSE_SIZE-HLL_HDR_SIZE)
+	for i := 0; i < HLL_REGISTERS; i++ {
+		hllDenseSetRegister(regs, i, uint8(i%64))
+	}
+	for i := 0; i < HLL_REGISTERS; i++ {
+		assert.Equal(t, uint8(i%64), hllDenseGetRegister(regs, i))
+	}
+}
+
+func TestHLLAccuracy(t *testing.T) {
+	hll := createHLL()
+	added := 0
+	for _, card := range []int{1, 10, 100, 1000, 10000, 100000, 500000} {
+		for ; added < card; added++ {
+			assert.NotEqual(t, -1, hllAdd(hll, []byte(fmt.Sprintf("ele:%d", added))))
+		}
+		hllInvalidateCache(*hll)
+		count, ok := hllCount(*hll)
+		assert.True(t, ok)
+		// the standard error is 0.81%, allow 5 times of it
+		relErr := math.Abs(float64(count)-float64(card)) / float64(card)
+		assert.Less(t, relErr, 0.0405, "cardinality %d estimated as %d", card, count)
+	}
+	assert.Equal(t, byte(HLL_DENSE), (*hll)[4])
+
+	// the cached cardinality is used
+	cached, ok := hllCount(*hll)
+	assert.True(t, ok)
+	hllInvalidateCache(*hll)
+	count, _ := hllCount(*hll)
+	assert.Equal(t, count, cached)
+}
+
+func TestHLLCommands(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, ":1\r\n", runCommand(c, "pfadd", "hll1", "a", "b", "c", "d"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "pfadd", "hll1", "a", "b"))
+	assert.Equal(t, ":4\r\n", runCommand(c, "pfcount", "hll1"))
+	assert.Equal(t, "+sparse\r\n", runCommand(c, "pfdebug", "encoding", "hll1"))
+
+	runCommand(c, "pfadd", "hll2", "c", "d", "e", "f")
+	assert.Equal(t, ":6\r\n", runCommand(c, "pfcount", "hll1", "hll2"))
+	assert.Equal(t, ":4\r\n", runCommand(c, "pfcount", "hll1"))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "pfmerge", "hll3", "hll1", "hll2"))
+	assert.Equal(t, ":6\r\n", runCommand(c, "pfcount", "hll3"))
+	assert.Equal(t, "+dense\r\n", runCommand(c, "pfdebug", "encoding", "hll3"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "pfdebug", "todense", "hll3"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "pfdebug", "todense", "hll2"))
+
+	runCommand(c, "set", "str", "foo")
+	assert.Equal(t, REPLY_INVALID_HLL, runCommand(c, "pfadd", "str", "a"))
+	assert.Equal(t, REPLY_INVALID_HLL, runCommand(c, "pfcount", "hll1", "str"))
+
+	// the HLL is a string, so it can be copied with GET and SET
+	runCommand(c, "pfadd", "hll4", "x", "y")
+	reply := runCommand(c, "get", "hll4")
+	assert.Equal(t, "$", reply[:1])
+	hll, ok := lookupHLLRead(c, NewObject(STR, "hll4"))
+	assert.True(t, ok)
+	runCommand(c, "set", "copy", string(hll))
+	assert.Equal(t, ":2\r\n", runCommand(c, "pfcount", "copy"))
+}
+
+func TestHLLPersistence(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	server.aofFileName = "test_hll.aof"
+	defer os.Remove(server.aofFileName)
+
+	for i := 0; i < 5000; i++ {
+		runCommand(c, "pfadd", "visitors", fmt.Sprintf("user:%d", i))
+	}
+	before := runCommand(c, "pfcount", "visitors")
+	assert.Nil(t, rewriteAppendOnlyFile(server.aofFileName))
+
+	initTestServer(t)
+	server.aofFileName = "test_hll.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	assert.Equal(t, before, runCommand(NewClient(0), "pfcount", "visitors"))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	STATS_METRIC_SAMPLES       = 16   // the samples averaged by instantaneous_ops_per_sec
+	STATS_METRIC_SAMPLE_PERIOD = 100  // ms, the period of the samples taken by ServerCron
+	PEAK_MEMORY_SAMPLE_PERIOD  = 1000 // ms, reading the memory stats stops the world
+)
+
+// the sections of INFO without arguments, "all" and "everything" add the ones which list every
+// command
+var infoDefaultSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cpu", "errorstats", "keyspace"}
+
+var infoAllSections = []string{"commandstats", "latencystats"}
+
+// trackInstantaneousOps samples the commands processed per second since the last sample
+func trackInstantaneousOps(now int64) {
+	elapsed := now - server.statOpsLastTime
+	if elapsed <= 0 {
+		return
+	}
+	ops := (server.statNumCommands - server.statOpsLastCount) * 1000 / elapsed
+	server.statOpsSamples[server.statOpsIdx] = ops
+	server.statOpsIdx = (server.statOpsIdx + 1) % STATS_METRIC_SAMPLES
+	server.statOpsLastTime = now
+	server.statOpsLastCount = server.statNumCommands
+}
+
+func getInstantaneousOps() int64 {
+	var sum int64
+	for _, ops := range server.statOpsSamples {
+		sum += ops
+	}
+	return sum / STATS_METRIC_SAMPLES
+}
+
+// updatePeakMemory samples the memory allocated by the runtime, and returns the stats read
+func updatePeakMemory() *runtime.MemStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.Alloc > server.statPeakMemory {
+		server.statPeakMemory = m.Alloc
+	}
+	return &m
+}
+
+// bytesToHuman formats the bytes like 1.50M
+func bytesToHuman(n uint64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	}
+	return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// genGedisInfoString returns the text of the sections, the default ones if none is specified
+func genGedisInfoString(sections []string) string {
+	if len(sections) == 0 {
+		sections = infoDefaultSections
+	}
+	wanted := make(map[string]bool)
+	for _, s := range sections {
+		switch s = strings.ToLower(s); s {
+		case "all", "everything":
+			for _, d := range infoAllSections {
+				wanted[d] = true
+			}
+			fallthrough
+		case "default":
+			for _, d := range infoDefaultSections {
+				wanted[d] = true
+			}
+		default:
+			wanted[s] = true
+		}
+	}
+
+	var sb strings.Builder
+	section := func(name string) bool {
+		if !wanted[strings.ToLower(name)] {
+			return false
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString("# " + name + "\r\n")
+		return true
+	}
+	field := func(name string, val any) {
+		fmt.Fprintf(&sb, "%s:%v\r\n", name, val)
+	}
+	now := GetTimeMs()
+
+	if section("Server") {
+		uptime := (now - server.startTime) / 1000
+		executable, _ := os.Executable()
+		field("gedis_version", GEDIS_VERSION)
+		field("os", runtime.GOOS+" "+runtime.GOARCH)
+		field("arch_bits", strconv.IntSize)
+		field("go_version", runtime.Version())
+		field("process_id", os.Getpid())
+		field("run_id", server.runID)
+		field("tcp_port", server.port)
+		field("server_time_usec", now*1000)
+		field("uptime_in_seconds", uptime)
+		field("uptime_in_days", uptime/(3600*24))
+		field("executable", executable)
+		field("config_file", server.configFile)
+	}
+
+	if section("Clients") {
+		tracking, pubsub := 0, 0
+		for _, c := range server.clients {
+			if c.flags&CLIENT_TRACKING != 0 {
+				tracking++
+			}
+			if clientSubscriptionsCount(c)+clientShardSubscriptionsCount(c) > 0 {
+				pubsub++
+			}
+		}
+		field("connected_clients", len(server.clients)-len(server.slaves))
+		field("maxclients", server.maxClients)
+		field("blocked_clients", len(server.blockedClients))
+		field("tracking_clients", tracking)
+		field("pubsub_clients", pubsub)
+	}
+
+	if section("Memory") {
+		m := updatePeakMemory()
+		field("used_memory", m.Alloc)
+		field("used_memory_human", bytesToHuman(m.Alloc))
+		field("used_memory_peak", server.statPeakMemory)
+		field("used_memory_peak_human", bytesToHuman(server.statPeakMemory))
+		// the memory obtained from the OS by the Go runtime
+		field("used_memory_sys", m.Sys)
+		field("used_memory_sys_human", bytesToHuman(m.Sys))
+		field("gc_count", m.NumGC)
+	}
+
+	if section("Persistence") {
+		field("loading", boolToInt(server.loading))
+		field("aof_enabled", 1)
+		field("aof_rewrite_in_progress", boolToInt(server.aofRewriteChan != nil))
+		field("aof_current_size", server.aofCurrentSize)
+		field("aof_base_size", server.aofRewriteBaseSize)
+		field("aof_buffer_length", len(server.aofBuf))
+		field("aof_rewrite_buffer_length", len(server.aofRewriteBuf))
+	}
+
+	if section("Stats") {
+		field("total_connections_received", server.statNumConnections)
+		field("total_commands_processed", server.statNumCommands)
+		field("instantaneous_ops_per_sec", getInstantaneousOps())
+		field("rejected_connections", server.statRejectedConn)
+		field("client_output_buffer_limit_disconnections", server.statObufLimitConn)
+		field("expired_keys", server.statExpiredKeys)
+		field("keyspace_hits", server.statKeyspaceHits)
+		field("keyspace_misses", server.statKeyspaceMisses)
+		field("total_error_replies", server.statTotalErrorReplies)
+		field("pubsub_channels", len(server.pubsubChannels))
+		field("pubsub_patterns", len(server.pubsubPatterns))
+		field("pubsubshard_channels", len(server.pubsubShardChannels))
+	}
+
+	if section("Replication") {
+		genReplicationInfoString(&sb, now)
+	}
+
+	if section("CPU") {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
+			field("used_cpu_sys", fmt.Sprintf("%d.%06d", ru.Stime.Sec, ru.Stime.Usec))
+			field("used_cpu_user", fmt.Sprintf("%d.%06d", ru.Utime.Sec, ru.Utime.Usec))
+		}
+	}
+
+	if section("Commandstats") {
+		genCommandStatsString(&sb)
+	}
+
+	if section("Errorstats") {
+		genErrorStatsString(&sb)
+	}
+
+	if section("Latencystats") {
+		genLatencyStatsString(&sb)
+	}
+
+	if section("Keyspace") {
+		if keys := server.db.data.Size(); keys > 0 {
+			fmt.Fprintf(&sb, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", keys, server.db.expire.Size())
+		}
+	}
+	return sb.String()
+}
+
+// genReplicationInfoString writes the fields of the replication section
+func genReplicationInfoString(sb *strings.Builder, now int64) {
+	if server.masterHost == "" {
+		fmt.Fprintf(sb, "role:master\r\nconnected_slaves:%d\r\n", len(server.slaves))
+		for i, slave := range server.slaves {
+			ip, _, err := PeerName(slave.nfd)
+			if err != nil {
+				ip = "?"
+			}
+			lag := int64(-1)
+			if slave.replAckTime != 0 {
+				lag = (now - slave.replAckTime) / 1000
+			}
+			fmt.Fprintf(sb, "slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d\r\n",
+				i, ip, slave.slavePort, slave.replAckOff, lag)
+		}
+	} else {
+		linkUp := server.replState == REPL_STATE_CONNECTED
+		lastIO := int64(-1)
+		if linkUp {
+			lastIO = (now - server.master.lastInteraction) / 1000
+		}
+		var offset int64
+		if server.master != nil {
+			offset = server.master.replOff
+		}
+		status := "down"
+		if linkUp {
+			status = "up"
+		}
+		fmt.Fprintf(sb, "role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_link_status:%s\r\n",
+			server.masterHost, server.masterPort, status)
+		fmt.Fprintf(sb, "master_last_io_seconds_ago:%d\r\nmaster_sync_in_progress:%d\r\n",
+			lastIO, boolToInt(server.replState == REPL_STATE_TRANSFER))
+		fmt.Fprintf(sb, "slave_repl_offset:%d\r\nslave_read_only:%d\r\n", offset, boolToInt(server.replicaReadOnly))
+	}
+	fmt.Fprintf(sb, "master_replid:%s\r\nmaster_replid2:%s\r\n", server.replid, server.replid2)
+	fmt.Fprintf(sb, "master_repl_offset:%d\r\nsecond_repl_offset:%d\r\n", server.masterReplOffset, server.secondReplidOffset)
+	if b := server.replBacklog; b != nil {
+		fmt.Fprintf(sb, "repl_backlog_active:1\r\nrepl_backlog_size:%d\r\nrepl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n",
+			len(b.buf), b.offset, b.histlen)
+	} else {
+		fmt.Fprintf(sb, "repl_backlog_active:0\r\nrepl_backlog_size:%d\r\nrepl_backlog_first_byte_offset:0\r\nrepl_backlog_histlen:0\r\n",
+			server.replBacklogSize)
+	}
+}
+
+// INFO [section [section ...]]
+var infoCommand CommandProc = func(c *GedisClient) {
+	sections := make([]string, len(c.args)-1)
+	for i, arg := range c.args[1:] {
+		sections[i] = arg.StrVal()
+	}
+	c.AddReplyVerbatim(genGedisInfoString(sections), "txt")
+}
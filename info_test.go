@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// infoFields parses the fields of the INFO reply
+func infoFields(t *testing.T, reply string) map[string]string {
+	assert.True(t, strings.HasPrefix(reply, "$"), reply)
+	body := reply[strings.Index(reply, "\r\n")+2 : len(reply)-2]
+	fields := make(map[string]string)
+	for _, line := range strings.Split(body, "\r\n") {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		assert.Equal(t, 2, len(kv), line)
+		fields[kv[0]] = kv[1]
+	}
+	return fields
+}
+
+func TestInfoCommand(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	runCommand(c, "set", "k1", "v")
+	runCommand(c, "set", "k2", "v")
+	runCommand(c, "expire", "k2", "100")
+	runCommand(c, "get", "k1")
+	runCommand(c, "get", "nokey")
+	runCommand(c, "lrange", "nokey", "0", "-1")
+	runCommand(c, "set", "gone", "v")
+	setExpire(NewObject(STR, "gone"), "1")
+	runCommand(c, "get", "gone")
+
+	fields := infoFields(t, runCommand(c, "info"))
+	assert.Equal(t, "8", fields["total_commands_processed"])
+	assert.Equal(t, "1", fields["keyspace_hits"])
+	assert.Equal(t, "3", fields["keyspace_misses"])
+	assert.Equal(t, "1", fields["expired_keys"])
+	assert.Equal(t, "keys=2,expires=1,avg_ttl=0", fields["db0"])
+	assert.Equal(t, "8888", fields["tcp_port"])
+	assert.Equal(t, "master", fields["role"])
+	assert.Equal(t, "0", fields["aof_rewrite_in_progress"])
+	assert.Equal(t, "1", fields["aof_enabled"])
+	assert.Equal(t, 40, len(fields["run_id"]))
+	assert.NotEqual(t, "0", fields["used_memory"])
+	for _, name := range []string{"uptime_in_seconds", "connected_clients", "used_memory_human", "aof_current_size",
+		"aof_base_size", "instantaneous_ops_per_sec", "used_cpu_user", "master_repl_offset"} {
+		assert.Contains(t, fields, name)
+	}
+
+	// the sections are case insensitive, and the unknown ones are empty
+	reply := runCommand(c, "info", "STATS", "keyspace")
+	assert.True(t, strings.Contains(reply, "# Stats\r\n"), reply)
+	assert.True(t, strings.Contains(reply, "\r\n\r\n# Keyspace\r\ndb0:"), reply)
+	assert.False(t, strings.Contains(reply, "# Server"), reply)
+	assert.Equal(t, "$0\r\n\r\n", runCommand(c, "info", "nosuchsection"))
+	assert.Equal(t, len(infoFields(t, runCommand(c, "info", "default"))), len(infoFields(t, runCommand(c, "info"))))
+	assert.True(t, strings.Contains(runCommand(c, "info", "all"), "# Commandstats\r\n"))
+
+	// RESP3 replies the verbatim string
+	c.resp = 3
+	reply = runCommand(c, "info", "server")
+	assert.True(t, strings.HasPrefix(reply, "="), reply)
+	assert.True(t, strings.Contains(reply, "\r\ntxt:# Server\r\n"), reply)
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "resetstat"))
+	assert.Equal(t, int64(0), server.statKeyspaceHits)
+	assert.Equal(t, int64(0), server.statExpiredKeys)
+}
+
+func TestInstantaneousOps(t *testing.T) {
+	initTestServer(t)
+	now := server.statOpsLastTime
+
+	// 50 commands in 100ms is 500 ops/sec
+	server.statNumCommands = 50
+	trackInstantaneousOps(now + 100)
+	assert.Equal(t, int64(500), server.statOpsSamples[0])
+	assert.Equal(t, int64(500/STATS_METRIC_SAMPLES), getInstantaneousOps())
+
+	for i := 1; i <= STATS_METRIC_SAMPLES; i++ {
+		server.statNumCommands += 20
+		trackInstantaneousOps(now + 100 + int64(i)*100)
+	}
+	assert.Equal(t, int64(200), getInstantaneousOps())
+	// no time elapsed, no sample
+	trackInstantaneousOps(server.statOpsLastTime)
+	assert.Equal(t, int64(200), getInstantaneousOps())
+
+	// the peak memory is sampled every second instead of with every sample of the ops
+	assert.Equal(t, uint64(0), server.statPeakMemory)
+	ServerCron(server.aeloop, 0, nil)
+	assert.NotEqual(t, uint64(0), server.statPeakMemory)
+	server.statPeakMemory = 0
+	ServerCron(server.aeloop, 0, nil)
+	assert.Equal(t, uint64(0), server.statPeakMemory)
+}
+
+func TestBytesToHuman(t *testing.T) {
+	assert.Equal(t, "1023B", bytesToHuman(1023))
+	assert.Equal(t, "1.50K", bytesToHuman(1536))
+	assert.Equal(t, "2.00M", bytesToHuman(2<<20))
+	assert.Equal(t, "3.25G", bytesToHuman(3<<30+1<<28))
+}
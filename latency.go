@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The latency monitor samples the events of the server which took at least
+ * latency-monitor-threshold ms, like an iteration of the event loop or the fsync of the AOF.
+ * Every event keeps the latest LATENCY_TS_LEN samples, one per second at most, the max of the
+ * second is kept if there are more of them. */
+
+const (
+	LATENCY_TS_LEN            = 160
+	LATENCY_MONITOR_THRESHOLD = 0 // ms, 0 disables the latency monitor
+
+	LATENCY_GRAPH_COLS = 80
+	LATENCY_GRAPH_ROWS = 4
+)
+
+/* the events */
+const (
+	LATENCY_EVENT_LOOP       = "event-loop"       // the file and time events of an iteration of the event loop
+	LATENCY_AOF_WRITE        = "aof-write"        // the write of the AOF buffer
+	LATENCY_AOF_FSYNC        = "aof-fsync"        // the fsync of the AOF by appendfsync
+	LATENCY_AOF_REWRITE_DONE = "aof-rewrite-done" // the rewrite buffer appended once the background rewrite is done
+	LATENCY_EXPIRE_CYCLE     = "expire-cycle"     // the keys expired by ServerCron
+)
+
+type latencySample struct {
+	time    int64 // unix time in seconds
+	latency int64 // ms
+}
+
+type latencyTimeSeries struct {
+	idx     int   // the slot of the next sample
+	max     int64 // the max latency ever sampled
+	samples [LATENCY_TS_LEN]latencySample
+}
+
+// latest returns the samples in the order of the time
+func (ts *latencyTimeSeries) latest() []latencySample {
+	var samples []latencySample
+	for i := 0; i < LATENCY_TS_LEN; i++ {
+		s := ts.samples[(ts.idx+i)%LATENCY_TS_LEN]
+		if s.time != 0 {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// latencyAddSampleIfNeeded samples the event which took ms if the latency monitor is enabled
+// and it's slow enough
+func latencyAddSampleIfNeeded(event string, ms int64) {
+	if server.latencyMonitorThreshold > 0 && ms >= server.latencyMonitorThreshold {
+		latencyAddSample(event, ms, GetTimeMs()/1000)
+	}
+}
+
+func latencyAddSample(event string, ms int64, now int64) {
+	ts := server.latencyEvents[event]
+	if ts == nil {
+		ts = &latencyTimeSeries{}
+		if server.latencyEvents == nil {
+			server.latencyEvents = make(map[string]*latencyTimeSeries)
+		}
+		server.latencyEvents[event] = ts
+	}
+	if ms > ts.max {
+		ts.max = ms
+	}
+	// only the max of the same second is kept
+	prev := &ts.samples[(ts.idx+LATENCY_TS_LEN-1)%LATENCY_TS_LEN]
+	if prev.time == now {
+		if ms > prev.latency {
+			prev.latency = ms
+		}
+		return
+	}
+	ts.samples[ts.idx] = latencySample{time: now, latency: ms}
+	ts.idx = (ts.idx + 1) % LATENCY_TS_LEN
+}
+
+// latencyResetEvents removes the samples of the events, of all the events if none is specified,
+// and returns the number of the events removed
+func latencyResetEvents(events []string) int {
+	if len(events) == 0 {
+		n := len(server.latencyEvents)
+		server.latencyEvents = make(map[string]*latencyTimeSeries)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := server.latencyEvents[event]; ok {
+			delete(server.latencyEvents, event)
+			n++
+		}
+	}
+	return n
+}
+
+func sortedLatencyEvents() []string {
+	events := make([]string, 0, len(server.latencyEvents))
+	for event := range server.latencyEvents {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// latencyTimeAgo formats the seconds elapsed like 15s, 3m or 2h
+func latencyTimeAgo(secs int64) string {
+	switch {
+	case secs < 60:
+		return strconv.FormatInt(secs, 10) + "s"
+	case secs < 3600:
+		return strconv.FormatInt(secs/60, 10) + "m"
+	case secs < 3600*24:
+		return strconv.FormatInt(secs/3600, 10) + "h"
+	}
+	return strconv.FormatInt(secs/(3600*24), 10) + "d"
+}
+
+// latencyGraph draws the latest samples of the event as a sparkline, the columns are labeled
+// vertically with the time elapsed since the sample
+func latencyGraph(event string, ts *latencyTimeSeries, now int64) string {
+	samples := ts.latest()
+	if len(samples) > LATENCY_GRAPH_COLS {
+		samples = samples[len(samples)-LATENCY_GRAPH_COLS:]
+	}
+	low, high := samples[0].latency, samples[0].latency
+	labels := make([]string, len(samples))
+	for i, s := range samples {
+		if s.latency < low {
+			low = s.latency
+		}
+		if s.latency > high {
+			high = s.latency
+		}
+		labels[i] = latencyTimeAgo(now - s.time)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s - high %d ms, low %d ms (all time high %d ms)\n", event, high, low, ts.max)
+	sb.WriteString(strings.Repeat("-", LATENCY_GRAPH_COLS) + "\n")
+
+	// every row has 3 levels, the full rows below the top of the column are filled by "|"
+	const charset = "_o#"
+	steps := len(charset) * LATENCY_GRAPH_ROWS
+	span := high - low
+	if span == 0 {
+		span = 1
+	}
+	for row := 0; row < LATENCY_GRAPH_ROWS; row++ {
+		for _, s := range samples {
+			step := int((s.latency - low) * int64(steps) / span)
+			if step >= steps {
+				step = steps - 1
+			}
+			level := step - (LATENCY_GRAPH_ROWS-row-1)*len(charset)
+			switch {
+			case level >= len(charset):
+				sb.WriteByte('|')
+			case level >= 0:
+				sb.WriteByte(charset[level])
+			default:
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	for row := 0; ; row++ {
+		var line strings.Builder
+		more := false
+		for _, label := range labels {
+			if row < len(label) {
+				line.WriteByte(label[row])
+				more = true
+			} else {
+				line.WriteByte(' ')
+			}
+		}
+		if !more {
+			break
+		}
+		sb.WriteString(strings.TrimRight(line.String(), " ") + "\n")
+	}
+	return sb.String()
+}
+
+// latencyAdvice tells the possible causes of the spikes of the event
+var latencyAdvice = map[string]string{
+	LATENCY_EVENT_LOOP:       "Check the SLOWLOG and INFO latencystats for the slow commands, the commands over big keys like LRANGE of the whole list block the server.",
+	LATENCY_AOF_WRITE:        "The disk is slow or busy, check whether other processes are writing to the same disk.",
+	LATENCY_AOF_FSYNC:        "The fsync of the disk is slow, consider 'appendfsync everysec' or 'appendfsync no' if some data loss is acceptable.",
+	LATENCY_AOF_REWRITE_DONE: "The writes during the AOF rewrite are appended once it's done, consider lowering auto-aof-rewrite-percentage so the rewrites are smaller.",
+	LATENCY_EXPIRE_CYCLE:     "Many keys expire at the same time, consider adding a random part to the TTL of the keys set together.",
+}
+
+// latencyDoctor reports the spikes of every event in human readable form
+func latencyDoctor() string {
+	if server.latencyMonitorThreshold == 0 {
+		return "The latency monitor is disabled, use CONFIG SET latency-monitor-threshold <milliseconds> to enable it.\n"
+	}
+	if len(server.latencyEvents) == 0 {
+		return "No latency spike was observed since the server started, or since the latest LATENCY RESET.\n"
+	}
+	var sb strings.Builder
+	sb.WriteString("The latency spikes observed:\n\n")
+	for i, event := range sortedLatencyEvents() {
+		ts := server.latencyEvents[event]
+		samples := ts.latest()
+		var sum int64
+		for _, s := range samples {
+			sum += s.latency
+		}
+		avg := sum / int64(len(samples))
+		var dev int64
+		for _, s := range samples {
+			if s.latency > avg {
+				dev += s.latency - avg
+			} else {
+				dev += avg - s.latency
+			}
+		}
+		dev /= int64(len(samples))
+		period := 0.0
+		if len(samples) > 1 {
+			period = float64(samples[len(samples)-1].time-samples[0].time) / float64(len(samples)-1)
+		}
+		fmt.Fprintf(&sb, "%d. %s: %d latency spikes (average %dms, mean deviation %dms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, event, len(samples), avg, dev, period, ts.max)
+		if advice, ok := latencyAdvice[event]; ok {
+			sb.WriteString("   " + advice + "\n")
+		}
+	}
+	return sb.String()
+}
+
+var latencyHelp = []string{
+	"DOCTOR",
+	"    Return a human readable latency analysis report.",
+	"GRAPH <event>",
+	"    Return an ASCII latency graph for the <event> class.",
+	"HISTORY <event>",
+	"    Return time-latency samples for the <event> class.",
+	"LATEST",
+	"    Return the latest latency samples for all events.",
+	"RESET [<event> ...]",
+	"    Reset latency data of one or more <event> classes.",
+	"    (default: reset all data for all event classes)",
+}
+
+// LATENCY LATEST | HISTORY event | RESET [event ...] | DOCTOR | GRAPH event | HELP
+var latencyCommand CommandProc = func(c *GedisClient) {
+	switch sub := strings.ToLower(c.args[1].StrVal()); {
+	case sub == "help" && len(c.args) == 2:
+		c.AddReplyHelp("latency", latencyHelp)
+		return
+	case sub == "latest" && len(c.args) == 2:
+		events := sortedLatencyEvents()
+		c.AddReplyArrayLen(len(events))
+		for _, event := range events {
+			ts := server.latencyEvents[event]
+			last := ts.samples[(ts.idx+LATENCY_TS_LEN-1)%LATENCY_TS_LEN]
+			c.AddReplyArrayLen(4)
+			c.AddReplyBulkString(event)
+			c.AddReplyLongLong(last.time)
+			c.AddReplyLongLong(last.latency)
+			c.AddReplyLongLong(ts.max)
+		}
+		return
+	case sub == "history" && len(c.args) == 3:
+		ts := server.latencyEvents[c.args[2].StrVal()]
+		if ts == nil {
+			c.AddReplyArrayLen(0)
+			return
+		}
+		samples := ts.latest()
+		c.AddReplyArrayLen(len(samples))
+		for _, s := range samples {
+			c.AddReplyArrayLen(2)
+			c.AddReplyLongLong(s.time)
+			c.AddReplyLongLong(s.latency)
+		}
+		return
+	case sub == "reset":
+		events := make([]string, len(c.args)-2)
+		for i, arg := range c.args[2:] {
+			events[i] = arg.StrVal()
+		}
+		c.AddReplyInt(latencyResetEvents(events))
+		return
+	case sub == "doctor" && len(c.args) == 2:
+		c.AddReplyVerbatim(latencyDoctor(), "txt")
+		return
+	case sub == "graph" && len(c.args) == 3:
+		event := c.args[2].StrVal()
+		ts := server.latencyEvents[event]
+		if ts == nil {
+			c.AddReplyErrorf("No samples available for event '%s'", event)
+			return
+		}
+		c.AddReplyVerbatim(latencyGraph(event, ts, GetTimeMs()/1000), "txt")
+		return
+	}
+	c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+}
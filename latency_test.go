@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLatencySamples(t *testing.T) {
+	initTestServer(t)
+
+	// nothing is sampled until the threshold is set
+	latencyAddSampleIfNeeded(LATENCY_EXPIRE_CYCLE, 1000)
+	assert.Equal(t, 0, len(server.latencyEvents))
+	server.latencyMonitorThreshold = 10
+	latencyAddSampleIfNeeded(LATENCY_EXPIRE_CYCLE, 9)
+	assert.Equal(t, 0, len(server.latencyEvents))
+	latencyAddSampleIfNeeded(LATENCY_EXPIRE_CYCLE, 10)
+	assert.Equal(t, 1, len(server.latencyEvents))
+
+	// the max of the same second is kept
+	latencyAddSample("test", 20, 100)
+	latencyAddSample("test", 30, 100)
+	latencyAddSample("test", 25, 100)
+	latencyAddSample("test", 15, 101)
+	ts := server.latencyEvents["test"]
+	assert.Equal(t, []latencySample{{100, 30}, {101, 15}}, ts.latest())
+	assert.Equal(t, int64(30), ts.max)
+
+	// the oldest samples are dropped
+	for i := int64(0); i < LATENCY_TS_LEN; i++ {
+		latencyAddSample("test", i, 200+i)
+	}
+	samples := ts.latest()
+	assert.Equal(t, LATENCY_TS_LEN, len(samples))
+	assert.Equal(t, latencySample{200, 0}, samples[0])
+	assert.Equal(t, int64(LATENCY_TS_LEN-1), ts.max)
+
+	assert.Equal(t, 0, latencyResetEvents([]string{"nosuchevent"}))
+	assert.Equal(t, 1, latencyResetEvents([]string{"test", "test"}))
+	assert.Equal(t, 1, latencyResetEvents(nil))
+	assert.Equal(t, 0, len(server.latencyEvents))
+}
+
+func TestLatencyGraph(t *testing.T) {
+	initTestServer(t)
+	latencyAddSample("test", 10, 1000)
+	latencyAddSample("test", 40, 1010)
+	latencyAddSample("test", 20, 1020)
+	graph := latencyGraph("test", server.latencyEvents["test"], 1030)
+	lines := []string{
+		"test - high 40 ms, low 10 ms (all time high 40 ms)",
+		strings.Repeat("-", LATENCY_GRAPH_COLS),
+		" # ",
+		" | ",
+		" |o",
+		"_||",
+		"321",
+		"000",
+		"sss",
+	}
+	assert.Equal(t, strings.Join(lines, "\n")+"\n", graph)
+}
+
+func TestLatencyCommand(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, "*0\r\n", runCommand(c, "latency", "latest"))
+	assert.True(t, strings.Contains(runCommand(c, "latency", "doctor"), "latency monitor is disabled"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "latency-monitor-threshold", "5"))
+	assert.True(t, strings.Contains(runCommand(c, "latency", "doctor"), "No latency spike"))
+
+	latencyAddSample(LATENCY_AOF_FSYNC, 8, 1000)
+	latencyAddSample(LATENCY_AOF_FSYNC, 50, 1002)
+	latencyAddSample(LATENCY_AOF_WRITE, 6, 1001)
+	assert.Equal(t, "*2\r\n*4\r\n$9\r\naof-fsync\r\n:1002\r\n:50\r\n:50\r\n*4\r\n$9\r\naof-write\r\n:1001\r\n:6\r\n:6\r\n",
+		runCommand(c, "latency", "latest"))
+	assert.Equal(t, "*2\r\n*2\r\n:1000\r\n:8\r\n*2\r\n:1002\r\n:50\r\n", runCommand(c, "latency", "history", "aof-fsync"))
+	assert.Equal(t, "*0\r\n", runCommand(c, "latency", "history", "nosuchevent"))
+
+	reply := runCommand(c, "latency", "doctor")
+	assert.True(t, strings.Contains(reply, "1. aof-fsync: 2 latency spikes (average 29ms, mean deviation 21ms, period 2.00 sec). Worst all time event 50ms.\n"), reply)
+	assert.True(t, strings.Contains(reply, "appendfsync everysec"), reply)
+	assert.True(t, strings.Contains(runCommand(c, "latency", "graph", "aof-fsync"), "aof-fsync - high 50 ms, low 8 ms"))
+	assert.Equal(t, "-ERR No samples available for event 'nosuchevent'\r\n", runCommand(c, "latency", "graph", "nosuchevent"))
+
+	assert.Equal(t, ":1\r\n", runCommand(c, "latency", "reset", "aof-write"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "latency", "reset"))
+	assert.Equal(t, "*0\r\n", runCommand(c, "latency", "latest"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'history'\r\n", runCommand(c, "latency", "history"))
+	assert.True(t, strings.HasPrefix(runCommand(c, "latency", "help"), "*14\r\n+LATENCY <subcommand>"))
+}
@@ -219,26 +219,46 @@ func pushGenericCommand(c *GedisClient, where int) {
 		push++
 	}
 	if push > 0 {
-		c.AddReplyInt(push)
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
+		if where == LIST_HEAD {
+			notifyKeyspaceEvent(NOTIFY_LIST, "lpush", c.args[1])
+		} else {
+			notifyKeyspaceEvent(NOTIFY_LIST, "rpush", c.args[1])
+		}
 	}
+	c.AddReplyInt(l.Length())
 }
 
 func popGenericCommand(c *GedisClient, where int) {
 	lobj := LookupKey(c.args[1])
 
-	if lobj == nil || lobj.Type_ != LIST {
+	if lobj == nil {
+		c.AddReplyNull()
+		return
+	}
+	if lobj.Type_ != LIST {
+		c.AddReply(REPLY_WRONG_TYPE)
 		return
 	}
 
 	l := lobj.Val_.(*List)
 	val := l.TypePop(where)
 	if val == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReplyNull()
 	} else {
-		c.AddReplyStr(val)
+		c.AddReplyBulk(val)
+		if where == LIST_HEAD {
+			notifyKeyspaceEvent(NOTIFY_LIST, "lpop", c.args[1])
+		} else {
+			notifyKeyspaceEvent(NOTIFY_LIST, "rpop", c.args[1])
+		}
 		if l.length == 0 {
-			_ = server.db.data.Delete(lobj)
+			_ = server.db.data.Delete(c.args[1])
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.args[1])
 		}
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
 	}
 }
 
@@ -264,9 +284,9 @@ var lrangeCommand CommandProc = func(c *GedisClient) {
 		c.AddReply(REPLY_INVALID_VALUE)
 		return
 	}
-	lobj := LookupKey(c.args[1])
+	lobj := LookupKeyRead(c.args[1])
 	if lobj == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReplyArrayLen(0)
 		return
 	}
 	if lobj.Type_ != LIST {
@@ -288,7 +308,7 @@ var lrangeCommand CommandProc = func(c *GedisClient) {
 	/* Invariant: start >= 0, so this test will be true when end < 0.
 	 * The range is empty when start > end or start >= length. */
 	if start > end || start >= llen {
-		c.AddReply(REPLY_INVALID_VALUE)
+		c.AddReplyArrayLen(0)
 		return
 	}
 	if end >= llen {
@@ -296,19 +316,20 @@ var lrangeCommand CommandProc = func(c *GedisClient) {
 	}
 	rangeLen := end - start + 1
 
+	c.AddReplyArrayLen(int(rangeLen))
 	ln := l.Index(start)
 	for rangeLen > 0 {
-		c.AddReplyStr(ln.Val)
+		c.AddReplyBulk(ln.Val)
 		ln = ln.next
 		rangeLen--
 	}
 }
 
 var llenCommand CommandProc = func(c *GedisClient) {
-	lobj := LookupKey(c.args[1])
+	lobj := LookupKeyRead(c.args[1])
 
 	if lobj == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReply(REPLY_ZERO)
 		return
 	}
 	if lobj.Type_ != LIST {
@@ -323,7 +344,7 @@ var lremCommand CommandProc = func(c *GedisClient) {
 	lobj := LookupKey(c.args[1])
 
 	if lobj == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReply(REPLY_ZERO)
 		return
 	}
 	if lobj.Type_ != LIST {
@@ -341,15 +362,15 @@ var lremCommand CommandProc = func(c *GedisClient) {
 	var li *ListIterator
 	if toRemove < 0 {
 		toRemove = -toRemove
-		li = l.TypeInitIterator(-1, LIST_HEAD)
+		li = l.TypeInitIterator(-1, LIST_TAIL)
 	} else {
-		li = l.TypeInitIterator(0, LIST_TAIL)
+		li = l.TypeInitIterator(0, LIST_HEAD)
 	}
 
-	var entry *ListEntry
+	var entry ListEntry
 	obj := c.args[3]
 	removed := int64(0)
-	for li.Next(entry) > 0 {
+	for li.Next(&entry) > 0 {
 		if EqualStr(entry.ln.Val, obj) {
 			l.DelNode(entry.ln)
 			removed++
@@ -359,8 +380,16 @@ var lremCommand CommandProc = func(c *GedisClient) {
 		}
 	}
 
+	if removed > 0 {
+		notifyKeyspaceEvent(NOTIFY_LIST, "lrem", c.args[1])
+	}
 	if l.Length() == 0 {
 		_ = server.db.data.Delete(c.args[1])
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.args[1])
+	}
+	if removed > 0 {
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
 	}
 
 	c.AddReplyInt(int(removed))
@@ -368,10 +397,10 @@ var lremCommand CommandProc = func(c *GedisClient) {
 
 var lindexCommand CommandProc = func(c *GedisClient) {
 	key := c.args[1]
-	lobj := LookupKey(key)
+	lobj := LookupKeyRead(key)
 
 	if lobj == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReplyNull()
 		return
 	}
 	if lobj.Type_ != LIST {
@@ -379,7 +408,7 @@ var lindexCommand CommandProc = func(c *GedisClient) {
 		return
 	}
 	var index int64
-	if GetNumber(key.StrVal(), &index) != nil {
+	if GetNumber(c.args[2].StrVal(), &index) != nil {
 		c.AddReply(REPLY_INVALID_VALUE)
 		return
 	}
@@ -387,8 +416,8 @@ var lindexCommand CommandProc = func(c *GedisClient) {
 
 	ln := l.Index(index)
 	if ln != nil {
-		c.AddReplyStr(ln.Val)
+		c.AddReplyBulk(ln.Val)
 	} else {
-		c.AddReply(REPLY_NIL)
+		c.AddReplyNull()
 	}
 }
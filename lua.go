@@ -0,0 +1,856 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* The scripts are written in a subset of Lua 5.1, which is parsed into a syntax tree and
+ * evaluated directly by luaeval.go. The subset has the statements, expressions, closures
+ * and tables of Lua, but no varargs, metatables, coroutines or string patterns. */
+
+type luaTokenType int8
+
+const (
+	LUA_TK_EOF     luaTokenType = 0
+	LUA_TK_NAME    luaTokenType = 1
+	LUA_TK_STRING  luaTokenType = 2
+	LUA_TK_NUMBER  luaTokenType = 3
+	LUA_TK_KEYWORD luaTokenType = 4
+	LUA_TK_OP      luaTokenType = 5 // the operators and the punctuations
+)
+
+type luaToken struct {
+	typ  luaTokenType
+	text string // the name, keyword, operator or the value of string
+	num  float64
+	line int
+}
+
+var luaKeywords = map[string]struct{}{
+	"and": {}, "break": {}, "do": {}, "else": {}, "elseif": {}, "end": {}, "false": {}, "for": {},
+	"function": {}, "if": {}, "in": {}, "local": {}, "nil": {}, "not": {}, "or": {}, "repeat": {},
+	"return": {}, "then": {}, "true": {}, "until": {}, "while": {},
+}
+
+// the operators of more than one character, the longer ones first
+var luaLongOps = []string{"...", "..", "==", "~=", "<=", ">="}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func luaSyntaxError(line int, format string, args ...any) error {
+	return fmt.Errorf("user_script:%d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// luaLex splits the source into tokens, the last one is always LUA_TK_EOF
+func luaLex(src string) ([]luaToken, error) {
+	lx := &luaLexer{src: src, line: 1}
+	var tokens []luaToken
+	for {
+		tk, err := lx.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tk)
+		if tk.typ == LUA_TK_EOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *luaLexer) next() (luaToken, error) {
+	if err := lx.skipSpaceAndComments(); err != nil {
+		return luaToken{}, err
+	}
+	if lx.pos >= len(lx.src) {
+		return luaToken{typ: LUA_TK_EOF, text: "<eof>", line: lx.line}, nil
+	}
+	ch := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(ch):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isLuaNameStart(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		name := lx.src[start:lx.pos]
+		if _, ok := luaKeywords[name]; ok {
+			return luaToken{typ: LUA_TK_KEYWORD, text: name, line: lx.line}, nil
+		}
+		return luaToken{typ: LUA_TK_NAME, text: name, line: lx.line}, nil
+	case isDigit(ch) || (ch == '.' && lx.pos+1 < len(lx.src) && isDigit(lx.src[lx.pos+1])):
+		return lx.readNumber()
+	case ch == '"' || ch == '\'':
+		return lx.readString(ch)
+	case ch == '[':
+		if level := lx.longBracketLevel(); level >= 0 {
+			line := lx.line
+			s, err := lx.readLongString(level)
+			if err != nil {
+				return luaToken{}, err
+			}
+			return luaToken{typ: LUA_TK_STRING, text: s, line: line}, nil
+		}
+	}
+	for _, op := range luaLongOps {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return luaToken{typ: LUA_TK_OP, text: op, line: lx.line}, nil
+		}
+	}
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", ch) >= 0 {
+		lx.pos++
+		return luaToken{typ: LUA_TK_OP, text: string(ch), line: lx.line}, nil
+	}
+	return luaToken{}, luaSyntaxError(lx.line, "unexpected symbol near '%c'", ch)
+}
+
+func (lx *luaLexer) skipSpaceAndComments() error {
+	for lx.pos < len(lx.src) {
+		ch := lx.src[lx.pos]
+		if ch == '\n' {
+			lx.line++
+			lx.pos++
+		} else if ch == ' ' || ch == '\t' || ch == '\r' || ch == '\f' || ch == '\v' {
+			lx.pos++
+		} else if strings.HasPrefix(lx.src[lx.pos:], "--") {
+			lx.pos += 2
+			if lx.pos < len(lx.src) && lx.src[lx.pos] == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					if _, err := lx.readLongString(level); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		} else {
+			break
+		}
+	}
+	return nil
+}
+
+// longBracketLevel returns the level of the long bracket like [==[ at the position, or -1
+func (lx *luaLexer) longBracketLevel() int {
+	p := lx.pos + 1
+	for p < len(lx.src) && lx.src[p] == '=' {
+		p++
+	}
+	if p < len(lx.src) && lx.src[p] == '[' {
+		return p - lx.pos - 1
+	}
+	return -1
+}
+
+func (lx *luaLexer) readLongString(level int) (string, error) {
+	line := lx.line
+	lx.pos += level + 2
+	// the first newline is skipped
+	if strings.HasPrefix(lx.src[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if lx.pos < len(lx.src) && lx.src[lx.pos] == '\n' {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		return "", luaSyntaxError(line, "unfinished long string near '<eof>'")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
+
+func (lx *luaLexer) readNumber() (luaToken, error) {
+	start := lx.pos
+	if strings.HasPrefix(lx.src[lx.pos:], "0x") || strings.HasPrefix(lx.src[lx.pos:], "0X") {
+		lx.pos += 2
+	}
+	for lx.pos < len(lx.src) {
+		ch := lx.src[lx.pos]
+		if (ch == '+' || ch == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') {
+			lx.pos++
+		} else if isLuaNameStart(ch) || isDigit(ch) || ch == '.' {
+			lx.pos++
+		} else {
+			break
+		}
+	}
+	text := lx.src[start:lx.pos]
+	num, ok := luaStr2Number(text)
+	if !ok {
+		return luaToken{}, luaSyntaxError(lx.line, "malformed number near '%s'", text)
+	}
+	return luaToken{typ: LUA_TK_NUMBER, text: text, num: num, line: lx.line}, nil
+}
+
+func (lx *luaLexer) readString(quote byte) (luaToken, error) {
+	line := lx.line
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) || lx.src[lx.pos] == '\n' {
+			return luaToken{}, luaSyntaxError(line, "unfinished string")
+		}
+		ch := lx.src[lx.pos]
+		if ch == quote {
+			lx.pos++
+			break
+		}
+		if ch != '\\' {
+			sb.WriteByte(ch)
+			lx.pos++
+			continue
+		}
+		lx.pos++
+		if lx.pos >= len(lx.src) {
+			return luaToken{}, luaSyntaxError(line, "unfinished string")
+		}
+		ch = lx.src[lx.pos]
+		lx.pos++
+		switch ch {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\n':
+			sb.WriteByte('\n')
+			lx.line++
+		case '\\', '"', '\'':
+			sb.WriteByte(ch)
+		default:
+			if !isDigit(ch) {
+				return luaToken{}, luaSyntaxError(line, "invalid escape sequence '\\%c'", ch)
+			}
+			// \ddd, up to 3 decimal digits
+			n := int(ch - '0')
+			for i := 0; i < 2 && lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]); i++ {
+				n = n*10 + int(lx.src[lx.pos]-'0')
+				lx.pos++
+			}
+			if n > 255 {
+				return luaToken{}, luaSyntaxError(line, "escape sequence too large")
+			}
+			sb.WriteByte(byte(n))
+		}
+	}
+	return luaToken{typ: LUA_TK_STRING, text: sb.String(), line: line}, nil
+}
+
+func isLuaNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// luaStr2Number converts the string to number like Lua, the decimal and the hexadecimal
+// integer are accepted, with the leading and trailing spaces
+func luaStr2Number(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	digits := s
+	if digits[0] == '-' || digits[0] == '+' {
+		neg = digits[0] == '-'
+		digits = digits[1:]
+	}
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		n, err := strconv.ParseUint(digits[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	// strconv accepts more forms than Lua, like "inf" and "1_000"
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte("0123456789+-.eE", s[i]) < 0 {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+/* syntax tree */
+
+type luaExpr interface{}
+
+type luaConstExpr struct {
+	val luaValue
+}
+
+type luaNameExpr struct {
+	name string
+}
+
+type luaIndexExpr struct {
+	obj, key luaExpr
+}
+
+type luaCallExpr struct {
+	fn     luaExpr
+	method string // obj:method(args) if not empty
+	args   []luaExpr
+	line   int
+}
+
+type luaFuncExpr struct {
+	name   string // for the error messages
+	params []string
+	body   *luaBlock
+}
+
+type luaBinExpr struct {
+	op   string
+	l, r luaExpr
+}
+
+type luaUnExpr struct {
+	op string
+	e  luaExpr
+}
+
+// luaParenExpr truncates the results of the call to one value
+type luaParenExpr struct {
+	e luaExpr
+}
+
+type luaTableField struct {
+	key luaExpr // nil for the positional field
+	val luaExpr
+}
+
+type luaTableExpr struct {
+	fields []luaTableField
+}
+
+type luaStmt interface{}
+
+type luaBlock struct {
+	stmts []luaStmt
+	lines []int // the line of every statement
+}
+
+type luaLocalStmt struct {
+	names []string
+	exprs []luaExpr
+}
+
+type luaAssignStmt struct {
+	targets []luaExpr // luaNameExpr or luaIndexExpr
+	exprs   []luaExpr
+}
+
+type luaCallStmt struct {
+	call *luaCallExpr
+}
+
+type luaDoStmt struct {
+	body *luaBlock
+}
+
+type luaWhileStmt struct {
+	cond luaExpr
+	body *luaBlock
+}
+
+type luaRepeatStmt struct {
+	body *luaBlock
+	cond luaExpr
+}
+
+type luaIfStmt struct {
+	conds     []luaExpr
+	blocks    []*luaBlock
+	elseBlock *luaBlock
+}
+
+type luaNumForStmt struct {
+	name               string
+	start, limit, step luaExpr
+	body               *luaBlock
+}
+
+type luaGenForStmt struct {
+	names []string
+	exprs []luaExpr
+	body  *luaBlock
+}
+
+type luaLocalFunctionStmt struct {
+	name string
+	fn   *luaFuncExpr
+}
+
+type luaReturnStmt struct {
+	exprs []luaExpr
+}
+
+type luaBreakStmt struct{}
+
+/* parser */
+
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+}
+
+// luaCompile parses the script into a function without parameters
+func luaCompile(src string) (fn *luaFuncExpr, err error) {
+	tokens, err := luaLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &luaParser{tokens: tokens}
+	// the syntax errors are raised by panic to unwind the recursive descent
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(luaParseError)
+			if !ok {
+				panic(r)
+			}
+			fn, err = nil, perr.err
+		}
+	}()
+	body := p.block()
+	if p.peek().typ != LUA_TK_EOF {
+		p.errorExpected("<eof>")
+	}
+	return &luaFuncExpr{name: "main chunk", body: body}, nil
+}
+
+type luaParseError struct {
+	err error
+}
+
+func (p *luaParser) peek() luaToken {
+	return p.tokens[p.pos]
+}
+
+func (p *luaParser) advance() luaToken {
+	tk := p.tokens[p.pos]
+	if tk.typ != LUA_TK_EOF {
+		p.pos++
+	}
+	return tk
+}
+
+// check reports whether the next token is the keyword or the operator
+func (p *luaParser) check(text string) bool {
+	tk := p.peek()
+	return (tk.typ == LUA_TK_KEYWORD || tk.typ == LUA_TK_OP) && tk.text == text
+}
+
+func (p *luaParser) accept(text string) bool {
+	if p.check(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(text string) {
+	if !p.accept(text) {
+		p.errorExpected("'" + text + "'")
+	}
+}
+
+func (p *luaParser) errorExpected(what string) {
+	tk := p.peek()
+	panic(luaParseError{luaSyntaxError(tk.line, "%s expected near '%s'", what, tk.text)})
+}
+
+func (p *luaParser) expectName() string {
+	tk := p.peek()
+	if tk.typ != LUA_TK_NAME {
+		p.errorExpected("<name>")
+	}
+	p.advance()
+	return tk.text
+}
+
+func (p *luaParser) blockFollows() bool {
+	tk := p.peek()
+	if tk.typ == LUA_TK_EOF {
+		return true
+	}
+	if tk.typ != LUA_TK_KEYWORD {
+		return false
+	}
+	switch tk.text {
+	case "else", "elseif", "end", "until":
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) block() *luaBlock {
+	b := &luaBlock{}
+	for !p.blockFollows() {
+		line := p.peek().line
+		if p.check("return") || p.check("break") {
+			b.stmts = append(b.stmts, p.lastStatement())
+			b.lines = append(b.lines, line)
+			p.accept(";")
+			break
+		}
+		b.stmts = append(b.stmts, p.statement())
+		b.lines = append(b.lines, line)
+		p.accept(";")
+	}
+	return b
+}
+
+func (p *luaParser) lastStatement() luaStmt {
+	if p.accept("break") {
+		return &luaBreakStmt{}
+	}
+	p.expect("return")
+	if p.blockFollows() || p.check(";") {
+		return &luaReturnStmt{}
+	}
+	return &luaReturnStmt{exprs: p.exprList()}
+}
+
+func (p *luaParser) statement() luaStmt {
+	switch {
+	case p.accept("do"):
+		body := p.block()
+		p.expect("end")
+		return &luaDoStmt{body: body}
+	case p.accept("while"):
+		cond := p.expr()
+		p.expect("do")
+		body := p.block()
+		p.expect("end")
+		return &luaWhileStmt{cond: cond, body: body}
+	case p.accept("repeat"):
+		body := p.block()
+		p.expect("until")
+		return &luaRepeatStmt{body: body, cond: p.expr()}
+	case p.accept("if"):
+		return p.ifStatement()
+	case p.accept("for"):
+		return p.forStatement()
+	case p.accept("function"):
+		return p.functionStatement()
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.expectName()
+			return &luaLocalFunctionStmt{name: name, fn: p.funcBody(name)}
+		}
+		s := &luaLocalStmt{names: []string{p.expectName()}}
+		for p.accept(",") {
+			s.names = append(s.names, p.expectName())
+		}
+		if p.accept("=") {
+			s.exprs = p.exprList()
+		}
+		return s
+	}
+	return p.exprStatement()
+}
+
+func (p *luaParser) ifStatement() luaStmt {
+	s := &luaIfStmt{}
+	for {
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.block())
+		if !p.accept("elseif") {
+			break
+		}
+	}
+	if p.accept("else") {
+		s.elseBlock = p.block()
+	}
+	p.expect("end")
+	return s
+}
+
+func (p *luaParser) forStatement() luaStmt {
+	name := p.expectName()
+	if p.accept("=") {
+		s := &luaNumForStmt{name: name, start: p.expr()}
+		p.expect(",")
+		s.limit = p.expr()
+		if p.accept(",") {
+			s.step = p.expr()
+		}
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	}
+	s := &luaGenForStmt{names: []string{name}}
+	for p.accept(",") {
+		s.names = append(s.names, p.expectName())
+	}
+	p.expect("in")
+	s.exprs = p.exprList()
+	p.expect("do")
+	s.body = p.block()
+	p.expect("end")
+	return s
+}
+
+// function a.b.c:m() is the assignment of the function to the field
+func (p *luaParser) functionStatement() luaStmt {
+	name := p.expectName()
+	fullName := name
+	var target luaExpr = &luaNameExpr{name: name}
+	method := false
+	for p.check(".") || p.check(":") {
+		method = p.advance().text == ":"
+		field := p.expectName()
+		fullName += "." + field
+		target = &luaIndexExpr{obj: target, key: &luaConstExpr{val: field}}
+		if method {
+			break
+		}
+	}
+	fn := p.funcBody(fullName)
+	if method {
+		fn.params = append([]string{"self"}, fn.params...)
+	}
+	return &luaAssignStmt{targets: []luaExpr{target}, exprs: []luaExpr{fn}}
+}
+
+func (p *luaParser) funcBody(name string) *luaFuncExpr {
+	fn := &luaFuncExpr{name: name}
+	p.expect("(")
+	if !p.check(")") {
+		for {
+			if p.check("...") {
+				tk := p.peek()
+				panic(luaParseError{luaSyntaxError(tk.line, "varargs are not supported")})
+			}
+			fn.params = append(fn.params, p.expectName())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	fn.body = p.block()
+	p.expect("end")
+	return fn
+}
+
+// exprStatement is either the function call or the assignment
+func (p *luaParser) exprStatement() luaStmt {
+	e := p.suffixedExpr()
+	if p.check("=") || p.check(",") {
+		targets := []luaExpr{e}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		for _, t := range targets {
+			switch t.(type) {
+			case *luaNameExpr, *luaIndexExpr:
+			default:
+				p.errorExpected("<name>")
+			}
+		}
+		p.expect("=")
+		return &luaAssignStmt{targets: targets, exprs: p.exprList()}
+	}
+	call, ok := e.(*luaCallExpr)
+	if !ok {
+		tk := p.peek()
+		panic(luaParseError{luaSyntaxError(tk.line, "syntax error near '%s'", tk.text)})
+	}
+	return &luaCallStmt{call: call}
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+// the left and right priorities of the binary operators, as Lua 5.1
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4}, // right associative
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9}, // right associative
+}
+
+const LUA_UNARY_PRIORITY = 8
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+// subExpr parses the expression whose binary operators have the priority greater than limit
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var e luaExpr
+	if p.check("not") || p.check("-") || p.check("#") {
+		op := p.advance().text
+		e = &luaUnExpr{op: op, e: p.subExpr(LUA_UNARY_PRIORITY)}
+	} else {
+		e = p.simpleExpr()
+	}
+	for {
+		tk := p.peek()
+		if tk.typ != LUA_TK_OP && tk.typ != LUA_TK_KEYWORD {
+			break
+		}
+		prio, ok := luaBinaryPriority[tk.text]
+		if !ok || prio[0] <= limit {
+			break
+		}
+		p.advance()
+		e = &luaBinExpr{op: tk.text, l: e, r: p.subExpr(prio[1])}
+	}
+	return e
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	tk := p.peek()
+	switch tk.typ {
+	case LUA_TK_NUMBER:
+		p.advance()
+		return &luaConstExpr{val: tk.num}
+	case LUA_TK_STRING:
+		p.advance()
+		return &luaConstExpr{val: tk.text}
+	case LUA_TK_KEYWORD:
+		switch tk.text {
+		case "nil":
+			p.advance()
+			return &luaConstExpr{val: nil}
+		case "true":
+			p.advance()
+			return &luaConstExpr{val: true}
+		case "false":
+			p.advance()
+			return &luaConstExpr{val: false}
+		case "function":
+			p.advance()
+			return p.funcBody("anonymous")
+		}
+	case LUA_TK_OP:
+		switch tk.text {
+		case "{":
+			return p.tableConstructor()
+		case "...":
+			panic(luaParseError{luaSyntaxError(tk.line, "varargs are not supported")})
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	tk := p.peek()
+	if tk.typ == LUA_TK_NAME {
+		p.advance()
+		return &luaNameExpr{name: tk.text}
+	}
+	if p.accept("(") {
+		e := p.expr()
+		p.expect(")")
+		return &luaParenExpr{e: e}
+	}
+	panic(luaParseError{luaSyntaxError(tk.line, "unexpected symbol near '%s'", tk.text)})
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	e := p.primaryExpr()
+	for {
+		tk := p.peek()
+		switch {
+		case p.accept("."):
+			e = &luaIndexExpr{obj: e, key: &luaConstExpr{val: p.expectName()}}
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			e = &luaIndexExpr{obj: e, key: key}
+		case p.accept(":"):
+			method := p.expectName()
+			e = &luaCallExpr{fn: e, method: method, args: p.callArgs(), line: tk.line}
+		case p.check("(") || p.check("{") || tk.typ == LUA_TK_STRING:
+			e = &luaCallExpr{fn: e, args: p.callArgs(), line: tk.line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	tk := p.peek()
+	if tk.typ == LUA_TK_STRING {
+		p.advance()
+		return []luaExpr{&luaConstExpr{val: tk.text}}
+	}
+	if p.check("{") {
+		return []luaExpr{p.tableConstructor()}
+	}
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	args := p.exprList()
+	p.expect(")")
+	return args
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	t := &luaTableExpr{}
+	p.expect("{")
+	for !p.check("}") {
+		if p.accept("[") {
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.fields = append(t.fields, luaTableField{key: key, val: p.expr()})
+		} else if p.peek().typ == LUA_TK_NAME && p.tokens[p.pos+1].typ == LUA_TK_OP &&
+			p.tokens[p.pos+1].text == "=" {
+			name := p.advance().text
+			p.advance()
+			t.fields = append(t.fields, luaTableField{key: &luaConstExpr{val: name}, val: p.expr()})
+		} else {
+			t.fields = append(t.fields, luaTableField{val: p.expr()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return t
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// luaRun runs the script by a new state, and returns the results and the error message
+func luaRun(t *testing.T, src string) ([]luaValue, luaValue) {
+	fn, err := luaCompile(src)
+	assert.Nil(t, err, src)
+	if err != nil {
+		return nil, nil
+	}
+	rets, lerr := newLuaState().pcall(&luaClosure{fn: fn}, nil)
+	if lerr != nil {
+		return nil, lerr.value
+	}
+	return rets, nil
+}
+
+func TestLuaCompile(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"return 1", ""},
+		{"local a = [[\nlong\n]] -- comment\n--[==[ long\ncomment ]==]\nreturn a", ""},
+		{"x = ", "user_script:1: unexpected symbol near '<eof>'"},
+		{"if true then\nreturn 1", "user_script:2: 'end' expected near '<eof>'"},
+		{"local s = 'abc", "user_script:1: unfinished string"},
+		{"return 1 +* 2", "user_script:1: unexpected symbol near '*'"},
+		{"return 0x", "user_script:1: malformed number near '0x'"},
+		{"f(...)", "user_script:1: varargs are not supported"},
+		{"a.b", "user_script:1: syntax error near '<eof>'"},
+		{"return @", "user_script:1: unexpected symbol near '@'"},
+	}
+	for _, tt := range tests {
+		_, err := luaCompile(tt.src)
+		if tt.err == "" {
+			assert.Nil(t, err, tt.src)
+		} else if assert.NotNil(t, err, tt.src) {
+			assert.Equal(t, tt.err, err.Error(), tt.src)
+		}
+	}
+}
+
+func TestLuaEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		rets []luaValue
+	}{
+		{"return 1 + 2 * 3 ^ 2, (1 + 2) * 3, 7 % 3, -7 % 3, 2 ^ 3 ^ 2", []luaValue{19.0, 9.0, 1.0, 2.0, 512.0}},
+		{"return 'a' .. 'b' .. 1 .. 2.5, 10 / 4, '10' + 1", []luaValue{"ab12.5", 2.5, 11.0}},
+		{"return 1 < 2, 'a' < 'b', 1 == '1', nil == false, not nil", []luaValue{true, true, false, false, true}},
+		{"return nil or 'x', false and 1, 1 and 2, #'abc', #{1, 2, 3}", []luaValue{"x", false, 2.0, 3.0, 3.0}},
+		{"local a, b, c = 1, 2 return a, b, c", []luaValue{1.0, 2.0, nil}},
+		{"local a, b = 1, 2 a, b = b, a return a, b", []luaValue{2.0, 1.0}},
+		{"local s = 0 for i = 1, 10 do s = s + i end return s", []luaValue{55.0}},
+		{"local s = 0 for i = 10, 1, -3 do s = s + i end return s", []luaValue{22.0}},
+		{"local i = 0 while true do i = i + 1 if i > 5 then break end end return i", []luaValue{6.0}},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", []luaValue{4.0}},
+		{"local x = 5 if x < 3 then return 'a' elseif x < 6 then return 'b' else return 'c' end", []luaValue{"b"}},
+		{"local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(15)", []luaValue{610.0}},
+		{"local function counter() local n = 0 return function() n = n + 1 return n end end " +
+			"local c = counter() c() c() return c()", []luaValue{3.0}},
+		{"local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1]() + fs[3]()", []luaValue{4.0}},
+		{"local t = {1, 2, x = 'y', ['z'] = 3} t[3] = 3 t.x = nil return #t, t.x, t.z", []luaValue{3.0, nil, 3.0}},
+		{"local t = {} t[2] = 'b' t[1] = 'a' return #t, t[2]", []luaValue{2.0, "b"}},
+		{"local function f() return 1, 2 end local t = {f(), f()} return #t, (f())", []luaValue{3.0, 1.0}},
+		{"local t = {} for i, v in ipairs({'a', 'b', nil, 'd'}) do t[#t+1] = i .. v end return table.concat(t, ',')", []luaValue{"1a,2b"}},
+		{"local ks = {} for k, v in pairs({b = 1, a = 2, 10, 20}) do ks[#ks+1] = k end return table.concat(ks, ' ')", []luaValue{"1 2 a b"}},
+		{"local o = {n = 1} function o.inc(self, d) self.n = self.n + d return self.n end return o:inc(2)", []luaValue{3.0}},
+		{"local t = {3, 1, 2} table.sort(t) table.insert(t, 1, 0) table.insert(t, 9) return table.concat(t, ','), table.remove(t), #t", []luaValue{"0,1,2,3,9", 9.0, 4.0}},
+		{"local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return unpack(t)", []luaValue{3.0, 2.0, 1.0}},
+		{"return string.format('%s=%d %05.2f %x %%', 'k', 42, 3.14159, 255)", []luaValue{"k=42 03.14 ff %"}},
+		{"local s = 'Hello' return s:upper(), s:sub(2, -2), s:len(), string.rep('ab', 3), s:byte(1)", []luaValue{"HELLO", "ell", 5.0, "ababab", 72.0}},
+		{"return string.char(104, 105), string.find('a.b.c', '.', 3, true)", []luaValue{"hi", 4.0, 4.0}},
+		{"return tonumber('0x10'), tonumber(' 12 '), tonumber('z', 36), tonumber('abc'), tostring(1e100)", []luaValue{16.0, 12.0, 35.0, nil, "1e+100"}},
+		{"return type(nil), type({}), type(print), type(type), math.floor(-1.5), math.max(1, 5, 3)", []luaValue{"nil", "table", "nil", "function", -2.0, 5.0}},
+		{"return pcall(function() error('boom') end)", []luaValue{false, "user_script:1: boom"}},
+		{"return pcall(function() error({code = 1}) end) == false", []luaValue{true}},
+		{"return pcall(function(a, b) return a + b end, 1, 2)", []luaValue{true, 3.0}},
+		{"do local x = 1 end return x", []luaValue{nil}},
+	}
+	for _, tt := range tests {
+		rets, err := luaRun(t, tt.src)
+		assert.Nil(t, err, tt.src)
+		assert.Equal(t, tt.rets, rets, tt.src)
+	}
+}
+
+func TestLuaError(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"return 1 + {}", "user_script:1: attempt to perform arithmetic on a table value"},
+		{"return 'a' .. nil", "user_script:1: attempt to concatenate a nil value"},
+		{"return 1 < 'a'", "user_script:1: attempt to compare number with string"},
+		{"return {} < {}", "user_script:1: attempt to compare two table values"},
+		{"local t = nil\nreturn t.x", "user_script:2: attempt to index a nil value"},
+		{"undefined()", "user_script:1: attempt to call a nil value"},
+		{"x = 1", "user_script:1: Attempt to modify a readonly table"},
+		{"string.x = 1", "user_script:1: Attempt to modify a readonly table"},
+		{"local t = {} t[nil] = 1", "user_script:1: table index is nil"},
+		{"local function f() return f() + 1 end return f()", "user_script:1: stack overflow"},
+		{"error('msg', 0)", "msg"},
+		{"assert(false, 'failed')", "failed"},
+		{"assert(nil)", "user_script:1: assertion failed!"},
+		{"return ('x'):find('.')", "user_script:1: patterns are not supported, use string.find(s, sub, init, true)"},
+		{"return string.rep('xx', 2^62)", "user_script:1: resulting string too large"},
+		{"return string.rep('x', 0/0)", "user_script:1: resulting string too large"},
+		{"return unpack({1, 2}, 1, 1e9)", "user_script:1: too many results to unpack"},
+	}
+	for _, tt := range tests {
+		_, err := luaRun(t, tt.src)
+		assert.Equal(t, tt.err, err, tt.src)
+	}
+}
+
+func TestLuaHook(t *testing.T) {
+	fn, err := luaCompile("while true do end")
+	assert.Nil(t, err)
+	L := newLuaState()
+	calls := 0
+	L.hook = func(L *luaState) {
+		calls++
+		if calls == 3 {
+			panic(&luaError{value: "stopped", fatal: true})
+		}
+	}
+	_, lerr := L.pcall(&luaClosure{fn: fn}, nil)
+	assert.Equal(t, "stopped", lerr.value)
+
+	// the fatal error can't be caught by pcall
+	fn, _ = luaCompile("while true do pcall(function() while true do end end) end")
+	calls = 0
+	_, lerr = L.pcall(&luaClosure{fn: fn}, nil)
+	assert.Equal(t, "stopped", lerr.value)
+}
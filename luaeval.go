@@ -0,0 +1,1135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The values of the scripts are nil, bool, float64, string, *luaTable, *luaClosure and
+ * *luaGoFunction. The errors are raised by panic with *luaError and recovered by pcall or
+ * by the caller of the script. */
+
+type luaValue any
+
+type luaError struct {
+	value luaValue // usually the message string, or the error table of redis.call
+	fatal bool     // the error can't be caught by pcall, like a killed script
+}
+
+type luaGoFunction struct {
+	name string
+	fn   func(L *luaState, args []luaValue) []luaValue
+}
+
+type luaClosure struct {
+	fn    *luaFuncExpr
+	scope *luaScope
+}
+
+// luaScope holds the local variables of a block, the variables are pointers so the closures
+// share them with the block
+type luaScope struct {
+	vars   map[string]*luaValue
+	parent *luaScope
+}
+
+func newLuaScope(parent *luaScope) *luaScope {
+	return &luaScope{parent: parent}
+}
+
+func (s *luaScope) define(name string, v luaValue) {
+	if s.vars == nil {
+		s.vars = make(map[string]*luaValue)
+	}
+	p := new(luaValue)
+	*p = v
+	s.vars[name] = p
+}
+
+func (s *luaScope) lookup(name string) *luaValue {
+	for ; s != nil; s = s.parent {
+		if p, ok := s.vars[name]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+/* table */
+
+// luaTable keeps the values of the keys 1..n in arr, the others in hash
+type luaTable struct {
+	arr      []luaValue
+	hash     map[luaValue]luaValue
+	readonly bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{}
+}
+
+// luaArrayIndex returns the index in arr if the key is a positive integer
+func luaArrayIndex(k luaValue) (int, bool) {
+	f, ok := k.(float64)
+	if !ok || f < 1 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f) - 1, true
+}
+
+func (t *luaTable) get(k luaValue) luaValue {
+	if i, ok := luaArrayIndex(k); ok && i < len(t.arr) {
+		return t.arr[i]
+	}
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[k]
+}
+
+// rawSet sets the value without checking the key and the readonly flag
+func (t *luaTable) rawSet(k, v luaValue) {
+	if i, ok := luaArrayIndex(k); ok {
+		if i < len(t.arr) {
+			t.arr[i] = v
+			// keep the last element of arr not nil
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+			return
+		}
+		if i == len(t.arr) && v != nil {
+			t.arr = append(t.arr, v)
+			delete(t.hash, k)
+			// move the following keys from hash
+			for {
+				next := float64(len(t.arr) + 1)
+				nv, ok := t.hash[next]
+				if !ok {
+					break
+				}
+				t.arr = append(t.arr, nv)
+				delete(t.hash, next)
+			}
+			return
+		}
+	}
+	if v == nil {
+		delete(t.hash, k)
+		return
+	}
+	if t.hash == nil {
+		t.hash = make(map[luaValue]luaValue)
+	}
+	t.hash[k] = v
+}
+
+func (t *luaTable) length() int {
+	return len(t.arr)
+}
+
+// keys returns the keys in a stable order, the array part first, then the numbers and the
+// strings in ascending order, and the others
+func (t *luaTable) keys() []luaValue {
+	keys := make([]luaValue, 0, len(t.arr)+len(t.hash))
+	for i := range t.arr {
+		keys = append(keys, float64(i+1))
+	}
+	var nums []float64
+	var strs []string
+	var others []luaValue
+	for k := range t.hash {
+		switch kv := k.(type) {
+		case float64:
+			nums = append(nums, kv)
+		case string:
+			strs = append(strs, kv)
+		default:
+			others = append(others, kv)
+		}
+	}
+	sort.Float64s(nums)
+	sort.Strings(strs)
+	for _, n := range nums {
+		keys = append(keys, n)
+	}
+	for _, s := range strs {
+		keys = append(keys, s)
+	}
+	return append(keys, others...)
+}
+
+/* state */
+
+const (
+	LUA_CTRL_NONE   = 0
+	LUA_CTRL_BREAK  = 1
+	LUA_CTRL_RETURN = 2
+
+	LUA_MAX_CALL_DEPTH  = 200
+	LUA_MAX_STRING_SIZE = 512 * 1024 * 1024 // the biggest string built by string.rep
+	LUA_MAX_UNPACK      = 8000              // the most values returned by unpack, like LUAI_MAXCSTACK
+	LUA_HOOK_STEPS      = 1000              // the hook is called every N steps
+)
+
+type luaState struct {
+	globals *luaTable
+	strlib  *luaTable // the methods of the strings
+	line    int       // the line of the statement being executed
+	depth   int
+	steps   int
+	hook    func(L *luaState) // called periodically while running, may raise an error
+}
+
+// newLuaState creates the state with the libraries, the globals are readonly so the scripts
+// can't leak the state to each other
+func newLuaState() *luaState {
+	L := &luaState{globals: newLuaTable()}
+	luaOpenLibs(L)
+	L.globals.readonly = true
+	return L
+}
+
+func (L *luaState) errorf(format string, args ...any) {
+	panic(&luaError{value: fmt.Sprintf("user_script:%d: %s", L.line, fmt.Sprintf(format, args...))})
+}
+
+// pcall calls the function in protected mode, the raised error is returned
+func (L *luaState) pcall(fn luaValue, args []luaValue) (rets []luaValue, lerr *luaError) {
+	depth, line := L.depth, L.line
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			L.depth, L.line = depth, line
+			rets, lerr = nil, e
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+func (L *luaState) call(fn luaValue, args []luaValue) []luaValue {
+	switch f := fn.(type) {
+	case *luaGoFunction:
+		return f.fn(L, args)
+	case *luaClosure:
+		if L.depth >= LUA_MAX_CALL_DEPTH {
+			L.errorf("stack overflow")
+		}
+		L.depth++
+		line := L.line
+		scope := newLuaScope(f.scope)
+		for i, name := range f.fn.params {
+			var v luaValue
+			if i < len(args) {
+				v = args[i]
+			}
+			scope.define(name, v)
+		}
+		ctrl, rets := L.execBlock(f.fn.body, scope)
+		L.depth--
+		L.line = line
+		if ctrl == LUA_CTRL_RETURN {
+			return rets
+		}
+		return nil
+	}
+	L.errorf("attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+/* statements */
+
+// step counts the executed statements and blocks, so the hook is called even by the loop
+// with an empty body
+func (L *luaState) step() {
+	L.steps++
+	if L.hook != nil && L.steps%LUA_HOOK_STEPS == 0 {
+		L.hook(L)
+	}
+}
+
+func (L *luaState) execBlock(b *luaBlock, scope *luaScope) (int, []luaValue) {
+	L.step()
+	for i, stmt := range b.stmts {
+		L.line = b.lines[i]
+		L.step()
+		if ctrl, rets := L.exec(stmt, scope); ctrl != LUA_CTRL_NONE {
+			return ctrl, rets
+		}
+	}
+	return LUA_CTRL_NONE, nil
+}
+
+func (L *luaState) exec(stmt luaStmt, scope *luaScope) (int, []luaValue) {
+	switch s := stmt.(type) {
+	case *luaLocalStmt:
+		vals := L.evalList(s.exprs, scope)
+		for i, name := range s.names {
+			var v luaValue
+			if i < len(vals) {
+				v = vals[i]
+			}
+			scope.define(name, v)
+		}
+	case *luaAssignStmt:
+		vals := L.evalList(s.exprs, scope)
+		for i, target := range s.targets {
+			var v luaValue
+			if i < len(vals) {
+				v = vals[i]
+			}
+			L.assign(target, v, scope)
+		}
+	case *luaCallStmt:
+		L.evalCall(s.call, scope)
+	case *luaDoStmt:
+		return L.execBlock(s.body, newLuaScope(scope))
+	case *luaWhileStmt:
+		for luaToBoolean(L.eval(s.cond, scope)) {
+			ctrl, rets := L.execBlock(s.body, newLuaScope(scope))
+			if ctrl == LUA_CTRL_BREAK {
+				break
+			} else if ctrl == LUA_CTRL_RETURN {
+				return ctrl, rets
+			}
+		}
+	case *luaRepeatStmt:
+		for {
+			// the condition can see the locals of the body
+			body := newLuaScope(scope)
+			ctrl, rets := L.execBlock(s.body, body)
+			if ctrl == LUA_CTRL_BREAK {
+				break
+			} else if ctrl == LUA_CTRL_RETURN {
+				return ctrl, rets
+			}
+			if luaToBoolean(L.eval(s.cond, body)) {
+				break
+			}
+		}
+	case *luaIfStmt:
+		for i, cond := range s.conds {
+			if luaToBoolean(L.eval(cond, scope)) {
+				return L.execBlock(s.blocks[i], newLuaScope(scope))
+			}
+		}
+		if s.elseBlock != nil {
+			return L.execBlock(s.elseBlock, newLuaScope(scope))
+		}
+	case *luaNumForStmt:
+		return L.execNumFor(s, scope)
+	case *luaGenForStmt:
+		return L.execGenFor(s, scope)
+	case *luaLocalFunctionStmt:
+		// the function can call itself
+		scope.define(s.name, nil)
+		*scope.lookup(s.name) = &luaClosure{fn: s.fn, scope: scope}
+	case *luaReturnStmt:
+		return LUA_CTRL_RETURN, L.evalList(s.exprs, scope)
+	case *luaBreakStmt:
+		return LUA_CTRL_BREAK, nil
+	}
+	return LUA_CTRL_NONE, nil
+}
+
+func (L *luaState) execNumFor(s *luaNumForStmt, scope *luaScope) (int, []luaValue) {
+	start, ok1 := luaToNumber(L.eval(s.start, scope))
+	limit, ok2 := luaToNumber(L.eval(s.limit, scope))
+	step, ok3 := 1.0, true
+	if s.step != nil {
+		step, ok3 = luaToNumber(L.eval(s.step, scope))
+	}
+	if !ok1 {
+		L.errorf("'for' initial value must be a number")
+	} else if !ok2 {
+		L.errorf("'for' limit must be a number")
+	} else if !ok3 {
+		L.errorf("'for' step must be a number")
+	}
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		body := newLuaScope(scope)
+		body.define(s.name, i)
+		ctrl, rets := L.execBlock(s.body, body)
+		if ctrl == LUA_CTRL_BREAK {
+			break
+		} else if ctrl == LUA_CTRL_RETURN {
+			return ctrl, rets
+		}
+	}
+	return LUA_CTRL_NONE, nil
+}
+
+// for k, v in f, s, var do ... end
+func (L *luaState) execGenFor(s *luaGenForStmt, scope *luaScope) (int, []luaValue) {
+	vals := L.evalList(s.exprs, scope)
+	for len(vals) < 3 {
+		vals = append(vals, nil)
+	}
+	f, state, control := vals[0], vals[1], vals[2]
+	for {
+		rets := L.call(f, []luaValue{state, control})
+		if len(rets) == 0 || rets[0] == nil {
+			break
+		}
+		control = rets[0]
+		body := newLuaScope(scope)
+		for i, name := range s.names {
+			var v luaValue
+			if i < len(rets) {
+				v = rets[i]
+			}
+			body.define(name, v)
+		}
+		ctrl, r := L.execBlock(s.body, body)
+		if ctrl == LUA_CTRL_BREAK {
+			break
+		} else if ctrl == LUA_CTRL_RETURN {
+			return ctrl, r
+		}
+	}
+	return LUA_CTRL_NONE, nil
+}
+
+func (L *luaState) assign(target luaExpr, v luaValue, scope *luaScope) {
+	switch t := target.(type) {
+	case *luaNameExpr:
+		if p := scope.lookup(t.name); p != nil {
+			*p = v
+			return
+		}
+		L.setIndex(L.globals, t.name, v)
+	case *luaIndexExpr:
+		L.setIndex(L.eval(t.obj, scope), L.eval(t.key, scope), v)
+	}
+}
+
+func (L *luaState) setIndex(obj, k, v luaValue) {
+	t, ok := obj.(*luaTable)
+	if !ok {
+		L.errorf("attempt to index a %s value", luaTypeName(obj))
+	}
+	if t.readonly {
+		L.errorf("Attempt to modify a readonly table")
+	}
+	if k == nil {
+		L.errorf("table index is nil")
+	}
+	if f, ok := k.(float64); ok && math.IsNaN(f) {
+		L.errorf("table index is NaN")
+	}
+	t.rawSet(k, v)
+}
+
+func (L *luaState) index(obj, k luaValue) luaValue {
+	switch o := obj.(type) {
+	case *luaTable:
+		return o.get(k)
+	case string:
+		return L.strlib.get(k)
+	}
+	L.errorf("attempt to index a %s value", luaTypeName(obj))
+	return nil
+}
+
+/* expressions */
+
+// eval evaluates the expression to a single value
+func (L *luaState) eval(e luaExpr, scope *luaScope) luaValue {
+	switch x := e.(type) {
+	case *luaConstExpr:
+		return x.val
+	case *luaNameExpr:
+		if p := scope.lookup(x.name); p != nil {
+			return *p
+		}
+		return L.globals.get(x.name)
+	case *luaIndexExpr:
+		return L.index(L.eval(x.obj, scope), L.eval(x.key, scope))
+	case *luaCallExpr:
+		rets := L.evalCall(x, scope)
+		if len(rets) == 0 {
+			return nil
+		}
+		return rets[0]
+	case *luaParenExpr:
+		return L.eval(x.e, scope)
+	case *luaFuncExpr:
+		return &luaClosure{fn: x, scope: scope}
+	case *luaTableExpr:
+		return L.evalTable(x, scope)
+	case *luaUnExpr:
+		return L.evalUnary(x, scope)
+	case *luaBinExpr:
+		return L.evalBinary(x, scope)
+	}
+	return nil
+}
+
+// evalList evaluates the expressions, the last one expands to all its results
+func (L *luaState) evalList(exprs []luaExpr, scope *luaScope) []luaValue {
+	vals := make([]luaValue, 0, len(exprs))
+	for i, e := range exprs {
+		if call, ok := e.(*luaCallExpr); ok && i == len(exprs)-1 {
+			return append(vals, L.evalCall(call, scope)...)
+		}
+		vals = append(vals, L.eval(e, scope))
+	}
+	return vals
+}
+
+func (L *luaState) evalCall(x *luaCallExpr, scope *luaScope) []luaValue {
+	var fn luaValue
+	var args []luaValue
+	if x.method != "" {
+		obj := L.eval(x.fn, scope)
+		fn = L.index(obj, x.method)
+		args = append([]luaValue{obj}, L.evalList(x.args, scope)...)
+	} else {
+		fn = L.eval(x.fn, scope)
+		args = L.evalList(x.args, scope)
+	}
+	L.line = x.line
+	return L.call(fn, args)
+}
+
+func (L *luaState) evalTable(x *luaTableExpr, scope *luaScope) luaValue {
+	t := newLuaTable()
+	n := 1
+	for i, f := range x.fields {
+		if f.key != nil {
+			L.setIndex(t, L.eval(f.key, scope), L.eval(f.val, scope))
+			continue
+		}
+		// the last positional call expands to all its results
+		if call, ok := f.val.(*luaCallExpr); ok && i == len(x.fields)-1 {
+			for _, v := range L.evalCall(call, scope) {
+				t.rawSet(float64(n), v)
+				n++
+			}
+			continue
+		}
+		t.rawSet(float64(n), L.eval(f.val, scope))
+		n++
+	}
+	return t
+}
+
+func (L *luaState) evalUnary(x *luaUnExpr, scope *luaScope) luaValue {
+	v := L.eval(x.e, scope)
+	switch x.op {
+	case "not":
+		return !luaToBoolean(v)
+	case "-":
+		n, ok := luaToNumber(v)
+		if !ok {
+			L.errorf("attempt to perform arithmetic on a %s value", luaTypeName(v))
+		}
+		return -n
+	default: // #
+		switch o := v.(type) {
+		case string:
+			return float64(len(o))
+		case *luaTable:
+			return float64(o.length())
+		}
+		L.errorf("attempt to get length of a %s value", luaTypeName(v))
+	}
+	return nil
+}
+
+func (L *luaState) evalBinary(x *luaBinExpr, scope *luaScope) luaValue {
+	// short circuit
+	switch x.op {
+	case "and":
+		l := L.eval(x.l, scope)
+		if !luaToBoolean(l) {
+			return l
+		}
+		return L.eval(x.r, scope)
+	case "or":
+		l := L.eval(x.l, scope)
+		if luaToBoolean(l) {
+			return l
+		}
+		return L.eval(x.r, scope)
+	}
+
+	l, r := L.eval(x.l, scope), L.eval(x.r, scope)
+	switch x.op {
+	case "==":
+		return luaRawEqual(l, r)
+	case "~=":
+		return !luaRawEqual(l, r)
+	case "<":
+		return L.lessThan(l, r)
+	case ">":
+		return L.lessThan(r, l)
+	case "<=":
+		return !L.lessThan(r, l)
+	case ">=":
+		return !L.lessThan(l, r)
+	case "..":
+		ls, ok1 := luaToString(l)
+		rs, ok2 := luaToString(r)
+		if !ok1 || !ok2 {
+			bad := l
+			if ok1 {
+				bad = r
+			}
+			L.errorf("attempt to concatenate a %s value", luaTypeName(bad))
+		}
+		return ls + rs
+	}
+
+	a, ok1 := luaToNumber(l)
+	b, ok2 := luaToNumber(r)
+	if !ok1 || !ok2 {
+		bad := l
+		if ok1 {
+			bad = r
+		}
+		L.errorf("attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch x.op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - math.Floor(a/b)*b
+	default: // ^
+		return math.Pow(a, b)
+	}
+}
+
+func (L *luaState) lessThan(l, r luaValue) bool {
+	switch a := l.(type) {
+	case float64:
+		if b, ok := r.(float64); ok {
+			return a < b
+		}
+	case string:
+		if b, ok := r.(string); ok {
+			return a < b
+		}
+	}
+	if luaTypeName(l) == luaTypeName(r) {
+		L.errorf("attempt to compare two %s values", luaTypeName(l))
+	}
+	L.errorf("attempt to compare %s with %s", luaTypeName(l), luaTypeName(r))
+	return false
+}
+
+/* conversion */
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaToBoolean(v luaValue) bool {
+	return v != nil && v != false
+}
+
+func luaRawEqual(a, b luaValue) bool {
+	return a == b
+}
+
+// luaToNumber converts the number or the numeric string
+func luaToNumber(v luaValue) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		return luaStr2Number(n)
+	}
+	return 0, false
+}
+
+// luaToString converts the string or the number
+func luaToString(v luaValue) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return luaNumber2Str(s), true
+	}
+	return "", false
+}
+
+// luaNumber2Str formats the number like "%.14g" of Lua
+func luaNumber2Str(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	if math.IsInf(f, 0) {
+		if f > 0 {
+			return "inf"
+		}
+		return "-inf"
+	}
+	if math.IsNaN(f) {
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
+}
+
+// luaToDisplay converts any value to string, like tostring
+func luaToDisplay(v luaValue) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return luaNumber2Str(x)
+	case string:
+		return x
+	case *luaTable:
+		return fmt.Sprintf("table: %p", x)
+	case *luaClosure:
+		return fmt.Sprintf("function: %p", x)
+	case *luaGoFunction:
+		return fmt.Sprintf("function: builtin: %s", x.name)
+	}
+	return "userdata"
+}
+
+/* libraries */
+
+func (L *luaState) register(t *luaTable, name string, fn func(L *luaState, args []luaValue) []luaValue) {
+	t.rawSet(name, &luaGoFunction{name: name, fn: fn})
+}
+
+// luaArg returns the nth argument, nil if it's absent
+func luaArg(args []luaValue, n int) luaValue {
+	if n < len(args) {
+		return args[n]
+	}
+	return nil
+}
+
+func (L *luaState) checkNumber(args []luaValue, n int, fname string) float64 {
+	v := luaArg(args, n)
+	f, ok := luaToNumber(v)
+	if !ok {
+		L.errorf("bad argument #%d to '%s' (number expected, got %s)", n+1, fname, luaTypeName(v))
+	}
+	return f
+}
+
+func (L *luaState) optNumber(args []luaValue, n int, fname string, def float64) float64 {
+	if luaArg(args, n) == nil {
+		return def
+	}
+	return L.checkNumber(args, n, fname)
+}
+
+func (L *luaState) checkString(args []luaValue, n int, fname string) string {
+	v := luaArg(args, n)
+	s, ok := luaToString(v)
+	if !ok {
+		L.errorf("bad argument #%d to '%s' (string expected, got %s)", n+1, fname, luaTypeName(v))
+	}
+	return s
+}
+
+func (L *luaState) checkTable(args []luaValue, n int, fname string) *luaTable {
+	v := luaArg(args, n)
+	t, ok := v.(*luaTable)
+	if !ok {
+		L.errorf("bad argument #%d to '%s' (table expected, got %s)", n+1, fname, luaTypeName(v))
+	}
+	return t
+}
+
+func luaOpenLibs(L *luaState) {
+	g := L.globals
+	g.rawSet("_G", g)
+	L.register(g, "type", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) == 0 {
+			L.errorf("bad argument #1 to 'type' (value expected)")
+		}
+		return []luaValue{luaTypeName(args[0])}
+	})
+	L.register(g, "tostring", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{luaToDisplay(luaArg(args, 0))}
+	})
+	L.register(g, "tonumber", func(L *luaState, args []luaValue) []luaValue {
+		base := L.optNumber(args, 1, "tonumber", 10)
+		if base == 10 {
+			if n, ok := luaToNumber(luaArg(args, 0)); ok {
+				return []luaValue{n}
+			}
+			return []luaValue{nil}
+		}
+		s := strings.ToLower(strings.TrimSpace(L.checkString(args, 0, "tonumber")))
+		n, err := strconv.ParseInt(s, int(base), 64)
+		if err != nil {
+			return []luaValue{nil}
+		}
+		return []luaValue{float64(n)}
+	})
+	L.register(g, "ipairs", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 0, "ipairs")
+		iter := &luaGoFunction{name: "ipairs_iter", fn: func(L *luaState, args []luaValue) []luaValue {
+			i, _ := luaToNumber(luaArg(args, 1))
+			v := t.get(i + 1)
+			if v == nil {
+				return []luaValue{nil}
+			}
+			return []luaValue{i + 1, v}
+		}}
+		return []luaValue{iter, t, 0.0}
+	})
+	L.register(g, "pairs", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 0, "pairs")
+		keys, i := t.keys(), 0
+		iter := &luaGoFunction{name: "pairs_iter", fn: func(L *luaState, args []luaValue) []luaValue {
+			// the keys removed while iterating are skipped
+			for ; i < len(keys); i++ {
+				if v := t.get(keys[i]); v != nil {
+					i++
+					return []luaValue{keys[i-1], v}
+				}
+			}
+			return []luaValue{nil}
+		}}
+		return []luaValue{iter, t, nil}
+	})
+	L.register(g, "unpack", luaUnpack)
+	L.register(g, "error", func(L *luaState, args []luaValue) []luaValue {
+		v := luaArg(args, 0)
+		level := L.optNumber(args, 1, "error", 1)
+		if s, ok := v.(string); ok && level > 0 {
+			v = fmt.Sprintf("user_script:%d: %s", L.line, s)
+		}
+		panic(&luaError{value: v})
+	})
+	L.register(g, "assert", func(L *luaState, args []luaValue) []luaValue {
+		if !luaToBoolean(luaArg(args, 0)) {
+			if msg := luaArg(args, 1); msg != nil {
+				panic(&luaError{value: msg})
+			}
+			L.errorf("assertion failed!")
+		}
+		return args
+	})
+	L.register(g, "pcall", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) == 0 {
+			L.errorf("bad argument #1 to 'pcall' (value expected)")
+		}
+		rets, err := L.pcall(args[0], args[1:])
+		if err != nil && err.fatal {
+			panic(err)
+		} else if err != nil {
+			return []luaValue{false, err.value}
+		}
+		return append([]luaValue{true}, rets...)
+	})
+
+	g.rawSet("table", luaOpenTable(L))
+	L.strlib = luaOpenString(L)
+	g.rawSet("string", L.strlib)
+	g.rawSet("math", luaOpenMath(L))
+}
+
+func luaUnpack(L *luaState, args []luaValue) []luaValue {
+	t := L.checkTable(args, 0, "unpack")
+	fi := L.optNumber(args, 1, "unpack", 1)
+	fj := L.optNumber(args, 2, "unpack", float64(t.length()))
+	if fi > fj {
+		return nil
+	}
+	// NaN is rejected too
+	if !(fj-fi < LUA_MAX_UNPACK) {
+		L.errorf("too many results to unpack")
+	}
+	i, j := int(fi), int(fj)
+	rets := make([]luaValue, 0, j-i+1)
+	for ; i <= j; i++ {
+		rets = append(rets, t.get(float64(i)))
+	}
+	return rets
+}
+
+func luaOpenTable(L *luaState) *luaTable {
+	t := newLuaTable()
+	L.register(t, "getn", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{float64(L.checkTable(args, 0, "getn").length())}
+	})
+	L.register(t, "insert", func(L *luaState, args []luaValue) []luaValue {
+		tbl := L.checkTable(args, 0, "insert")
+		n := tbl.length()
+		switch len(args) {
+		case 2:
+			tbl.rawSet(float64(n+1), args[1])
+		case 3:
+			pos := int(L.checkNumber(args, 1, "insert"))
+			if pos < 1 || pos > n+1 {
+				L.errorf("bad argument #2 to 'insert' (position out of bounds)")
+			}
+			for i := n; i >= pos; i-- {
+				tbl.rawSet(float64(i+1), tbl.get(float64(i)))
+			}
+			tbl.rawSet(float64(pos), args[2])
+		default:
+			L.errorf("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	L.register(t, "remove", func(L *luaState, args []luaValue) []luaValue {
+		tbl := L.checkTable(args, 0, "remove")
+		n := tbl.length()
+		if n == 0 {
+			return []luaValue{nil}
+		}
+		pos := int(L.optNumber(args, 1, "remove", float64(n)))
+		v := tbl.get(float64(pos))
+		for i := pos; i < n; i++ {
+			tbl.rawSet(float64(i), tbl.get(float64(i+1)))
+		}
+		tbl.rawSet(float64(n), nil)
+		return []luaValue{v}
+	})
+	L.register(t, "concat", func(L *luaState, args []luaValue) []luaValue {
+		tbl := L.checkTable(args, 0, "concat")
+		sep := ""
+		if luaArg(args, 1) != nil {
+			sep = L.checkString(args, 1, "concat")
+		}
+		i := int(L.optNumber(args, 2, "concat", 1))
+		j := int(L.optNumber(args, 3, "concat", float64(tbl.length())))
+		parts := make([]string, 0)
+		for ; i <= j; i++ {
+			s, ok := luaToString(tbl.get(float64(i)))
+			if !ok {
+				L.errorf("invalid value (at index %d) in table for 'concat'", i)
+			}
+			parts = append(parts, s)
+		}
+		return []luaValue{strings.Join(parts, sep)}
+	})
+	L.register(t, "sort", func(L *luaState, args []luaValue) []luaValue {
+		tbl := L.checkTable(args, 0, "sort")
+		comp := luaArg(args, 1)
+		sort.SliceStable(tbl.arr, func(i, j int) bool {
+			if comp != nil {
+				rets := L.call(comp, []luaValue{tbl.arr[i], tbl.arr[j]})
+				return len(rets) > 0 && luaToBoolean(rets[0])
+			}
+			return L.lessThan(tbl.arr[i], tbl.arr[j])
+		})
+		return nil
+	})
+	t.readonly = true
+	return t
+}
+
+func luaOpenString(L *luaState) *luaTable {
+	t := newLuaTable()
+	L.register(t, "len", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{float64(len(L.checkString(args, 0, "len")))}
+	})
+	L.register(t, "sub", func(L *luaState, args []luaValue) []luaValue {
+		s := L.checkString(args, 0, "sub")
+		i, j := luaStrRange(len(s), int(L.optNumber(args, 1, "sub", 1)), int(L.optNumber(args, 2, "sub", -1)))
+		if i > j {
+			return []luaValue{""}
+		}
+		return []luaValue{s[i-1 : j]}
+	})
+	L.register(t, "upper", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{strings.ToUpper(L.checkString(args, 0, "upper"))}
+	})
+	L.register(t, "lower", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{strings.ToLower(L.checkString(args, 0, "lower"))}
+	})
+	L.register(t, "rep", func(L *luaState, args []luaValue) []luaValue {
+		s, n := L.checkString(args, 0, "rep"), L.checkNumber(args, 1, "rep")
+		if n < 1 || len(s) == 0 {
+			return []luaValue{""}
+		}
+		// NaN is rejected too
+		if !(n <= float64(LUA_MAX_STRING_SIZE/len(s))) {
+			L.errorf("resulting string too large")
+		}
+		return []luaValue{strings.Repeat(s, int(n))}
+	})
+	L.register(t, "reverse", func(L *luaState, args []luaValue) []luaValue {
+		b := []byte(L.checkString(args, 0, "reverse"))
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []luaValue{string(b)}
+	})
+	L.register(t, "byte", func(L *luaState, args []luaValue) []luaValue {
+		s := L.checkString(args, 0, "byte")
+		first := int(L.optNumber(args, 1, "byte", 1))
+		i, j := luaStrRange(len(s), first, int(L.optNumber(args, 2, "byte", float64(first))))
+		var rets []luaValue
+		for ; i <= j; i++ {
+			rets = append(rets, float64(s[i-1]))
+		}
+		return rets
+	})
+	L.register(t, "char", func(L *luaState, args []luaValue) []luaValue {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := L.checkNumber(args, i, "char")
+			if c < 0 || c > 255 {
+				L.errorf("bad argument #%d to 'char' (invalid value)", i+1)
+			}
+			b[i] = byte(c)
+		}
+		return []luaValue{string(b)}
+	})
+	// only the plain search is supported, the patterns are not
+	L.register(t, "find", func(L *luaState, args []luaValue) []luaValue {
+		s, sub := L.checkString(args, 0, "find"), L.checkString(args, 1, "find")
+		init, _ := luaStrRange(len(s), int(L.optNumber(args, 2, "find", 1)), -1)
+		if !luaToBoolean(luaArg(args, 3)) && strings.ContainsAny(sub, "^$*+?.([%-") {
+			L.errorf("patterns are not supported, use string.find(s, sub, init, true)")
+		}
+		if init > len(s)+1 {
+			return []luaValue{nil}
+		}
+		idx := strings.Index(s[init-1:], sub)
+		if idx < 0 {
+			return []luaValue{nil}
+		}
+		start := init + idx
+		return []luaValue{float64(start), float64(start + len(sub) - 1)}
+	})
+	L.register(t, "format", luaStringFormat)
+	t.readonly = true
+	return t
+}
+
+// luaStrRange converts the 1-based range which may be negative to the valid range
+func luaStrRange(n, i, j int) (int, int) {
+	if i < 0 {
+		i = n + i + 1
+	}
+	if j < 0 {
+		j = n + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > n {
+		j = n
+	}
+	return i, j
+}
+
+// luaStringFormat supports the conversions %d %i %u %c %x %X %o %e %E %f %g %G %q %s and %%
+func luaStringFormat(L *luaState, args []luaValue) []luaValue {
+	format := L.checkString(args, 0, "format")
+	var sb strings.Builder
+	argn := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			L.errorf("invalid option in format")
+		}
+		spec := "%" + format[start:i]
+		conv := format[i]
+		if argn >= len(args) {
+			L.errorf("bad argument #%d to 'format' (no value)", argn+1)
+		}
+		switch conv {
+		case 'd', 'i':
+			sb.WriteString(fmt.Sprintf(spec+"d", int64(L.checkNumber(args, argn, "format"))))
+		case 'u':
+			sb.WriteString(fmt.Sprintf(spec+"d", uint64(L.checkNumber(args, argn, "format"))))
+		case 'c':
+			sb.WriteByte(byte(L.checkNumber(args, argn, "format")))
+		case 'x', 'X', 'o':
+			sb.WriteString(fmt.Sprintf(spec+string(conv), int64(L.checkNumber(args, argn, "format"))))
+		case 'e', 'E', 'f', 'g', 'G':
+			sb.WriteString(fmt.Sprintf(spec+string(conv), L.checkNumber(args, argn, "format")))
+		case 'q':
+			sb.WriteString(strconv.Quote(L.checkString(args, argn, "format")))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec+"s", luaToDisplay(args[argn])))
+		default:
+			L.errorf("invalid option '%%%c' to 'format'", conv)
+		}
+		argn++
+	}
+	return []luaValue{sb.String()}
+}
+
+func luaOpenMath(L *luaState) *luaTable {
+	t := newLuaTable()
+	t.rawSet("huge", math.Inf(1))
+	t.rawSet("pi", math.Pi)
+	unary := map[string]func(float64) float64{
+		"floor": math.Floor, "ceil": math.Ceil, "abs": math.Abs, "sqrt": math.Sqrt,
+		"exp": math.Exp, "log": math.Log, "log10": math.Log10,
+	}
+	for name, f := range unary {
+		name, f := name, f
+		L.register(t, name, func(L *luaState, args []luaValue) []luaValue {
+			return []luaValue{f(L.checkNumber(args, 0, name))}
+		})
+	}
+	L.register(t, "fmod", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Mod(L.checkNumber(args, 0, "fmod"), L.checkNumber(args, 1, "fmod"))}
+	})
+	L.register(t, "pow", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Pow(L.checkNumber(args, 0, "pow"), L.checkNumber(args, 1, "pow"))}
+	})
+	L.register(t, "max", func(L *luaState, args []luaValue) []luaValue {
+		m := L.checkNumber(args, 0, "max")
+		for i := 1; i < len(args); i++ {
+			m = math.Max(m, L.checkNumber(args, i, "max"))
+		}
+		return []luaValue{m}
+	})
+	L.register(t, "min", func(L *luaState, args []luaValue) []luaValue {
+		m := L.checkNumber(args, 0, "min")
+		for i := 1; i < len(args); i++ {
+			m = math.Min(m, L.checkNumber(args, i, "min"))
+		}
+		return []luaValue{m}
+	})
+	t.readonly = true
+	return t
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/* The metrics are served in the Prometheus text format by an HTTP server running in its own
+ * goroutine, so a slow scrape never blocks the event loop. The goroutine can't read the state of
+ * the server, ServerCron renders the metrics every METRICS_REFRESH_PERIOD and the handler serves
+ * the latest rendering. */
+
+const (
+	METRICS_PORT           = 0    // the port of the HTTP listener, 0 disables it
+	METRICS_REFRESH_PERIOD = 1000 // ms, the period of the rendering of the metrics by ServerCron
+)
+
+// the upper bounds of the buckets of the latency histograms, in seconds
+var metricsLatencyBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// the latest rendering of the metrics, shared with the goroutine of the HTTP server
+var metricsSnapshot atomic.Value
+
+// startMetricsServer listens the port and serves /metrics in a new goroutine
+func startMetricsServer(port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("metrics server error: %v \n", err)
+		}
+	}()
+	return ln, nil
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	text, _ := metricsSnapshot.Load().(string)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(text))
+}
+
+// updateMetricsSnapshot renders the metrics for the HTTP server, it's called by ServerCron
+func updateMetricsSnapshot() {
+	metricsSnapshot.Store(genMetricsString())
+}
+
+// genMetricsString renders the metrics of the server in the Prometheus text format
+func genMetricsString() string {
+	var sb strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&sb, "# HELP gedis_%s %s\n# TYPE gedis_%s %s\n", name, help, name, typ)
+	}
+	sample := func(name, labels string, val any) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(&sb, "gedis_%s%s %v\n", name, labels, val)
+	}
+	m := updatePeakMemory()
+
+	metric("uptime_in_seconds", "gauge", "Seconds since the server started.")
+	sample("uptime_in_seconds", "", (GetTimeMs()-server.startTime)/1000)
+	metric("connected_clients", "gauge", "The clients connected, the replicas excluded.")
+	sample("connected_clients", "", len(server.clients)-len(server.slaves))
+	metric("blocked_clients", "gauge", "The clients waiting in a blocking command.")
+	sample("blocked_clients", "", len(server.blockedClients))
+	metric("connections_received_total", "counter", "The connections accepted.")
+	sample("connections_received_total", "", server.statNumConnections)
+	metric("rejected_connections_total", "counter", "The connections rejected because of maxclients.")
+	sample("rejected_connections_total", "", server.statRejectedConn)
+
+	metric("commands_processed_total", "counter", "The commands processed.")
+	sample("commands_processed_total", "", server.statNumCommands)
+	metric("instantaneous_ops_per_sec", "gauge", "The commands processed per second, the average of the latest samples.")
+	sample("instantaneous_ops_per_sec", "", getInstantaneousOps())
+	metric("error_replies_total", "counter", "The error replies.")
+	sample("error_replies_total", "", server.statTotalErrorReplies)
+	metric("keyspace_hits_total", "counter", "The lookups of the read commands finding the key.")
+	sample("keyspace_hits_total", "", server.statKeyspaceHits)
+	metric("keyspace_misses_total", "counter", "The lookups of the read commands missing the key.")
+	sample("keyspace_misses_total", "", server.statKeyspaceMisses)
+	metric("expired_keys_total", "counter", "The keys deleted once expired.")
+	sample("expired_keys_total", "", server.statExpiredKeys)
+
+	metric("db_keys", "gauge", "The keys of the database.")
+	sample("db_keys", `db="db0"`, server.db.data.Size())
+	metric("db_keys_expiring", "gauge", "The keys with a TTL of the database.")
+	sample("db_keys_expiring", `db="db0"`, server.db.expire.Size())
+
+	metric("memory_used_bytes", "gauge", "The memory allocated by the runtime.")
+	sample("memory_used_bytes", "", m.Alloc)
+	metric("memory_used_peak_bytes", "gauge", "The max of the memory allocated sampled.")
+	sample("memory_used_peak_bytes", "", server.statPeakMemory)
+	metric("memory_used_sys_bytes", "gauge", "The memory obtained from the OS by the runtime.")
+	sample("memory_used_sys_bytes", "", m.Sys)
+
+	metric("aof_rewrite_in_progress", "gauge", "Whether the AOF is being rewritten.")
+	sample("aof_rewrite_in_progress", "", boolToInt(server.aofRewriteChan != nil))
+	metric("aof_current_size_bytes", "gauge", "The size of the AOF.")
+	sample("aof_current_size_bytes", "", server.aofCurrentSize)
+	metric("aof_base_size_bytes", "gauge", "The size of the AOF at the latest rewrite or startup.")
+	sample("aof_base_size_bytes", "", server.aofRewriteBaseSize)
+	metric("aof_buffer_length_bytes", "gauge", "The bytes of the AOF buffer not written yet.")
+	sample("aof_buffer_length_bytes", "", len(server.aofBuf))
+
+	cmds := sortedStatsCommands()
+	metric("commands_total", "counter", "The calls of the command.")
+	for _, cmd := range cmds {
+		if stats := server.commandStats[cmd]; stats.calls > 0 {
+			sample("commands_total", `cmd="`+cmd.name+`"`, stats.calls)
+		}
+	}
+	metric("commands_rejected_calls_total", "counter", "The calls of the command rejected before the execution.")
+	for _, cmd := range cmds {
+		if stats := server.commandStats[cmd]; stats.rejectedCalls > 0 {
+			sample("commands_rejected_calls_total", `cmd="`+cmd.name+`"`, stats.rejectedCalls)
+		}
+	}
+	metric("commands_failed_calls_total", "counter", "The calls of the command which replied an error.")
+	for _, cmd := range cmds {
+		if stats := server.commandStats[cmd]; stats.failedCalls > 0 {
+			sample("commands_failed_calls_total", `cmd="`+cmd.name+`"`, stats.failedCalls)
+		}
+	}
+	metric("command_latency_seconds", "histogram", "The latency of the calls of the command.")
+	for _, cmd := range cmds {
+		stats := server.commandStats[cmd]
+		if stats.latency == nil || stats.latency.total == 0 {
+			continue
+		}
+		label := `cmd="` + cmd.name + `"`
+		for _, le := range metricsLatencyBuckets {
+			sample("command_latency_seconds_bucket", label+`,le="`+strconv.FormatFloat(le, 'f', -1, 64)+`"`,
+				stats.latency.countBelow(int64(le*1e9)))
+		}
+		sample("command_latency_seconds_bucket", label+`,le="+Inf"`, stats.latency.total)
+		sample("command_latency_seconds_sum", label, strconv.FormatFloat(float64(stats.latency.sum)/1e9, 'f', -1, 64))
+		sample("command_latency_seconds_count", label, stats.latency.total)
+	}
+	return sb.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "get", "k")
+	runCommand(c, "get", "nokey")
+	runCommand(c, "get")
+
+	ln, err := startMetricsServer(0)
+	assert.Nil(t, err)
+	defer ln.Close()
+	url := "http://" + ln.Addr().String() + "/metrics"
+
+	// nothing is served until the metrics are rendered
+	metricsSnapshot.Store("")
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+
+	updateMetricsSnapshot()
+	resp, err = http.Get(url)
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE gedis_commands_processed_total counter",
+		"gedis_commands_processed_total 3",
+		"gedis_connected_clients 0",
+		`gedis_db_keys{db="db0"} 1`,
+		`gedis_commands_total{cmd="get"} 2`,
+		`gedis_commands_rejected_calls_total{cmd="get"} 1`,
+		"gedis_keyspace_misses_total 1",
+		"gedis_aof_rewrite_in_progress 0",
+		"# TYPE gedis_command_latency_seconds histogram",
+		`gedis_command_latency_seconds_bucket{cmd="get",le="+Inf"} 2`,
+		`gedis_command_latency_seconds_count{cmd="set"} 1`,
+	} {
+		assert.True(t, strings.Contains(text, line+"\n"), line)
+	}
+	assert.True(t, strings.Contains(text, `gedis_command_latency_seconds_bucket{cmd="get",le="1"} 2`), text)
+
+	resp, err = http.Post(url, "text/plain", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Get("http://" + ln.Addr().String() + "/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
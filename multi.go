@@ -0,0 +1,176 @@
+package main
+
+/* In a transaction the commands are queued until EXEC executes all of them at once. The errors
+ * which can be detected before the execution, like an unknown command or the wrong number of
+ * arguments, make EXEC abort. WATCH makes EXEC abort if any of the watched keys is modified
+ * or expired before EXEC. */
+
+type multiCmd struct {
+	cmd  *GedisCommand
+	args []*GObj
+}
+
+type multiState struct {
+	commands []multiCmd // the queued commands
+}
+
+type propagatedCmd struct {
+	cmd  *GedisCommand
+	args []*GObj
+}
+
+func queueMultiCommand(c *GedisClient, cmd *GedisCommand) {
+	c.mstate.commands = append(c.mstate.commands, multiCmd{cmd: cmd, args: c.args})
+}
+
+func discardTransaction(c *GedisClient) {
+	c.mstate.commands = nil
+	c.flags &= ^(CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC)
+	unwatchAllKeys(c)
+}
+
+// flagTransaction makes EXEC abort if an error happened while queueing the command
+func flagTransaction(c *GedisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.flags |= CLIENT_DIRTY_EXEC
+	}
+}
+
+// the commands executed immediately in a transaction
+func isTransactionCommand(name string) bool {
+	switch name {
+	case "multi", "exec", "discard", "watch", "unwatch", "quit":
+		return true
+	}
+	return false
+}
+
+// propagateTransaction propagates the commands executed by EXEC wrapped in MULTI/EXEC,
+// nothing is propagated if none of them is a write command
+func propagateTransaction() {
+	commands := server.txCommands
+	server.inTransaction = false
+	server.txCommands = nil
+	if len(commands) == 0 {
+		return
+	}
+	alsoPropagate(NewObject(STR, "multi"))
+	for _, pc := range commands {
+		propagate(pc.cmd, pc.args)
+	}
+	alsoPropagate(NewObject(STR, "exec"))
+}
+
+/* watch */
+
+// watchForKey makes the client watch the key
+func watchForKey(c *GedisClient, key *GObj) {
+	for _, k := range c.watchedKeys {
+		if k.StrVal() == key.StrVal() {
+			return
+		}
+	}
+	c.watchedKeys = append(c.watchedKeys, key)
+	server.watchedKeys[key.StrVal()] = append(server.watchedKeys[key.StrVal()], c)
+}
+
+func unwatchAllKeys(c *GedisClient) {
+	for _, key := range c.watchedKeys {
+		removeClient(server.watchedKeys, key.StrVal(), c)
+	}
+	c.watchedKeys = nil
+}
+
+// touchWatchedKey makes the EXEC of the clients watching the key abort
+func touchWatchedKey(key *GObj) {
+	for _, c := range server.watchedKeys[key.StrVal()] {
+		c.flags |= CLIENT_DIRTY_CAS
+	}
+}
+
+// touchAllWatchedKeys is touchWatchedKey of every existing key, before the dataset is emptied
+func touchAllWatchedKeys() {
+	for key, clients := range server.watchedKeys {
+		if server.db.data.Find(NewObject(STR, key)) == nil {
+			continue
+		}
+		for _, c := range clients {
+			c.flags |= CLIENT_DIRTY_CAS
+		}
+	}
+}
+
+/* transaction command implement */
+
+// MULTI
+var multiCommand CommandProc = func(c *GedisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("MULTI calls can not be nested")
+		return
+	}
+	c.flags |= CLIENT_MULTI | CLIENT_PREVENT_PROP
+	c.AddReply(REPLY_OK)
+}
+
+// DISCARD
+var discardCommand CommandProc = func(c *GedisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("DISCARD without MULTI")
+		return
+	}
+	discardTransaction(c)
+	c.AddReply(REPLY_OK)
+}
+
+// EXEC
+var execCommand CommandProc = func(c *GedisClient) {
+	// MULTI and EXEC are propagated with the commands of the transaction
+	defer func() { c.flags |= CLIENT_PREVENT_PROP }()
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("EXEC without MULTI")
+		return
+	}
+	if c.flags&CLIENT_DIRTY_EXEC != 0 {
+		c.AddReplyError("-EXECABORT Transaction discarded because of previous errors.")
+		discardTransaction(c)
+		return
+	}
+	// a watched key was touched
+	if c.flags&CLIENT_DIRTY_CAS != 0 {
+		c.AddReplyNullArray()
+		discardTransaction(c)
+		return
+	}
+
+	// the keys modified by the transaction itself don't need to be watched
+	unwatchAllKeys(c)
+	server.inTransaction = true
+	origArgs := c.args
+	c.AddReplyArrayLen(len(c.mstate.commands))
+	for _, mc := range c.mstate.commands {
+		c.args = mc.args
+		call(c, mc.cmd)
+	}
+	c.args = origArgs
+	discardTransaction(c)
+	propagateTransaction()
+}
+
+// WATCH key [key ...]
+var watchCommand CommandProc = func(c *GedisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("WATCH inside MULTI is not allowed")
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		watchForKey(c, c.args[i])
+	}
+	c.AddReply(REPLY_OK)
+}
+
+// UNWATCH
+var unwatchCommand CommandProc = func(c *GedisClient) {
+	unwatchAllKeys(c)
+	c.flags &= ^CLIENT_DIRTY_CAS
+	c.AddReply(REPLY_OK)
+}
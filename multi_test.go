@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMultiExec(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n", runCommand(c, "exec"))
+	assert.Equal(t, "-ERR DISCARD without MULTI\r\n", runCommand(c, "discard"))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "multi"))
+	assert.Equal(t, "-ERR MULTI calls can not be nested\r\n", runCommand(c, "multi"))
+	assert.Equal(t, "+QUEUED\r\n", runCommand(c, "set", "k", "v"))
+	assert.Equal(t, "+QUEUED\r\n", runCommand(c, "get", "k"))
+	// the commands are not executed until EXEC
+	assert.Nil(t, server.db.data.Find(NewObject(STR, "k")))
+	assert.Equal(t, "*2\r\n"+REPLY_OK+"$1\r\nv\r\n", runCommand(c, "exec"))
+	assert.Equal(t, 0, c.flags&CLIENT_MULTI)
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "multi"))
+	assert.Equal(t, "+QUEUED\r\n", runCommand(c, "set", "k", "v2"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "discard"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+
+	// the errors while queueing make EXEC abort
+	runCommand(c, "multi")
+	assert.Equal(t, REPLY_UNKNOWN_CMD, runCommand(c, "nosuchcommand"))
+	assert.Equal(t, "+QUEUED\r\n", runCommand(c, "set", "k", "v2"))
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", runCommand(c, "exec"))
+	runCommand(c, "multi")
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "set", "k"))
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", runCommand(c, "exec"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+
+	// the runtime errors don't abort the rest of the transaction
+	runCommand(c, "multi")
+	runCommand(c, "zadd", "k", "1", "m")
+	runCommand(c, "set", "k", "v3")
+	assert.Equal(t, "*2\r\n"+REPLY_WRONG_TYPE+REPLY_OK, runCommand(c, "exec"))
+}
+
+func TestWatch(t *testing.T) {
+	initTestServer(t)
+	c, other := NewClient(0), NewClient(0)
+
+	runCommand(c, "set", "k", "v")
+	assert.Equal(t, REPLY_OK, runCommand(c, "watch", "k", "k"))
+	assert.Equal(t, 1, len(server.watchedKeys["k"]))
+	runCommand(other, "set", "k", "other")
+	runCommand(c, "multi")
+	assert.Equal(t, "-ERR WATCH inside MULTI is not allowed\r\n", runCommand(c, "watch", "k"))
+	runCommand(c, "set", "k", "mine")
+	assert.Equal(t, "*-1\r\n", runCommand(c, "exec"))
+	assert.Equal(t, "$5\r\nother\r\n", runCommand(c, "get", "k"))
+	// EXEC unwatches all the keys
+	assert.Equal(t, 0, len(server.watchedKeys))
+
+	// the keys which are not touched don't abort EXEC
+	runCommand(c, "watch", "k")
+	runCommand(other, "set", "k2", "other")
+	runCommand(c, "multi")
+	runCommand(c, "set", "k", "mine")
+	assert.Equal(t, "*1\r\n"+REPLY_OK, runCommand(c, "exec"))
+
+	runCommand(c, "watch", "k")
+	runCommand(other, "set", "k", "other")
+	assert.Equal(t, REPLY_OK, runCommand(c, "unwatch"))
+	runCommand(c, "multi")
+	runCommand(c, "set", "k", "mine")
+	assert.Equal(t, "*1\r\n"+REPLY_OK, runCommand(c, "exec"))
+
+	// an expired key is touched
+	at := time.Now().UnixMilli() + 50
+	runCommand(c, "pexpireat", "k", strconv.FormatInt(at, 10))
+	runCommand(c, "watch", "k")
+	time.Sleep(60 * time.Millisecond)
+	runCommand(other, "get", "k")
+	runCommand(c, "multi")
+	runCommand(c, "set", "k", "mine")
+	assert.Equal(t, "*-1\r\n", runCommand(c, "exec"))
+
+	// the freed client stops watching
+	runCommand(c, "watch", "k")
+	freeClient(c)
+	assert.Equal(t, 0, len(server.watchedKeys))
+}
+
+func TestMultiPropagate(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	server.aofFileName = "test_multi.aof"
+	defer os.Remove(server.aofFileName)
+
+	// a read only transaction propagates nothing
+	runCommand(c, "multi")
+	runCommand(c, "get", "k")
+	runCommand(c, "exec")
+	assert.Equal(t, "", server.aofBuf)
+
+	runCommand(c, "multi")
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "get", "k")
+	runCommand(c, "zadd", "z", "1", "m")
+	runCommand(c, "exec")
+	assert.Equal(t, "*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"+
+		"*4\r\n$4\r\nzadd\r\n$1\r\nz\r\n$1\r\n1\r\n$1\r\nm\r\n*1\r\n$4\r\nexec\r\n", server.aofBuf)
+
+	// the incomplete transaction at the end of the file is reverted
+	aof := server.aofBuf + "*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\nx\r\n$1\r\ny\r\n"
+	assert.Nil(t, os.WriteFile(server.aofFileName, []byte(aof), 0666))
+	initTestServer(t)
+	server.aofFileName = "test_multi.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	c = NewClient(0)
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+	assert.Equal(t, REPLY_NIL, runCommand(c, "get", "x"))
+}
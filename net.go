@@ -2,16 +2,22 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"syscall"
+	"unsafe"
 )
 
+// Read returns io.EOF once the peer closed the connection
 func Read(nfd int, b []byte) (n int, err error) {
 	n, err = syscall.Read(nfd, b)
 	if err != nil {
 		if err == syscall.EAGAIN || err == syscall.EINTR {
 			return 0, nil
 		}
+	} else if n == 0 && len(b) > 0 {
+		return 0, io.EOF
 	}
 	return n, err
 }
@@ -26,6 +32,18 @@ func Write(nfd int, b []byte) (n int, err error) {
 	return n, err
 }
 
+// Writev writes the buffers described by the iovecs in one syscall
+func Writev(nfd int, iovs []syscall.Iovec) (int, error) {
+	n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(nfd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if errno != 0 {
+		if errno == syscall.EAGAIN || errno == syscall.EINTR {
+			return 0, nil
+		}
+		return 0, errno
+	}
+	return int(n), nil
+}
+
 func Accept(fd int) (int, error) {
 	nfd, _, err := syscall.Accept(fd)
 	return nfd, err
@@ -49,6 +67,96 @@ func Dial(host [4]byte, port int) (int, error) {
 	return sfd, nil
 }
 
+// DialNonBlock starts connecting to the host without waiting, the socket becomes writable once
+// the connection is established or failed
+func DialNonBlock(host string, port int) (int, error) {
+	ip, err := ResolveIPv4(host)
+	if err != nil {
+		return -1, err
+	}
+	sfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		log.Printf("init socket error: %v \n", err)
+		return -1, err
+	}
+	if err = syscall.SetNonblock(sfd, true); err != nil {
+		_ = syscall.Close(sfd)
+		return -1, err
+	}
+	err = syscall.Connect(sfd, &syscall.SockaddrInet4{Port: port, Addr: ip})
+	if err != nil && err != syscall.EINPROGRESS {
+		_ = syscall.Close(sfd)
+		return -1, err
+	}
+	return sfd, nil
+}
+
+// SocketError returns the pending error of the socket, like the result of a non blocking connect
+func SocketError(fd int) error {
+	errno, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
+// ResolveIPv4 resolves the host name or the dotted address
+func ResolveIPv4(host string) ([4]byte, error) {
+	var ip [4]byte
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return ip, err
+	}
+	copy(ip[:], addr.IP.To4())
+	return ip, nil
+}
+
+// PeerName returns the address of the peer connected to the socket
+func PeerName(fd int) (string, int, error) {
+	sa, err := syscall.Getpeername(fd)
+	if err != nil {
+		return "", 0, err
+	}
+	if in4, ok := sa.(*syscall.SockaddrInet4); ok {
+		return net.IP(in4.Addr[:]).String(), in4.Port, nil
+	}
+	return "", 0, fmt.Errorf("unsupported address %v", sa)
+}
+
+// SockName returns the local address of the socket
+func SockName(fd int) (string, int, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return "", 0, err
+	}
+	if in4, ok := sa.(*syscall.SockaddrInet4); ok {
+		return net.IP(in4.Addr[:]).String(), in4.Port, nil
+	}
+	return "", 0, fmt.Errorf("unsupported address %v", sa)
+}
+
+// KeepAlive turns on the TCP keepalive of the socket, the first probe is sent after the
+// connection is idle for interval seconds, and the peer is considered dead after 3 more probes
+func KeepAlive(fd int, interval int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, interval); err != nil {
+		return err
+	}
+	probeInterval := interval / 3
+	if probeInterval == 0 {
+		probeInterval = 1
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, probeInterval); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3)
+}
+
 func TcpServer(port int) (int, error) {
 	sfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
 	if err != nil {
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"syscall"
 	"testing"
 )
 
@@ -56,3 +57,20 @@ func TestNet(t *testing.T) {
 	err = Close(nfd)
 	assert.Nil(t, err)
 }
+
+func TestKeepAlive(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fd)
+	assert.Nil(t, KeepAlive(fd, 100))
+	for opt, val := range map[[2]int]int{
+		{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE}:   1,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE}:  100,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL}: 33,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT}:   3,
+	} {
+		got, err := syscall.GetsockoptInt(fd, opt[0], opt[1])
+		assert.Nil(t, err)
+		assert.Equal(t, val, got)
+	}
+}
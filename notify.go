@@ -0,0 +1,93 @@
+package main
+
+import "strings"
+
+/* The keyspace notifications publish the events of the keys to the pub/sub channels, the
+ * keyspace channel __keyspace@0__:<key> gets the name of event, and the keyevent channel
+ * __keyevent@0__:<event> gets the name of key. The classes of events to notify are
+ * configured by notify-keyspace-events, nothing is notified by default. */
+
+const (
+	NOTIFY_KEYSPACE = 1 << 0  // K
+	NOTIFY_KEYEVENT = 1 << 1  // E
+	NOTIFY_GENERIC  = 1 << 2  // g
+	NOTIFY_STRING   = 1 << 3  // $
+	NOTIFY_LIST     = 1 << 4  // l
+	NOTIFY_SET      = 1 << 5  // s
+	NOTIFY_HASH     = 1 << 6  // h
+	NOTIFY_ZSET     = 1 << 7  // z
+	NOTIFY_EXPIRED  = 1 << 8  // x
+	NOTIFY_EVICTED  = 1 << 9  // e
+	NOTIFY_STREAM   = 1 << 10 // t
+	NOTIFY_KEY_MISS = 1 << 11 // m, excluded from all
+	NOTIFY_NEW      = 1 << 12 // n, excluded from all
+	NOTIFY_ALL      = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM // A
+)
+
+// the class of every character of notify-keyspace-events, in the order of the string form
+var notifyClasses = []struct {
+	ch    byte
+	class int
+}{
+	{'g', NOTIFY_GENERIC}, {'$', NOTIFY_STRING}, {'l', NOTIFY_LIST}, {'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH}, {'z', NOTIFY_ZSET}, {'x', NOTIFY_EXPIRED}, {'e', NOTIFY_EVICTED},
+	{'t', NOTIFY_STREAM}, {'m', NOTIFY_KEY_MISS}, {'n', NOTIFY_NEW},
+	{'K', NOTIFY_KEYSPACE}, {'E', NOTIFY_KEYEVENT},
+}
+
+// keyspaceEventsStringToFlags parses the classes like "KEg$", -1 is returned if any of the
+// characters is invalid
+func keyspaceEventsStringToFlags(classes string) int {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		if classes[i] == 'A' {
+			flags |= NOTIFY_ALL
+			continue
+		}
+		found := false
+		for _, nc := range notifyClasses {
+			if nc.ch == classes[i] {
+				flags |= nc.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return -1
+		}
+	}
+	return flags
+}
+
+// keyspaceEventsFlagsToString is the reverse of keyspaceEventsStringToFlags, "A" is used if
+// all the classes are set
+func keyspaceEventsFlagsToString(flags int) string {
+	var sb strings.Builder
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		sb.WriteByte('A')
+	}
+	for _, nc := range notifyClasses {
+		if flags&NOTIFY_ALL == NOTIFY_ALL && nc.class&NOTIFY_ALL != 0 {
+			continue
+		}
+		if flags&nc.class != 0 {
+			sb.WriteByte(nc.ch)
+		}
+	}
+	return sb.String()
+}
+
+// notifyKeyspaceEvent publishes the event of the key if the class of event is enabled
+func notifyKeyspaceEvent(class int, event string, key *GObj) {
+	flags := server.notifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	if flags&NOTIFY_KEYSPACE != 0 {
+		pubsubPublishMessage("__keyspace@0__:"+key.StrVal(), event, &pubsubTypeNormal)
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		pubsubPublishMessage("__keyevent@0__:"+event, key.StrVal(), &pubsubTypeNormal)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeyspaceEventsFlags(t *testing.T) {
+	assert.Equal(t, 0, keyspaceEventsStringToFlags(""))
+	assert.Equal(t, NOTIFY_KEYSPACE|NOTIFY_GENERIC|NOTIFY_STRING, keyspaceEventsStringToFlags("Kg$"))
+	assert.Equal(t, NOTIFY_KEYEVENT|NOTIFY_ALL, keyspaceEventsStringToFlags("EA"))
+	assert.Equal(t, -1, keyspaceEventsStringToFlags("Kq"))
+
+	assert.Equal(t, "g$K", keyspaceEventsFlagsToString(keyspaceEventsStringToFlags("K$g")))
+	assert.Equal(t, "AmKE", keyspaceEventsFlagsToString(keyspaceEventsStringToFlags("KEAm")))
+}
+
+// keyspaceMessages is the messages the subscriber of the pattern "__key*__:*" gets for the events
+func keyspaceMessages(events ...string) string {
+	reply := ""
+	for i := 0; i < len(events); i += 2 {
+		key, event := events[i], events[i+1]
+		for _, m := range [][2]string{{"__keyspace@0__:" + key, event}, {"__keyevent@0__:" + event, key}} {
+			reply += fmt.Sprintf("*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+				len(m[0]), m[0], len(m[1]), m[1])
+		}
+	}
+	return reply
+}
+
+func TestNotifyKeyspaceEvent(t *testing.T) {
+	initTestServer(t)
+	sub, c := NewClient(0), NewClient(0)
+	runCommand(sub, "psubscribe", "__key*__:*")
+
+	// nothing is notified by default
+	runCommand(c, "set", "k", "v")
+	assert.Equal(t, "", drainClientReply(sub))
+
+	server.notifyKeyspaceEvents = keyspaceEventsStringToFlags("KEA")
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "expire", "k", "100")
+	assert.Equal(t, keyspaceMessages("k", "set", "k", "expire"), drainClientReply(sub))
+
+	runCommand(c, "rpush", "l", "a")
+	runCommand(c, "lpop", "l", "1")
+	assert.Equal(t, keyspaceMessages("l", "rpush", "l", "lpop", "l", "del"), drainClientReply(sub))
+
+	runCommand(c, "zadd", "z", "1", "a")
+	runCommand(c, "zincrby", "z", "1", "a")
+	runCommand(c, "zrem", "z", "a")
+	assert.Equal(t, keyspaceMessages("z", "zadd", "z", "zincr", "z", "zrem", "z", "del"), drainClientReply(sub))
+
+	runCommand(c, "xadd", "s", "maxlen", "1", "*", "f", "v")
+	runCommand(c, "xadd", "s", "maxlen", "1", "*", "f", "v")
+	runCommand(c, "xgroup", "create", "s", "g", "0")
+	runCommand(c, "xreadgroup", "group", "g", "alice", "streams", "s", ">")
+	runCommand(c, "xreadgroup", "group", "g", "alice", "streams", "s", ">")
+	assert.Equal(t, keyspaceMessages("s", "xadd", "s", "xadd", "s", "xtrim", "s", "xgroup-create",
+		"s", "xgroup-createconsumer"), drainClientReply(sub))
+
+	// the failed command notifies nothing
+	runCommand(c, "lpush", "k", "a")
+	runCommand(c, "zrem", "none", "a")
+	assert.Equal(t, "", drainClientReply(sub))
+
+	// only the enabled classes are notified
+	server.notifyKeyspaceEvents = keyspaceEventsStringToFlags("Kl")
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "lpush", "l", "a")
+	runCommand(c, "rpop", "l", "1")
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$16\r\n__keyspace@0__:l\r\n$5\r\nlpush\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$16\r\n__keyspace@0__:l\r\n$4\r\nrpop\r\n", drainClientReply(sub))
+}
+
+func TestNotifyExpired(t *testing.T) {
+	initTestServer(t)
+	sub, c := NewClient(0), NewClient(0)
+	runCommand(sub, "psubscribe", "__key*__:*")
+	server.notifyKeyspaceEvents = keyspaceEventsStringToFlags("KEx")
+
+	runCommand(c, "set", "k", "v")
+	runCommand(c, "pexpireat", "k", "1")
+	assert.Equal(t, "", drainClientReply(sub))
+	assert.Equal(t, REPLY_NIL, runCommand(c, "get", "k"))
+	assert.Equal(t, keyspaceMessages("k", "expired"), drainClientReply(sub))
+}
@@ -9,6 +9,7 @@ const (
 	DICT   GType = 3
 	ZSET   GType = 4
 	BITMAP GType = 5
+	STREAM GType = 6
 )
 
 type GObj struct {
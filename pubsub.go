@@ -0,0 +1,343 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+/* The server keeps the subscribed clients of every channel and pattern, and every client keeps
+ * the channels and patterns it subscribed, so both PUBLISH and UNSUBSCRIBE are cheap. A client
+ * with at least one subscription is in the pub/sub mode, where only the pub/sub commands, PING
+ * and QUIT are allowed. The sharded channels work the same as the channels, but in their own
+ * namespace. */
+
+type pubsubType struct {
+	shard          bool
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageBulk    string
+	// the channels of the server, and of the client
+	serverChannels func() map[string][]*GedisClient
+	clientChannels func(c *GedisClient) map[string]struct{}
+	// the count of subscriptions replied to the client
+	subscriptionCount func(c *GedisClient) int
+}
+
+var pubsubTypeNormal = pubsubType{
+	shard:          false,
+	subscribeMsg:   "subscribe",
+	unsubscribeMsg: "unsubscribe",
+	messageBulk:    "message",
+	serverChannels: func() map[string][]*GedisClient {
+		return server.pubsubChannels
+	},
+	clientChannels: func(c *GedisClient) map[string]struct{} {
+		return c.pubsubChannels
+	},
+	subscriptionCount: clientSubscriptionsCount,
+}
+
+var pubsubTypeShard = pubsubType{
+	shard:          true,
+	subscribeMsg:   "ssubscribe",
+	unsubscribeMsg: "sunsubscribe",
+	messageBulk:    "smessage",
+	serverChannels: func() map[string][]*GedisClient {
+		return server.pubsubShardChannels
+	},
+	clientChannels: func(c *GedisClient) map[string]struct{} {
+		return c.pubsubShardChannels
+	},
+	subscriptionCount: clientShardSubscriptionsCount,
+}
+
+// the count of channels and patterns subscribed by the client
+func clientSubscriptionsCount(c *GedisClient) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+func clientShardSubscriptionsCount(c *GedisClient) int {
+	return len(c.pubsubShardChannels)
+}
+
+// updatePubsubFlag sets CLIENT_PUBSUB if the client has any subscription, otherwise clears it
+func updatePubsubFlag(c *GedisClient) {
+	if clientSubscriptionsCount(c)+clientShardSubscriptionsCount(c) > 0 {
+		c.flags |= CLIENT_PUBSUB
+	} else {
+		c.flags &= ^CLIENT_PUBSUB
+	}
+}
+
+func addReplyBulkStrings(c *GedisClient, strs ...string) {
+	c.AddReplyArrayLen(len(strs))
+	for _, s := range strs {
+		c.AddReplyBulkString(s)
+	}
+}
+
+// addReplyPubsubSubscribed replies the (un)subscription of the channel with the count of
+// subscriptions, a nil channel means the client had nothing to unsubscribe
+func addReplyPubsubSubscribed(c *GedisClient, kind string, channel *string, count int) {
+	c.AddReplyPushLen(3)
+	c.AddReplyBulkString(kind)
+	if channel == nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyBulkString(*channel)
+	}
+	c.AddReplyLongLong(int64(count))
+}
+
+// pubsubSubscribeChannel subscribes the client to the channel, false is returned if the
+// client already subscribed it
+func pubsubSubscribeChannel(c *GedisClient, channel string, t *pubsubType) bool {
+	subscribed := false
+	if _, ok := t.clientChannels(c)[channel]; !ok {
+		t.clientChannels(c)[channel] = struct{}{}
+		t.serverChannels()[channel] = append(t.serverChannels()[channel], c)
+		subscribed = true
+	}
+	updatePubsubFlag(c)
+	addReplyPubsubSubscribed(c, t.subscribeMsg, &channel, t.subscriptionCount(c))
+	return subscribed
+}
+
+// pubsubUnsubscribeChannel unsubscribes the client from the channel, false is returned if the
+// client didn't subscribe it
+func pubsubUnsubscribeChannel(c *GedisClient, channel string, notify bool, t *pubsubType) bool {
+	unsubscribed := false
+	if _, ok := t.clientChannels(c)[channel]; ok {
+		delete(t.clientChannels(c), channel)
+		removeClient(t.serverChannels(), channel, c)
+		unsubscribed = true
+	}
+	updatePubsubFlag(c)
+	if notify {
+		addReplyPubsubSubscribed(c, t.unsubscribeMsg, &channel, t.subscriptionCount(c))
+	}
+	return unsubscribed
+}
+
+// pubsubUnsubscribeAllChannels unsubscribes the client from all the channels, returns the count
+func pubsubUnsubscribeAllChannels(c *GedisClient, notify bool, t *pubsubType) int {
+	count := 0
+	for _, channel := range sortedKeys(t.clientChannels(c)) {
+		if pubsubUnsubscribeChannel(c, channel, notify, t) {
+			count++
+		}
+	}
+	// the client is notified even if it had nothing to unsubscribe
+	if notify && count == 0 {
+		addReplyPubsubSubscribed(c, t.unsubscribeMsg, nil, t.subscriptionCount(c))
+	}
+	return count
+}
+
+func pubsubSubscribePattern(c *GedisClient, pattern string) bool {
+	subscribed := false
+	if _, ok := c.pubsubPatterns[pattern]; !ok {
+		c.pubsubPatterns[pattern] = struct{}{}
+		server.pubsubPatterns[pattern] = append(server.pubsubPatterns[pattern], c)
+		subscribed = true
+	}
+	updatePubsubFlag(c)
+	addReplyPubsubSubscribed(c, "psubscribe", &pattern, clientSubscriptionsCount(c))
+	return subscribed
+}
+
+func pubsubUnsubscribePattern(c *GedisClient, pattern string, notify bool) bool {
+	unsubscribed := false
+	if _, ok := c.pubsubPatterns[pattern]; ok {
+		delete(c.pubsubPatterns, pattern)
+		removeClient(server.pubsubPatterns, pattern, c)
+		unsubscribed = true
+	}
+	updatePubsubFlag(c)
+	if notify {
+		addReplyPubsubSubscribed(c, "punsubscribe", &pattern, clientSubscriptionsCount(c))
+	}
+	return unsubscribed
+}
+
+func pubsubUnsubscribeAllPatterns(c *GedisClient, notify bool) int {
+	count := 0
+	for _, pattern := range sortedKeys(c.pubsubPatterns) {
+		if pubsubUnsubscribePattern(c, pattern, notify) {
+			count++
+		}
+	}
+	if notify && count == 0 {
+		addReplyPubsubSubscribed(c, "punsubscribe", nil, clientSubscriptionsCount(c))
+	}
+	return count
+}
+
+// pubsubUnsubscribeAll removes all the subscriptions of the client without notification
+func pubsubUnsubscribeAll(c *GedisClient) {
+	pubsubUnsubscribeAllChannels(c, false, &pubsubTypeNormal)
+	pubsubUnsubscribeAllChannels(c, false, &pubsubTypeShard)
+	pubsubUnsubscribeAllPatterns(c, false)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deliverPubsubMessage appends the message to the reply list of the subscriber, which is a
+// push message in RESP3
+func deliverPubsubMessage(c *GedisClient, strs ...string) {
+	c.flags |= CLIENT_PUSHING
+	c.AddReplyPushLen(len(strs))
+	for _, s := range strs {
+		c.AddReplyBulkString(s)
+	}
+	c.flags &= ^CLIENT_PUSHING
+	server.aeloop.AddFileEvent(c.nfd, AE_WRITABLE, SendReplyToClient, c)
+}
+
+// pubsubPublishMessage publishes the message to the subscribers of the channel and of the
+// patterns matching the channel, returns the count of the receivers
+func pubsubPublishMessage(channel, message string, t *pubsubType) int {
+	receivers := 0
+	for _, c := range t.serverChannels()[channel] {
+		deliverPubsubMessage(c, t.messageBulk, channel, message)
+		receivers++
+	}
+	if t.shard {
+		return receivers
+	}
+	for pattern, clients := range server.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for _, c := range clients {
+			deliverPubsubMessage(c, "pmessage", pattern, channel, message)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+/* pub/sub command implement */
+
+// SUBSCRIBE channel [channel ...]
+var subscribeCommand CommandProc = func(c *GedisClient) {
+	for i := 1; i < len(c.args); i++ {
+		pubsubSubscribeChannel(c, c.args[i].StrVal(), &pubsubTypeNormal)
+	}
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+var unsubscribeCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) == 1 {
+		pubsubUnsubscribeAllChannels(c, true, &pubsubTypeNormal)
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		pubsubUnsubscribeChannel(c, c.args[i].StrVal(), true, &pubsubTypeNormal)
+	}
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+var psubscribeCommand CommandProc = func(c *GedisClient) {
+	for i := 1; i < len(c.args); i++ {
+		pubsubSubscribePattern(c, c.args[i].StrVal())
+	}
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+var punsubscribeCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		pubsubUnsubscribePattern(c, c.args[i].StrVal(), true)
+	}
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+var ssubscribeCommand CommandProc = func(c *GedisClient) {
+	for i := 1; i < len(c.args); i++ {
+		pubsubSubscribeChannel(c, c.args[i].StrVal(), &pubsubTypeShard)
+	}
+}
+
+// SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+var sunsubscribeCommand CommandProc = func(c *GedisClient) {
+	if len(c.args) == 1 {
+		pubsubUnsubscribeAllChannels(c, true, &pubsubTypeShard)
+		return
+	}
+	for i := 1; i < len(c.args); i++ {
+		pubsubUnsubscribeChannel(c, c.args[i].StrVal(), true, &pubsubTypeShard)
+	}
+}
+
+// PUBLISH channel message
+var publishCommand CommandProc = func(c *GedisClient) {
+	receivers := pubsubPublishMessage(c.args[1].StrVal(), c.args[2].StrVal(), &pubsubTypeNormal)
+	c.AddReplyLongLong(int64(receivers))
+}
+
+// SPUBLISH shardchannel message
+var spublishCommand CommandProc = func(c *GedisClient) {
+	receivers := pubsubPublishMessage(c.args[1].StrVal(), c.args[2].StrVal(), &pubsubTypeShard)
+	c.AddReplyLongLong(int64(receivers))
+}
+
+// addReplyChannelList replies the channels matching the pattern, all the channels if pattern is nil
+func addReplyChannelList(c *GedisClient, channels map[string][]*GedisClient, pattern *GObj) {
+	var names []string
+	for channel := range channels {
+		if pattern == nil || stringMatch(pattern.StrVal(), channel, false) {
+			names = append(names, channel)
+		}
+	}
+	sort.Strings(names)
+	addReplyBulkStrings(c, names...)
+}
+
+// addReplyNumSub replies the channels with the count of their subscribers
+func addReplyNumSub(c *GedisClient, channels map[string][]*GedisClient) {
+	c.AddReplyArrayLen((len(c.args) - 2) * 2)
+	for i := 2; i < len(c.args); i++ {
+		c.AddReplyBulk(c.args[i])
+		c.AddReplyLongLong(int64(len(channels[c.args[i].StrVal()])))
+	}
+}
+
+// PUBSUB CHANNELS [pattern]
+// PUBSUB NUMSUB [channel ...]
+// PUBSUB NUMPAT
+// PUBSUB SHARDCHANNELS [pattern]
+// PUBSUB SHARDNUMSUB [shardchannel ...]
+var pubsubCommand CommandProc = func(c *GedisClient) {
+	opt := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case (opt == "channels" || opt == "shardchannels") && len(c.args) <= 3:
+		channels := server.pubsubChannels
+		if opt == "shardchannels" {
+			channels = server.pubsubShardChannels
+		}
+		var pattern *GObj
+		if len(c.args) == 3 {
+			pattern = c.args[2]
+		}
+		addReplyChannelList(c, channels, pattern)
+	case opt == "numsub":
+		addReplyNumSub(c, server.pubsubChannels)
+	case opt == "shardnumsub":
+		addReplyNumSub(c, server.pubsubShardChannels)
+	case opt == "numpat" && len(c.args) == 2:
+		c.AddReplyLongLong(int64(len(server.pubsubPatterns)))
+	default:
+		c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+	}
+}
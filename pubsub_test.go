@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPubsubCommands(t *testing.T) {
+	initTestServer(t)
+	sub, psub, pub, c := NewClient(0), NewClient(0), NewClient(0), NewClient(0)
+
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n",
+		runCommand(sub, "subscribe", "news", "sport"))
+	assert.NotEqual(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$3\r\nn*s\r\n:1\r\n", runCommand(psub, "psubscribe", "n*s"))
+
+	// only the pub/sub commands are allowed in the pub/sub mode
+	assert.Equal(t, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n",
+		runCommand(sub, "get", "k"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", runCommand(sub, "ping"))
+	assert.Equal(t, "+PONG\r\n", runCommand(pub, "ping"))
+
+	assert.Equal(t, ":2\r\n", runCommand(pub, "publish", "news", "hello"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", drainClientReply(sub))
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$3\r\nn*s\r\n$4\r\nnews\r\n$5\r\nhello\r\n", drainClientReply(psub))
+	assert.Equal(t, ":0\r\n", runCommand(pub, "publish", "nothing", "hello"))
+
+	assert.Equal(t, "*2\r\n$4\r\nnews\r\n$5\r\nsport\r\n", runCommand(pub, "pubsub", "channels"))
+	assert.Equal(t, "*1\r\n$5\r\nsport\r\n", runCommand(pub, "pubsub", "channels", "s*"))
+	assert.Equal(t, "*4\r\n$4\r\nnews\r\n:1\r\n$3\r\nfoo\r\n:0\r\n", runCommand(pub, "pubsub", "numsub", "news", "foo"))
+	assert.Equal(t, ":1\r\n", runCommand(pub, "pubsub", "numpat"))
+
+	// sharded channels are in their own namespace
+	assert.Equal(t, "*3\r\n$10\r\nssubscribe\r\n$4\r\nnews\r\n:1\r\n", runCommand(pub, "ssubscribe", "news"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "spublish", "news", "hi"))
+	assert.Equal(t, "*3\r\n$8\r\nsmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n", drainClientReply(pub))
+	assert.Equal(t, "*1\r\n$4\r\nnews\r\n", runCommand(c, "pubsub", "shardchannels"))
+	assert.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$4\r\nnews\r\n:0\r\n", runCommand(pub, "sunsubscribe"))
+	assert.Equal(t, 0, pub.flags&CLIENT_PUBSUB)
+
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:0\r\n",
+		runCommand(sub, "unsubscribe"))
+	assert.Equal(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n"+REPLY_NIL+":0\r\n", runCommand(sub, "unsubscribe"))
+	assert.Equal(t, 0, len(server.pubsubChannels))
+
+	pubsubUnsubscribeAll(psub)
+	assert.Equal(t, 0, psub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, 0, len(server.pubsubPatterns))
+
+	assert.Equal(t, REPLY_OK, runCommand(pub, "quit"))
+	assert.NotEqual(t, 0, pub.flags&CLIENT_CLOSE_AFTER_REPLY)
+}
+
+func TestPubsubResp3(t *testing.T) {
+	initTestServer(t)
+	sub, pub := NewClient(0), NewClient(0)
+	sub.resp = 3
+
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n", runCommand(sub, "subscribe", "news"))
+	runCommand(pub, "publish", "news", "hello")
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", drainClientReply(sub))
+
+	// any command is allowed while subscribed
+	assert.Equal(t, "_\r\n", runCommand(sub, "get", "k"))
+	assert.Equal(t, "+PONG\r\n", runCommand(sub, "ping"))
+	assert.Equal(t, ">3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:0\r\n", runCommand(sub, "unsubscribe"))
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* The replica connects to the master and asks PSYNC with the replication ID and the offset of
+ * its dataset. The master continues from the offset if its backlog still has the bytes, or
+ * sends the snapshot of the dataset followed by the stream of the write commands. A replica
+ * proxies the stream of its master to its own backlog and replicas, so the offsets are the
+ * same along the chain. The replicas acknowledge the applied offset every second by
+ * REPLCONF ACK, and WAIT blocks until enough replicas acknowledged the writes. */
+
+const (
+	REPL_STATE_NONE          = 0 // not a replica
+	REPL_STATE_CONNECT       = 1 // connect to the master by the cron
+	REPL_STATE_CONNECTING    = 2 // the non blocking connect is in progress
+	REPL_STATE_RECEIVE_PING  = 3 // the handshake, waiting for the reply of every step
+	REPL_STATE_RECEIVE_PORT  = 4
+	REPL_STATE_RECEIVE_CAPA  = 5
+	REPL_STATE_RECEIVE_PSYNC = 6
+	REPL_STATE_TRANSFER      = 7 // receiving the snapshot
+	REPL_STATE_CONNECTED     = 8 // the master link is up
+
+	REPL_SYNC_TMPFILE = "temp-repl-sync.aof"
+)
+
+// replBacklog is the ring buffer keeping the latest bytes of the replication stream
+type replBacklog struct {
+	buf     []byte
+	idx     int   // the position of the next byte to write
+	histlen int   // the count of the valid bytes
+	offset  int64 // the replication offset of the first valid byte
+}
+
+func newReplBacklog(size int) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: server.masterReplOffset + 1}
+}
+
+// feed appends the bytes, the oldest bytes are overwritten once the buffer is full
+func (b *replBacklog) feed(p []byte) {
+	b.histlen += len(p)
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		p = p[n:]
+	}
+	if b.histlen > len(b.buf) {
+		b.offset += int64(b.histlen - len(b.buf))
+		b.histlen = len(b.buf)
+	}
+}
+
+// since returns the bytes from the offset to the end, false is returned if the backlog doesn't
+// have the offset
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.offset || offset > b.offset+int64(b.histlen) {
+		return nil, false
+	}
+	n := b.histlen - int(offset-b.offset)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append([]byte(nil), b.buf[start:start+n]...), true
+	}
+	return append(append([]byte(nil), b.buf[start:]...), b.buf[:start+n-len(b.buf)]...), true
+}
+
+func genReplicationID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// shiftReplicationID starts a new history once the replica becomes a master, the replicas of
+// the former master can still continue with the old ID up to the current offset
+func shiftReplicationID() {
+	server.replid2 = server.replid
+	server.secondReplidOffset = server.masterReplOffset + 1
+	server.replid = genReplicationID()
+}
+
+func clearReplicationID2() {
+	server.replid2 = ""
+	server.secondReplidOffset = -1
+}
+
+/* master */
+
+// replicationFeedSlaves appends the persisted command to the replication stream
+func replicationFeedSlaves(cmd *GedisCommand, args []*GObj) {
+	// a replica proxies the stream of its master instead, see replicationCommandProcessed
+	if server.masterHost != "" || server.replBacklog == nil {
+		return
+	}
+	feedReplicationStream(catPersistedCommand(cmd, args))
+}
+
+// feedReplicationStream appends the bytes to the backlog and sends them to the replicas
+func feedReplicationStream(buf string) {
+	server.masterReplOffset += int64(len(buf))
+	server.replBacklog.feed([]byte(buf))
+	for _, slave := range server.slaves {
+		slave.AddReply(buf)
+		server.aeloop.AddFileEvent(slave.nfd, AE_WRITABLE, SendReplyToClient, slave)
+	}
+}
+
+// replicationSnapshot returns the commands rebuilding the dataset, which are written to a
+// temp file like the AOF rewrite
+func replicationSnapshot() ([]byte, error) {
+	fp, err := os.OpenFile(REPL_SYNC_TMPFILE, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(REPL_SYNC_TMPFILE) }()
+	rio := NewRioWithFile(fp)
+	rio.file.autoSync = 0
+	err = rewriteAppendOnlyFileRio(rio)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(REPL_SYNC_TMPFILE)
+}
+
+func replicaName(c *GedisClient) string {
+	ip, _, err := PeerName(c.nfd)
+	if err != nil {
+		ip = "?"
+	}
+	return fmt.Sprintf("%s:%d", ip, c.slavePort)
+}
+
+func replicationAddSlave(c *GedisClient) {
+	c.flags |= CLIENT_SLAVE
+	server.slaves = append(server.slaves, c)
+}
+
+func replicationRemoveSlave(c *GedisClient) {
+	server.slaves = removeClientFromList(server.slaves, c)
+	log.Printf("Connection with replica %s lost \n", replicaName(c))
+}
+
+// disconnectSlaves closes the replicas, they connect again to sync with the new dataset
+func disconnectSlaves() {
+	for _, slave := range append([]*GedisClient(nil), server.slaves...) {
+		freeClient(slave)
+	}
+}
+
+// masterTryPartialResynchronization continues the replication from the offset the replica
+// asked, false is returned if the full resync is needed
+func masterTryPartialResynchronization(c *GedisClient) bool {
+	replid := c.args[1].StrVal()
+	offset, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		return false
+	}
+	if replid != server.replid && (replid != server.replid2 || offset > server.secondReplidOffset) {
+		if replid != "?" {
+			log.Printf("Partial resynchronization not accepted: replication ID mismatch \n")
+		}
+		return false
+	}
+	if server.replBacklog == nil {
+		return false
+	}
+	data, ok := server.replBacklog.since(offset)
+	if !ok {
+		log.Printf("Unable to partial resync with replica %s for lack of backlog (offset %d) \n", replicaName(c), offset)
+		return false
+	}
+	c.AddReply(fmt.Sprintf("+CONTINUE %s\r\n", server.replid))
+	if len(data) > 0 {
+		c.AddReply(string(data))
+	}
+	replicationAddSlave(c)
+	log.Printf("Partial resynchronization request from %s accepted, sending %d bytes of backlog starting from offset %d \n",
+		replicaName(c), len(data), offset)
+	return true
+}
+
+// SYNC
+// PSYNC replicationid offset
+var syncCommand CommandProc = func(c *GedisClient) {
+	// the replica is already syncing
+	if c.flags&CLIENT_SLAVE != 0 {
+		return
+	}
+	if server.masterHost != "" && server.replState != REPL_STATE_CONNECTED {
+		c.AddReplyError("-NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+	psync := strings.EqualFold(c.args[0].StrVal(), "psync")
+	if psync && masterTryPartialResynchronization(c) {
+		return
+	}
+
+	// the backlog is created with the first replica, there is no history before it
+	if server.replBacklog == nil {
+		server.replid = genReplicationID()
+		clearReplicationID2()
+		server.replBacklog = newReplBacklog(int(server.replBacklogSize))
+	}
+	snapshot, err := replicationSnapshot()
+	if err != nil {
+		log.Printf("Creating the snapshot for the replica error: %v \n", err)
+		c.AddReplyErrorf("can't create the snapshot: %v", err)
+		return
+	}
+	// the snapshot isn't counted by the output buffer limits, only the stream after it
+	c.obufExemptBytes = math.MaxInt
+	if psync {
+		c.AddReply(fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset))
+	}
+	c.AddReply(fmt.Sprintf("$%d\r\n", len(snapshot)))
+	if len(snapshot) > 0 {
+		c.AddReply(string(snapshot))
+	}
+	c.obufExemptBytes = c.replyBytes
+	replicationAddSlave(c)
+	log.Printf("Full resync with replica %s, sending %d bytes of snapshot \n", replicaName(c), len(snapshot))
+}
+
+// REPLCONF option value [option value ...]
+var replconfCommand CommandProc = func(c *GedisClient) {
+	if len(c.args)%2 == 0 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	for i := 1; i < len(c.args); i += 2 {
+		val := c.args[i+1].StrVal()
+		switch strings.ToLower(c.args[i].StrVal()) {
+		case "listening-port":
+			port, err := strconv.Atoi(val)
+			if err != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			c.slavePort = port
+		case "capa":
+			// the replicas always use PSYNC, nothing to record
+		case "ack":
+			// ACK gets no reply
+			if c.flags&CLIENT_SLAVE == 0 {
+				return
+			}
+			if offset, err := strconv.ParseInt(val, 10, 64); err == nil && offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			c.replAckTime = GetTimeMs()
+			processClientsWaitingReplicas()
+			return
+		case "getack":
+			if c == server.master {
+				replicationSendAck()
+			}
+			return
+		default:
+			c.AddReplyErrorf("Unrecognized REPLCONF option: %s", c.args[i].StrVal())
+			return
+		}
+	}
+	c.AddReply(REPLY_OK)
+}
+
+// replicationCountAcksByOffset returns the count of the replicas acknowledged the offset
+func replicationCountAcksByOffset(offset int64) int {
+	count := 0
+	for _, slave := range server.slaves {
+		if slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// processClientsWaitingReplicas unblocks the WAIT clients got enough acknowledgements
+func processClientsWaitingReplicas() {
+	for _, c := range append([]*GedisClient(nil), server.clientsWaitingAcks...) {
+		acks := replicationCountAcksByOffset(c.bstate.replOff)
+		if acks >= c.bstate.numReplicas {
+			c.AddReplyLongLong(int64(acks))
+			unblockClient(c)
+			unblockedClientReady(c)
+		}
+	}
+}
+
+// unblockClientsWaitingReplicas replies the WAIT clients with the acknowledgements they got,
+// the replicas won't acknowledge once the server becomes a replica
+func unblockClientsWaitingReplicas() {
+	for _, c := range append([]*GedisClient(nil), server.clientsWaitingAcks...) {
+		replyToBlockedClientTimedOut(c)
+		unblockClient(c)
+		unblockedClientReady(c)
+	}
+}
+
+// WAIT numreplicas timeout
+var waitCommand CommandProc = func(c *GedisClient) {
+	if server.masterHost != "" {
+		c.AddReplyError("WAIT cannot be used with replica instances")
+		return
+	}
+	numReplicas, err := strconv.Atoi(c.args[1].StrVal())
+	if err != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+	timeout, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+	if timeout < 0 {
+		c.AddReplyError("timeout is negative")
+		return
+	}
+
+	// wait for all the writes done so far
+	offset := server.masterReplOffset
+	acks := replicationCountAcksByOffset(offset)
+	// a transaction or a script never blocks
+	if acks >= numReplicas || c.flags&(CLIENT_MULTI|CLIENT_SCRIPT) != 0 {
+		c.AddReplyLongLong(int64(acks))
+		return
+	}
+	deadline := int64(0)
+	if timeout > 0 {
+		deadline = GetTimeMs() + timeout
+	}
+	c.bstate.numReplicas, c.bstate.replOff = numReplicas, offset
+	blockClient(c, BLOCKED_WAIT, deadline)
+	server.clientsWaitingAcks = append(server.clientsWaitingAcks, c)
+	// ask the replicas to acknowledge now instead of the next second, without any replica
+	// the client just waits for the timeout
+	if server.replBacklog == nil || len(server.slaves) == 0 {
+		return
+	}
+	feedReplicationStream("*3\r\n$8\r\nreplconf\r\n$6\r\ngetack\r\n$1\r\n*\r\n")
+}
+
+/* replica */
+
+// REPLICAOF host port
+// REPLICAOF NO ONE
+var replicaofCommand CommandProc = func(c *GedisClient) {
+	host, portArg := c.args[1].StrVal(), c.args[2].StrVal()
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg, "one") {
+		if server.masterHost != "" {
+			replicationUnsetMaster()
+			log.Printf("MASTER MODE enabled \n")
+		}
+		c.AddReply(REPLY_OK)
+		return
+	}
+	if c.flags&CLIENT_SLAVE != 0 {
+		c.AddReplyError("Command is not valid when client is a replica")
+		return
+	}
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port <= 0 || port > 65535 {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+	if server.masterHost == host && server.masterPort == port {
+		c.AddReplyStatus("OK Already connected to specified master")
+		return
+	}
+	replicationSetMaster(host, port)
+	log.Printf("REPLICAOF %s:%d enabled \n", host, port)
+	c.AddReply(REPLY_OK)
+}
+
+// replicationSetMaster makes the server a replica of the master, its own replicas are
+// disconnected to sync with the new history. The connection is started by the next cron
+func replicationSetMaster(host string, port int) {
+	server.masterHost, server.masterPort = host, port
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	cancelReplicationHandshake()
+	disconnectSlaves()
+	unblockClientsWaitingReplicas()
+	server.replState = REPL_STATE_CONNECT
+}
+
+// replicationUnsetMaster makes the replica a master, which starts a new history
+func replicationUnsetMaster() {
+	server.masterHost = ""
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	cancelReplicationHandshake()
+	shiftReplicationID()
+	// the replicas connect again to learn the new replication ID
+	disconnectSlaves()
+	server.replState = REPL_STATE_NONE
+}
+
+// replicationHandleMasterDisconnection is called once the client of the master is freed, the
+// cron connects again and the sync continues from the offset of the dataset
+func replicationHandleMasterDisconnection() {
+	server.master = nil
+	if server.masterHost != "" {
+		server.replState = REPL_STATE_CONNECT
+		log.Printf("Connection with master lost \n")
+	}
+}
+
+func replicationInHandshake() bool {
+	return server.replState >= REPL_STATE_CONNECTING && server.replState <= REPL_STATE_TRANSFER
+}
+
+// connectWithMaster starts the non blocking connection to the master, the handshake is done by
+// syncWithMaster once it's connected
+func connectWithMaster() {
+	fd, err := DialNonBlock(server.masterHost, server.masterPort)
+	if err != nil {
+		log.Printf("Unable to connect to MASTER %s:%d: %v \n", server.masterHost, server.masterPort, err)
+		return
+	}
+	server.aeloop.AddFileEvent(fd, AE_WRITABLE, syncWithMaster, nil)
+	server.replTransferFd = fd
+	server.replTransferBuf = nil
+	server.replTransferLastIO = GetTimeMs()
+	server.replState = REPL_STATE_CONNECTING
+	log.Printf("Connecting to MASTER %s:%d \n", server.masterHost, server.masterPort)
+}
+
+// cancelReplicationHandshake closes the connection in the handshake, the cron connects again
+func cancelReplicationHandshake() {
+	if !replicationInHandshake() {
+		return
+	}
+	if server.replState == REPL_STATE_CONNECTING {
+		server.aeloop.RemoveFileEvent(server.replTransferFd, AE_WRITABLE)
+	} else {
+		server.aeloop.RemoveFileEvent(server.replTransferFd, AE_READABLE)
+	}
+	_ = Close(server.replTransferFd)
+	server.replTransferFd = -1
+	server.replTransferBuf = nil
+	server.replState = REPL_STATE_CONNECT
+}
+
+// sendCommandToMaster writes the command of the handshake, the handshake is canceled if it
+// failed
+func sendCommandToMaster(args ...string) bool {
+	objs := make([]*GObj, len(args))
+	for i, arg := range args {
+		objs[i] = NewObject(STR, arg)
+	}
+	buf := []byte(catAppendOnlyGenericCommand(objs))
+	if n, err := Write(server.replTransferFd, buf); err != nil || n != len(buf) {
+		log.Printf("Error writing %s to MASTER: %v \n", args[0], err)
+		cancelReplicationHandshake()
+		return false
+	}
+	return true
+}
+
+// syncWithMaster is the FileProc of the socket to the master until the sync is done, which is
+// declared as a function since it registers itself
+func syncWithMaster(loop *AeEventLoop, fd int, extra any) {
+	if server.replState == REPL_STATE_CONNECTING {
+		if err := SocketError(fd); err != nil {
+			log.Printf("Error condition on socket for SYNC: %v \n", err)
+			cancelReplicationHandshake()
+			return
+		}
+		loop.RemoveFileEvent(fd, AE_WRITABLE)
+		loop.AddFileEvent(fd, AE_READABLE, syncWithMaster, nil)
+		server.replState = REPL_STATE_RECEIVE_PING
+		sendCommandToMaster("ping")
+		return
+	}
+
+	buf := make([]byte, GEDIS_IO_BUF)
+	n, err := Read(fd, buf)
+	if err != nil {
+		log.Printf("I/O error reading from MASTER: %v \n", err)
+		cancelReplicationHandshake()
+		return
+	}
+	server.replTransferBuf = append(server.replTransferBuf, buf[:n]...)
+	server.replTransferLastIO = GetTimeMs()
+	for processMasterHandshake() {
+	}
+}
+
+// readTransferLine returns the next line received from the master without the CRLF
+func readTransferLine() (string, bool) {
+	idx := bytes.IndexByte(server.replTransferBuf, '\n')
+	if idx < 0 {
+		return "", false
+	}
+	line := strings.TrimSuffix(string(server.replTransferBuf[:idx]), "\r")
+	server.replTransferBuf = server.replTransferBuf[idx+1:]
+	return line, true
+}
+
+// processMasterHandshake processes the received reply of the current step and sends the next
+// one, false is returned if it needs more bytes or the handshake is done or canceled
+func processMasterHandshake() bool {
+	if server.replState == REPL_STATE_TRANSFER {
+		return readSyncBulkPayload()
+	}
+	line, ok := readTransferLine()
+	if !ok {
+		return false
+	}
+	switch server.replState {
+	case REPL_STATE_RECEIVE_PING:
+		if strings.HasPrefix(line, "-") {
+			log.Printf("Error reply to PING from master: '%s' \n", line)
+			cancelReplicationHandshake()
+			return false
+		}
+		server.replState = REPL_STATE_RECEIVE_PORT
+		return sendCommandToMaster("replconf", "listening-port", strconv.Itoa(server.port))
+	case REPL_STATE_RECEIVE_PORT:
+		if strings.HasPrefix(line, "-") {
+			log.Printf("(Non critical) Master does not understand REPLCONF listening-port: %s \n", line)
+		}
+		server.replState = REPL_STATE_RECEIVE_CAPA
+		return sendCommandToMaster("replconf", "capa", "psync2")
+	case REPL_STATE_RECEIVE_CAPA:
+		if strings.HasPrefix(line, "-") {
+			log.Printf("(Non critical) Master does not understand REPLCONF capa: %s \n", line)
+		}
+		server.replState = REPL_STATE_RECEIVE_PSYNC
+		// the master continues if it has the history of this dataset
+		return sendCommandToMaster("psync", server.replid, strconv.FormatInt(server.masterReplOffset+1, 10))
+	case REPL_STATE_RECEIVE_PSYNC:
+		return processPsyncReply(line)
+	}
+	return false
+}
+
+func processPsyncReply(line string) bool {
+	fields := strings.Fields(line)
+	switch {
+	case strings.HasPrefix(line, "+FULLRESYNC"):
+		var err error
+		if len(fields) == 3 {
+			server.replTransferReplid = fields[1]
+			server.replTransferOffset, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+		if len(fields) != 3 || err != nil {
+			log.Printf("Master replied with wrong +FULLRESYNC syntax: %s \n", line)
+			cancelReplicationHandshake()
+			return false
+		}
+		server.replState = REPL_STATE_TRANSFER
+		server.replTransferSize = -1
+		log.Printf("Full resync from master: %s:%d \n", server.replTransferReplid, server.replTransferOffset)
+		return true
+	case strings.HasPrefix(line, "+CONTINUE"):
+		// the master changed its ID after a failover, the replicas of this server sync again
+		if len(fields) > 1 && fields[1] != server.replid {
+			server.replid2 = server.replid
+			server.secondReplidOffset = server.masterReplOffset + 1
+			server.replid = fields[1]
+			disconnectSlaves()
+		}
+		if server.replBacklog == nil {
+			server.replBacklog = newReplBacklog(int(server.replBacklogSize))
+		}
+		log.Printf("Successful partial resynchronization with master \n")
+		replicationCreateMasterClient(server.replTransferBuf)
+		return false
+	}
+	log.Printf("Unexpected reply to PSYNC from master: %s \n", line)
+	cancelReplicationHandshake()
+	return false
+}
+
+// readSyncBulkPayload receives the snapshot in the bulk format, then the replica loads it and
+// starts to process the stream of the master
+func readSyncBulkPayload() bool {
+	if server.replTransferSize == -1 {
+		line, ok := readTransferLine()
+		if !ok {
+			return false
+		}
+		// the newlines keep the link alive while the master prepares the snapshot
+		if line == "" {
+			return true
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if line[0] != '$' || err != nil || size < 0 {
+			log.Printf("Bad protocol from MASTER, expect the snapshot but got '%s' \n", line)
+			cancelReplicationHandshake()
+			return false
+		}
+		server.replTransferSize = size
+	}
+	if len(server.replTransferBuf) < server.replTransferSize {
+		return false
+	}
+
+	snapshot := server.replTransferBuf[:server.replTransferSize]
+	rest := server.replTransferBuf[server.replTransferSize:]
+	if err := replicationLoadSnapshot(snapshot); err != nil {
+		log.Printf("Failed trying to load the MASTER synchronization snapshot: %v \n", err)
+		cancelReplicationHandshake()
+		return false
+	}
+	server.replid, server.masterReplOffset = server.replTransferReplid, server.replTransferOffset
+	clearReplicationID2()
+	server.replBacklog = newReplBacklog(int(server.replBacklogSize))
+	// the replicas of this server have the old dataset
+	disconnectSlaves()
+	log.Printf("MASTER <-> REPLICA sync: finished with success, %d bytes loaded \n", len(snapshot))
+	replicationCreateMasterClient(rest)
+	return false
+}
+
+// replicationLoadSnapshot replaces the dataset with the snapshot, which is the new AOF too
+func replicationLoadSnapshot(snapshot []byte) error {
+	emptyData()
+	if err := loadCommands(bufio.NewReader(bytes.NewReader(snapshot))); err != nil {
+		return err
+	}
+	if err := os.WriteFile(server.aofFileName, snapshot, 0666); err != nil {
+		log.Printf("Writing the synchronization snapshot to the append only file error: %v \n", err)
+	}
+	server.aofBuf = ""
+	aofUpdateCurrentSize()
+	server.aofRewriteBaseSize = server.aofCurrentSize
+	return nil
+}
+
+// replicationCreateMasterClient turns the socket of the handshake to the client of the master,
+// the rest of the received bytes are the stream of the master
+func replicationCreateMasterClient(rest []byte) {
+	fd := server.replTransferFd
+	server.replTransferFd = -1
+	server.replTransferBuf = nil
+	c := NewClient(fd)
+	c.flags |= CLIENT_MASTER
+	c.readReplOff, c.replOff = server.masterReplOffset, server.masterReplOffset
+	c.lastInteraction = GetTimeMs()
+	server.clients[fd] = c
+	server.master = c
+	server.replState = REPL_STATE_CONNECTED
+	server.aeloop.AddFileEvent(fd, AE_READABLE, ReadQueryFromClient, c)
+	if len(rest) == 0 {
+		return
+	}
+	c.makeRoomForQuery(len(rest))
+	c.queryLen = copy(c.queryBuf, rest)
+	c.readReplOff += int64(len(rest))
+	c.replBuf = append(c.replBuf, rest...)
+	if err := c.ProcessQueryBuf(); err != nil {
+		log.Printf("process query buf of master err: %v", err)
+		freeClient(c)
+	}
+}
+
+// replicationCommandProcessed proxies the bytes of the command applied from the master to the
+// backlog and the replicas of this server, the offset is the same as the master
+func replicationCommandProcessed(c *GedisClient) {
+	// the offset in the middle of a transaction can't be acknowledged
+	if c.flags&CLIENT_MULTI != 0 {
+		return
+	}
+	applied := int(c.readReplOff - int64(c.queryLen-c.qbPos) - c.replOff)
+	if applied <= 0 {
+		return
+	}
+	c.replOff += int64(applied)
+	feedReplicationStream(string(c.replBuf[:applied]))
+	c.replBuf = c.replBuf[applied:]
+}
+
+// replicationSendAck acknowledges the applied offset to the master
+func replicationSendAck() {
+	c := server.master
+	c.flags |= CLIENT_MASTER_FORCE_REPLY
+	addReplyBulkStrings(c, "replconf", "ack", strconv.FormatInt(c.replOff, 10))
+	c.flags &= ^CLIENT_MASTER_FORCE_REPLY
+	server.aeloop.AddFileEvent(c.nfd, AE_WRITABLE, SendReplyToClient, c)
+}
+
+// replicationCron is called every second, it connects to the master, closes the idle links and
+// sends the ACKs and the PINGs
+func replicationCron(now int64) {
+	if server.masterHost != "" {
+		switch {
+		case server.replState == REPL_STATE_CONNECT:
+			connectWithMaster()
+		case replicationInHandshake() && now-server.replTransferLastIO > server.replTimeout:
+			log.Printf("Timeout connecting to the MASTER \n")
+			cancelReplicationHandshake()
+		case server.replState == REPL_STATE_CONNECTED && now-server.master.lastInteraction > server.replTimeout:
+			log.Printf("MASTER timeout: no data nor PING received \n")
+			freeClient(server.master)
+		case server.replState == REPL_STATE_CONNECTED:
+			replicationSendAck()
+		}
+	}
+
+	// the PINGs of a replica's master are proxied
+	if server.masterHost == "" && len(server.slaves) > 0 && now-server.replLastPing >= server.replPingPeriod {
+		server.replLastPing = now
+		feedReplicationStream("*1\r\n$4\r\nping\r\n")
+	}
+	// the replicas never acknowledged, like the ones by SYNC, are not checked
+	for _, slave := range append([]*GedisClient(nil), server.slaves...) {
+		if slave.replAckTime != 0 && now-slave.replAckTime > server.replTimeout {
+			log.Printf("Disconnecting timedout replica %s \n", replicaName(slave))
+			freeClient(slave)
+		}
+	}
+}
+
+// ROLE
+var roleCommand CommandProc = func(c *GedisClient) {
+	if server.masterHost == "" {
+		c.AddReplyArrayLen(3)
+		c.AddReplyBulkString("master")
+		c.AddReplyLongLong(server.masterReplOffset)
+		c.AddReplyArrayLen(len(server.slaves))
+		for _, slave := range server.slaves {
+			ip, _, err := PeerName(slave.nfd)
+			if err != nil {
+				ip = "?"
+			}
+			addReplyBulkStrings(c, ip, strconv.Itoa(slave.slavePort), strconv.FormatInt(slave.replAckOff, 10))
+		}
+		return
+	}
+	state, offset := "connect", int64(-1)
+	switch {
+	case server.replState == REPL_STATE_CONNECTING:
+		state = "connecting"
+	case server.replState == REPL_STATE_TRANSFER:
+		state = "sync"
+	case replicationInHandshake():
+		state = "handshake"
+	case server.replState == REPL_STATE_CONNECTED:
+		state, offset = "connected", server.master.replOff
+	}
+	c.AddReplyArrayLen(5)
+	c.AddReplyBulkString("slave")
+	c.AddReplyBulkString(server.masterHost)
+	c.AddReplyLongLong(int64(server.masterPort))
+	c.AddReplyBulkString(state)
+	c.AddReplyLongLong(offset)
+}
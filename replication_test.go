@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	initTestServer(t)
+	b := newReplBacklog(8)
+
+	b.feed([]byte("abcde"))
+	data, ok := b.since(1)
+	assert.True(t, ok)
+	assert.Equal(t, "abcde", string(data))
+
+	// the oldest bytes are overwritten
+	b.feed([]byte("fghij"))
+	assert.Equal(t, int64(3), b.offset)
+	data, ok = b.since(3)
+	assert.True(t, ok)
+	assert.Equal(t, "cdefghij", string(data))
+	data, ok = b.since(9)
+	assert.True(t, ok)
+	assert.Equal(t, "ij", string(data))
+	data, ok = b.since(11)
+	assert.True(t, ok)
+	assert.Equal(t, "", string(data))
+
+	_, ok = b.since(2)
+	assert.False(t, ok)
+	_, ok = b.since(12)
+	assert.False(t, ok)
+}
+
+// newSocketClient returns the client connected by a socket pair, the other end is returned too
+func newSocketClient(t *testing.T) (*GedisClient, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = syscall.Close(fds[1]) })
+	c := NewClient(fds[0])
+	server.clients[fds[0]] = c
+	return c, fds[1]
+}
+
+func TestSyncCommand(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	runCommand(c, "set", "k", "v")
+
+	slave, _ := newSocketClient(t)
+	reply := runCommand(slave, "psync", "?", "-1")
+	snapshot := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	assert.Equal(t, fmt.Sprintf("+FULLRESYNC %s 0\r\n$%d\r\n%s", server.replid, len(snapshot), snapshot), reply)
+	assert.Equal(t, []*GedisClient{slave}, server.slaves)
+
+	// the writes are sent to the replica
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	runCommand(c, "set", "a", "1")
+	runCommand(c, "get", "a")
+	assert.Equal(t, set, drainClientReply(slave))
+	assert.Equal(t, int64(len(set)), server.masterReplOffset)
+
+	// the replica continues from the offset it has
+	other, _ := newSocketClient(t)
+	assert.Equal(t, "+CONTINUE "+server.replid+"\r\n"+set, runCommand(other, "psync", server.replid, "1"))
+	third, _ := newSocketClient(t)
+	assert.Equal(t, "+CONTINUE "+server.replid+"\r\n", runCommand(third, "psync", server.replid, fmt.Sprint(len(set)+1)))
+	assert.Equal(t, 3, len(server.slaves))
+
+	// the unknown history needs the full resync
+	fourth, _ := newSocketClient(t)
+	reply = runCommand(fourth, "psync", "0123456789", "1")
+	assert.Equal(t, fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, len(set)), reply[:len(server.replid)+17])
+
+	freeClient(slave)
+	assert.Equal(t, 3, len(server.slaves))
+}
+
+func TestSyncListKey(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	runCommand(c, "rpush", "l", "a")
+	runCommand(c, "rpush", "l", "b")
+
+	// the list is in the snapshot, and the list commands are in the stream
+	slave, _ := newSocketClient(t)
+	reply := runCommand(slave, "psync", "?", "-1")
+	snapshot := "*4\r\n$5\r\nrpush\r\n$1\r\nl\r\n$1\r\na\r\n$1\r\nb\r\n"
+	assert.Equal(t, fmt.Sprintf("+FULLRESYNC %s 0\r\n$%d\r\n%s", server.replid, len(snapshot), snapshot), reply)
+
+	runCommand(c, "lpush", "l", "c")
+	runCommand(c, "lrange", "l", "0", "-1")
+	runCommand(c, "rpop", "l", "1")
+	assert.Equal(t, "*3\r\n$5\r\nlpush\r\n$1\r\nl\r\n$1\r\nc\r\n*3\r\n$4\r\nrpop\r\n$1\r\nl\r\n$1\r\n1\r\n",
+		drainClientReply(slave))
+}
+
+func TestSyncOutputBufferLimit(t *testing.T) {
+	initTestServer(t)
+	assert.Nil(t, parseClientOutputBufferLimit("replica 64kb 0 0"))
+	c := NewClient(0)
+	runCommand(c, "set", "k", strings.Repeat("x", 100*1024))
+
+	// the snapshot isn't counted, only the stream after it
+	slave, _ := newSocketClient(t)
+	slave.args = []*GObj{NewObject(STR, "sync")}
+	ProcessCommand(slave)
+	assert.Greater(t, slave.replyBytes, 64*1024)
+	assert.Zero(t, slave.outputBufferUsage())
+	runCommand(c, "set", "a", strings.Repeat("y", 32*1024))
+	assert.Zero(t, slave.flags&CLIENT_CLOSE_ASAP)
+
+	// once the snapshot is sent, the stream is counted
+	slave.consumeReplies(slave.bufpos + slave.obufExemptBytes)
+	assert.Zero(t, slave.obufExemptBytes)
+	assert.Greater(t, slave.outputBufferUsage(), int64(32*1024))
+	runCommand(c, "set", "a", strings.Repeat("y", 32*1024))
+	assert.NotZero(t, slave.flags&CLIENT_CLOSE_ASAP)
+}
+
+func TestWait(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	assert.Equal(t, ":0\r\n", runCommand(c, "wait", "0", "0"))
+
+	// without any replica the client waits for the timeout
+	assert.Equal(t, "", runCommand(c, "wait", "1", "100"))
+	assert.NotEqual(t, 0, c.flags&CLIENT_BLOCKED)
+	c.bstate.timeout = 1
+	handleBlockedClientsTimeout(GetTimeMs())
+	assert.Equal(t, ":0\r\n", drainClientReply(c))
+
+	slave, _ := newSocketClient(t)
+	runCommand(slave, "sync")
+	runCommand(c, "set", "k", "v")
+	offset := server.masterReplOffset
+
+	// WAIT asks the replicas to acknowledge
+	assert.Equal(t, "", runCommand(c, "wait", "1", "0"))
+	assert.NotEqual(t, 0, c.flags&CLIENT_BLOCKED)
+	getack := "*3\r\n$8\r\nreplconf\r\n$6\r\ngetack\r\n$1\r\n*\r\n"
+	assert.Equal(t, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"+getack, drainClientReply(slave))
+
+	// the ACK before the write doesn't unblock
+	assert.Equal(t, "", runCommand(slave, "replconf", "ack", fmt.Sprint(offset-1)))
+	assert.NotEqual(t, 0, c.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "", runCommand(slave, "replconf", "ack", fmt.Sprint(offset)))
+	assert.Equal(t, 0, c.flags&CLIENT_BLOCKED)
+	assert.Equal(t, ":1\r\n", drainClientReply(c))
+	assert.Equal(t, 0, len(server.clientsWaitingAcks))
+
+	// the timeout replies the count of acknowledged replicas
+	runCommand(slave, "replconf", "ack", fmt.Sprint(server.masterReplOffset))
+	runCommand(c, "wait", "2", "1")
+	c.bstate.timeout = 1
+	handleBlockedClientsTimeout(GetTimeMs())
+	assert.Equal(t, ":1\r\n", drainClientReply(c))
+
+	assert.Equal(t, "-ERR timeout is negative\r\n", runCommand(c, "wait", "1", "-1"))
+	server.masterHost = "127.0.0.1"
+	assert.Equal(t, "-ERR WAIT cannot be used with replica instances\r\n", runCommand(c, "wait", "1", "0"))
+}
+
+func TestReplconf(t *testing.T) {
+	initTestServer(t)
+	slave, _ := newSocketClient(t)
+
+	assert.Equal(t, REPLY_OK, runCommand(slave, "replconf", "listening-port", "6380", "capa", "psync2"))
+	assert.Equal(t, 6380, slave.slavePort)
+	assert.Equal(t, REPLY_SYNTAX_ERR, runCommand(slave, "replconf", "listening-port"))
+	assert.Equal(t, "-ERR Unrecognized REPLCONF option: nope\r\n", runCommand(slave, "replconf", "nope", "1"))
+}
+
+func TestReadonlyReplica(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	server.masterHost = "127.0.0.1"
+
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", runCommand(c, "set", "k", "v"))
+	assert.Equal(t, REPLY_NIL, runCommand(c, "get", "k"))
+	assert.Equal(t, "-NOMASTERLINK Can't SYNC while not connected with my master\r\n", runCommand(c, "sync"))
+
+	// the master writes without getting the replies
+	c.flags |= CLIENT_MASTER
+	assert.Equal(t, "", runCommand(c, "set", "k", "v"))
+	assert.Equal(t, "", runCommand(c, "get", "k"))
+	c.flags &= ^CLIENT_MASTER
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+}
+
+// masterSend writes the bytes as the master and lets the replica process them
+func masterSend(t *testing.T, fd int, s string) {
+	_, err := syscall.Write(fd, []byte(s))
+	assert.Nil(t, err)
+	syncWithMaster(server.aeloop, server.replTransferFd, nil)
+}
+
+// masterRecv returns the bytes the replica sent to the master
+func masterRecv(t *testing.T, fd int) string {
+	buf := make([]byte, 1024)
+	n, err := syscall.Read(fd, buf)
+	assert.Nil(t, err)
+	return string(buf[:n])
+}
+
+func TestReplicaSync(t *testing.T) {
+	initTestServer(t)
+	server.aofFileName = "test_replica_sync.aof"
+	c := NewClient(0)
+	runCommand(c, "set", "old", "1")
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer func() { _ = syscall.Close(fds[1]) }()
+	server.masterHost, server.masterPort = "127.0.0.1", 6379
+	server.replTransferFd, server.replState = fds[0], REPL_STATE_CONNECTING
+	server.aeloop.AddFileEvent(fds[0], AE_WRITABLE, syncWithMaster, nil)
+	assert.Equal(t, "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:6379\r\n$10\r\nconnecting\r\n:-1\r\n", runCommand(c, "role"))
+
+	syncWithMaster(server.aeloop, fds[0], nil)
+	assert.Equal(t, "*1\r\n$4\r\nping\r\n", masterRecv(t, fds[1]))
+	masterSend(t, fds[1], "+PONG\r\n")
+	assert.Equal(t, "*3\r\n$8\r\nreplconf\r\n$14\r\nlistening-port\r\n$4\r\n8888\r\n", masterRecv(t, fds[1]))
+	masterSend(t, fds[1], "+OK\r\n")
+	assert.Equal(t, "*3\r\n$8\r\nreplconf\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n", masterRecv(t, fds[1]))
+	masterSend(t, fds[1], "+OK\r\n")
+	replid := server.replid
+	assert.Equal(t, fmt.Sprintf("*3\r\n$5\r\npsync\r\n$40\r\n%s\r\n$1\r\n1\r\n", replid), masterRecv(t, fds[1]))
+
+	// the snapshot replaces the dataset, the stream after it is applied
+	snapshot := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	masterReplid := genReplicationID()
+	masterSend(t, fds[1], fmt.Sprintf("+FULLRESYNC %s 100\r\n\n$%d\r\n%s%s", masterReplid, len(snapshot), snapshot, set))
+	assert.Equal(t, REPL_STATE_CONNECTED, server.replState)
+	assert.Equal(t, masterReplid, server.replid)
+	assert.Equal(t, int64(100+len(set)), server.masterReplOffset)
+	assert.Equal(t, REPLY_NIL, runCommand(c, "get", "old"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "get", "k"))
+	assert.Equal(t, "$1\r\n1\r\n", runCommand(c, "get", "a"))
+	assert.Equal(t, "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:6379\r\n$9\r\nconnected\r\n:"+fmt.Sprint(100+len(set))+"\r\n",
+		runCommand(c, "role"))
+
+	// the replica acknowledges the applied offset
+	replicationSendAck()
+	assert.Equal(t, fmt.Sprintf("*3\r\n$8\r\nreplconf\r\n$3\r\nack\r\n$3\r\n%d\r\n", 100+len(set)), drainClientReply(server.master))
+
+	// the stream is proxied to the backlog
+	data, ok := server.replBacklog.since(101)
+	assert.True(t, ok)
+	assert.Equal(t, set, string(data))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "replicaof", "no", "one"))
+	assert.Equal(t, "", server.masterHost)
+	assert.Nil(t, server.master)
+	assert.Equal(t, masterReplid, server.replid2)
+	assert.Equal(t, REPLY_OK, runCommand(c, "set", "b", "1"))
+}
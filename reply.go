@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+/* The replies are appended to the static buffer of the client first. Once it's full, the rest
+ * go to the list of reply blocks, so that the order is kept. The large bulk strings aren't
+ * copied, a block references the value itself, which can't change since the strings are
+ * immutable. All of them are flushed by writev, many buffers in one syscall.
+ *
+ * The bytes of the reply blocks are counted as they're appended, the client whose replies grow
+ * over the output buffer limits of its type, like a slow subscriber, is closed. */
+
+const (
+	GEDIS_REPLY_CHUNK_BYTES   = 16 * 1024 // the size of the static buffer and of the reply blocks
+	GEDIS_REPLY_SHARED_BYTES  = 4 * 1024  // the bulk strings at least this long are referenced
+	GEDIS_IOV_MAX             = 1024      // the iovecs of one writev
+	GEDIS_MAX_WRITE_PER_EVENT = 64 * 1024 // the bytes written in one event, then the others are served
+)
+
+type replyBlock struct {
+	buf []byte // the bytes of the block, cap(buf) is its size
+	ref string // the string referenced by the block, which holds nothing else
+}
+
+func (b *replyBlock) size() int {
+	if b.ref != "" {
+		return len(b.ref)
+	}
+	return len(b.buf)
+}
+
+// avail returns the free space of the block, the referencing block and the deferred length
+// have none
+func (b *replyBlock) avail() int {
+	if b.ref != "" {
+		return 0
+	}
+	return cap(b.buf) - len(b.buf)
+}
+
+// iovec returns the iovec of the bytes from offset
+func (b *replyBlock) iovec(offset int) syscall.Iovec {
+	var iov syscall.Iovec
+	if b.ref != "" {
+		// the data pointer is the first word of the string header
+		iov.Base = (*byte)(unsafe.Add(unsafe.Pointer(*(**byte)(unsafe.Pointer(&b.ref))), offset))
+	} else {
+		iov.Base = &b.buf[offset]
+	}
+	iov.SetLen(b.size() - offset)
+	return iov
+}
+
+// hasPendingReplies reports whether any reply isn't sent yet
+func (client *GedisClient) hasPendingReplies() bool {
+	return client.bufpos > 0 || len(client.reply) > 0
+}
+
+// addReplyProto appends the protocol to the static buffer, or to the reply list if the buffer
+// is full or the list isn't empty
+func (client *GedisClient) addReplyProto(s string) {
+	if len(client.reply) == 0 {
+		n := copy(client.buf[client.bufpos:], s)
+		client.bufpos += n
+		s = s[n:]
+	}
+	if s == "" {
+		return
+	}
+	if len(client.reply) > 0 {
+		tail := client.reply[len(client.reply)-1]
+		n := copy(tail.buf[len(tail.buf):cap(tail.buf)], s)
+		if n > 0 {
+			tail.buf = tail.buf[:len(tail.buf)+n]
+			client.replyBytes += n
+			s = s[n:]
+		}
+	}
+	if s == "" {
+		return
+	}
+	size := GEDIS_REPLY_CHUNK_BYTES
+	if len(s) > size {
+		size = len(s)
+	}
+	block := &replyBlock{buf: make([]byte, len(s), size)}
+	copy(block.buf, s)
+	client.reply = append(client.reply, block)
+	client.replyBytes += len(s)
+	closeClientOnOutputBufferLimitReached(client, GetTimeMs())
+}
+
+// addReplyRef appends the block referencing the string instead of copying it
+func (client *GedisClient) addReplyRef(s string) {
+	client.reply = append(client.reply, &replyBlock{ref: s})
+	client.replyBytes += len(s)
+	closeClientOnOutputBufferLimitReached(client, GetTimeMs())
+}
+
+// addReplyPlaceholder appends the empty block which is set later, the next replies go to the
+// blocks after it
+func (client *GedisClient) addReplyPlaceholder() *replyBlock {
+	block := &replyBlock{}
+	client.reply = append(client.reply, block)
+	return block
+}
+
+func (client *GedisClient) setReplyPlaceholder(block *replyBlock, s string) {
+	block.buf = []byte(s)
+	client.replyBytes += len(s)
+}
+
+// consumeReplies removes the n bytes sent from the replies
+func (client *GedisClient) consumeReplies(n int) {
+	if client.bufpos > 0 {
+		if n < client.bufpos-client.sentLen {
+			client.sentLen += n
+			return
+		}
+		n -= client.bufpos - client.sentLen
+		client.bufpos, client.sentLen = 0, 0
+	}
+	for len(client.reply) > 0 {
+		block := client.reply[0]
+		if n < block.size()-client.sentLen {
+			client.sentLen += n
+			return
+		}
+		n -= block.size() - client.sentLen
+		client.replyBytes -= block.size()
+		if client.obufExemptBytes > 0 {
+			client.obufExemptBytes -= block.size()
+			if client.obufExemptBytes < 0 {
+				client.obufExemptBytes = 0
+			}
+		}
+		client.reply[0] = nil
+		client.reply = client.reply[1:]
+		client.sentLen = 0
+	}
+}
+
+// outputBufferUsage returns the bytes of the replies counted by the output buffer limits
+func (client *GedisClient) outputBufferUsage() int64 {
+	if client.replyBytes <= client.obufExemptBytes {
+		return 0
+	}
+	return int64(client.replyBytes - client.obufExemptBytes)
+}
+
+// checkClientOutputBufferLimits reports whether the client reached the hard limit, or stayed
+// over the soft limit longer than the soft seconds
+func checkClientOutputBufferLimits(c *GedisClient, now int64) bool {
+	ctype := getClientType(c)
+	if ctype == CLIENT_TYPE_MASTER {
+		ctype = CLIENT_TYPE_NORMAL
+	}
+	limit := server.clientObufLimits[ctype]
+	used := c.outputBufferUsage()
+	hard := limit.hard > 0 && used >= limit.hard
+	if limit.soft == 0 || used < limit.soft {
+		c.obufSoftLimitReachedTime = 0
+		return hard
+	}
+	// the time starts once the soft limit is reached
+	if c.obufSoftLimitReachedTime == 0 {
+		c.obufSoftLimitReachedTime = now
+		return hard
+	}
+	return hard || now-c.obufSoftLimitReachedTime > limit.softSeconds*1000
+}
+
+// closeClientOnOutputBufferLimitReached closes the client over the limits asynchronously, since
+// the limits are checked while the replies are added and the caller may still use the client.
+// true is returned if the client is going to be closed
+func closeClientOnOutputBufferLimitReached(c *GedisClient, now int64) bool {
+	// the fake client of the scripts collects the replies of the whole script
+	if c.flags&(CLIENT_CLOSE_ASAP|CLIENT_SCRIPT) != 0 || !checkClientOutputBufferLimits(c, now) {
+		return false
+	}
+	log.Printf("client %d scheduled to be closed ASAP for overcoming of output buffer limits", c.id)
+	freeClientAsync(c)
+	server.statObufLimitConn++
+	return true
+}
+
+// writeToClient writes the replies by writev until the socket can't accept more, or enough
+// bytes are written for this event
+func writeToClient(client *GedisClient) error {
+	iovs := make([]syscall.Iovec, 0, 16)
+	written := 0
+	for client.hasPendingReplies() && written < GEDIS_MAX_WRITE_PER_EVENT {
+		iovs = iovs[:0]
+		offset := client.sentLen
+		if client.bufpos > 0 {
+			iovs = append(iovs, syscall.Iovec{Base: &client.buf[offset]})
+			iovs[0].SetLen(client.bufpos - offset)
+			offset = 0
+		}
+		for _, block := range client.reply {
+			if len(iovs) == GEDIS_IOV_MAX {
+				break
+			}
+			// the deferred length which is never set has nothing to send
+			if block.size() > offset {
+				iovs = append(iovs, block.iovec(offset))
+			}
+			offset = 0
+		}
+		if len(iovs) == 0 {
+			client.reply = client.reply[:0]
+			break
+		}
+		n, err := Writev(client.nfd, iovs)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		client.consumeReplies(n)
+		written += n
+	}
+	// the replies to the master don't make the link alive, see replicationCron
+	if written > 0 && client.flags&CLIENT_MASTER == 0 {
+		client.lastInteraction = GetTimeMs()
+	}
+	return nil
+}
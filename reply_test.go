@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestReplyBuffer(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	// the small replies share the static buffer
+	c.AddReply(REPLY_OK)
+	c.AddReplyBulkString("v")
+	assert.Equal(t, len(REPLY_OK)+len("$1\r\nv\r\n"), c.bufpos)
+	assert.Equal(t, 0, len(c.reply))
+
+	// the rest goes to the blocks once the buffer is full
+	big := strings.Repeat("a", GEDIS_REPLY_CHUNK_BYTES)
+	c.AddReply(big)
+	assert.Equal(t, GEDIS_REPLY_CHUNK_BYTES, c.bufpos)
+	assert.Equal(t, 1, len(c.reply))
+	c.AddReply(REPLY_ZERO)
+	assert.Equal(t, 1, len(c.reply))
+	assert.Equal(t, REPLY_OK+"$1\r\nv\r\n"+big+REPLY_ZERO, drainClientReply(c))
+	assert.False(t, c.hasPendingReplies())
+	assert.Equal(t, 0, c.replyBytes)
+}
+
+func TestReplyReference(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	value := strings.Repeat("x", GEDIS_REPLY_SHARED_BYTES)
+	c.AddReplyBulk(NewObject(STR, value))
+
+	// the large bulk is referenced, not copied
+	assert.Equal(t, 2, len(c.reply))
+	assert.Equal(t, unsafe.Pointer(*(**byte)(unsafe.Pointer(&value))), unsafe.Pointer(c.reply[0].iovec(0).Base))
+	assert.Equal(t, len(value)+2, c.replyBytes)
+
+	// the placeholder isn't appended to
+	node := c.AddReplyDeferredLen()
+	c.AddReplyBulkString("a")
+	c.SetDeferredArrayLen(node, 1)
+	assert.Equal(t, "$4096\r\n"+value+"\r\n*1\r\n$1\r\na\r\n", drainClientReply(c))
+}
+
+func TestWriteToClient(t *testing.T) {
+	initTestServer(t)
+	c, peer := newSocketClient(t)
+	assert.Nil(t, syscall.SetNonblock(c.nfd, true))
+
+	var expected strings.Builder
+	for i := 0; i < 100; i++ {
+		value := strings.Repeat(string(rune('a'+i%26)), GEDIS_REPLY_SHARED_BYTES+i)
+		c.AddReplyBulkString(value)
+		c.AddReplyInt(i)
+		expected.WriteString(fmt.Sprintf("$%d\r\n%s\r\n:%d\r\n", len(value), value, i))
+	}
+	c.AddReplyDeferredLen()
+
+	// the socket accepts a part of the replies each time
+	var got []byte
+	buf := make([]byte, 64*1024)
+	for c.hasPendingReplies() {
+		assert.Nil(t, writeToClient(c))
+		n, err := syscall.Read(peer, buf)
+		assert.Nil(t, err)
+		got = append(got, buf[:n]...)
+	}
+	for len(got) < expected.Len() {
+		n, err := syscall.Read(peer, buf)
+		assert.Nil(t, err)
+		got = append(got, buf[:n]...)
+	}
+	assert.Equal(t, expected.String(), string(got))
+	assert.Equal(t, 0, c.replyBytes)
+}
+
+// BenchmarkPipelinedReplies flushes the replies of 16 pipelined GETs each time
+func BenchmarkPipelinedReplies(b *testing.B) {
+	initServerConfig()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	c := NewClient(fds[0])
+	value := NewObject(STR, "xxx")
+	buf := make([]byte, 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			c.AddReplyBulk(value)
+		}
+		if err := writeToClient(c); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := syscall.Read(fds[1], buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
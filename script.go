@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/* The scripts are executed by the interpreter in lua.go and luaeval.go. redis.call executes the
+ * command by a fake client through ProcessCommand, like the AOF loading, and converts the reply
+ * to the value of script. The effects of the script are propagated wrapped in MULTI/EXEC
+ * instead of the script itself, the same as a transaction.
+ *
+ * A script running longer than the time limit isn't stopped, but the server starts to process
+ * the events while it runs, and replies BUSY to all the commands except SCRIPT KILL, which
+ * stops the script if it didn't write anything. */
+
+const (
+	REPLY_NOSCRIPT   = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	REPLY_BUSY       = "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.\r\n"
+	REPLY_NOTBUSY    = "-NOTBUSY No scripts in execution right now.\r\n"
+	REPLY_UNKILLABLE = "-UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n"
+)
+
+type scriptState struct {
+	scripts   map[string]*luaFuncExpr // the compiled scripts by SHA1
+	lua       *luaState
+	client    *GedisClient // the fake client executing the commands of scripts
+	caller    *GedisClient // the client running the script, nil if no script is running
+	startTime int64        // unix time in ms
+	timedOut  bool         // the script is running longer than the time limit
+	killed    bool         // SCRIPT KILL was called
+	wrote     bool         // the script executed write commands
+	timeLimit int64        // ms
+}
+
+// scriptingInit creates the interpreter and the fake client
+func scriptingInit() {
+	server.script.scripts = make(map[string]*luaFuncExpr)
+	server.script.client = NewClient(0)
+	server.script.client.flags |= CLIENT_SCRIPT
+	L := newLuaState()
+	redis := newLuaTable()
+	L.register(redis, "call", func(L *luaState, args []luaValue) []luaValue {
+		return luaRedisCall(L, args, true)
+	})
+	L.register(redis, "pcall", func(L *luaState, args []luaValue) []luaValue {
+		return luaRedisCall(L, args, false)
+	})
+	L.register(redis, "error_reply", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{luaReplyTable("err", L.checkString(args, 0, "error_reply"))}
+	})
+	L.register(redis, "status_reply", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{luaReplyTable("ok", L.checkString(args, 0, "status_reply"))}
+	})
+	L.register(redis, "sha1hex", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{sha1hex(L.checkString(args, 0, "sha1hex"))}
+	})
+	L.register(redis, "log", func(L *luaState, args []luaValue) []luaValue {
+		L.checkNumber(args, 0, "log")
+		msg := make([]string, 0, len(args)-1)
+		for i := 1; i < len(args); i++ {
+			msg = append(msg, L.checkString(args, i, "log"))
+		}
+		log.Printf("script: %s\n", strings.Join(msg, " "))
+		return nil
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.rawSet(level, float64(i))
+	}
+	redis.readonly = true
+	L.globals.rawSet("redis", redis)
+	L.hook = scriptInterrupt
+	server.script.lua = L
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// luaReplyTable creates the table like {err="..."} or {ok="..."}
+func luaReplyTable(field, msg string) *luaTable {
+	t := newLuaTable()
+	t.rawSet(field, msg)
+	return t
+}
+
+// luaRedisCall executes the command by the fake client, the error reply is raised if raise
+// is true, otherwise returned as the error table
+func luaRedisCall(L *luaState, args []luaValue, raise bool) []luaValue {
+	if len(args) == 0 {
+		L.errorf("Please specify at least one argument for this redis lib call")
+	}
+	c := server.script.client
+	c.args = make([]*GObj, len(args))
+	for i, arg := range args {
+		s, ok := luaToString(arg)
+		if !ok {
+			L.errorf("Lua redis lib command arguments must be strings or integers")
+		}
+		c.args[i] = NewObject(STR, s)
+	}
+	// the scripts usually call the commands in upper case
+	name := strings.ToLower(c.args[0].StrVal())
+	c.args[0] = NewObject(STR, name)
+
+	cmd := lookUpCommand(name)
+	if cmd != nil && cmd.flags&CMD_NOSCRIPT != 0 {
+		c.AddReplyError("This Redis command is not allowed from script")
+	} else {
+		ProcessCommand(c)
+		if cmd != nil && cmd.flags&CMD_WRITE != 0 {
+			server.script.wrote = true
+		}
+	}
+	reply, _ := luaParseReply(drainClientReply(c), 0)
+	c.args = nil
+	if t, ok := reply.(*luaTable); ok && raise && t.get("err") != nil {
+		panic(&luaError{value: reply})
+	}
+	return []luaValue{reply}
+}
+
+// drainClientReply returns the replies the client got and clears them
+func drainClientReply(c *GedisClient) string {
+	var sb strings.Builder
+	offset := c.sentLen
+	if c.bufpos > 0 {
+		sb.Write(c.buf[offset:c.bufpos])
+		offset = 0
+	}
+	for _, block := range c.reply {
+		if block.ref != "" {
+			sb.WriteString(block.ref[offset:])
+		} else {
+			sb.Write(block.buf[offset:])
+		}
+		offset = 0
+	}
+	c.bufpos, c.sentLen = 0, 0
+	c.reply, c.replyBytes, c.obufExemptBytes = nil, 0, 0
+	return sb.String()
+}
+
+// luaParseReply converts the reply at pos to the value of script, and returns the position
+// after it
+func luaParseReply(reply string, pos int) (luaValue, int) {
+	if pos >= len(reply) {
+		return false, pos
+	}
+	end := strings.IndexByte(reply[pos:], '\n')
+	if end < 0 {
+		return false, len(reply)
+	}
+	line := strings.TrimSuffix(reply[pos+1:pos+end], "\r")
+	next := pos + end + 1
+	switch reply[pos] {
+	case '+':
+		return luaReplyTable("ok", line), next
+	case '-':
+		return luaReplyTable("err", line), next
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return float64(n), next
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return false, next
+		}
+		return reply[next : next+n], next + n + 2
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return false, next
+		}
+		t := newLuaTable()
+		for i := 1; i <= n; i++ {
+			var v luaValue
+			v, next = luaParseReply(reply, next)
+			t.rawSet(float64(i), v)
+		}
+		return t, next
+	}
+	return false, next
+}
+
+// addReplyLuaValue replies the value returned by the script
+func addReplyLuaValue(c *GedisClient, v luaValue) {
+	switch x := v.(type) {
+	case string:
+		c.AddReplyBulkString(x)
+	case float64:
+		c.AddReplyLongLong(int64(x))
+	case bool:
+		if x {
+			c.AddReply(REPLY_ONE)
+		} else {
+			c.AddReplyNull()
+		}
+	case *luaTable:
+		if msg, ok := x.get("err").(string); ok {
+			if !strings.HasPrefix(msg, "-") {
+				msg = "-" + msg
+			}
+			c.AddReplyError(msg)
+			return
+		}
+		if msg, ok := x.get("ok").(string); ok {
+			c.AddReplyStatus(msg)
+			return
+		}
+		// the array ends at the first nil
+		node := c.AddReplyDeferredLen()
+		n := 0
+		for e := x.get(float64(n + 1)); e != nil; e = x.get(float64(n + 1)) {
+			addReplyLuaValue(c, e)
+			n++
+		}
+		c.SetDeferredArrayLen(node, n)
+	default:
+		c.AddReplyNull()
+	}
+}
+
+// the status and the error replies can't contain newlines
+func sanitizeErrorMsg(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// scriptInterrupt is the hook of interpreter, it processes the events once the script runs
+// longer than the time limit, and stops the killed script
+func scriptInterrupt(L *luaState) {
+	s := &server.script
+	if !s.timedOut {
+		if GetTimeMs()-s.startTime < s.timeLimit {
+			return
+		}
+		log.Printf("Slow script detected: still in execution after %d milliseconds. You can try killing the script using the SCRIPT KILL command.\n", GetTimeMs()-s.startTime)
+		s.timedOut = true
+		// the next commands of the caller are processed after the script, not replied BUSY
+		s.caller.flags |= CLIENT_PROTECTED
+	}
+	processEventsWhileBlocked()
+	if s.killed {
+		panic(&luaError{value: "ERR Script killed by user with SCRIPT KILL...", fatal: true})
+	}
+}
+
+// scriptAllowedWhileBusy reports whether the command can be executed while the script timed out
+func scriptAllowedWhileBusy(c *GedisClient) bool {
+	return strings.EqualFold(c.args[0].StrVal(), "script") && len(c.args) == 2 && strings.EqualFold(c.args[1].StrVal(), "kill")
+}
+
+// luaCreateFunction compiles the script if it isn't cached, and returns the SHA1 of it
+func luaCreateFunction(c *GedisClient, body string) (string, bool) {
+	sha := sha1hex(body)
+	if _, ok := server.script.scripts[sha]; ok {
+		return sha, true
+	}
+	fn, err := luaCompile(body)
+	if err != nil {
+		c.AddReplyErrorf("Error compiling script (new function): %s", sanitizeErrorMsg(err.Error()))
+		return "", false
+	}
+	server.script.scripts[sha] = fn
+	return sha, true
+}
+
+func luaStringArray(args []*GObj) *luaTable {
+	t := newLuaTable()
+	for i, arg := range args {
+		t.rawSet(float64(i+1), arg.StrVal())
+	}
+	return t
+}
+
+func evalGenericCommand(c *GedisClient, evalsha bool) {
+	// the effects of the script are propagated instead of the script itself
+	c.flags |= CLIENT_PREVENT_PROP
+	numkeys, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+	if numkeys > int64(len(c.args)-3) {
+		c.AddReplyError("Number of keys can't be greater than number of args")
+		return
+	} else if numkeys < 0 {
+		c.AddReplyError("Number of keys can't be negative")
+		return
+	}
+
+	var sha string
+	if evalsha {
+		sha = strings.ToLower(c.args[1].StrVal())
+		if _, ok := server.script.scripts[sha]; !ok {
+			c.AddReply(REPLY_NOSCRIPT)
+			return
+		}
+	} else {
+		var ok bool
+		if sha, ok = luaCreateFunction(c, c.args[1].StrVal()); !ok {
+			return
+		}
+	}
+	fn := server.script.scripts[sha]
+
+	s := &server.script
+	L := s.lua
+	L.globals.rawSet("KEYS", luaStringArray(c.args[3:3+numkeys]))
+	L.globals.rawSet("ARGV", luaStringArray(c.args[3+numkeys:]))
+	s.caller, s.startTime = c, GetTimeMs()
+	s.timedOut, s.killed, s.wrote = false, false, false
+	// the script in a transaction is propagated with the transaction
+	nested := server.inTransaction
+	server.inTransaction = true
+
+	rets, lerr := scriptCall(L, fn)
+
+	if !nested {
+		propagateTransaction()
+	}
+	c.flags &= ^CLIENT_PROTECTED
+	s.caller, s.timedOut = nil, false
+	L.globals.rawSet("KEYS", nil)
+	L.globals.rawSet("ARGV", nil)
+
+	if lerr != nil {
+		if t, ok := lerr.value.(*luaTable); ok && t.get("err") != nil {
+			addReplyLuaValue(c, t)
+			return
+		}
+		msg := sanitizeErrorMsg(luaToDisplay(lerr.value))
+		if !strings.HasPrefix(msg, "ERR ") {
+			msg = "ERR " + msg
+		}
+		c.AddReply(fmt.Sprintf("-%s script: %s\r\n", msg, sha))
+		return
+	}
+	if len(rets) == 0 {
+		c.AddReplyNull()
+		return
+	}
+	addReplyLuaValue(c, rets[0])
+}
+
+// scriptCall runs the script, the unexpected runtime panics of the interpreter are returned as
+// the errors of the script instead of crashing the server
+func scriptCall(L *luaState, fn *luaFuncExpr) (rets []luaValue, lerr *luaError) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("unexpected error running the script: %v", r)
+			L.depth = 0
+			// the replies of the command being called are dropped
+			drainClientReply(server.script.client)
+			server.script.client.args = nil
+			rets, lerr = nil, &luaError{value: fmt.Sprintf("user_script:%d: %v", L.line, r)}
+		}
+	}()
+	return L.pcall(&luaClosure{fn: fn}, nil)
+}
+
+/* scripting command implement */
+
+// EVAL script numkeys [key ...] [arg ...]
+var evalCommand CommandProc = func(c *GedisClient) {
+	evalGenericCommand(c, false)
+}
+
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+var evalshaCommand CommandProc = func(c *GedisClient) {
+	evalGenericCommand(c, true)
+}
+
+// SCRIPT LOAD script
+// SCRIPT EXISTS sha1 [sha1 ...]
+// SCRIPT FLUSH [ASYNC|SYNC]
+// SCRIPT KILL
+var scriptCommand CommandProc = func(c *GedisClient) {
+	opt := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case opt == "load" && len(c.args) == 3:
+		if sha, ok := luaCreateFunction(c, c.args[2].StrVal()); ok {
+			c.AddReplyBulkString(sha)
+		}
+	case opt == "exists" && len(c.args) >= 3:
+		c.AddReplyArrayLen(len(c.args) - 2)
+		for _, arg := range c.args[2:] {
+			if _, ok := server.script.scripts[strings.ToLower(arg.StrVal())]; ok {
+				c.AddReply(REPLY_ONE)
+			} else {
+				c.AddReply(REPLY_ZERO)
+			}
+		}
+	case opt == "flush" && len(c.args) <= 3:
+		if len(c.args) == 3 {
+			mode := strings.ToLower(c.args[2].StrVal())
+			if mode != "async" && mode != "sync" {
+				c.AddReplyError("SCRIPT FLUSH only support SYNC|ASYNC option")
+				return
+			}
+		}
+		server.script.scripts = make(map[string]*luaFuncExpr)
+		c.AddReply(REPLY_OK)
+	case opt == "kill" && len(c.args) == 2:
+		if server.script.caller == nil {
+			c.AddReply(REPLY_NOTBUSY)
+		} else if server.script.wrote {
+			c.AddReply(REPLY_UNKILLABLE)
+		} else {
+			server.script.killed = true
+			c.AddReply(REPLY_OK)
+		}
+	default:
+		c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+	}
+}
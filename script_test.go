@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, ":3\r\n", runCommand(c, "eval", "return 1 + 2", "0"))
+	assert.Equal(t, "*3\r\n$1\r\nk\r\n$1\r\na\r\n$1\r\nb\r\n",
+		runCommand(c, "eval", "return {KEYS[1], ARGV[1], ARGV[2]}", "1", "k", "a", "b"))
+	assert.Equal(t, "*2\r\n:1\r\n$1\r\nx\r\n", runCommand(c, "eval", "return {1, 'x', nil, 'y'}", "0"))
+	assert.Equal(t, ":1\r\n"+REPLY_NIL+REPLY_NIL, runCommand(c, "eval", "return true", "0")+
+		runCommand(c, "eval", "return false", "0")+runCommand(c, "eval", "local a = 1", "0"))
+	assert.Equal(t, "+fine\r\n-MY error\r\n", runCommand(c, "eval", "return redis.status_reply('fine')", "0")+
+		runCommand(c, "eval", "return redis.error_reply('MY error')", "0"))
+
+	assert.Equal(t, REPLY_INVALID_VALUE, runCommand(c, "eval", "return 1", "x"))
+	assert.Equal(t, "-ERR Number of keys can't be greater than number of args\r\n", runCommand(c, "eval", "return 1", "2", "k"))
+	assert.Equal(t, "-ERR Number of keys can't be negative\r\n", runCommand(c, "eval", "return 1", "-1"))
+	assert.Equal(t, "-ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'\r\n",
+		runCommand(c, "eval", "return +", "0"))
+	assert.Equal(t, "-ERR user_script:1: attempt to call a nil value script: "+sha1hex("nothing()")+"\r\n",
+		runCommand(c, "eval", "nothing()", "0"))
+	assert.Equal(t, "-ERR user_script:1: resulting string too large script: "+sha1hex("return string.rep('xx', 2^62)")+"\r\n",
+		runCommand(c, "eval", "return string.rep('xx', 2^62)", "0"))
+
+	// the runtime panics are the errors of the script
+	server.script.lua.globals.rawSet("crash", &luaGoFunction{name: "crash", fn: func(L *luaState, args []luaValue) []luaValue {
+		var t *luaTable
+		return []luaValue{t.get(1)}
+	}})
+	reply := runCommand(c, "eval", "return pcall(crash)", "0")
+	assert.True(t, strings.HasPrefix(reply, "-ERR user_script:1: runtime error: invalid memory address"), reply)
+	assert.Equal(t, ":3\r\n", runCommand(c, "eval", "return 1 + 2", "0"))
+}
+
+func TestEvalRedisCall(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "eval", "return redis.call('SET', KEYS[1], ARGV[1])", "1", "k", "v"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "eval", "return redis.call('get', KEYS[1])", "1", "k"))
+	// the nil reply is false
+	assert.Equal(t, "$3\r\nnil\r\n", runCommand(c, "eval", "if redis.call('get', 'none') == false then return 'nil' end", "0"))
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(c, "eval", "redis.call('xadd', 's', '1-1', 'f', 'v') return redis.call('xrange', 's', '-', '+')[1][2][2]", "0"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "eval", "return redis.call('zadd', 'z', 3, 'c')", "0"))
+
+	// the error reply is raised by redis.call and returned by redis.pcall
+	assert.Equal(t, REPLY_WRONG_TYPE, runCommand(c, "eval", "redis.call('get', 'z') return 1", "0"))
+	assert.Equal(t, "$16\r\nERR invalid type\r\n",
+		runCommand(c, "eval", "local r = redis.pcall('get', 'z') return r.err", "0"))
+	assert.Equal(t, REPLY_UNKNOWN_CMD, runCommand(c, "eval", "return redis.call('nosuch')", "0"))
+	assert.Equal(t, "-ERR This Redis command is not allowed from script\r\n",
+		runCommand(c, "eval", "return redis.call('multi')", "0"))
+	script := "return redis.call('get', {})"
+	assert.Equal(t, "-ERR user_script:1: Lua redis lib command arguments must be strings or integers script: "+
+		sha1hex(script)+"\r\n", runCommand(c, "eval", script, "0"))
+	// XREAD never blocks in the script
+	assert.Equal(t, REPLY_NIL, runCommand(c, "eval", "return redis.call('xread', 'block', 0, 'streams', 's', '$')", "0"))
+	assert.Equal(t, 0, len(server.blockedClients))
+}
+
+func TestEvalsha(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	sha := sha1hex("return ARGV[1]")
+
+	assert.Equal(t, REPLY_NOSCRIPT, runCommand(c, "evalsha", sha, "0", "x"))
+	assert.Equal(t, "$40\r\n"+sha+"\r\n", runCommand(c, "script", "load", "return ARGV[1]"))
+	assert.Equal(t, "$1\r\nx\r\n", runCommand(c, "evalsha", sha, "0", "x"))
+	assert.Equal(t, "*2\r\n:1\r\n:0\r\n", runCommand(c, "script", "exists", sha, "ffff"))
+
+	// EVAL caches the script too
+	runCommand(c, "eval", "return 2", "0")
+	assert.Equal(t, ":2\r\n", runCommand(c, "evalsha", sha1hex("return 2"), "0"))
+
+	assert.Equal(t, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option\r\n", runCommand(c, "script", "flush", "now"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "script", "flush"))
+	assert.Equal(t, "*1\r\n:0\r\n", runCommand(c, "script", "exists", sha))
+	assert.Equal(t, REPLY_NOTBUSY, runCommand(c, "script", "kill"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'nope'\r\n", runCommand(c, "script", "nope"))
+}
+
+func TestEvalPropagate(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	// the effects are propagated instead of the script
+	runCommand(c, "eval", "redis.call('get', 'k') return 1", "0")
+	assert.Equal(t, "", server.aofBuf)
+	runCommand(c, "eval", "redis.call('set', KEYS[1], 'v') redis.call('get', KEYS[1])", "1", "k")
+	assert.Equal(t, "*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n*1\r\n$4\r\nexec\r\n", server.aofBuf)
+
+	// the script in a transaction is propagated with the transaction
+	server.aofBuf = ""
+	runCommand(c, "multi")
+	runCommand(c, "set", "a", "1")
+	runCommand(c, "eval", "redis.call('set', 'b', '2')", "0")
+	assert.Equal(t, "*2\r\n"+REPLY_OK+REPLY_NIL, runCommand(c, "exec"))
+	assert.Equal(t, "*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"+
+		"*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n2\r\n*1\r\n$4\r\nexec\r\n", server.aofBuf)
+}
+
+// busyScriptEvent registers a readable pipe, so proc is called while the script is busy
+func busyScriptEvent(t *testing.T, proc func()) {
+	fds := make([]int, 2)
+	assert.Nil(t, syscall.Pipe(fds))
+	_, err := syscall.Write(fds[1], []byte("x"))
+	assert.Nil(t, err)
+	server.aeloop.AddFileEvent(fds[0], AE_READABLE, func(loop *AeEventLoop, fd int, extra any) {
+		loop.RemoveFileEvent(fd, AE_READABLE)
+		_ = syscall.Close(fds[0])
+		_ = syscall.Close(fds[1])
+		proc()
+	}, nil)
+}
+
+func TestScriptKill(t *testing.T) {
+	initTestServer(t)
+	c, other := NewClient(0), NewClient(0)
+	server.script.timeLimit = 10
+
+	busyScriptEvent(t, func() {
+		assert.True(t, server.script.timedOut)
+		assert.Equal(t, REPLY_BUSY, runCommand(other, "get", "k"))
+		assert.Equal(t, REPLY_OK, runCommand(other, "script", "kill"))
+	})
+	assert.Equal(t, "-ERR Script killed by user with SCRIPT KILL... script: "+sha1hex("while true do end")+"\r\n",
+		runCommand(c, "eval", "while true do end", "0"))
+	assert.False(t, server.script.timedOut)
+	assert.Equal(t, REPLY_NIL, runCommand(other, "get", "k"))
+
+	// the script which wrote can't be killed
+	busyScriptEvent(t, func() {
+		assert.Equal(t, REPLY_UNKILLABLE, runCommand(other, "script", "kill"))
+		server.db.data.Set(NewObject(STR, "stop"), NewObject(STR, "1"))
+	})
+	assert.Equal(t, ":1\r\n", runCommand(c, "eval",
+		"redis.call('set', 'k', 'v') while not redis.call('get', 'stop') do end return 1", "0"))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* The slow log remembers the commands which ran longer than slowlog-log-slower-than, the
+ * newest slowlog-max-len of them are kept in a ring. The time is the execution of the command
+ * only, the I/O of the client isn't included. */
+
+const (
+	SLOWLOG_LOG_SLOWER_THAN = 10000 // us, negative disables the slow log, 0 logs every command
+	SLOWLOG_MAX_LEN         = 128
+
+	SLOWLOG_ENTRY_MAX_ARGC   = 32  // the arguments logged of a command
+	SLOWLOG_ENTRY_MAX_STRING = 128 // the bytes logged of an argument
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     int64 // unix time in seconds
+	duration int64 // us
+	args     []string
+	peerID   string // ip:port of the client
+	cname    string
+}
+
+type slowlog struct {
+	entries []*slowlogEntry // the ring, entries[head] is the oldest once it's full
+	head    int
+	len     int
+	nextID  int64 // the ID of the next entry, which isn't reset by SLOWLOG RESET
+}
+
+// push adds the entry, the oldest one is dropped once there are maxLen entries
+func (l *slowlog) push(entry *slowlogEntry, maxLen int) {
+	if maxLen <= 0 {
+		return
+	}
+	if len(l.entries) != maxLen {
+		l.resize(maxLen)
+	}
+	entry.id = l.nextID
+	l.nextID++
+	l.entries[(l.head+l.len)%maxLen] = entry
+	if l.len < maxLen {
+		l.len++
+	} else {
+		l.head = (l.head + 1) % maxLen
+	}
+}
+
+// resize changes the size of the ring, the newest entries are kept
+func (l *slowlog) resize(maxLen int) {
+	newest := l.latest(maxLen)
+	l.entries = make([]*slowlogEntry, maxLen)
+	l.head = 0
+	l.len = len(newest)
+	for i, entry := range newest {
+		l.entries[l.len-1-i] = entry
+	}
+}
+
+// latest returns the newest n entries, the newest first
+func (l *slowlog) latest(n int) []*slowlogEntry {
+	if n < 0 || n > l.len {
+		n = l.len
+	}
+	entries := make([]*slowlogEntry, n)
+	for i := range entries {
+		entries[i] = l.entries[(l.head+l.len-1-i)%len(l.entries)]
+	}
+	return entries
+}
+
+func (l *slowlog) reset() {
+	l.entries = nil
+	l.head = 0
+	l.len = 0
+}
+
+// slowlogPushEntryIfNeeded logs the command which took duration us if it's slow enough
+func slowlogPushEntryIfNeeded(c *GedisClient, args []*GObj, duration int64) {
+	if server.slowlogLogSlowerThan < 0 || duration < server.slowlogLogSlowerThan {
+		return
+	}
+	argc := len(args)
+	if argc > SLOWLOG_ENTRY_MAX_ARGC {
+		argc = SLOWLOG_ENTRY_MAX_ARGC
+	}
+	entry := &slowlogEntry{
+		time:     GetTimeMs() / 1000,
+		duration: duration,
+		args:     make([]string, argc),
+		peerID:   c.peerID(),
+		cname:    c.name,
+	}
+	for i := range entry.args {
+		// the last slot tells how many arguments are left out
+		if i == argc-1 && len(args) > argc {
+			entry.args[i] = fmt.Sprintf("... (%d more arguments)", len(args)-argc+1)
+			break
+		}
+		s := args[i].StrVal()
+		if len(s) > SLOWLOG_ENTRY_MAX_STRING {
+			s = fmt.Sprintf("%s... (%d more bytes)", s[:SLOWLOG_ENTRY_MAX_STRING], len(s)-SLOWLOG_ENTRY_MAX_STRING)
+		}
+		entry.args[i] = s
+	}
+	server.slowlog.push(entry, server.slowlogMaxLen)
+}
+
+var slowlogHelp = []string{
+	"GET [<count>]",
+	"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+	"    Entries are made of:",
+	"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+	"    client name",
+	"LEN",
+	"    Return the length of the slowlog.",
+	"RESET",
+	"    Reset the slowlog.",
+}
+
+// SLOWLOG GET [count] | LEN | RESET | HELP
+var slowlogCommand CommandProc = func(c *GedisClient) {
+	switch sub := strings.ToLower(c.args[1].StrVal()); {
+	case sub == "help" && len(c.args) == 2:
+		c.AddReplyHelp("slowlog", slowlogHelp)
+		return
+	case sub == "reset" && len(c.args) == 2:
+		server.slowlog.reset()
+		c.AddReply(REPLY_OK)
+		return
+	case sub == "len" && len(c.args) == 2:
+		c.AddReplyInt(server.slowlog.len)
+		return
+	case sub == "get" && len(c.args) <= 3:
+		count := 10
+		if len(c.args) == 3 {
+			n, err := strconv.Atoi(c.args[2].StrVal())
+			if err != nil || n < -1 {
+				c.AddReplyError("count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		entries := server.slowlog.latest(count)
+		c.AddReplyArrayLen(len(entries))
+		for _, entry := range entries {
+			c.AddReplyArrayLen(6)
+			c.AddReplyLongLong(entry.id)
+			c.AddReplyLongLong(entry.time)
+			c.AddReplyLongLong(entry.duration)
+			c.AddReplyArrayLen(len(entry.args))
+			for _, arg := range entry.args {
+				c.AddReplyBulkString(arg)
+			}
+			c.AddReplyBulkString(entry.peerID)
+			c.AddReplyBulkString(entry.cname)
+		}
+		return
+	}
+	c.AddReplyErrorf("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+}
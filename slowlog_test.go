@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSlowlogRing(t *testing.T) {
+	var l slowlog
+	assert.Equal(t, 0, len(l.latest(-1)))
+	for i := 0; i < 5; i++ {
+		l.push(&slowlogEntry{duration: int64(i)}, 3)
+	}
+	entries := l.latest(-1)
+	assert.Equal(t, 3, len(entries))
+	for i, entry := range entries {
+		assert.Equal(t, int64(4-i), entry.id)
+	}
+	assert.Equal(t, int64(4), l.latest(1)[0].id)
+
+	// the newest entries are kept once the ring is resized
+	l.push(&slowlogEntry{}, 2)
+	assert.Equal(t, 2, l.len)
+	assert.Equal(t, int64(5), l.latest(-1)[0].id)
+	assert.Equal(t, int64(4), l.latest(-1)[1].id)
+	l.push(&slowlogEntry{}, 4)
+	assert.Equal(t, 3, l.len)
+	assert.Equal(t, int64(4), l.latest(-1)[2].id)
+
+	// nothing is logged if the max length is 0, and the IDs go on after the reset
+	l.push(&slowlogEntry{}, 0)
+	assert.Equal(t, 3, l.len)
+	l.reset()
+	l.push(&slowlogEntry{}, 4)
+	assert.Equal(t, 1, l.len)
+	assert.Equal(t, int64(7), l.latest(-1)[0].id)
+}
+
+func TestSlowlogCommand(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	c.name = "worker"
+
+	runCommand(c, "set", "k", "v")
+	assert.Equal(t, ":0\r\n", runCommand(c, "slowlog", "len"))
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "slowlog-log-slower-than", "0"))
+	runCommand(c, "get", "k")
+	assert.Equal(t, ":2\r\n", runCommand(c, "slowlog", "len"))
+
+	reply := runCommand(c, "slowlog", "get", "1")
+	// the entry of SLOWLOG LEN is the newest
+	assert.True(t, strings.HasPrefix(reply, "*1\r\n*6\r\n:2\r\n:"), reply)
+	assert.True(t, strings.HasSuffix(reply, "*2\r\n$7\r\nslowlog\r\n$3\r\nlen\r\n$0\r\n\r\n$6\r\nworker\r\n"), reply)
+	assert.True(t, strings.HasPrefix(runCommand(c, "slowlog", "get"), "*4\r\n"))
+
+	// the arguments are truncated
+	args := []string{"pfadd", "hll", strings.Repeat("x", SLOWLOG_ENTRY_MAX_STRING+10)}
+	for i := 0; i < SLOWLOG_ENTRY_MAX_ARGC; i++ {
+		args = append(args, fmt.Sprint(i))
+	}
+	runCommand(c, args...)
+	entry := server.slowlog.latest(1)[0]
+	assert.Equal(t, SLOWLOG_ENTRY_MAX_ARGC, len(entry.args))
+	assert.Equal(t, strings.Repeat("x", SLOWLOG_ENTRY_MAX_STRING)+"... (10 more bytes)", entry.args[2])
+	assert.Equal(t, "27", entry.args[SLOWLOG_ENTRY_MAX_ARGC-2])
+	assert.Equal(t, "... (4 more arguments)", entry.args[SLOWLOG_ENTRY_MAX_ARGC-1])
+
+	assert.Equal(t, REPLY_OK, runCommand(c, "slowlog", "reset"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "slowlog", "len"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "config", "set", "slowlog-log-slower-than", "-1"))
+	runCommand(c, "get", "k")
+	assert.Equal(t, ":2\r\n", runCommand(c, "slowlog", "len"))
+
+	assert.Equal(t, "-ERR count should be greater than or equal to -1\r\n", runCommand(c, "slowlog", "get", "-2"))
+	assert.Equal(t, "-ERR unknown subcommand or wrong number of arguments for 'len'\r\n", runCommand(c, "slowlog", "len", "1"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "slowlog"))
+	reply = runCommand(c, "slowlog", "help")
+	assert.True(t, strings.HasPrefix(reply, fmt.Sprintf("*%d\r\n+SLOWLOG <subcommand>", len(slowlogHelp)+3)), reply)
+}
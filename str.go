@@ -50,3 +50,109 @@ func CompareStr(a, b *GObj) bool {
 	}
 	return a.StrVal() < b.StrVal()
 }
+
+// BytesVal returns the raw bytes of a string or a bitmap, nil for other types
+func (o *GObj) BytesVal() []byte {
+	switch o.Type_ {
+	case STR:
+		return []byte(o.StrVal())
+	case BITMAP:
+		return *o.Val_.(*Bitmap)
+	}
+	return nil
+}
+
+/* string command implement */
+
+// SETRANGE key offset value
+var setrangeCommand CommandProc = func(c *GedisClient) {
+	var offset int64
+	if GetNumber(c.args[2].StrVal(), &offset) != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+	if offset < 0 {
+		c.AddReply(REPLY_OFFSET_RANGE)
+		return
+	}
+	value := c.args[3].StrVal()
+	if offset > BITMAP_MAX_BITS/8-int64(len(value)) {
+		c.AddReply(REPLY_STRING_TOO_BIG)
+		return
+	}
+
+	obj := LookupKey(c.args[1])
+	if obj != nil && obj.Type_ != STR && obj.Type_ != BITMAP {
+		c.AddReply(REPLY_WRONG_TYPE)
+		return
+	}
+	// nothing to do with an empty value, just return the length
+	if len(value) == 0 {
+		if obj == nil {
+			c.AddReplyInt(0)
+		} else {
+			c.AddReplyInt(len(obj.BytesVal()))
+		}
+		return
+	}
+
+	bm := lookupBitmapOrCreate(c, c.args[1])
+	if bm == nil {
+		return
+	}
+	growIfNeedBitmap(bm, (offset+int64(len(value)))<<3-1)
+	copy((*bm)[offset:], value)
+	signalModifiedKey(c, c.args[1])
+	server.dirty++
+	notifyKeyspaceEvent(NOTIFY_STRING, "setrange", c.args[1])
+	c.AddReplyInt(len(*bm))
+}
+
+// GETRANGE key start end
+var getrangeCommand CommandProc = func(c *GedisClient) {
+	var start, end int64
+	if GetNumber(c.args[2].StrVal(), &start) != nil || GetNumber(c.args[3].StrVal(), &end) != nil {
+		c.AddReply(REPLY_INVALID_VALUE)
+		return
+	}
+
+	obj := LookupKeyRead(c.args[1])
+	if obj != nil && obj.Type_ != STR && obj.Type_ != BITMAP {
+		c.AddReply(REPLY_WRONG_TYPE)
+		return
+	}
+	var b []byte
+	if obj != nil {
+		b = obj.BytesVal()
+	}
+
+	/* Convert negative indexes */
+	strLen := int64(len(b))
+	if start < 0 && end < 0 && start > end {
+		c.AddReplyBulkString("")
+		return
+	}
+	if start < 0 {
+		start = strLen + start
+	}
+	if end < 0 {
+		end = strLen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strLen {
+		end = strLen - 1
+	}
+
+	/* Precondition: end >= 0 && end < strlen, so the only condition where
+	 * nothing can be returned is: start > end. */
+	if start > end || strLen == 0 {
+		c.AddReplyBulkString("")
+		return
+	}
+	c.AddReplyBulkString(string(b[start : end+1]))
+}
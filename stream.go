@@ -0,0 +1,1473 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* A stream is an append only log of entries ordered by their IDs. The IDs only grow, so the
+ * entries are kept in a slice and located by binary search. A consumer group remembers the
+ * last ID delivered to it, and the entries delivered but not acknowledged yet are kept in
+ * the pending entries list (PEL) of the group and of the consumer owning them. */
+
+const (
+	TRIM_STRATEGY_NONE   = 0
+	TRIM_STRATEGY_MAXLEN = 1
+	TRIM_STRATEGY_MINID  = 2
+
+	STREAM_AUTOCLAIM_COUNT = 100 // the default COUNT of XAUTOCLAIM
+
+	REPLY_INVALID_STREAM_ID = "-ERR Invalid stream ID specified as stream command argument\r\n"
+	REPLY_XADD_ID_SMALLER   = "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"
+	REPLY_XGROUP_NO_KEY     = "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"
+)
+
+type StreamID struct {
+	ms  uint64 // unix time in ms
+	seq uint64 // sequence number for the entries in the same ms
+}
+
+var streamMaxID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id StreamID) compare(o StreamID) int {
+	if id.ms != o.ms {
+		if id.ms > o.ms {
+			return 1
+		}
+		return -1
+	}
+	if id.seq != o.seq {
+		if id.seq > o.seq {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+// incr returns the next ID, false is returned if the ID is the max
+func (id StreamID) incr() (StreamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return StreamID{id.ms, id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return StreamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// decr returns the previous ID, false is returned if the ID is 0-0
+func (id StreamID) decr() (StreamID, bool) {
+	if id.seq > 0 {
+		return StreamID{id.ms, id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return StreamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+type streamEntry struct {
+	id     StreamID
+	fields []*GObj // field value pairs, nil means the entry was deleted
+}
+
+type streamNACK struct {
+	deliveryTime  int64 // the last time the entry was delivered, unix time in ms
+	deliveryCount int64
+	consumer      *streamConsumer
+}
+
+type streamConsumer struct {
+	name     string
+	seenTime int64
+	pel      map[StreamID]*streamNACK // shares the NACKs with the PEL of the group
+}
+
+type streamCG struct {
+	lastID    StreamID // the last ID delivered to the group
+	pel       map[StreamID]*streamNACK
+	consumers map[string]*streamConsumer
+}
+
+type Stream struct {
+	entries      []*streamEntry // ordered by ID
+	lastID       StreamID       // the ID of the last added entry, even if it's deleted
+	maxDeletedID StreamID
+	entriesAdded int64 // the count of all the entries added in the lifetime
+	cgroups      map[string]*streamCG
+}
+
+func NewStream() *Stream {
+	return &Stream{cgroups: make(map[string]*streamCG)}
+}
+
+func (s *Stream) Length() int {
+	return len(s.entries)
+}
+
+// search returns the index of the first entry whose ID is not smaller than the id
+func (s *Stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].id.compare(id) >= 0
+	})
+}
+
+func (s *Stream) find(id StreamID) *streamEntry {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i]
+	}
+	return nil
+}
+
+// nextID returns the ID of the entry to append. The ID is generated if id is nil, and only the
+// sequence number is generated if seqGiven is false. False is returned if the ID is not greater
+// than the last ID.
+func (s *Stream) nextID(id *StreamID, seqGiven bool) (StreamID, bool) {
+	last := s.lastID
+	if id == nil {
+		ms := uint64(GetTimeMs())
+		if ms > last.ms {
+			return StreamID{ms, 0}, true
+		}
+		return last.incr()
+	}
+	if !seqGiven {
+		if id.ms == last.ms {
+			if last.seq == math.MaxUint64 {
+				return last, false
+			}
+			return StreamID{id.ms, last.seq + 1}, true
+		}
+		return StreamID{id.ms, 0}, id.ms > last.ms
+	}
+	return *id, id.compare(last) > 0
+}
+
+// append adds the entry, the ID must be greater than the last ID
+func (s *Stream) append(id StreamID, fields []*GObj) {
+	s.entries = append(s.entries, &streamEntry{id: id, fields: fields})
+	s.lastID = id
+	s.entriesAdded++
+}
+
+func (s *Stream) delete(id StreamID) bool {
+	i := s.search(id)
+	if i == len(s.entries) || s.entries[i].id != id {
+		return false
+	}
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	if id.compare(s.maxDeletedID) > 0 {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// rangeEntries returns at most count entries between start and end, both inclusive,
+// count < 0 means no limit
+func (s *Stream) rangeEntries(start, end StreamID, count int, rev bool) []*streamEntry {
+	if start.compare(end) > 0 {
+		return nil
+	}
+	lo := s.search(start)
+	hi := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].id.compare(end) > 0
+	})
+	n := hi - lo
+	if count >= 0 && count < n {
+		n = count
+	}
+	res := make([]*streamEntry, n)
+	for i := 0; i < n; i++ {
+		if rev {
+			res[i] = s.entries[hi-1-i]
+		} else {
+			res[i] = s.entries[lo+i]
+		}
+	}
+	return res
+}
+
+type streamTrimArgs struct {
+	strategy int
+	maxLen   int64
+	minID    StreamID
+	approx   bool  // the ~ option, as the entries are not stored in nodes it trims exactly
+	limit    int64 // the max entries to trim, 0 means no limit
+}
+
+// trim removes the oldest entries according to the strategy, returns the count of the removed
+func (s *Stream) trim(args *streamTrimArgs) int64 {
+	var n int64
+	for len(s.entries) > 0 && (args.limit == 0 || n < args.limit) {
+		if args.strategy == TRIM_STRATEGY_MAXLEN && int64(len(s.entries)) <= args.maxLen {
+			break
+		}
+		if args.strategy == TRIM_STRATEGY_MINID && s.entries[0].id.compare(args.minID) >= 0 {
+			break
+		}
+		s.entries[0] = nil
+		s.entries = s.entries[1:]
+		n++
+	}
+	return n
+}
+
+func (s *Stream) createCG(name string, id StreamID) *streamCG {
+	cg := &streamCG{
+		lastID:    id,
+		pel:       make(map[StreamID]*streamNACK),
+		consumers: make(map[string]*streamConsumer),
+	}
+	s.cgroups[name] = cg
+	return cg
+}
+
+func (cg *streamCG) lookupConsumer(name string, create bool) *streamConsumer {
+	consumer := cg.consumers[name]
+	if consumer == nil && create {
+		consumer = &streamConsumer{name: name, pel: make(map[StreamID]*streamNACK)}
+		cg.consumers[name] = consumer
+	}
+	if consumer != nil {
+		consumer.seenTime = GetTimeMs()
+	}
+	return consumer
+}
+
+// lookupConsumerOrCreate is lookupConsumer creating the missing consumer, the creation is notified
+func (cg *streamCG) lookupConsumerOrCreate(name string, key *GObj) *streamConsumer {
+	if consumer := cg.lookupConsumer(name, false); consumer != nil {
+		return consumer
+	}
+	notifyKeyspaceEvent(NOTIFY_STREAM, "xgroup-createconsumer", key)
+	return cg.lookupConsumer(name, true)
+}
+
+func (cg *streamCG) deleteConsumer(consumer *streamConsumer) {
+	for id := range consumer.pel {
+		delete(cg.pel, id)
+	}
+	delete(cg.consumers, consumer.name)
+}
+
+// ack removes the entry from the PEL
+func (cg *streamCG) ack(id StreamID) bool {
+	nack := cg.pel[id]
+	if nack == nil {
+		return false
+	}
+	delete(cg.pel, id)
+	if nack.consumer != nil {
+		delete(nack.consumer.pel, id)
+	}
+	return true
+}
+
+// sortedPEL returns the IDs of the PEL between start and end in order
+func sortedPEL(pel map[StreamID]*streamNACK, start, end StreamID) []StreamID {
+	ids := make([]StreamID, 0, len(pel))
+	for id := range pel {
+		if id.compare(start) >= 0 && id.compare(end) <= 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].compare(ids[j]) < 0
+	})
+	return ids
+}
+
+// claim transfers the NACK to the consumer
+func (nack *streamNACK) claim(id StreamID, consumer *streamConsumer) {
+	if nack.consumer == consumer {
+		return
+	}
+	if nack.consumer != nil {
+		delete(nack.consumer.pel, id)
+	}
+	nack.consumer = consumer
+	consumer.pel[id] = nack
+}
+
+/* stream ID parsing */
+
+// parseStreamID parses the ID in the form of ms-seq or ms, the missing seq is set to missingSeq.
+// "-" and "+" are the min and max ID.
+func parseStreamID(s string, missingSeq uint64) (id StreamID, seqGiven bool, ok bool) {
+	if s == "-" {
+		return StreamID{}, true, true
+	} else if s == "+" {
+		return streamMaxID, true, true
+	}
+	msPart, seqPart, found := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return id, false, false
+	}
+	if !found {
+		return StreamID{ms, missingSeq}, false, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return id, false, false
+	}
+	return StreamID{ms, seq}, true, true
+}
+
+// parseStreamIDOrReply parses the ID with the missing seq 0, false is returned if the error reply was added.
+func parseStreamIDOrReply(c *GedisClient, arg *GObj) (StreamID, bool) {
+	id, _, ok := parseStreamID(arg.StrVal(), 0)
+	if !ok {
+		c.AddReply(REPLY_INVALID_STREAM_ID)
+	}
+	return id, ok
+}
+
+// parseIntervalIDOrReply parses the start or end of a range, which is exclusive with the prefix "(".
+func parseIntervalIDOrReply(c *GedisClient, arg *GObj, isStart bool) (StreamID, bool) {
+	s := arg.StrVal()
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+	if !strings.HasPrefix(s, "(") {
+		id, _, ok := parseStreamID(s, missingSeq)
+		if !ok {
+			c.AddReply(REPLY_INVALID_STREAM_ID)
+		}
+		return id, ok
+	}
+	id, _, ok := parseStreamID(s[1:], missingSeq)
+	if !ok || s[1:] == "-" || s[1:] == "+" {
+		c.AddReply(REPLY_INVALID_STREAM_ID)
+		return id, false
+	}
+	if isStart {
+		id, ok = id.incr()
+		if !ok {
+			c.AddReplyError("invalid start ID for the interval")
+		}
+	} else {
+		id, ok = id.decr()
+		if !ok {
+			c.AddReplyError("invalid end ID for the interval")
+		}
+	}
+	return id, ok
+}
+
+// streamParseAddOrTrimArgs parses the options of XADD and XTRIM, for XADD the position of ID is
+// returned, it returns -1 if the error reply was added.
+func streamParseAddOrTrimArgs(c *GedisClient, trim *streamTrimArgs, nomkstream *bool) int {
+	xadd := nomkstream != nil
+	limitGiven := false
+	i := 2
+	for ; i < len(c.args); i++ {
+		moreargs := len(c.args) - 1 - i
+		opt := strings.ToLower(c.args[i].StrVal())
+		if (opt == "maxlen" || opt == "minid") && moreargs > 0 {
+			if trim.strategy != TRIM_STRATEGY_NONE {
+				c.AddReplyError("syntax error, MAXLEN and MINID options at the same time are not compatible")
+				return -1
+			}
+			next := c.args[i+1].StrVal()
+			if (next == "~" || next == "=") && moreargs > 1 {
+				trim.approx = next == "~"
+				i++
+			}
+			i++
+			if opt == "maxlen" {
+				trim.strategy = TRIM_STRATEGY_MAXLEN
+				n, err := strconv.ParseInt(c.args[i].StrVal(), 10, 64)
+				if err != nil {
+					c.AddReply(REPLY_INVALID_VALUE)
+					return -1
+				}
+				if n < 0 {
+					c.AddReplyError("The MAXLEN argument must be >= 0.")
+					return -1
+				}
+				trim.maxLen = n
+			} else {
+				trim.strategy = TRIM_STRATEGY_MINID
+				id, ok := parseStreamIDOrReply(c, c.args[i])
+				if !ok {
+					return -1
+				}
+				trim.minID = id
+			}
+		} else if opt == "limit" && moreargs > 0 {
+			i++
+			n, err := strconv.ParseInt(c.args[i].StrVal(), 10, 64)
+			if err != nil || n < 0 {
+				c.AddReplyError("The LIMIT argument must be >= 0.")
+				return -1
+			}
+			trim.limit = n
+			limitGiven = true
+		} else if xadd && opt == "nomkstream" {
+			*nomkstream = true
+		} else if xadd {
+			// the rest is the ID and the fields
+			break
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return -1
+		}
+	}
+
+	if limitGiven && !trim.approx {
+		c.AddReplyError("syntax error, LIMIT cannot be used without the special ~ option")
+		return -1
+	}
+	if !xadd && trim.strategy == TRIM_STRATEGY_NONE {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return -1
+	}
+	return i
+}
+
+/* stream lookup and reply */
+
+// lookupStreamRead returns the stream stored at the key, ok is false if the error reply was added.
+func lookupStreamRead(c *GedisClient, key *GObj) (s *Stream, ok bool) {
+	o := LookupKeyRead(key)
+	if o == nil {
+		return nil, true
+	}
+	if o.Type_ != STREAM {
+		c.AddReply(REPLY_WRONG_TYPE)
+		return nil, false
+	}
+	return o.Val_.(*Stream), true
+}
+
+// lookupStreamOrCreate returns the stream stored at the key, a new one is created if missing.
+func lookupStreamOrCreate(c *GedisClient, key *GObj) (s *Stream, ok bool) {
+	s, ok = lookupStreamRead(c, key)
+	if ok && s == nil {
+		s = NewStream()
+		_ = server.db.data.Add(key, NewObject(STREAM, s))
+	}
+	return s, ok
+}
+
+// lookupCGOrReply returns the consumer group, nil is returned if the NOGROUP error was added.
+func lookupCGOrReply(c *GedisClient, s *Stream, key, group *GObj) *streamCG {
+	var cg *streamCG
+	if s != nil {
+		cg = s.cgroups[group.StrVal()]
+	}
+	if cg == nil {
+		c.AddReplyErrorf("-NOGROUP No such key '%s' or consumer group '%s'", key.StrVal(), group.StrVal())
+	}
+	return cg
+}
+
+func addReplyStreamID(c *GedisClient, id StreamID) {
+	c.AddReplyBulkString(id.String())
+}
+
+func addReplyStreamEntries(c *GedisClient, entries []*streamEntry) {
+	c.AddReplyArrayLen(len(entries))
+	for _, e := range entries {
+		c.AddReplyArrayLen(2)
+		addReplyStreamID(c, e.id)
+		if e.fields == nil {
+			c.AddReplyNullArray()
+			continue
+		}
+		c.AddReplyArrayLen(len(e.fields))
+		for _, f := range e.fields {
+			c.AddReplyBulk(f)
+		}
+	}
+}
+
+// streamPropagateXCLAIM propagates the delivery of a pending entry as an XCLAIM command, which
+// restores the NACK exactly when the AOF is loaded.
+func streamPropagateXCLAIM(key, group *GObj, cg *streamCG, id StreamID, nack *streamNACK) {
+	alsoPropagate(
+		NewObject(STR, "xclaim"), key, group,
+		NewObject(STR, nack.consumer.name),
+		NewObject(STR, "0"),
+		NewObject(STR, id.String()),
+		NewObject(STR, "time"),
+		NewObject(STR, strconv.FormatInt(nack.deliveryTime, 10)),
+		NewObject(STR, "retrycount"),
+		NewObject(STR, strconv.FormatInt(nack.deliveryCount, 10)),
+		NewObject(STR, "force"),
+		NewObject(STR, "justid"),
+		NewObject(STR, "lastid"),
+		NewObject(STR, cg.lastID.String()),
+	)
+}
+
+// streamPropagateXACK propagates the removal of a pending entry
+func streamPropagateXACK(key, group *GObj, id StreamID) {
+	alsoPropagate(NewObject(STR, "xack"), key, group, NewObject(STR, id.String()))
+}
+
+/* stream command implement */
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+var xaddCommand CommandProc = func(c *GedisClient) {
+	var trim streamTrimArgs
+	nomkstream := false
+	idPos := streamParseAddOrTrimArgs(c, &trim, &nomkstream)
+	if idPos < 0 {
+		return
+	}
+	fields := len(c.args) - idPos - 1
+	if fields < 2 || fields%2 != 0 {
+		c.AddReply(REPLY_WRONG_ARITY)
+		return
+	}
+
+	var useID *StreamID
+	seqGiven := true
+	if idArg := c.args[idPos].StrVal(); idArg != "*" {
+		var id StreamID
+		var ok bool
+		if strings.HasSuffix(idArg, "-*") {
+			id, _, ok = parseStreamID(strings.TrimSuffix(idArg, "-*"), 0)
+			seqGiven = false
+		} else {
+			id, seqGiven, ok = parseStreamID(idArg, 0)
+			ok = ok && idArg != "-" && idArg != "+"
+		}
+		if !ok {
+			c.AddReply(REPLY_INVALID_STREAM_ID)
+			return
+		}
+		if seqGiven && id == (StreamID{}) {
+			c.AddReplyError("The ID specified in XADD must be greater than 0-0")
+			return
+		}
+		useID = &id
+	}
+
+	key := c.args[1]
+	s, ok := lookupStreamRead(c, key)
+	if !ok {
+		return
+	}
+	if s == nil && nomkstream {
+		c.AddReplyNull()
+		return
+	}
+	last := NewStream()
+	if s != nil {
+		last = s
+	}
+	id, ok := last.nextID(useID, seqGiven)
+	if !ok {
+		if useID == nil {
+			c.AddReplyError("The stream has exhausted the last possible ID, unable to add more items")
+		} else {
+			c.AddReply(REPLY_XADD_ID_SMALLER)
+		}
+		return
+	}
+	if s == nil {
+		s, _ = lookupStreamOrCreate(c, key)
+	}
+
+	s.append(id, append([]*GObj(nil), c.args[idPos+1:]...))
+	// propagate the generated ID
+	c.args[idPos] = NewObject(STR, id.String())
+	addReplyStreamID(c, id)
+	notifyKeyspaceEvent(NOTIFY_STREAM, "xadd", key)
+	if trim.strategy != TRIM_STRATEGY_NONE && s.trim(&trim) > 0 {
+		notifyKeyspaceEvent(NOTIFY_STREAM, "xtrim", key)
+	}
+	signalModifiedKey(c, key)
+	server.dirty++
+	signalKeyAsReady(key)
+}
+
+func xrangeGenericCommand(c *GedisClient, rev bool) {
+	startArg, endArg := c.args[2], c.args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, ok := parseIntervalIDOrReply(c, startArg, true)
+	if !ok {
+		return
+	}
+	end, ok := parseIntervalIDOrReply(c, endArg, false)
+	if !ok {
+		return
+	}
+
+	count := -1
+	for i := 4; i < len(c.args); i++ {
+		if strings.ToLower(c.args[i].StrVal()) == "count" && i+1 < len(c.args) {
+			n, err := strconv.Atoi(c.args[i+1].StrVal())
+			if err != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			if n < 0 {
+				n = 0
+			}
+			count = n
+			i++
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	if s == nil {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	addReplyStreamEntries(c, s.rangeEntries(start, end, count, rev))
+}
+
+// XRANGE key start end [COUNT count]
+var xrangeCommand CommandProc = func(c *GedisClient) {
+	xrangeGenericCommand(c, false)
+}
+
+// XREVRANGE key end start [COUNT count]
+var xrevrangeCommand CommandProc = func(c *GedisClient) {
+	xrangeGenericCommand(c, true)
+}
+
+// XLEN key
+var xlenCommand CommandProc = func(c *GedisClient) {
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	n := 0
+	if s != nil {
+		n = s.Length()
+	}
+	c.AddReplyLongLong(int64(n))
+}
+
+// XDEL key id [id ...]
+var xdelCommand CommandProc = func(c *GedisClient) {
+	ids := make([]StreamID, 0, len(c.args)-2)
+	for i := 2; i < len(c.args); i++ {
+		id, ok := parseStreamIDOrReply(c, c.args[i])
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	deleted := 0
+	if s != nil {
+		for _, id := range ids {
+			if s.delete(id) {
+				deleted++
+			}
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
+		notifyKeyspaceEvent(NOTIFY_STREAM, "xdel", c.args[1])
+	}
+	c.AddReplyLongLong(int64(deleted))
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+var xtrimCommand CommandProc = func(c *GedisClient) {
+	var trim streamTrimArgs
+	if streamParseAddOrTrimArgs(c, &trim, nil) < 0 {
+		return
+	}
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	var deleted int64
+	if s != nil {
+		deleted = s.trim(&trim)
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.args[1])
+		server.dirty++
+		notifyKeyspaceEvent(NOTIFY_STREAM, "xtrim", c.args[1])
+	}
+	c.AddReplyLongLong(int64(deleted))
+}
+
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+var xsetidCommand CommandProc = func(c *GedisClient) {
+	id, ok := parseStreamIDOrReply(c, c.args[2])
+	if !ok {
+		return
+	}
+	entriesAdded := int64(-1)
+	maxDeletedID := StreamID{}
+	maxDeletedGiven := false
+	for i := 3; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "entriesadded" && i+1 < len(c.args) {
+			n, err := strconv.ParseInt(c.args[i+1].StrVal(), 10, 64)
+			if err != nil || n < 0 {
+				c.AddReplyError("entries_added must be positive")
+				return
+			}
+			entriesAdded = n
+		} else if opt == "maxdeletedid" && i+1 < len(c.args) {
+			if maxDeletedID, ok = parseStreamIDOrReply(c, c.args[i+1]); !ok {
+				return
+			}
+			maxDeletedGiven = true
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+		i++
+	}
+
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	if s == nil {
+		c.AddReplyError("no such key")
+		return
+	}
+	if s.Length() > 0 && id.compare(s.entries[s.Length()-1].id) < 0 {
+		c.AddReplyError("The ID specified in XSETID is smaller than the target stream top item")
+		return
+	}
+	if entriesAdded != -1 && entriesAdded < int64(s.Length()) {
+		c.AddReplyError("The entries_added specified in XSETID is smaller than the target stream length")
+		return
+	}
+	if maxDeletedGiven && id.compare(maxDeletedID) < 0 {
+		c.AddReplyError("The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+		return
+	}
+	s.lastID = id
+	if entriesAdded != -1 {
+		s.entriesAdded = entriesAdded
+	}
+	if maxDeletedGiven {
+		s.maxDeletedID = maxDeletedID
+	}
+	signalModifiedKey(c, c.args[1])
+	server.dirty++
+	notifyKeyspaceEvent(NOTIFY_STREAM, "xsetid", c.args[1])
+	c.AddReply(REPLY_OK)
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+var xreadCommand CommandProc = func(c *GedisClient) {
+	xreadGenericCommand(c, false)
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+var xreadgroupCommand CommandProc = func(c *GedisClient) {
+	xreadGenericCommand(c, true)
+}
+
+func xreadGenericCommand(c *GedisClient, xreadgroup bool) {
+	// XREADGROUP propagates its effects by XCLAIM and XGROUP SETID instead of itself
+	if xreadgroup {
+		c.flags |= CLIENT_PREVENT_PROP
+	}
+	timeout := int64(-1)
+	count := -1
+	noack := false
+	var group, consumerName *GObj
+	streamsArg := 0
+	for i := 1; i < len(c.args); i++ {
+		moreargs := len(c.args) - 1 - i
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "block" && moreargs > 0 {
+			i++
+			ms, err := strconv.ParseInt(c.args[i].StrVal(), 10, 64)
+			if err != nil {
+				c.AddReplyError("timeout is not an integer or out of range")
+				return
+			}
+			if ms < 0 {
+				c.AddReplyError("timeout is negative")
+				return
+			}
+			timeout = ms
+		} else if opt == "count" && moreargs > 0 {
+			i++
+			n, err := strconv.Atoi(c.args[i].StrVal())
+			if err != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			if n > 0 {
+				count = n
+			}
+		} else if opt == "streams" && moreargs > 0 {
+			streamsArg = i + 1
+			if (len(c.args)-streamsArg)%2 != 0 {
+				c.AddReplyErrorf("Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", c.args[0].StrVal())
+				return
+			}
+			break
+		} else if opt == "group" && moreargs > 1 {
+			if !xreadgroup {
+				c.AddReplyError("The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			group, consumerName = c.args[i+1], c.args[i+2]
+			i += 2
+		} else if opt == "noack" {
+			if !xreadgroup {
+				c.AddReplyError("The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			noack = true
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+	if streamsArg == 0 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	if xreadgroup && group == nil {
+		c.AddReplyError("Missing GROUP option for XREADGROUP")
+		return
+	}
+
+	nkeys := (len(c.args) - streamsArg) / 2
+	streams := make([]*Stream, nkeys)
+	groups := make([]*streamCG, nkeys)
+	ids := make([]StreamID, nkeys)
+	newOnly := make([]bool, nkeys) // the ID is ">"
+	dollars := make([]bool, nkeys) // the ID is "$"
+	for i := 0; i < nkeys; i++ {
+		key := c.args[streamsArg+i]
+		s, ok := lookupStreamRead(c, key)
+		if !ok {
+			return
+		}
+		if xreadgroup {
+			if s != nil {
+				groups[i] = s.cgroups[group.StrVal()]
+			}
+			if groups[i] == nil {
+				c.AddReply(fmt.Sprintf("-NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option\r\n",
+					key.StrVal(), group.StrVal()))
+				return
+			}
+		}
+		streams[i] = s
+
+		idArg := c.args[streamsArg+nkeys+i].StrVal()
+		if idArg == "$" {
+			if xreadgroup {
+				c.AddReplyError("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+				return
+			}
+			if s != nil {
+				ids[i] = s.lastID
+			}
+			dollars[i] = true
+		} else if idArg == ">" {
+			if !xreadgroup {
+				c.AddReplyError("The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+				return
+			}
+			newOnly[i] = true
+		} else {
+			id, ok := parseStreamIDOrReply(c, c.args[streamsArg+nkeys+i])
+			if !ok {
+				return
+			}
+			ids[i] = id
+		}
+	}
+
+	type readResult struct {
+		key     *GObj
+		entries []*streamEntry
+	}
+	var results []readResult
+	for i := 0; i < nkeys; i++ {
+		key, s := c.args[streamsArg+i], streams[i]
+		if !xreadgroup {
+			start, ok := ids[i].incr()
+			if s == nil || !ok {
+				continue
+			}
+			if entries := s.rangeEntries(start, streamMaxID, count, false); len(entries) > 0 {
+				results = append(results, readResult{key, entries})
+			}
+			continue
+		}
+
+		cg := groups[i]
+		consumer := cg.lookupConsumerOrCreate(consumerName.StrVal(), key)
+		now := GetTimeMs()
+		if !newOnly[i] {
+			// read the history of the consumer, the deleted entries are replied with nil fields
+			start, ok := ids[i].incr()
+			if !ok {
+				results = append(results, readResult{key, nil})
+				continue
+			}
+			pending := sortedPEL(consumer.pel, start, streamMaxID)
+			if count > 0 && len(pending) > count {
+				pending = pending[:count]
+			}
+			entries := make([]*streamEntry, len(pending))
+			for j, id := range pending {
+				entries[j] = &streamEntry{id: id}
+				if e := s.find(id); e != nil {
+					entries[j] = e
+				}
+				nack := consumer.pel[id]
+				nack.deliveryTime = now
+				nack.deliveryCount++
+				streamPropagateXCLAIM(key, group, cg, id, nack)
+			}
+			results = append(results, readResult{key, entries})
+			continue
+		}
+
+		start, _ := cg.lastID.incr()
+		entries := s.rangeEntries(start, streamMaxID, count, false)
+		if cg.lastID == streamMaxID || len(entries) == 0 {
+			continue
+		}
+		for _, e := range entries {
+			cg.lastID = e.id
+			if noack {
+				continue
+			}
+			// the entry may be still pending if the last ID of the group was set back
+			nack := cg.pel[e.id]
+			if nack == nil {
+				nack = &streamNACK{}
+				cg.pel[e.id] = nack
+			}
+			nack.claim(e.id, consumer)
+			nack.deliveryTime = now
+			nack.deliveryCount = 1
+			streamPropagateXCLAIM(key, group, cg, e.id, nack)
+		}
+		if noack {
+			alsoPropagate(NewObject(STR, "xgroup"), NewObject(STR, "setid"), key, group, NewObject(STR, cg.lastID.String()))
+		}
+		results = append(results, readResult{key, entries})
+	}
+
+	if len(results) > 0 {
+		c.AddReplyArrayLen(len(results))
+		for _, r := range results {
+			c.AddReplyArrayLen(2)
+			c.AddReplyBulk(r.key)
+			addReplyStreamEntries(c, r.entries)
+		}
+		return
+	}
+
+	// a transaction never blocks
+	if timeout == -1 || c.flags&(CLIENT_MULTI|CLIENT_SCRIPT) != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	// the "$" is replaced with the last ID, so the command executed again reads the entries added later
+	for i := 0; i < nkeys; i++ {
+		if dollars[i] {
+			c.args[streamsArg+nkeys+i] = NewObject(STR, ids[i].String())
+		}
+	}
+	deadline := int64(0)
+	if timeout > 0 {
+		deadline = GetTimeMs() + timeout
+	}
+	blockForKeys(c, BLOCKED_STREAM, c.args[streamsArg:streamsArg+nkeys], deadline)
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM]
+// XGROUP SETID key group id|$
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+var xgroupCommand CommandProc = func(c *GedisClient) {
+	opt := strings.ToLower(c.args[1].StrVal())
+	arityOK := false
+	switch opt {
+	case "create":
+		arityOK = len(c.args) == 5 || len(c.args) == 6
+	case "setid", "createconsumer", "delconsumer":
+		arityOK = len(c.args) == 5
+	case "destroy":
+		arityOK = len(c.args) == 4
+	default:
+		c.AddReplyErrorf("unknown subcommand '%s'", c.args[1].StrVal())
+		return
+	}
+	if !arityOK {
+		c.AddReply(REPLY_WRONG_ARITY)
+		return
+	}
+
+	key, group := c.args[2], c.args[3]
+	mkstream := false
+	if opt == "create" && len(c.args) == 6 {
+		if strings.ToLower(c.args[5].StrVal()) != "mkstream" {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+		mkstream = true
+	}
+	s, ok := lookupStreamRead(c, key)
+	if !ok {
+		return
+	}
+	if s == nil {
+		if !mkstream {
+			c.AddReply(REPLY_XGROUP_NO_KEY)
+			return
+		}
+		s, _ = lookupStreamOrCreate(c, key)
+		signalModifiedKey(c, key)
+		server.dirty++
+	}
+
+	var cg *streamCG
+	if opt != "create" && opt != "destroy" {
+		if cg = lookupCGOrReply(c, s, key, group); cg == nil {
+			return
+		}
+	}
+
+	switch opt {
+	case "create", "setid":
+		id := s.lastID
+		if c.args[4].StrVal() != "$" {
+			if id, ok = parseStreamIDOrReply(c, c.args[4]); !ok {
+				return
+			}
+		}
+		if opt == "setid" {
+			cg.lastID = id
+		} else if s.cgroups[group.StrVal()] != nil {
+			c.AddReplyError("-BUSYGROUP Consumer Group name already exists")
+			return
+		} else {
+			s.createCG(group.StrVal(), id)
+		}
+		server.dirty++
+		notifyKeyspaceEvent(NOTIFY_STREAM, "xgroup-"+opt, key)
+		c.AddReply(REPLY_OK)
+	case "destroy":
+		if s.cgroups[group.StrVal()] == nil {
+			c.AddReply(REPLY_ZERO)
+			return
+		}
+		delete(s.cgroups, group.StrVal())
+		server.dirty++
+		// the clients blocked on the group get the error
+		signalKeyAsReady(key)
+		notifyKeyspaceEvent(NOTIFY_STREAM, "xgroup-destroy", key)
+		c.AddReply(REPLY_ONE)
+	case "createconsumer":
+		if cg.lookupConsumer(c.args[4].StrVal(), false) != nil {
+			c.AddReply(REPLY_ZERO)
+			return
+		}
+		cg.lookupConsumerOrCreate(c.args[4].StrVal(), key)
+		server.dirty++
+		c.AddReply(REPLY_ONE)
+	case "delconsumer":
+		pending := 0
+		if consumer := cg.lookupConsumer(c.args[4].StrVal(), false); consumer != nil {
+			pending = len(consumer.pel)
+			cg.deleteConsumer(consumer)
+			server.dirty++
+			notifyKeyspaceEvent(NOTIFY_STREAM, "xgroup-delconsumer", key)
+		}
+		c.AddReplyLongLong(int64(pending))
+	}
+}
+
+// XACK key group id [id ...]
+var xackCommand CommandProc = func(c *GedisClient) {
+	ids := make([]StreamID, 0, len(c.args)-3)
+	for i := 3; i < len(c.args); i++ {
+		id, ok := parseStreamIDOrReply(c, c.args[i])
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+	s, ok := lookupStreamRead(c, c.args[1])
+	if !ok {
+		return
+	}
+	acked := 0
+	if s != nil {
+		if cg := s.cgroups[c.args[2].StrVal()]; cg != nil {
+			for _, id := range ids {
+				if cg.ack(id) {
+					acked++
+				}
+			}
+		}
+	}
+	server.dirty += int64(acked)
+	c.AddReplyLongLong(int64(acked))
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+var xpendingCommand CommandProc = func(c *GedisClient) {
+	key, group := c.args[1], c.args[2]
+	extended := len(c.args) > 3
+	minIdle := int64(0)
+	var start, end StreamID
+	count := 0
+	var consumerName *GObj
+	if extended {
+		i := 3
+		if strings.ToLower(c.args[i].StrVal()) == "idle" && len(c.args) > 4 {
+			n, err := strconv.ParseInt(c.args[4].StrVal(), 10, 64)
+			if err != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			minIdle = n
+			i += 2
+		}
+		if rest := len(c.args) - i; rest != 3 && rest != 4 {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+		var ok bool
+		if start, ok = parseIntervalIDOrReply(c, c.args[i], true); !ok {
+			return
+		}
+		if end, ok = parseIntervalIDOrReply(c, c.args[i+1], false); !ok {
+			return
+		}
+		n, err := strconv.Atoi(c.args[i+2].StrVal())
+		if err != nil {
+			c.AddReply(REPLY_INVALID_VALUE)
+			return
+		}
+		if n > 0 {
+			count = n
+		}
+		if i+3 < len(c.args) {
+			consumerName = c.args[i+3]
+		}
+	}
+
+	s, ok := lookupStreamRead(c, key)
+	if !ok {
+		return
+	}
+	cg := lookupCGOrReply(c, s, key, group)
+	if cg == nil {
+		return
+	}
+
+	if !extended {
+		if len(cg.pel) == 0 {
+			c.AddReplyArrayLen(4)
+			c.AddReply(REPLY_ZERO)
+			c.AddReplyNull()
+			c.AddReplyNull()
+			c.AddReplyNullArray()
+			return
+		}
+		ids := sortedPEL(cg.pel, StreamID{}, streamMaxID)
+		c.AddReply(fmt.Sprintf("*4\r\n:%d\r\n", len(ids)))
+		addReplyStreamID(c, ids[0])
+		addReplyStreamID(c, ids[len(ids)-1])
+		var names []string
+		for name, consumer := range cg.consumers {
+			if len(consumer.pel) > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		c.AddReplyArrayLen(len(names))
+		for _, name := range names {
+			c.AddReplyArrayLen(2)
+			c.AddReplyBulkString(name)
+			c.AddReplyBulkString(strconv.Itoa(len(cg.consumers[name].pel)))
+		}
+		return
+	}
+
+	pel := cg.pel
+	if consumerName != nil {
+		pel = nil
+		if consumer := cg.consumers[consumerName.StrVal()]; consumer != nil {
+			pel = consumer.pel
+		}
+	}
+	now := GetTimeMs()
+	var replies []string
+	for _, id := range sortedPEL(pel, start, end) {
+		if len(replies) == count {
+			break
+		}
+		nack := pel[id]
+		idle := now - nack.deliveryTime
+		if idle < minIdle {
+			continue
+		}
+		replies = append(replies, fmt.Sprintf("*4\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n:%d\r\n",
+			len(id.String()), id.String(), len(nack.consumer.name), nack.consumer.name, idle, nack.deliveryCount))
+	}
+	c.AddReplyArrayLen(len(replies))
+	for _, r := range replies {
+		c.AddReply(r)
+	}
+}
+
+// parseMinIdleOrReply parses the min-idle-time of XCLAIM and XAUTOCLAIM
+func parseMinIdleOrReply(c *GedisClient, arg *GObj) (int64, bool) {
+	minIdle, err := strconv.ParseInt(arg.StrVal(), 10, 64)
+	if err != nil {
+		c.AddReplyErrorf("Invalid min-idle-time argument for %s", strings.ToUpper(c.args[0].StrVal()))
+		return 0, false
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	return minIdle, true
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+var xclaimCommand CommandProc = func(c *GedisClient) {
+	key, group := c.args[1], c.args[2]
+	s, ok := lookupStreamRead(c, key)
+	if !ok {
+		return
+	}
+	cg := lookupCGOrReply(c, s, key, group)
+	if cg == nil {
+		return
+	}
+	minIdle, ok := parseMinIdleOrReply(c, c.args[4])
+	if !ok {
+		return
+	}
+
+	var ids []StreamID
+	j := 5
+	for ; j < len(c.args); j++ {
+		id, _, ok := parseStreamID(c.args[j].StrVal(), 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := GetTimeMs()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	lastID := StreamID{}
+	for ; j < len(c.args); j++ {
+		moreargs := len(c.args) - 1 - j
+		opt := strings.ToLower(c.args[j].StrVal())
+		if opt == "force" {
+			force = true
+		} else if opt == "justid" {
+			justID = true
+		} else if (opt == "idle" || opt == "time" || opt == "retrycount") && moreargs > 0 {
+			j++
+			n, err := strconv.ParseInt(c.args[j].StrVal(), 10, 64)
+			if err != nil {
+				c.AddReplyErrorf("Invalid %s option argument for XCLAIM", strings.ToUpper(opt))
+				return
+			}
+			switch opt {
+			case "idle":
+				deliveryTime = now - n
+			case "time":
+				deliveryTime = n
+			default:
+				retryCount = n
+			}
+		} else if opt == "lastid" && moreargs > 0 {
+			j++
+			if lastID, ok = parseStreamIDOrReply(c, c.args[j]); !ok {
+				return
+			}
+		} else {
+			c.AddReplyErrorf("Unrecognized XCLAIM option '%s'", c.args[j].StrVal())
+			return
+		}
+	}
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+	if lastID.compare(cg.lastID) > 0 {
+		cg.lastID = lastID
+	}
+
+	// XCLAIM is propagated as the XCLAIM of every claimed entry, which doesn't depend on the time
+	c.flags |= CLIENT_PREVENT_PROP
+	var claimed []*streamEntry
+	var consumer *streamConsumer
+	for _, id := range ids {
+		nack := cg.pel[id]
+		entry := s.find(id)
+		if force && nack == nil && entry != nil {
+			nack = &streamNACK{}
+			cg.pel[id] = nack
+		}
+		if nack == nil {
+			continue
+		}
+		if entry == nil {
+			cg.ack(id)
+			streamPropagateXACK(key, group, id)
+			continue
+		}
+		if minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+		if consumer == nil {
+			consumer = cg.lookupConsumerOrCreate(c.args[3].StrVal(), c.args[1])
+		}
+		nack.claim(id, consumer)
+		nack.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			nack.deliveryCount = retryCount
+		} else if !justID {
+			nack.deliveryCount++
+		}
+		claimed = append(claimed, entry)
+		streamPropagateXCLAIM(key, group, cg, id, nack)
+	}
+
+	if justID {
+		c.AddReplyArrayLen(len(claimed))
+		for _, e := range claimed {
+			addReplyStreamID(c, e.id)
+		}
+		return
+	}
+	addReplyStreamEntries(c, claimed)
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+var xautoclaimCommand CommandProc = func(c *GedisClient) {
+	key, group := c.args[1], c.args[2]
+	minIdle, ok := parseMinIdleOrReply(c, c.args[4])
+	if !ok {
+		return
+	}
+	start, ok := parseIntervalIDOrReply(c, c.args[5], true)
+	if !ok {
+		return
+	}
+	count := STREAM_AUTOCLAIM_COUNT
+	justID := false
+	for i := 6; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "count" && i+1 < len(c.args) {
+			n, err := strconv.Atoi(c.args[i+1].StrVal())
+			if err != nil || n < 1 || n > math.MaxInt32 {
+				c.AddReplyError("COUNT must be > 0")
+				return
+			}
+			count = n
+			i++
+		} else if opt == "justid" {
+			justID = true
+		} else {
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+
+	s, ok := lookupStreamRead(c, key)
+	if !ok {
+		return
+	}
+	cg := lookupCGOrReply(c, s, key, group)
+	if cg == nil {
+		return
+	}
+
+	c.flags |= CLIENT_PREVENT_PROP
+	now := GetTimeMs()
+	pending := sortedPEL(cg.pel, start, streamMaxID)
+	attempts := count * 10
+	var claimed []*streamEntry
+	var deleted []StreamID
+	var consumer *streamConsumer
+	i := 0
+	for ; i < len(pending) && attempts > 0 && len(claimed) < count; i++ {
+		attempts--
+		id := pending[i]
+		nack := cg.pel[id]
+		entry := s.find(id)
+		if entry == nil {
+			cg.ack(id)
+			deleted = append(deleted, id)
+			streamPropagateXACK(key, group, id)
+			continue
+		}
+		if minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+		if consumer == nil {
+			consumer = cg.lookupConsumerOrCreate(c.args[3].StrVal(), c.args[1])
+		}
+		nack.claim(id, consumer)
+		nack.deliveryTime = now
+		if !justID {
+			nack.deliveryCount++
+		}
+		claimed = append(claimed, entry)
+		streamPropagateXCLAIM(key, group, cg, id, nack)
+	}
+
+	// the cursor to continue, 0-0 means the scan is complete
+	next := StreamID{}
+	if i < len(pending) {
+		next = pending[i]
+	}
+	c.AddReplyArrayLen(3)
+	addReplyStreamID(c, next)
+	if justID {
+		c.AddReplyArrayLen(len(claimed))
+		for _, e := range claimed {
+			addReplyStreamID(c, e.id)
+		}
+	} else {
+		addReplyStreamEntries(c, claimed)
+	}
+	c.AddReplyArrayLen(len(deleted))
+	for _, id := range deleted {
+		addReplyStreamID(c, id)
+	}
+}
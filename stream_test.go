@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStreamID(t *testing.T) {
+	id, seqGiven, ok := parseStreamID("1526919030474-55", 0)
+	assert.True(t, ok)
+	assert.True(t, seqGiven)
+	assert.Equal(t, StreamID{1526919030474, 55}, id)
+
+	id, seqGiven, ok = parseStreamID("5", 7)
+	assert.True(t, ok)
+	assert.False(t, seqGiven)
+	assert.Equal(t, StreamID{5, 7}, id)
+
+	_, _, ok = parseStreamID("5-x", 0)
+	assert.False(t, ok)
+
+	next, ok := StreamID{1, streamMaxID.seq}.incr()
+	assert.True(t, ok)
+	assert.Equal(t, StreamID{2, 0}, next)
+	_, ok = streamMaxID.incr()
+	assert.False(t, ok)
+	_, ok = StreamID{}.decr()
+	assert.False(t, ok)
+}
+
+func TestStreamCommands(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, "$3\r\n1-1\r\n", runCommand(c, "xadd", "s", "1-1", "a", "1"))
+	assert.Equal(t, "$3\r\n1-2\r\n", runCommand(c, "xadd", "s", "1-*", "b", "2"))
+	assert.Equal(t, "$3\r\n2-0\r\n", runCommand(c, "xadd", "s", "2", "c", "3"))
+	assert.Equal(t, REPLY_XADD_ID_SMALLER, runCommand(c, "xadd", "s", "1-5", "d", "4"))
+	assert.Equal(t, "-ERR The ID specified in XADD must be greater than 0-0\r\n", runCommand(c, "xadd", "s", "0-0", "d", "4"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "xadd", "s", "*", "d"))
+	assert.Equal(t, REPLY_NIL, runCommand(c, "xadd", "missing", "nomkstream", "*", "d", "4"))
+	// the auto generated ID is propagated
+	assert.True(t, strings.HasPrefix(runCommand(c, "xadd", "s", "*", "d", "4"), "$"))
+	assert.NotEqual(t, "*", c.args[2].StrVal())
+	assert.Equal(t, ":4\r\n", runCommand(c, "xlen", "s"))
+
+	assert.Equal(t, "*2\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		runCommand(c, "xrange", "s", "-", "1"))
+	assert.Equal(t, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		runCommand(c, "xrange", "s", "(1-1", "+", "count", "1"))
+	assert.Equal(t, "*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n",
+		runCommand(c, "xrevrange", "s", "2", "-", "count", "1"))
+	assert.Equal(t, "*0\r\n", runCommand(c, "xrange", "missing", "-", "+"))
+	assert.Equal(t, REPLY_INVALID_STREAM_ID, runCommand(c, "xrange", "s", "x", "+"))
+
+	assert.Equal(t, ":1\r\n", runCommand(c, "xdel", "s", "1-2", "9-9"))
+	assert.Equal(t, ":3\r\n", runCommand(c, "xlen", "s"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xtrim", "s", "maxlen", "2"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xtrim", "s", "minid", "=", "3"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xlen", "s"))
+	assert.Equal(t, "-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n",
+		runCommand(c, "xtrim", "s", "maxlen", "0", "limit", "1"))
+
+	runCommand(c, "xadd", "t", "maxlen", "~", "2", "*", "f", "v")
+	runCommand(c, "xadd", "t", "maxlen", "~", "2", "*", "f", "v")
+	runCommand(c, "xadd", "t", "maxlen", "~", "2", "*", "f", "v")
+	assert.Equal(t, ":2\r\n", runCommand(c, "xlen", "t"))
+
+	runCommand(c, "set", "str", "v")
+	assert.Equal(t, REPLY_WRONG_TYPE, runCommand(c, "xadd", "str", "*", "f", "v"))
+}
+
+func TestStreamRead(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	runCommand(c, "xadd", "s1", "1-0", "a", "1")
+	runCommand(c, "xadd", "s1", "2-0", "b", "2")
+	assert.Equal(t, "*1\r\n*2\r\n$2\r\ns1\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		runCommand(c, "xread", "count", "5", "streams", "s1", "s2", "1", "0"))
+	assert.Equal(t, "*-1\r\n", runCommand(c, "xread", "streams", "s1", "$"))
+	assert.Equal(t, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n",
+		runCommand(c, "xread", "streams", "s1", "s2", "0"))
+
+	// the blocked client is served by the XADD of another client
+	blocked := NewClient(0)
+	assert.Equal(t, "", runCommand(blocked, "xread", "block", "0", "streams", "s2", "s1", "$", "$"))
+	assert.NotEqual(t, 0, blocked.flags&CLIENT_BLOCKED)
+	assert.Equal(t, 2, len(server.blockingKeys))
+	assert.Equal(t, "2-0", blocked.args[7].StrVal())
+
+	runCommand(c, "xadd", "s1", "3-0", "c", "3")
+	assert.Equal(t, 0, blocked.flags&CLIENT_BLOCKED)
+	assert.Equal(t, 0, len(server.blockingKeys))
+	assert.Equal(t, "*1\r\n*2\r\n$2\r\ns1\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n",
+		drainClientReply(blocked))
+
+	// the blocked client gets nil once it reaches the timeout
+	assert.Equal(t, "", runCommand(blocked, "xread", "block", "100", "streams", "s1", "$"))
+	handleBlockedClientsTimeout(GetTimeMs())
+	assert.NotEqual(t, 0, blocked.flags&CLIENT_BLOCKED)
+	handleBlockedClientsTimeout(GetTimeMs() + 200)
+	assert.Equal(t, 0, blocked.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "*-1\r\n", drainClientReply(blocked))
+}
+
+func TestStreamConsumerGroup(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, REPLY_XGROUP_NO_KEY, runCommand(c, "xgroup", "create", "s", "g", "$"))
+	assert.Equal(t, REPLY_OK, runCommand(c, "xgroup", "create", "s", "g", "$", "mkstream"))
+	assert.Equal(t, "-BUSYGROUP Consumer Group name already exists\r\n", runCommand(c, "xgroup", "create", "s", "g", "0"))
+	runCommand(c, "xadd", "s", "1-0", "a", "1")
+	runCommand(c, "xadd", "s", "2-0", "b", "2")
+	runCommand(c, "xadd", "s", "3-0", "c", "3")
+
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		runCommand(c, "xreadgroup", "group", "g", "alice", "count", "2", "streams", "s", ">"))
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n",
+		runCommand(c, "xreadgroup", "group", "g", "bob", "streams", "s", ">"))
+	assert.Equal(t, "*-1\r\n", runCommand(c, "xreadgroup", "group", "g", "bob", "streams", "s", ">"))
+	assert.True(t, strings.HasPrefix(runCommand(c, "xreadgroup", "group", "x", "bob", "streams", "s", ">"), "-NOGROUP"))
+
+	// the history of the consumer
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		runCommand(c, "xreadgroup", "group", "g", "alice", "streams", "s", "1-0"))
+
+	assert.Equal(t, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n2\r\n*2\r\n$3\r\nbob\r\n$1\r\n1\r\n",
+		runCommand(c, "xpending", "s", "g"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xack", "s", "g", "1-0", "9-0"))
+
+	pending := runCommand(c, "xpending", "s", "g", "-", "+", "10", "alice")
+	assert.True(t, strings.HasPrefix(pending, "*1\r\n*4\r\n$3\r\n2-0\r\n$5\r\nalice\r\n:"))
+	assert.True(t, strings.HasSuffix(pending, ":2\r\n"))
+
+	// nothing is claimed if the entry is not idle enough
+	assert.Equal(t, "*0\r\n", runCommand(c, "xclaim", "s", "g", "bob", "3600000", "2-0"))
+	assert.Equal(t, "*1\r\n$3\r\n2-0\r\n", runCommand(c, "xclaim", "s", "g", "bob", "0", "2-0", "justid"))
+	assert.Equal(t, ":2\r\n", runCommand(c, "xgroup", "delconsumer", "s", "g", "bob"))
+	assert.Equal(t, "*4\r\n:0\r\n"+REPLY_NIL+REPLY_NIL+"*-1\r\n", runCommand(c, "xpending", "s", "g"))
+
+	// the deleted entries are removed from the PEL by XAUTOCLAIM
+	runCommand(c, "xgroup", "setid", "s", "g", "0")
+	runCommand(c, "xreadgroup", "group", "g", "alice", "streams", "s", ">")
+	runCommand(c, "xdel", "s", "2-0")
+	assert.Equal(t, "*3\r\n$3\r\n0-0\r\n*2\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*1\r\n$3\r\n2-0\r\n",
+		runCommand(c, "xautoclaim", "s", "g", "carol", "0", "-", "justid"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xgroup", "createconsumer", "s", "g", "dave"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "xgroup", "destroy", "s", "g"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "xgroup", "destroy", "s", "g"))
+}
+
+func TestStreamPersistence(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+	server.aofFileName = "test_stream.aof"
+	defer os.Remove(server.aofFileName)
+
+	runCommand(c, "xadd", "s", "1-1", "a", "1")
+	runCommand(c, "xadd", "s", "1-*", "b", "2")
+	runCommand(c, "xadd", "s", "*", "c", "3")
+	runCommand(c, "xdel", "s", "1-1")
+	runCommand(c, "xgroup", "create", "s", "g", "0")
+	runCommand(c, "xreadgroup", "group", "g", "alice", "count", "2", "streams", "s", ">")
+	runCommand(c, "xgroup", "create", "empty", "g", "$", "mkstream")
+	before := runCommand(c, "xrange", "s", "-", "+") + runCommand(c, "xpending", "s", "g") +
+		runCommand(c, "xlen", "empty")
+
+	// load the propagated commands
+	assert.Nil(t, os.WriteFile(server.aofFileName, []byte(server.aofBuf), 0666))
+	initTestServer(t)
+	server.aofFileName = "test_stream.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	assert.Equal(t, "", server.aofBuf)
+	c = NewClient(0)
+	assert.Equal(t, before, runCommand(c, "xrange", "s", "-", "+")+runCommand(c, "xpending", "s", "g")+
+		runCommand(c, "xlen", "empty"))
+
+	// load the rewritten file
+	assert.Nil(t, rewriteAppendOnlyFile(server.aofFileName))
+	initTestServer(t)
+	server.aofFileName = "test_stream.aof"
+	assert.Nil(t, loadAppendOnlyFile(server.aofFileName))
+	c = NewClient(0)
+	assert.Equal(t, before, runCommand(c, "xrange", "s", "-", "+")+runCommand(c, "xpending", "s", "g")+
+		runCommand(c, "xlen", "empty"))
+	// the last delivered ID of the group is restored
+	assert.Equal(t, "*-1\r\n", runCommand(c, "xreadgroup", "group", "g", "bob", "streams", "s", ">"))
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The client side caching lets the clients cache the keys they read and get the invalidation
+ * messages once the keys are modified, deleted or expired. In the default mode the server
+ * remembers the IDs of the clients read every key, the key is forgotten after its invalidation
+ * is sent, so it's tracked again by the next read. In the BCAST mode the clients subscribe to
+ * the prefixes instead, the keys of a prefix modified in an iteration of the event loop are
+ * sent together. A RESP3 client gets the invalidations as push messages, a RESP2 client gets
+ * them by the pub/sub connection it redirects to, as the messages of __redis__:invalidate. */
+
+const TRACKING_CHANNEL = "__redis__:invalidate"
+
+// bcastState is the clients subscribed to a BCAST prefix, and the keys of the prefix modified
+// since the last broadcast
+type bcastState struct {
+	keys    map[string]struct{}
+	clients map[*GedisClient]struct{}
+}
+
+// lookupClientByID returns the connected client of the ID, nil if it doesn't exist
+func lookupClientByID(id uint64) *GedisClient {
+	return server.clientsIndex[id]
+}
+
+// enableTracking turns on the tracking of the client, the prefixes are for the BCAST mode
+func enableTracking(c *GedisClient, redirect uint64, options int, prefixes []string) {
+	c.flags |= CLIENT_TRACKING | options
+	c.trackingRedirect = redirect
+	if options&CLIENT_TRACKING_BCAST == 0 {
+		return
+	}
+	if c.trackingPrefixes == nil {
+		c.trackingPrefixes = make(map[string]struct{})
+	}
+	// no prefix means all the keys
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		bs := server.trackingPrefixes[prefix]
+		if bs == nil {
+			bs = &bcastState{keys: make(map[string]struct{}), clients: make(map[*GedisClient]struct{})}
+			server.trackingPrefixes[prefix] = bs
+		}
+		bs.clients[c] = struct{}{}
+		c.trackingPrefixes[prefix] = struct{}{}
+	}
+}
+
+// disableTracking turns off the tracking of the client, the IDs in the tracking table are
+// removed lazily once the keys are invalidated
+func disableTracking(c *GedisClient) {
+	for prefix := range c.trackingPrefixes {
+		bs := server.trackingPrefixes[prefix]
+		delete(bs.clients, c)
+		if len(bs.clients) == 0 {
+			delete(server.trackingPrefixes, prefix)
+		}
+	}
+	c.trackingPrefixes = nil
+	c.trackingRedirect = 0
+	c.flags &= ^(CLIENT_TRACKING | CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT |
+		CLIENT_TRACKING_CACHING | CLIENT_TRACKING_BROKEN)
+}
+
+// checkPrefixCollisions returns the error message if any of the prefixes overlaps with another
+// one of the client, the same key would be sent twice
+func checkPrefixCollisions(c *GedisClient, prefixes []string) string {
+	for i, prefix := range prefixes {
+		for existing := range c.trackingPrefixes {
+			if strings.HasPrefix(existing, prefix) || strings.HasPrefix(prefix, existing) {
+				return fmt.Sprintf("Prefix '%s' overlaps with an existing prefix '%s'. "+
+					"Prefixes for a single client must not overlap.", prefix, existing)
+			}
+		}
+		for j := i + 1; j < len(prefixes); j++ {
+			if strings.HasPrefix(prefixes[j], prefix) || strings.HasPrefix(prefix, prefixes[j]) {
+				return fmt.Sprintf("Prefix '%s' overlaps with another provided prefix '%s'. "+
+					"Prefixes for a single client must not overlap.", prefix, prefixes[j])
+			}
+		}
+	}
+	return ""
+}
+
+// commandReadKeys returns the keys read by the read only command, nil for the other commands
+func commandReadKeys(cmd *GedisCommand, args []*GObj) []*GObj {
+	if cmd.flags&CMD_READONLY == 0 {
+		return nil
+	}
+	var keys []*GObj
+	for _, i := range getKeysFromCommand(cmd, args) {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// trackingCommandDone remembers the keys read by the command for the client in the default
+// mode, the keys read by a script are remembered for the caller
+func trackingCommandDone(c *GedisClient, cmd *GedisCommand) {
+	tc := c
+	if c.flags&CLIENT_SCRIPT != 0 && server.script.caller != nil {
+		tc = server.script.caller
+	}
+	if tc.flags&CLIENT_TRACKING == 0 {
+		return
+	}
+	optin, optout := tc.flags&CLIENT_TRACKING_OPTIN != 0, tc.flags&CLIENT_TRACKING_OPTOUT != 0
+	caching := tc.flags&CLIENT_TRACKING_CACHING != 0
+	if tc.flags&CLIENT_TRACKING_BCAST == 0 && (!optin || caching) && (!optout || !caching) {
+		for _, key := range commandReadKeys(cmd, c.args) {
+			ids := server.trackingTable[key.StrVal()]
+			if ids == nil {
+				ids = make(map[uint64]struct{})
+				server.trackingTable[key.StrVal()] = ids
+			}
+			ids[tc.id] = struct{}{}
+		}
+	}
+	// CLIENT CACHING is valid for the next command, or the whole transaction
+	if c == tc && c.flags&CLIENT_MULTI == 0 && !(cmd.name == "client" && strings.EqualFold(c.args[1].StrVal(), "caching")) {
+		c.flags &= ^CLIENT_TRACKING_CACHING
+	}
+}
+
+// sendTrackingMessage sends the invalidated keys to the client, nil keys means all the keys
+// are invalidated
+func sendTrackingMessage(c *GedisClient, keys []string) {
+	target := c
+	if c.trackingRedirect != 0 {
+		target = lookupClientByID(c.trackingRedirect)
+		if target == nil {
+			// a RESP3 client learns the invalidations are lost
+			if c.resp > 2 && c.flags&CLIENT_TRACKING_BROKEN == 0 {
+				c.flags |= CLIENT_TRACKING_BROKEN | CLIENT_PUSHING
+				c.AddReplyPushLen(2)
+				c.AddReplyBulkString("tracking-redir-broken")
+				c.AddReplyLongLong(int64(c.trackingRedirect))
+				c.flags &= ^CLIENT_PUSHING
+				server.aeloop.AddFileEvent(c.nfd, AE_WRITABLE, SendReplyToClient, c)
+			}
+			return
+		}
+	}
+	// the invalidations are sent even if the replies are off
+	target.flags |= CLIENT_PUSHING
+	defer func() { target.flags &= ^CLIENT_PUSHING }()
+	if target.resp > 2 {
+		target.AddReplyPushLen(2)
+		target.AddReplyBulkString("invalidate")
+	} else if c.trackingRedirect != 0 && target.flags&CLIENT_PUBSUB != 0 {
+		// a RESP2 connection only gets the messages in the pub/sub mode
+		target.AddReply(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n", len(TRACKING_CHANNEL), TRACKING_CHANNEL))
+	} else {
+		return
+	}
+	if keys == nil {
+		target.AddReplyNullArray()
+	} else {
+		target.AddReplyArrayLen(len(keys))
+		for _, key := range keys {
+			target.AddReplyBulkString(key)
+		}
+	}
+	server.aeloop.AddFileEvent(target.nfd, AE_WRITABLE, SendReplyToClient, target)
+}
+
+// trackingInvalidateKey is called once the key is modified, deleted, expired or evicted, the
+// clients that may cache it get the invalidation
+func trackingInvalidateKey(key *GObj) {
+	k := key.StrVal()
+	for prefix, bs := range server.trackingPrefixes {
+		if strings.HasPrefix(k, prefix) {
+			bs.keys[k] = struct{}{}
+		}
+	}
+	ids, ok := server.trackingTable[k]
+	if !ok {
+		return
+	}
+	// the key is tracked again by the next read
+	delete(server.trackingTable, k)
+	for id := range ids {
+		c := lookupClientByID(id)
+		if c == nil || c.flags&CLIENT_TRACKING == 0 || c.flags&CLIENT_TRACKING_BCAST != 0 {
+			continue
+		}
+		sendTrackingMessage(c, []string{k})
+	}
+}
+
+// trackingInvalidateKeysOnFlush invalidates all the keys of the tracking clients, once the
+// dataset is emptied
+func trackingInvalidateKeysOnFlush() {
+	for _, c := range server.clients {
+		if c.flags&CLIENT_TRACKING != 0 {
+			sendTrackingMessage(c, nil)
+		}
+	}
+	server.trackingTable = make(map[string]map[uint64]struct{})
+	for _, bs := range server.trackingPrefixes {
+		bs.keys = make(map[string]struct{})
+	}
+}
+
+// trackingBroadcastInvalidationMessages sends the modified keys of every prefix to the BCAST
+// clients, it's called once per iteration of the event loop
+func trackingBroadcastInvalidationMessages() {
+	for _, bs := range server.trackingPrefixes {
+		if len(bs.keys) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(bs.keys))
+		for k := range bs.keys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for c := range bs.clients {
+			sendTrackingMessage(c, keys)
+		}
+		bs.keys = make(map[string]struct{})
+	}
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix [PREFIX prefix ...]] [BCAST] [OPTIN] [OPTOUT]
+func clientTrackingCommand(c *GedisClient) {
+	var redirect uint64
+	var prefixes []string
+	options := 0
+	for i := 3; i < len(c.args); i++ {
+		moreArgs := i+1 < len(c.args)
+		switch opt := strings.ToLower(c.args[i].StrVal()); {
+		case opt == "redirect" && moreArgs:
+			i++
+			id, err := strconv.ParseUint(c.args[i].StrVal(), 10, 64)
+			if err != nil {
+				c.AddReply(REPLY_INVALID_VALUE)
+				return
+			}
+			if lookupClientByID(id) == nil {
+				c.AddReplyError("The client ID you want redirect to does not exist")
+				return
+			}
+			redirect = id
+		case opt == "prefix" && moreArgs:
+			i++
+			prefixes = append(prefixes, c.args[i].StrVal())
+		case opt == "bcast":
+			options |= CLIENT_TRACKING_BCAST
+		case opt == "optin":
+			options |= CLIENT_TRACKING_OPTIN
+		case opt == "optout":
+			options |= CLIENT_TRACKING_OPTOUT
+		default:
+			c.AddReply(REPLY_SYNTAX_ERR)
+			return
+		}
+	}
+
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "on":
+		if options&CLIENT_TRACKING_BCAST == 0 && len(prefixes) > 0 {
+			c.AddReplyError("PREFIX option requires BCAST mode to be enabled")
+			return
+		}
+		if c.flags&CLIENT_TRACKING != 0 && (c.flags^options)&CLIENT_TRACKING_BCAST != 0 {
+			c.AddReplyError("You can't switch BCAST mode on/off before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.")
+			return
+		}
+		if options&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 {
+			c.AddReplyError("You can't use both OPTIN and OPTOUT")
+			return
+		}
+		if options&CLIENT_TRACKING_BCAST != 0 && options&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+			c.AddReplyError("OPTIN and OPTOUT are not compatible with BCAST")
+			return
+		}
+		if c.flags&CLIENT_TRACKING != 0 &&
+			(c.flags&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 ||
+				c.flags&CLIENT_TRACKING_OPTOUT != 0 && options&CLIENT_TRACKING_OPTIN != 0) {
+			c.AddReplyError("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.")
+			return
+		}
+		if options&CLIENT_TRACKING_BCAST != 0 {
+			if msg := checkPrefixCollisions(c, prefixes); msg != "" {
+				c.AddReplyError(msg)
+				return
+			}
+		}
+		enableTracking(c, redirect, options, prefixes)
+	case "off":
+		disableTracking(c)
+	default:
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	c.AddReply(REPLY_OK)
+}
+
+// CLIENT CACHING YES|NO
+func clientCachingCommand(c *GedisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		c.AddReplyError("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or " +
+			"OPTOUT mode enabled")
+		return
+	}
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "yes":
+		if c.flags&CLIENT_TRACKING_OPTIN == 0 {
+			c.AddReplyError("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			return
+		}
+	case "no":
+		if c.flags&CLIENT_TRACKING_OPTOUT == 0 {
+			c.AddReplyError("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			return
+		}
+	default:
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	c.flags |= CLIENT_TRACKING_CACHING
+	c.AddReply(REPLY_OK)
+}
+
+// CLIENT GETREDIR, -1 if the tracking is off, 0 if the invalidations aren't redirected
+func clientGetredirCommand(c *GedisClient) {
+	redirect := int64(-1)
+	if c.flags&CLIENT_TRACKING != 0 {
+		redirect = int64(c.trackingRedirect)
+	}
+	c.AddReplyLongLong(int64(redirect))
+}
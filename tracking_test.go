@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// invalidation is the message the redirected pub/sub connection gets, no key means all the keys
+func invalidation(keys ...string) string {
+	payload := "*-1\r\n"
+	if len(keys) > 0 {
+		payload = fmt.Sprintf("*%d\r\n", len(keys))
+		for _, key := range keys {
+			payload += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+	}
+	return "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n" + payload
+}
+
+// newTrackingClients returns a client tracking with the options, and the pub/sub connection it
+// redirects to
+func newTrackingClients(t *testing.T, options ...string) (*GedisClient, *GedisClient) {
+	c, _ := newSocketClient(t)
+	sub, _ := newSocketClient(t)
+	runCommand(sub, "subscribe", TRACKING_CHANNEL)
+	args := append([]string{"client", "tracking", "on", "redirect", fmt.Sprint(sub.id)}, options...)
+	assert.Equal(t, REPLY_OK, runCommand(c, args...))
+	return c, sub
+}
+
+func TestTrackingDefaultMode(t *testing.T) {
+	initTestServer(t)
+	c, sub := newTrackingClients(t)
+	other := NewClient(0)
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", sub.id), runCommand(c, "client", "getredir"))
+
+	// only the keys read are tracked
+	runCommand(other, "set", "k", "v")
+	assert.Equal(t, "", drainClientReply(sub))
+	runCommand(c, "get", "k")
+	runCommand(c, "get", "none")
+	runCommand(other, "set", "k", "v2")
+	assert.Equal(t, invalidation("k"), drainClientReply(sub))
+
+	// the key is tracked again by the next read
+	runCommand(other, "set", "k", "v3")
+	assert.Equal(t, "", drainClientReply(sub))
+	runCommand(c, "xread", "streams", "s", "k", "0", "0")
+	runCommand(other, "xadd", "s", "*", "f", "v")
+	runCommand(other, "pexpireat", "k", "1")
+	assert.Equal(t, invalidation("s")+invalidation("k"), drainClientReply(sub))
+
+	// the expired key is invalidated
+	runCommand(other, "set", "e", "v")
+	runCommand(c, "get", "e")
+	runCommand(other, "pexpireat", "e", fmt.Sprint(GetTimeMs()+10000))
+	runCommand(c, "get", "e")
+	server.db.expire.Set(NewObject(STR, "e"), NewObject(STR, "1"))
+	runCommand(other, "get", "e")
+	assert.Equal(t, invalidation("e")+invalidation("e"), drainClientReply(sub))
+
+	// the keys read by a script are tracked for the caller
+	runCommand(c, "eval", "return redis.call('get', 'x')", "0")
+	runCommand(other, "set", "x", "1")
+	assert.Equal(t, invalidation("x"), drainClientReply(sub))
+
+	runCommand(c, "get", "k")
+	assert.Equal(t, REPLY_OK, runCommand(c, "client", "tracking", "off"))
+	assert.Equal(t, ":-1\r\n", runCommand(c, "client", "getredir"))
+	runCommand(other, "set", "k", "v")
+	assert.Equal(t, "", drainClientReply(sub))
+
+	// the dataset is emptied
+	runCommand(c, "client", "tracking", "on", "redirect", fmt.Sprint(sub.id))
+	emptyData()
+	assert.Equal(t, invalidation(), drainClientReply(sub))
+}
+
+func TestTrackingOptinOptout(t *testing.T) {
+	initTestServer(t)
+	c, sub := newTrackingClients(t, "optin")
+	other := NewClient(0)
+
+	runCommand(c, "get", "a")
+	assert.Equal(t, REPLY_OK, runCommand(c, "client", "caching", "yes"))
+	runCommand(c, "get", "b")
+	runCommand(c, "get", "c")
+	runCommand(other, "set", "a", "1")
+	runCommand(other, "set", "b", "1")
+	runCommand(other, "set", "c", "1")
+	assert.Equal(t, invalidation("b"), drainClientReply(sub))
+
+	// CLIENT CACHING is valid for the whole transaction
+	runCommand(c, "client", "caching", "yes")
+	runCommand(c, "multi")
+	runCommand(c, "get", "a")
+	runCommand(c, "get", "c")
+	runCommand(c, "exec")
+	runCommand(c, "get", "b")
+	runCommand(other, "set", "a", "2")
+	runCommand(other, "set", "b", "2")
+	runCommand(other, "set", "c", "2")
+	assert.Equal(t, invalidation("a")+invalidation("c"), drainClientReply(sub))
+
+	assert.Equal(t, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n",
+		runCommand(c, "client", "caching", "no"))
+	assert.Equal(t, "-ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, "+
+		"and then re-enabling it with a different mode.\r\n", runCommand(c, "client", "tracking", "on", "optout"))
+
+	runCommand(c, "client", "tracking", "off")
+	runCommand(c, "client", "tracking", "on", "optout", "redirect", fmt.Sprint(sub.id))
+	runCommand(c, "client", "caching", "no")
+	runCommand(c, "get", "a")
+	runCommand(c, "get", "b")
+	runCommand(other, "set", "a", "3")
+	runCommand(other, "set", "b", "3")
+	assert.Equal(t, invalidation("b"), drainClientReply(sub))
+
+	assert.Equal(t, "-ERR You can't use both OPTIN and OPTOUT\r\n", runCommand(other, "client", "tracking", "on", "optin", "optout"))
+	assert.Equal(t, "-ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled\r\n",
+		runCommand(other, "client", "caching", "yes"))
+}
+
+func TestTrackingBcast(t *testing.T) {
+	initTestServer(t)
+	c, sub := newTrackingClients(t, "bcast", "prefix", "user:", "prefix", "item:")
+	all, allSub := newTrackingClients(t, "bcast")
+	other := NewClient(0)
+
+	// the keys are sent without being read, together once per event loop iteration
+	runCommand(other, "set", "user:2", "v")
+	runCommand(other, "set", "user:1", "v")
+	runCommand(other, "set", "item:1", "v")
+	runCommand(other, "set", "other", "v")
+	trackingBroadcastInvalidationMessages()
+	reply := drainClientReply(sub)
+	assert.Contains(t, []string{invalidation("user:1", "user:2") + invalidation("item:1"),
+		invalidation("item:1") + invalidation("user:1", "user:2")}, reply)
+	assert.Equal(t, invalidation("item:1", "other", "user:1", "user:2"), drainClientReply(allSub))
+	trackingBroadcastInvalidationMessages()
+	assert.Equal(t, "", drainClientReply(sub))
+
+	assert.Equal(t, "-ERR Prefix 'user:a' overlaps with an existing prefix 'user:'. Prefixes for a single client must not overlap.\r\n",
+		runCommand(c, "client", "tracking", "on", "bcast", "prefix", "user:a"))
+	assert.Equal(t, "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, "+
+		"and then re-enabling it with a different mode.\r\n", runCommand(c, "client", "tracking", "on"))
+	assert.Equal(t, "-ERR PREFIX option requires BCAST mode to be enabled\r\n",
+		runCommand(other, "client", "tracking", "on", "prefix", "a"))
+	assert.Equal(t, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n",
+		runCommand(other, "client", "tracking", "on", "bcast", "optin"))
+	assert.Equal(t, "-ERR The client ID you want redirect to does not exist\r\n",
+		runCommand(other, "client", "tracking", "on", "redirect", "12345"))
+
+	// the prefixes are removed once the clients are gone
+	freeClient(c)
+	freeClient(all)
+	assert.Equal(t, 0, len(server.trackingPrefixes))
+}
+
+func TestTrackingResp3(t *testing.T) {
+	initTestServer(t)
+	c, _ := newSocketClient(t)
+	other := NewClient(0)
+	c.resp = 3
+
+	// the invalidations are pushed to the RESP3 client itself
+	runCommand(c, "client", "tracking", "on")
+	runCommand(c, "get", "k")
+	runCommand(other, "set", "k", "v")
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n", drainClientReply(c))
+	emptyData()
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n_\r\n", drainClientReply(c))
+
+	// the client learns once the redirection is broken
+	redir, _ := newSocketClient(t)
+	runCommand(c, "client", "tracking", "off")
+	runCommand(c, "client", "tracking", "on", "redirect", fmt.Sprint(redir.id))
+	freeClient(redir)
+	runCommand(c, "get", "a")
+	runCommand(c, "get", "b")
+	runCommand(other, "set", "a", "v")
+	runCommand(other, "set", "b", "v")
+	assert.Equal(t, fmt.Sprintf(">2\r\n$21\r\ntracking-redir-broken\r\n:%d\r\n", redir.id), drainClientReply(c))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// stringMatch reports whether the string matches the glob-style pattern, which supports
+// *, ?, [abc], [^abc], [a-z] and the escape \
+func stringMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, nocase, &skipLongerMatches)
+}
+
+/* skipLongerMatches is set once a '*' failed to match the rest of the string at every position,
+ * then the outer '*' can't match by trying the longer strings, this avoids the exponential
+ * backtracking of the patterns like "a*a*a*a*b". */
+func stringMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p == len(pattern)-1 {
+				return true
+			}
+			for s < len(str) {
+				if stringMatchImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				s++
+			}
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p >= len(pattern) {
+					// the pattern ended without ']'
+					p--
+					break
+				}
+				if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	// the trailing '*' matches the empty string
+	if s == len(str) {
+		for p < len(pattern) && pattern[p] == '*' {
+			p++
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+// removeClient removes the client from the clients of the name, the name is deleted once it
+// has no clients
+func removeClient(m map[string][]*GedisClient, name string, c *GedisClient) {
+	clients := removeClientFromList(m[name], c)
+	if len(clients) == 0 {
+		delete(m, name)
+	} else {
+		m[name] = clients
+	}
+}
+
+// removeClientFromList removes the first occurrence of the client from the list
+func removeClientFromList(clients []*GedisClient, c *GedisClient) []*GedisClient {
+	for i, mc := range clients {
+		if mc == c {
+			return append(clients[:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+// bytesToString converts the bytes to the string without copying, the bytes must not be
+// modified after it
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// memtoll converts the memory size like "512mb" to bytes, the units are b, k, kb, m, mb, g, gb,
+// case insensitive
+func memtoll(s string) (int64, error) {
+	s = strings.ToLower(s)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1}}
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mul, nil
+}
+
+// formatMemory is the reverse of memtoll, the biggest unit which divides the bytes is used
+func formatMemory(n int64) string {
+	switch {
+	case n != 0 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dgb", n/(1<<30))
+	case n != 0 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dmb", n/(1<<20))
+	case n != 0 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dkb", n/(1<<10))
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// splitArgs splits the line into arguments like sdssplitargs of Redis. The arguments are
+// separated by whitespace, and can be quoted. The double quoted one supports the escapes
+// \n, \r, \t, \b, \a, \xHH and the escaped character itself, the single quoted one supports
+// \' only. The closing quote must be followed by whitespace or the end.
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, nil
+		}
+		var cur []byte
+		inq, insq, done := false, false, false
+		for !done {
+			if inq {
+				switch {
+				case p == len(line):
+					return nil, errors.New("unbalanced quotes")
+				case line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHexDigit(line[p+2]) && isHexDigit(line[p+3]):
+					cur = append(cur, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				case line[p] == '\\' && p+1 < len(line):
+					p++
+					c := line[p]
+					switch c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					cur = append(cur, c)
+				case line[p] == '"':
+					// the closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				default:
+					cur = append(cur, line[p])
+				}
+			} else if insq {
+				switch {
+				case p == len(line):
+					return nil, errors.New("unbalanced quotes")
+				case line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'':
+					p++
+					cur = append(cur, '\'')
+				case line[p] == '\'':
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				default:
+					cur = append(cur, line[p])
+				}
+			} else {
+				switch {
+				case p == len(line):
+					done = true
+				case line[p] == ' ' || line[p] == '\n' || line[p] == '\r' || line[p] == '\t' || line[p] == 0:
+					done = true
+				case line[p] == '"':
+					inq = true
+				case line[p] == '\'':
+					insq = true
+				default:
+					cur = append(cur, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, string(cur))
+	}
+}
+
+// reprString quotes the string like sdscatrepr of Redis, so it's parsed back by splitArgs
+func reprString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\a':
+			sb.WriteString("\\a")
+		case '\b':
+			sb.WriteString("\\b")
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&sb, "\\x%02x", c)
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
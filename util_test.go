@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		match   bool
+	}{
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"news.*", "news.tech", false, true},
+		{"news.*", "sport.tech", false, false},
+		{"NEWS.*", "news.tech", true, true},
+		{"h[A-B]llo", "hbllo", true, true},
+		{"a*a*a*a*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false, false},
+		{"h[abc", "hb", false, true},
+		{"*a", "ba", false, true},
+		{"a**", "a", false, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, stringMatch(c.pattern, c.str, c.nocase), "%s %s", c.pattern, c.str)
+	}
+}
+
+func TestMemtoll(t *testing.T) {
+	cases := []struct {
+		s string
+		n int64
+	}{
+		{"100", 100}, {"1b", 1}, {"1k", 1000}, {"1kb", 1024}, {"2M", 2000 * 1000}, {"512mb", 512 << 20}, {"1gb", 1 << 30},
+	}
+	for _, c := range cases {
+		n, err := memtoll(c.s)
+		assert.Nil(t, err)
+		assert.Equal(t, c.n, n, c.s)
+	}
+	_, err := memtoll("1tb")
+	assert.NotNil(t, err)
+
+	for _, n := range []int64{0, 100, 1024, 1000 * 1000, 512 << 20, 1 << 30, 3<<30 + 1} {
+		m, err := memtoll(formatMemory(n))
+		assert.Nil(t, err)
+		assert.Equal(t, n, m)
+	}
+	assert.Equal(t, "512mb", formatMemory(512<<20))
+	assert.Equal(t, "1536kb", formatMemory(1536<<10))
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+		ok   bool
+	}{
+		{"", []string{}, true},
+		{"   \t ", []string{}, true},
+		{"set key value", []string{"set", "key", "value"}, true},
+		{"  set   key\tvalue  ", []string{"set", "key", "value"}, true},
+		{`set key "hello world"`, []string{"set", "key", "hello world"}, true},
+		{`set key ""`, []string{"set", "key", ""}, true},
+		{`"a\nb\r\t\b\a"`, []string{"a\nb\r\t\b\a"}, true},
+		{`"\x41\x7a\xff"`, []string{"Az\xff"}, true},
+		{`"\x4"`, []string{"x4"}, true},
+		{`"\xZZ"`, []string{"xZZ"}, true},
+		{`"say \"hi\" \\ \q"`, []string{`say "hi" \ q`}, true},
+		{`'single \n "quoted"'`, []string{`single \n "quoted"`}, true},
+		{`'it\'s'`, []string{"it's"}, true},
+		{`'a\b'`, []string{`a\b`}, true},
+		{`key"quoted part"`, []string{"keyquoted part"}, true},
+		{`"a" "b"`, []string{"a", "b"}, true},
+		{`"unbalanced`, nil, false},
+		{`'unbalanced`, nil, false},
+		{`"closing"x`, nil, false},
+		{`'closing'x`, nil, false},
+		{`"trailing\`, nil, false},
+		{`"\x4`, nil, false},
+	}
+	for _, c := range cases {
+		args, err := splitArgs(c.line)
+		if !c.ok {
+			assert.NotNil(t, err, c.line)
+			continue
+		}
+		assert.Nil(t, err, c.line)
+		assert.Equal(t, c.args, args, c.line)
+	}
+}
+
+func TestSplitArgsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	separators := []string{" ", "  ", "\t", " \t "}
+	for i := 0; i < 1000; i++ {
+		args := make([]string, r.Intn(5)+1)
+		var line strings.Builder
+		for j := range args {
+			b := make([]byte, r.Intn(8))
+			r.Read(b)
+			args[j] = string(b)
+			line.WriteString(separators[r.Intn(len(separators))])
+			line.WriteString(reprString(args[j]))
+		}
+		got, err := splitArgs(line.String())
+		assert.Nil(t, err, line.String())
+		assert.Equal(t, args, got, line.String())
+	}
+}
+
+func FuzzSplitArgs(f *testing.F) {
+	for _, seed := range []string{`set k v`, `"a\x41" 'b\'c'`, `"unbalanced`, `x"y z"`, "\t\r\n"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		args, err := splitArgs(line)
+		if err != nil {
+			return
+		}
+		// the quoted arguments are split back to themselves
+		quoted := make([]string, len(args))
+		for i, a := range args {
+			quoted[i] = reprString(a)
+		}
+		again, err := splitArgs(strings.Join(quoted, " "))
+		assert.Nil(t, err)
+		assert.Equal(t, args, again)
+	})
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"fmt"
+	"math"
 	"math/bits"
 	"math/rand"
 	"strconv"
+	"strings"
 )
 
 const MAX_LEVEL = 32
@@ -89,7 +90,7 @@ func (zsl *zSkipList) insert(member *GObj, score float64) *zNode {
 			rank[i] = rank[i+1]
 		}
 		for node.level[i].forward != nil && (node.level[i].forward.Score < score ||
-			(node.level[i].forward.Score < score && CompareStr(node.level[i].forward.Member, member))) {
+			(node.level[i].forward.Score == score && CompareStr(node.level[i].forward.Member, member))) {
 			rank[i] += node.level[i].span
 			node = node.level[i].forward
 		}
@@ -219,22 +220,145 @@ func (zsl *zSkipList) getElementByRank(rank int64) *zNode {
 	return nil
 }
 
+// zRangeSpec is a score range, the min or max is excluded if minex or maxex is true
+type zRangeSpec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r *zRangeSpec) valueGteMin(value float64) bool {
+	if r.minex {
+		return value > r.min
+	}
+	return value >= r.min
+}
+
+func (r *zRangeSpec) valueLteMax(value float64) bool {
+	if r.maxex {
+		return value < r.max
+	}
+	return value <= r.max
+}
+
+// isInRange returns true if a part of the skip list is in the range.
+func (zsl *zSkipList) isInRange(r *zRangeSpec) bool {
+	/* Test for ranges that will always be empty. */
+	if r.min > r.max || (r.min == r.max && (r.minex || r.maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !r.valueGteMin(x.Score) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !r.valueLteMax(x.Score) {
+		return false
+	}
+	return true
+}
+
+// firstInRange finds the first node that is contained in the specified range, nil is returned if not found.
+func (zsl *zSkipList) firstInRange(r *zRangeSpec) *zNode {
+	if !zsl.isInRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		/* Go forward while *OUT* of range. */
+		for x.level[i].forward != nil && !r.valueGteMin(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+	/* This is an inner range, so the next node cannot be NULL. */
+	x = x.level[0].forward
+	if !r.valueLteMax(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// Score returns the score of the member, false is returned if the member doesn't exist.
+func (z *ZSet) Score(member *GObj) (float64, bool) {
+	entry := z.Dict.Find(member)
+	if entry == nil {
+		return 0, false
+	}
+	return entry.Val.FloatVal(), true
+}
+
+const (
+	/* Input flags. */
+	ZADD_IN_NONE = 0
+	ZADD_IN_INCR = 1 << 0 /* Increment the score instead of setting it. */
+	ZADD_IN_NX   = 1 << 1 /* Don't touch elements not already existing. */
+	ZADD_IN_XX   = 1 << 2 /* Only touch elements already existing. */
+
+	/* Output flags. */
+	ZADD_OUT_NOP     = 1 << 0 /* Operation not performed because of conditionals.*/
+	ZADD_OUT_ADDED   = 1 << 1 /* The element was new and was added. */
+	ZADD_OUT_UPDATED = 1 << 2 /* The element already existed, score updated. */
+	ZADD_OUT_NAN     = 1 << 3 /* Only touched if the result is not a number. */
+)
+
+// Add adds a new element or updates the score of an existing element, the flags control the behavior.
+// It returns the output flags and the new score of the element.
+func (z *ZSet) Add(member *GObj, score float64, inFlags int) (int, float64) {
+	curScore, exists := z.Score(member)
+	if exists {
+		if inFlags&ZADD_IN_NX != 0 {
+			return ZADD_OUT_NOP, curScore
+		}
+		if inFlags&ZADD_IN_INCR != 0 {
+			score += curScore
+			if math.IsNaN(score) {
+				return ZADD_OUT_NAN, curScore
+			}
+		}
+		if score == curScore {
+			return 0, score
+		}
+		/* Remove and re-insert when score changes. */
+		z.SkipList.delete(curScore, member)
+		z.SkipList.insert(member, score)
+		z.Dict.Set(member, NewObject(STR, strconv.FormatFloat(score, 'f', -1, 64)))
+		return ZADD_OUT_UPDATED, score
+	}
+
+	if inFlags&ZADD_IN_XX != 0 {
+		return ZADD_OUT_NOP, 0
+	}
+	z.SkipList.insert(member, score)
+	_ = z.Dict.Add(member, NewObject(STR, strconv.FormatFloat(score, 'f', -1, 64)))
+	return ZADD_OUT_ADDED, score
+}
+
+// Delete removes the member, false is returned if the member doesn't exist.
+func (z *ZSet) Delete(member *GObj) bool {
+	score, exists := z.Score(member)
+	if !exists {
+		return false
+	}
+	z.SkipList.delete(score, member)
+	_ = z.Dict.Delete(member)
+	return true
+}
+
 /* zset command implement */
 
 var zaddCommand CommandProc = func(c *GedisClient) {
-	zaddGenericCommand(c, 0)
+	zaddGenericCommand(c, ZADD_IN_NONE)
 }
 
 var zincrbyCommand CommandProc = func(c *GedisClient) {
-	zaddGenericCommand(c, 1)
+	zaddGenericCommand(c, ZADD_IN_INCR)
 }
 
 var zremCommand CommandProc = func(c *GedisClient) {
 	key := c.args[1]
 	zobj := LookupKey(key)
 
-	if zobj == nil || zobj.Type_ != ZSET {
-		c.AddReply(REPLY_NIL)
+	if zobj == nil {
+		c.AddReply(REPLY_ZERO)
 		return
 	}
 
@@ -245,15 +369,23 @@ var zremCommand CommandProc = func(c *GedisClient) {
 	zset := zobj.Val_.(*ZSet)
 	deleted := 0
 	for i := 2; i < len(c.args); i++ {
-		entry := zset.Dict.Find(c.args[i])
-		if entry != nil {
+		if zset.Delete(c.args[i]) {
 			deleted++
-			zset.SkipList.delete(entry.Val.FloatVal(), c.args[i])
-			_ = zset.Dict.Delete(c.args[i])
 		}
 	}
+	if deleted > 0 {
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zrem", key)
+	}
+	if zset.Length() == 0 {
+		_ = server.db.data.Delete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, key)
+		server.dirty++
+	}
 
-	c.AddReply(fmt.Sprintf("%d", deleted))
+	c.AddReplyInt(deleted)
 }
 
 var zrangeCommand CommandProc = func(c *GedisClient) {
@@ -275,9 +407,9 @@ func zrangeGenericCommand(c *GedisClient, reverse int) {
 		withScores = true
 	}
 
-	zobj := LookupKey(c.args[1])
+	zobj := LookupKeyRead(c.args[1])
 	if zobj == nil {
-		c.AddReply(REPLY_NIL)
+		c.AddReplyArrayLen(0)
 		return
 	}
 
@@ -304,15 +436,16 @@ func zrangeGenericCommand(c *GedisClient, reverse int) {
 		start = 0
 	}
 
+	// the range is empty
 	if start > end || start >= llen {
-		c.AddReply(REPLY_INVALID_VALUE)
+		c.AddReplyArrayLen(0)
 		return
 	}
 
 	if end >= llen {
 		end = llen - 1
 	}
-	rangeLen := start - end + 1
+	rangeLen := end - start + 1
 	var ln *zNode
 	if reverse == 1 {
 		ln = zset.SkipList.tail
@@ -326,46 +459,91 @@ func zrangeGenericCommand(c *GedisClient, reverse int) {
 		}
 	}
 
+	// RESP3 replies the pairs of member and score, RESP2 replies them flatten
+	if withScores && c.resp == 2 {
+		c.AddReplyArrayLen(int(rangeLen) * 2)
+	} else {
+		c.AddReplyArrayLen(int(rangeLen))
+	}
 	for rangeLen > 0 {
 		ele := ln.Member
-		c.AddReplyStr(ele)
+		if withScores && c.resp > 2 {
+			c.AddReplyArrayLen(2)
+		}
+		c.AddReplyBulk(ele)
 		if withScores {
-			c.AddReplyFloat(ln.Score)
+			c.AddReplyDouble(ln.Score)
 		}
 		if reverse == 1 {
 			ln = ln.backward
 		} else {
 			ln = ln.level[0].forward
 		}
+		rangeLen--
 	}
 }
 
-func zaddGenericCommand(c *GedisClient, incr int) {
+// ZADD key [NX|XX] [CH] [INCR] score member [score member ...]
+func zaddGenericCommand(c *GedisClient, flags int) {
+	ch := false
+	scoreIdx := 2
+	for ; scoreIdx < len(c.args); scoreIdx++ {
+		opt := strings.ToLower(c.args[scoreIdx].StrVal())
+		if opt == "nx" {
+			flags |= ZADD_IN_NX
+		} else if opt == "xx" {
+			flags |= ZADD_IN_XX
+		} else if opt == "ch" {
+			ch = true
+		} else if opt == "incr" {
+			flags |= ZADD_IN_INCR
+		} else {
+			break
+		}
+	}
+
 	// The score-member parameter must be in pairs
-	if len(c.args)%2 != 0 {
-		c.AddReply(REPLY_WRONG_ARITY)
+	elements := len(c.args) - scoreIdx
+	if elements == 0 || elements%2 != 0 {
+		c.AddReply(REPLY_SYNTAX_ERR)
+		return
+	}
+	elements /= 2
+	if flags&ZADD_IN_NX != 0 && flags&ZADD_IN_XX != 0 {
+		c.AddReplyError("XX and NX options at the same time are not compatible")
+		return
+	}
+	if flags&ZADD_IN_INCR != 0 && elements > 1 {
+		c.AddReplyError("INCR option supports a single increment-element pair")
 		return
 	}
 
 	/* Start parsing all the scores, we need to emit any syntax error
 	 * before executing additions to the sorted set, as the command should
 	 * either execute fully or nothing at all. */
-	elements := len(c.args) / 2
 	scores := make([]float64, elements)
 	members := make([]*GObj, elements)
 	for i := 0; i < elements; i++ {
-		score, err := strconv.ParseFloat(c.args[3+i*2].StrVal(), 64)
-		if err != nil {
-			c.AddReply(REPLY_INVALID_VALUE)
+		score, err := strconv.ParseFloat(c.args[scoreIdx+i*2].StrVal(), 64)
+		if err != nil || math.IsNaN(score) {
+			c.AddReplyError("value is not a valid float")
 			return
 		}
 		scores[i] = score
-		members[i] = c.args[2+i*2]
+		members[i] = c.args[scoreIdx+i*2+1]
 	}
 
 	key := c.args[1]
 	zobj := LookupKey(key)
 	if zobj == nil {
+		if flags&ZADD_IN_XX != 0 {
+			if flags&ZADD_IN_INCR != 0 {
+				c.AddReplyNull()
+			} else {
+				c.AddReply(REPLY_ZERO)
+			}
+			return
+		}
 		zobj = NewObject(ZSET, NewZSet())
 		_ = server.db.data.Add(key, zobj)
 	} else {
@@ -376,35 +554,41 @@ func zaddGenericCommand(c *GedisClient, incr int) {
 		}
 	}
 
-	added, score := 0, float64(0)
+	zSet := zobj.Val_.(*ZSet)
+	added, updated, score := 0, 0, float64(0)
 	for i := 0; i < elements; i++ {
-		zSet := zobj.Val_.(*ZSet)
-		entry := zSet.Dict.Find(members[i])
-		if entry != nil {
-			curObj := zSet.Dict.Get(members[i])
-			curScore := curObj.FloatVal()
-
-			score = scores[i]
-			if incr != 0 {
-				score += curScore
-			}
-			if curScore != score {
-				/* Re-inserted in skiplist. */
-				zSet.SkipList.delete(curScore, curObj)
-				zSet.SkipList.insert(curObj, score)
-				/* Update score */
-				zSet.Dict.Set(curObj, NewObject(STR, score))
-			}
-		} else {
-			zSet.SkipList.insert(members[i], scores[i])
-			_ = zSet.Dict.Add(members[i], NewObject(STR, scores[i]))
+		var retFlags int
+		retFlags, score = zSet.Add(members[i], scores[i], flags)
+		if retFlags&ZADD_OUT_NAN != 0 {
+			c.AddReplyError("resulting score is not a number (NaN)")
+			return
+		}
+		if retFlags&ZADD_OUT_ADDED != 0 {
 			added++
 		}
+		if retFlags&ZADD_OUT_UPDATED != 0 {
+			updated++
+		}
+		if retFlags&ZADD_OUT_NOP != 0 && flags&ZADD_IN_INCR != 0 {
+			c.AddReplyNull()
+			return
+		}
 	}
 
-	if incr != 0 { /* ZINCRBY */
-		c.AddReply(fmt.Sprintf("%f", score))
-	} else { /* ZADD */
-		c.AddReply(fmt.Sprintf("%d", added))
+	if added+updated > 0 {
+		signalModifiedKey(c, key)
+		server.dirty++
+		if flags&ZADD_IN_INCR != 0 {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zincr", key)
+		} else {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", key)
+		}
+	}
+	if flags&ZADD_IN_INCR != 0 { /* ZINCRBY */
+		c.AddReplyDouble(score)
+	} else if ch { /* ZADD */
+		c.AddReplyLongLong(int64(added + updated))
+	} else {
+		c.AddReplyLongLong(int64(added))
 	}
 }
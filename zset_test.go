@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"testing"
 )
 
@@ -21,3 +22,41 @@ func TestZslInsert(t *testing.T) {
 		assert.Equal(t, i, int(node.Score))
 	}
 }
+
+func TestZSetCommands(t *testing.T) {
+	initTestServer(t)
+	c := NewClient(0)
+
+	assert.Equal(t, ":3\r\n", runCommand(c, "zadd", "z", "1", "a", "2", "b", "3", "c"))
+	assert.Equal(t, ":0\r\n", runCommand(c, "zadd", "z", "nx", "5", "a"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "zadd", "z", "xx", "ch", "5", "a"))
+	assert.Equal(t, "$1\r\n7\r\n", runCommand(c, "zincrby", "z", "5", "b"))
+	assert.Equal(t, "*3\r\n$1\r\nc\r\n$1\r\na\r\n$1\r\nb\r\n", runCommand(c, "zrange", "z", "0", "-1"))
+	assert.Equal(t, "*2\r\n$1\r\nb\r\n$1\r\n7\r\n", runCommand(c, "zrevrange", "z", "0", "0", "withscores"))
+	assert.Equal(t, ":1\r\n", runCommand(c, "zrem", "z", "a", "x"))
+	assert.Equal(t, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n", runCommand(c, "zrange", "z", "0", "-1"))
+	assert.Equal(t, REPLY_WRONG_ARITY, runCommand(c, "zadd", "z", "1"))
+	assert.Equal(t, REPLY_SYNTAX_ERR, runCommand(c, "zadd", "z", "1", "a", "2"))
+
+	// the increment resulting in NaN is rejected
+	runCommand(c, "zadd", "n", "incr", "inf", "x")
+	nan := "-ERR resulting score is not a number (NaN)\r\n"
+	assert.Equal(t, nan, runCommand(c, "zadd", "n", "incr", "-inf", "x"))
+	assert.Equal(t, nan, runCommand(c, "zincrby", "n", "-inf", "x"))
+	score, _ := LookupKey(NewObject(STR, "n")).Val_.(*ZSet).Score(NewObject(STR, "x"))
+	assert.True(t, math.IsInf(score, 1))
+}
+
+func TestZslFirstInRange(t *testing.T) {
+	zsl := newSkipList()
+	for i := 1; i <= 10; i++ {
+		zsl.insert(NewObject(STR, fmt.Sprintf("z_%d", i)), float64(i))
+	}
+
+	node := zsl.firstInRange(&zRangeSpec{min: 3, max: 5})
+	assert.Equal(t, 3, int(node.Score))
+	node = zsl.firstInRange(&zRangeSpec{min: 3, max: 5, minex: true})
+	assert.Equal(t, 4, int(node.Score))
+	assert.Nil(t, zsl.firstInRange(&zRangeSpec{min: 5, max: 5, maxex: true}))
+	assert.Nil(t, zsl.firstInRange(&zRangeSpec{min: 10.5, max: 20}))
+}